@@ -0,0 +1,166 @@
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DefaultMaxAcceptFailures is how many consecutive errors accepting
+// connections on an upgrade socket mark it as degraded, unless
+// WithMaxAcceptFailures is used.
+const DefaultMaxAcceptFailures = 10
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound how long serveUpgrades
+	// waits after an accept error, doubling with each consecutive error.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// WithMaxAcceptFailures sets how many consecutive errors accepting
+// connections on an upgrade socket mark it as degraded. Errors which aren't
+// temporary mark it as degraded immediately.
+func WithMaxAcceptFailures(n int) Option {
+	return func(u *Upgrader) {
+		u.maxAcceptFailures = n
+	}
+}
+
+// UpgradeSocketError is returned by Health when an upgrade socket is
+// degraded: accepting connections on it keeps failing, so other processes
+// can't upgrade from this one, or control it.
+type UpgradeSocketError struct {
+	// Addr is the socket's address.
+	Addr string
+	// Failures is how many consecutive accepts failed.
+	Failures int
+	// Err is the last error.
+	Err error
+}
+
+func (e *UpgradeSocketError) Error() string {
+	return fmt.Sprintf("upgrade socket %s is degraded after %d consecutive accept errors: %v", e.Addr, e.Failures, e.Err)
+}
+
+// Unwrap returns the last accept error.
+func (e *UpgradeSocketError) Unwrap() error {
+	return e.Err
+}
+
+// Health returns an *UpgradeSocketError if one of this process's upgrade
+// sockets is degraded, or nil. Supervisors may want to restart a process
+// whose upgrade socket stays degraded, since it can't be upgraded.
+func (u *Upgrader) Health() error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.healthLocked()
+}
+
+func (u *Upgrader) healthLocked() error {
+	for _, err := range u.degradedSocks {
+		return err
+	}
+	return nil
+}
+
+// acceptUnixer is implemented by *net.UnixListener.
+type acceptUnixer interface {
+	AcceptUnix() (*net.UnixConn, error)
+	Addr() net.Addr
+}
+
+func (u *Upgrader) serveUpgrades(sock acceptUnixer, legacy bool) {
+	var b acceptBackoff
+	for {
+		conn, err := sock.AcceptUnix()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				u.l.Info("upgrade socket closed, no longer listening for upgrades", "legacy", legacy)
+				u.forgetSock(sock)
+				return
+			}
+			u.clock.Sleep(u.acceptFailed(sock, &b, err))
+			continue
+		}
+		u.acceptSucceeded(sock, &b)
+		u.dispatchUpgradeConn(conn, legacy)
+	}
+}
+
+// acceptBackoff tracks consecutive errors accepting on an upgrade socket.
+type acceptBackoff struct {
+	failures int
+	backoff  time.Duration
+}
+
+// acceptFailed records an error accepting on sock, marking it as degraded if
+// need be, and returns how long to wait before accepting again.
+func (u *Upgrader) acceptFailed(sock acceptUnixer, b *acceptBackoff, err error) time.Duration {
+	maxFailures := u.maxAcceptFailures
+	if maxFailures <= 0 {
+		maxFailures = DefaultMaxAcceptFailures
+	}
+	b.failures++
+	u.logRepeated(u.l.Error, "error awaiting upgrade", "err", err, "failures", b.failures)
+	u.reportErr(BackgroundOpAccept, err)
+	if ne, ok := err.(net.Error); b.failures >= maxFailures || !ok || !(ne.Temporary() || ne.Timeout()) {
+		u.setSockHealth(sock, &UpgradeSocketError{Addr: sock.Addr().String(), Failures: b.failures, Err: err})
+	}
+	if b.backoff == 0 {
+		b.backoff = minAcceptBackoff
+	} else if b.backoff *= 2; b.backoff > maxAcceptBackoff {
+		b.backoff = maxAcceptBackoff
+	}
+	return b.backoff
+}
+
+// acceptSucceeded records that sock accepted a connection, so it's healthy.
+func (u *Upgrader) acceptSucceeded(sock acceptUnixer, b *acceptBackoff) {
+	if b.failures > 0 {
+		*b = acceptBackoff{}
+		u.setSockHealth(sock, nil)
+	}
+}
+
+// dispatchUpgradeConn handles a connection accepted on an upgrade socket.
+func (u *Upgrader) dispatchUpgradeConn(conn *net.UnixConn, legacy bool) {
+	if legacy {
+		go u.handleLegacyUpgradeRequest(conn)
+	} else {
+		go u.handleUpgradeRequest(conn)
+	}
+}
+
+// forgetSock stops reporting sock as degraded once it's closed.
+func (u *Upgrader) forgetSock(sock acceptUnixer) {
+	u.stateLock.Lock()
+	delete(u.degradedSocks, sock)
+	u.stateLock.Unlock()
+}
+
+// setSockHealth records sock as degraded with err, or as healthy if err is
+// nil, emitting an event when it changes.
+func (u *Upgrader) setSockHealth(sock acceptUnixer, err *UpgradeSocketError) {
+	u.stateLock.Lock()
+	_, wasDegraded := u.degradedSocks[sock]
+	if err != nil {
+		if u.degradedSocks == nil {
+			u.degradedSocks = make(map[acceptUnixer]*UpgradeSocketError)
+		}
+		u.degradedSocks[sock] = err
+	} else {
+		delete(u.degradedSocks, sock)
+	}
+	u.stateLock.Unlock()
+
+	switch {
+	case err != nil && !wasDegraded:
+		u.l.Error("upgrade socket degraded", "addr", err.Addr, "failures", err.Failures, "err", err.Err)
+		u.emit(Event{Type: EventUpgradeSocketDegraded, Err: err})
+	case err == nil && wasDegraded:
+		u.l.Info("upgrade socket recovered", "addr", sock.Addr())
+		u.emit(Event{Type: EventUpgradeSocketRecovered})
+	}
+}
@@ -0,0 +1,113 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakySock fails to accept with the queued errors, and then accepts from
+// its underlying socket.
+type flakySock struct {
+	*net.UnixListener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (s *flakySock) AcceptUnix() (*net.UnixConn, error) {
+	s.mu.Lock()
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.mu.Unlock()
+	return s.UnixListener.AcceptUnix()
+}
+
+func TestServeUpgradesDegraded(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	events := make(chan Event, 10)
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithMaxAcceptFailures(3),
+		WithEventHandler(func(e Event) { events <- e }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+
+	path := filepath.Join(coordDir, "flaky.sock")
+	raw, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// temporary errors are retried until there are too many
+	sock := &flakySock{UnixListener: raw, errs: []error{temporaryError{}, temporaryError{}, temporaryError{}}}
+	go upg.serveUpgrades(sock, false)
+
+	e := <-events
+	if e.Type != EventUpgradeSocketDegraded {
+		t.Fatalf("expected the socket to be degraded, got %+v", e)
+	}
+	health, ok := upg.Health().(*UpgradeSocketError)
+	if !ok || health.Failures != 3 {
+		t.Fatalf("expected an *UpgradeSocketError after 3 failures, got %v", upg.Health())
+	}
+	if status := upg.Status(); status.Degraded == "" {
+		t.Fatalf("expected the status to report the socket as degraded")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if e := <-events; e.Type != EventUpgradeSocketRecovered {
+		t.Fatalf("expected the socket to recover, got %+v", e)
+	}
+	if err := upg.Health(); err != nil {
+		t.Fatalf("expected the upgrader to be healthy, got %v", err)
+	}
+
+	// an error which isn't temporary degrades the socket immediately. The
+	// socket is already waiting to accept, so it's seen after the next
+	// connection.
+	sock.mu.Lock()
+	sock.errs = []error{errors.New("broken")}
+	sock.mu.Unlock()
+	conn, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if e := <-events; e.Type != EventUpgradeSocketDegraded {
+		t.Fatalf("expected the socket to be degraded, got %+v", e)
+	}
+	if health, ok := upg.Health().(*UpgradeSocketError); !ok || health.Failures != 1 {
+		t.Fatalf("expected an *UpgradeSocketError after 1 failure, got %v", upg.Health())
+	}
+
+	// a closed socket is no longer reported
+	raw.Close()
+	for i := 0; upg.Health() != nil; i++ {
+		if i == 100 {
+			t.Fatalf("expected the closed socket to no longer be degraded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,244 @@
+// +build linux
+
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// acceptMux accepts connections on the upgrade sockets of several Upgraders
+// with one goroutine, waiting on all of them with epoll. Sockets must be
+// removed from it before they're closed, so that their fd numbers can't be
+// reused while it's still waiting on them.
+type acceptMux struct {
+	epfd int
+	// wakeR and wakeW are a pipe which wakes the loop up to exit.
+	wakeR, wakeW int
+
+	mu     sync.Mutex
+	socks  map[int]*muxSock
+	closed bool
+	done   chan struct{}
+}
+
+type muxSock struct {
+	u      *Upgrader
+	sock   *net.UnixListener
+	legacy bool
+	b      acceptBackoff
+}
+
+func newAcceptMux() (*acceptMux, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	m := &acceptMux{
+		epfd:  epfd,
+		wakeR: wake[0],
+		wakeW: wake[1],
+		socks: make(map[int]*muxSock),
+		done:  make(chan struct{}),
+	}
+	if err := m.ctl(syscall.EPOLL_CTL_ADD, m.wakeR, syscall.EPOLLIN); err != nil {
+		m.closeFds()
+		return nil, err
+	}
+	go m.loop()
+	return m, nil
+}
+
+func (m *acceptMux) ctl(op, fd int, events uint32) error {
+	event := syscall.EpollEvent{Events: events, Fd: int32(fd)}
+	return os.NewSyscallError("epoll_ctl", syscall.EpollCtl(m.epfd, op, fd, &event))
+}
+
+// add starts accepting upgrade connections on sock for u.
+func (m *acceptMux) add(u *Upgrader, sock *net.UnixListener, legacy bool) error {
+	raw, err := sock.SyscallConn()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return errors.New("accept loop is closed")
+	}
+	var ctlErr error
+	err = raw.Control(func(fd uintptr) {
+		if ctlErr = m.ctl(syscall.EPOLL_CTL_ADD, int(fd), syscall.EPOLLIN); ctlErr == nil {
+			m.socks[int(fd)] = &muxSock{u: u, sock: sock, legacy: legacy}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// remove stops accepting on sock. It must be called before sock is closed.
+func (m *acceptMux) remove(sock *net.UnixListener) {
+	m.mu.Lock()
+	var removed []*muxSock
+	for fd, s := range m.socks {
+		if s.sock == sock {
+			m.ctl(syscall.EPOLL_CTL_DEL, fd, 0)
+			delete(m.socks, fd)
+			removed = append(removed, s)
+		}
+	}
+	m.mu.Unlock()
+	for _, s := range removed {
+		s.u.l.Info("upgrade socket closed, no longer listening for upgrades", "legacy", s.legacy)
+		s.u.forgetSock(sock)
+	}
+}
+
+// served returns how many sockets are being served.
+func (m *acceptMux) served() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.socks)
+}
+
+// close stops the loop. Sockets still added are left open.
+func (m *acceptMux) close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.mu.Unlock()
+	syscall.Write(m.wakeW, []byte{0})
+	<-m.done
+	m.closeFds()
+}
+
+func (m *acceptMux) closeFds() {
+	syscall.Close(m.epfd)
+	syscall.Close(m.wakeR)
+	syscall.Close(m.wakeW)
+}
+
+func (m *acceptMux) loop() {
+	defer close(m.done)
+	events := make([]syscall.EpollEvent, 32)
+	for {
+		n, err := syscall.EpollWait(m.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			// this can't happen with a valid epoll fd, so all we can do is
+			// mark every socket as degraded
+			m.failAll(os.NewSyscallError("epoll_wait", err))
+			return
+		}
+		for _, event := range events[:n] {
+			fd := int(event.Fd)
+			if fd == m.wakeR {
+				m.mu.Lock()
+				closed := m.closed
+				m.mu.Unlock()
+				if closed {
+					return
+				}
+				continue
+			}
+			m.acceptAll(fd)
+		}
+	}
+}
+
+// acceptAll accepts connections on fd until there are none left waiting.
+// Accepting with the lock held means fd can't be removed, closed and reused
+// in the meantime.
+func (m *acceptMux) acceptAll(fd int) {
+	for {
+		m.mu.Lock()
+		s, ok := m.socks[fd]
+		if !ok {
+			m.mu.Unlock()
+			return
+		}
+		nfd, _, err := syscall.Accept4(fd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		failed := err != nil && err != syscall.EAGAIN && err != syscall.EINTR && err != syscall.ECONNABORTED
+		if failed {
+			// stop waiting on the socket until we've backed off, rather than
+			// spinning or holding up the others
+			m.ctl(syscall.EPOLL_CTL_MOD, fd, 0)
+		}
+		m.mu.Unlock()
+		if failed {
+			wait := s.u.acceptFailed(s.sock, &s.b, err)
+			m.rearmAfter(fd, s, wait)
+			return
+		}
+		switch err {
+		case syscall.EAGAIN:
+			return
+		case syscall.EINTR, syscall.ECONNABORTED:
+			continue
+		}
+		conn, err := unixConnFromFd(nfd)
+		if err != nil {
+			s.u.l.Warn("could not use an accepted upgrade connection", "err", err)
+			continue
+		}
+		s.u.acceptSucceeded(s.sock, &s.b)
+		s.u.dispatchUpgradeConn(conn, s.legacy)
+	}
+}
+
+// rearmAfter waits on fd again after wait, if it's still the same socket.
+func (m *acceptMux) rearmAfter(fd int, s *muxSock, wait time.Duration) {
+	timer := s.u.clock.NewTimer(wait)
+	go func() {
+		<-timer.C()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.socks[fd] == s {
+			m.ctl(syscall.EPOLL_CTL_MOD, fd, syscall.EPOLLIN)
+		}
+	}()
+}
+
+// failAll marks every socket as degraded with err.
+func (m *acceptMux) failAll(err error) {
+	m.mu.Lock()
+	socks := make([]*muxSock, 0, len(m.socks))
+	for _, s := range m.socks {
+		socks = append(socks, s)
+	}
+	m.mu.Unlock()
+	for _, s := range socks {
+		s.u.setSockHealth(s.sock, &UpgradeSocketError{Addr: s.sock.Addr().String(), Failures: 1, Err: err})
+	}
+}
+
+func unixConnFromFd(fd int) (*net.UnixConn, error) {
+	f := os.NewFile(uintptr(fd), "upgrade-conn")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("accepted a %T rather than a unix connection", conn)
+	}
+	return unixConn, nil
+}
@@ -0,0 +1,26 @@
+// +build !linux
+
+package tableroll
+
+import (
+	"errors"
+	"net"
+)
+
+// acceptMux is only implemented on linux; elsewhere each upgrade socket is
+// served by its own goroutine.
+type acceptMux struct{}
+
+func newAcceptMux() (*acceptMux, error) {
+	return &acceptMux{}, nil
+}
+
+func (m *acceptMux) add(u *Upgrader, sock *net.UnixListener, legacy bool) error {
+	return errors.New("a shared accept loop is only supported on linux")
+}
+
+func (m *acceptMux) remove(sock *net.UnixListener) {}
+
+func (m *acceptMux) served() int { return 0 }
+
+func (m *acceptMux) close() {}
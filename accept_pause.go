@@ -0,0 +1,125 @@
+package tableroll
+
+import (
+	"net"
+	"time"
+)
+
+// WithAcceptPauseDuringHandoff makes listeners wrapped with TrackListener
+// stop accepting connections while this process passes its fds to the next
+// owner. New connections queue in the kernel's accept backlog, which is
+// shared with the next owner, so they're accepted by it once it's ready
+// rather than by this process just before it drains, leaving fewer
+// connections to drain. If the upgrade fails, accepting resumes.
+//
+// A goroutine already blocked in Accept is interrupted by setting a deadline
+// on the wrapped listener, if it has a SetDeadline method, as *net.TCPListener
+// and *net.UnixListener do. Otherwise, the pause only takes effect at the next
+// call to Accept.
+func WithAcceptPauseDuringHandoff() Option {
+	return func(u *Upgrader) {
+		u.acceptPauseDuringHandoff = true
+	}
+}
+
+type deadlineListener interface {
+	SetDeadline(time.Time) error
+}
+
+// pauseAcceptsForHandoff pauses tracked listeners, if configured to, as an
+// upgrade begins.
+func (u *Upgrader) pauseAcceptsForHandoff() {
+	if !u.acceptPauseDuringHandoff {
+		return
+	}
+	if n := u.conns().pauseAccepts(); n > 0 {
+		u.l.Info("paused accepting connections during handoff", "listeners", n)
+	}
+}
+
+// resumeAcceptsAfterHandoff resumes tracked listeners after a failed upgrade.
+func (u *Upgrader) resumeAcceptsAfterHandoff() {
+	if !u.acceptPauseDuringHandoff {
+		return
+	}
+	if u.conns().resumeAccepts() {
+		u.l.Info("resumed accepting connections after a failed handoff")
+	}
+}
+
+// pauseAccepts makes tracked listeners stop accepting connections until
+// resumeAccepts is called, and returns how many there are.
+func (t *connTracker) pauseAccepts() int {
+	t.mu.Lock()
+	if t.acceptsResumed == nil {
+		t.acceptsResumed = make(chan struct{})
+	}
+	listeners := make([]*trackedListener, 0, len(t.listeners))
+	for tl := range t.listeners {
+		listeners = append(listeners, tl)
+	}
+	t.mu.Unlock()
+	for _, tl := range listeners {
+		tl.interruptAccept()
+	}
+	return len(listeners)
+}
+
+// resumeAccepts lets tracked listeners accept connections again. It returns
+// false if they weren't paused.
+func (t *connTracker) resumeAccepts() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.acceptsResumed == nil {
+		return false
+	}
+	close(t.acceptsResumed)
+	t.acceptsResumed = nil
+	return true
+}
+
+// awaitAccepts blocks while accepts are paused, until they're resumed or the
+// listener is closed.
+func (l *trackedListener) awaitAccepts() {
+	l.tracker.mu.Lock()
+	resumed := l.tracker.acceptsResumed
+	l.tracker.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-l.closedC:
+	}
+}
+
+// interruptAccept wakes up a goroutine blocked in Accept, so that it notices
+// accepts are paused.
+func (l *trackedListener) interruptAccept() {
+	dl, ok := l.Listener.(deadlineListener)
+	if !ok {
+		return
+	}
+	l.tracker.mu.Lock()
+	l.interrupted = true
+	l.tracker.mu.Unlock()
+	// any time in the past will do
+	dl.SetDeadline(time.Unix(1, 0))
+}
+
+// clearInterrupt returns true if err is due to interruptAccept, after
+// removing the deadline it set.
+func (l *trackedListener) clearInterrupt(err error) bool {
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		return false
+	}
+	l.tracker.mu.Lock()
+	interrupted := l.interrupted
+	l.interrupted = false
+	l.tracker.mu.Unlock()
+	if !interrupted {
+		return false
+	}
+	l.Listener.(deadlineListener).SetDeadline(time.Time{})
+	return true
+}
@@ -0,0 +1,95 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestAcceptPauseDuringHandoff(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	awaiting := make(chan struct{}, 1)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l), WithManualCommit(), WithAcceptPauseDuringHandoff(), WithEventHandler(func(e Event) {
+		if e.Type == EventAwaitingCommit {
+			awaiting <- struct{}{}
+		}
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	tracked := upg1.TrackListener(ln)
+	defer tracked.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := tracked.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("error dialing: %v", err)
+		}
+		defer conn.Close()
+	}
+	// accepts work as usual outside a handoff
+	dial()
+	(<-accepted).Close()
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- upg2.Ready()
+	}()
+	select {
+	case <-awaiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the owner didn't await a commit")
+	}
+
+	// the connection queues rather than being accepted by the owner
+	dial()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+		t.Fatal("expected accepts to be paused during the handoff")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := upg1.Abort("changed my mind"); err != nil {
+		t.Fatalf("error aborting: %v", err)
+	}
+	if err := <-readyErr; err == nil {
+		t.Fatal("expected Ready to fail after the upgrade was aborted")
+	}
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected accepts to resume after the upgrade failed")
+	}
+}
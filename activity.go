@@ -0,0 +1,128 @@
+package tableroll
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FdActivity describes when a listener was last used by this process, as
+// seen through listeners tracked with TrackListener. It helps tell whether an
+// old owner has gone idle and can be killed.
+type FdActivity struct {
+	ID string `json:"id"`
+	// LastAccept is when a connection was last accepted from the listener.
+	LastAccept time.Time `json:"lastAccept"`
+	// LastRead and LastWrite are when a connection accepted from the listener
+	// last read or wrote anything.
+	LastRead  time.Time `json:"lastRead"`
+	LastWrite time.Time `json:"lastWrite"`
+}
+
+// Last returns the latest of the times in a.
+func (a FdActivity) Last() time.Time {
+	last := a.LastAccept
+	for _, t := range []time.Time{a.LastRead, a.LastWrite} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// listenerActivity is shared by the tracked listeners with the same address,
+// so that an fd's activity includes every listener made from it, such as one
+// wrapped with TLS. The times are in unix nanoseconds, and are first so
+// they're 64-bit aligned for atomic access.
+type listenerActivity struct {
+	lastAccept int64
+	lastRead   int64
+	lastWrite  int64
+}
+
+func (a *listenerActivity) describe(id string) FdActivity {
+	return FdActivity{
+		ID:         id,
+		LastAccept: unixNanoTime(atomic.LoadInt64(&a.lastAccept)),
+		LastRead:   unixNanoTime(atomic.LoadInt64(&a.lastRead)),
+		LastWrite:  unixNanoTime(atomic.LoadInt64(&a.lastWrite)),
+	}
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// activityLocked returns the activity record for tracked listeners with the
+// given address, creating it if needed.
+func (t *connTracker) activityLocked(addr string) *listenerActivity {
+	a, ok := t.activity[addr]
+	if !ok {
+		a = &listenerActivity{}
+		t.activity[addr] = a
+	}
+	return a
+}
+
+// FdActivity returns the activity of each listener in Fds for which a
+// listener with the same address has been tracked with TrackListener, sorted
+// by id. Listeners which share an address, such as shards, share their
+// activity.
+func (u *Upgrader) FdActivity() []FdActivity {
+	addrs := u.Fds.listenerAddrs()
+	t := u.conns()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var activity []FdActivity
+	for _, la := range addrs {
+		if a, ok := t.activity[la.addr]; ok {
+			activity = append(activity, a.describe(la.id))
+		}
+	}
+	return activity
+}
+
+// LastActivity returns when a listener tracked with TrackListener last
+// accepted a connection, or one of their connections last read or wrote
+// anything, whichever was latest. Listeners which have since been closed,
+// e.g. by DrainThen, are included, so it may be exported as a metric by an
+// old owner to tell when it's gone idle. It's zero if there has been no
+// activity.
+func (u *Upgrader) LastActivity() time.Time {
+	t := u.conns()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var last time.Time
+	for _, a := range t.activity {
+		if l := a.describe("").Last(); l.After(last) {
+			last = l
+		}
+	}
+	return last
+}
+
+type listenerAddr struct {
+	id   string
+	addr string
+}
+
+// listenerAddrs returns the address each listener is bound to, sorted by id.
+// Listeners whose address can't be determined are skipped.
+func (f *Fds) listenerAddrs() []listenerAddr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var addrs []listenerAddr
+	for _, fi := range f.sortedLocked() {
+		if fi.Kind != fdKindListener || fi.file == nil {
+			continue
+		}
+		identity, err := identify(fi.file.fd)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, listenerAddr{id: fi.ID, addr: identity.SockAddr})
+	}
+	return addrs
+}
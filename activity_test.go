@@ -0,0 +1,81 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestFdActivity(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	start := time.Unix(1000, 0)
+	fake := fakeclock.NewFakeClock(start)
+	upg, err := newUpgrader(ctx, fake, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	rawLn, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if _, err := upg.Fds.Listen(ctx, "untracked", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln := upg.TrackListener(rawLn)
+	if !upg.LastActivity().IsZero() {
+		t.Fatalf("expected no activity yet, got %v", upg.LastActivity())
+	}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fake.Step(time.Second)
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	fake.Step(time.Second)
+	if _, err := client.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	activity := upg.FdActivity()
+	if len(activity) != 1 {
+		t.Fatalf("expected activity for only the tracked listener, got %+v", activity)
+	}
+	want := FdActivity{
+		ID:         "ln",
+		LastAccept: start,
+		LastWrite:  start.Add(time.Second),
+		LastRead:   start.Add(2 * time.Second),
+	}
+	if got := activity[0]; !got.LastAccept.Equal(want.LastAccept) || !got.LastWrite.Equal(want.LastWrite) || !got.LastRead.Equal(want.LastRead) || got.ID != want.ID {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+	if got := upg.Status().LastActivity; !got.Equal(want.LastRead) {
+		t.Fatalf("expected the last activity to be the last read, got %v", got)
+	}
+
+	// activity is remembered once the listener is closed, as by DrainThen
+	ln.Close()
+	if got := upg.LastActivity(); !got.Equal(want.LastRead) {
+		t.Fatalf("expected the last activity to outlive the listener, got %v", got)
+	}
+}
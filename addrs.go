@@ -0,0 +1,137 @@
+package tableroll
+
+import (
+	"net"
+	"syscall"
+)
+
+// Some sockets' addresses can't be recomputed from the fd alone once it's
+// inherited, e.g. unix sockets the kernel considers unnamed, which are
+// reported as "@", even though the process which created them knew them by a
+// meaningful address. The addresses a socket reported when it was added are
+// kept in its fd's metadata, and reported by the listeners and conns rebuilt
+// from it in place of any address which can't be recomputed, so logs and
+// routing decisions made after an upgrade see the same addresses as before.
+
+// recordedAddr is an address recorded when an fd was added.
+type recordedAddr struct {
+	network string
+	addr    string
+}
+
+func (a recordedAddr) Network() string { return a.network }
+func (a recordedAddr) String() string  { return a.addr }
+
+// unresolvedAddr returns true if a carries no meaningful address.
+func unresolvedAddr(a net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	switch a.String() {
+	case "", "<nil>", "@":
+		return true
+	}
+	return false
+}
+
+func addrString(a net.Addr) string {
+	if unresolvedAddr(a) {
+		return ""
+	}
+	return a.String()
+}
+
+// recordAddrs records the addresses conn reports in f's metadata.
+func (f *fd) recordAddrs(conn syscall.Conn) {
+	switch c := conn.(type) {
+	case net.Listener:
+		f.LocalAddr = addrString(c.Addr())
+	case net.Conn:
+		f.LocalAddr = addrString(c.LocalAddr())
+		f.RemoteAddr = addrString(c.RemoteAddr())
+	case net.PacketConn:
+		f.LocalAddr = addrString(c.LocalAddr())
+	}
+}
+
+// restoreAddr returns the recorded address s, in place of actual, if actual
+// couldn't be recomputed.
+func (f *fd) restoreAddr(actual net.Addr, s string) (net.Addr, bool) {
+	if s == "" || !unresolvedAddr(actual) {
+		return actual, false
+	}
+	return recordedAddr{network: f.Network, addr: s}, true
+}
+
+// addrListener is a listener reporting a recorded address.
+type addrListener struct {
+	Listener
+	addr net.Addr
+}
+
+func (l *addrListener) Addr() net.Addr { return l.addr }
+
+// addrConn is a conn reporting recorded addresses.
+type addrConn struct {
+	Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+type syscallPacketConn interface {
+	net.PacketConn
+	syscall.Conn
+}
+
+// addrPacketConn is a packet conn reporting a recorded address.
+type addrPacketConn struct {
+	syscallPacketConn
+	local net.Addr
+}
+
+func (c *addrPacketConn) LocalAddr() net.Addr { return c.local }
+
+// listenerWithRecordedAddr returns ln, reporting f's recorded address if its
+// own couldn't be recomputed.
+func (f *fd) listenerWithRecordedAddr(ln net.Listener) net.Listener {
+	sysLn, ok := ln.(Listener)
+	if !ok {
+		return ln
+	}
+	addr, restored := f.restoreAddr(ln.Addr(), f.LocalAddr)
+	if !restored {
+		return ln
+	}
+	return &addrListener{Listener: sysLn, addr: addr}
+}
+
+// connWithRecordedAddrs returns conn, reporting f's recorded addresses in
+// place of those which couldn't be recomputed.
+func (f *fd) connWithRecordedAddrs(conn net.Conn) net.Conn {
+	sysConn, ok := conn.(Conn)
+	if !ok {
+		return conn
+	}
+	local, restoredLocal := f.restoreAddr(conn.LocalAddr(), f.LocalAddr)
+	remote, restoredRemote := f.restoreAddr(conn.RemoteAddr(), f.RemoteAddr)
+	if !restoredLocal && !restoredRemote {
+		return conn
+	}
+	return &addrConn{Conn: sysConn, local: local, remote: remote}
+}
+
+// packetConnWithRecordedAddr returns conn, reporting f's recorded address if
+// its own couldn't be recomputed.
+func (f *fd) packetConnWithRecordedAddr(conn net.PacketConn) net.PacketConn {
+	sysConn, ok := conn.(syscallPacketConn)
+	if !ok {
+		return conn
+	}
+	local, restored := f.restoreAddr(conn.LocalAddr(), f.LocalAddr)
+	if !restored {
+		return conn
+	}
+	return &addrPacketConn{syscallPacketConn: sysConn, local: local}
+}
@@ -0,0 +1,98 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// namedConn reports a remote address the kernel doesn't know it by, as a
+// conn received from e.g. a supervisor might.
+type namedConn struct {
+	*net.UnixConn
+	remote net.Addr
+}
+
+func (c *namedConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestRecordedAddrs(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := os.NewFile(uintptr(pair[1]), "peer")
+	defer peer.Close()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	remote := &net.UnixAddr{Net: "unix", Name: "/run/peer.sock"}
+	conn, err := upg1.Fds.DialWith("peer", "unix", remote.Name, func(_, _ string) (net.Conn, error) {
+		f := os.NewFile(uintptr(pair[0]), "conn")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		if err != nil {
+			return nil, err
+		}
+		return &namedConn{UnixConn: c.(*net.UnixConn), remote: remote}, nil
+	})
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer conn.Close()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	inherited, err := upg2.Fds.Conn("peer")
+	if err != nil {
+		t.Fatalf("error inheriting conn: %v", err)
+	}
+	defer inherited.Close()
+	if got := inherited.RemoteAddr(); got.String() != remote.Name || got.Network() != "unix" {
+		t.Fatalf("expected the recorded remote address, got %v", got)
+	}
+	if got := inherited.LocalAddr().String(); got != "@" {
+		t.Fatalf("expected the unnamed local address to be left alone, got %q", got)
+	}
+	if _, err := peer.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := inherited.Read(buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("expected the inherited conn to work, got %q, %v", buf, err)
+	}
+
+	// addresses which can be recomputed aren't replaced
+	inheritedLn, err := upg2.Fds.Listener("ln")
+	if err != nil {
+		t.Fatalf("error inheriting listener: %v", err)
+	}
+	defer inheritedLn.Close()
+	if _, ok := inheritedLn.(*net.TCPListener); !ok {
+		t.Fatalf("expected a plain tcp listener, got %T", inheritedLn)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package tableroll
+
+import "fmt"
+
+// errsBufferSize is how many errors Errs buffers before further ones are
+// dropped.
+const errsBufferSize = 16
+
+// BackgroundOp identifies what an Upgrader was doing in the background when
+// it failed.
+type BackgroundOp string
+
+const (
+	// BackgroundOpAccept indicates accepting a connection on an upgrade
+	// socket failed. See also Health.
+	BackgroundOpAccept BackgroundOp = "accept"
+	// BackgroundOpProtocol indicates a process which connected to an upgrade
+	// socket didn't follow the protocol.
+	BackgroundOpProtocol BackgroundOp = "protocol"
+	// BackgroundOpHandoff indicates passing fds to the next owner failed.
+	// This process remains the owner.
+	BackgroundOpHandoff BackgroundOp = "handoff"
+	// BackgroundOpState indicates the Upgrader ended up in a state it
+	// couldn't recover from, such as being unable to remain the owner after
+	// a failed handoff.
+	BackgroundOpState BackgroundOp = "state"
+	// BackgroundOpPredecessor indicates receiving exclusive fds or
+	// connections from the previous owner failed.
+	BackgroundOpPredecessor BackgroundOp = "predecessor"
+	// BackgroundOpPanic indicates serving an upgrade request panicked. The
+	// error is an *UpgradePanicError.
+	BackgroundOpPanic BackgroundOp = "panic"
+)
+
+// BackgroundError is sent on Errs when something the Upgrader does in the
+// background fails.
+type BackgroundError struct {
+	Op  BackgroundOp
+	Err error
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("tableroll %s failed in the background: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// Errs returns a channel of *BackgroundErrors, one for each failure of the
+// work the Upgrader does in the background, such as serving upgrade requests,
+// which would otherwise only be logged. Applications may use it to alert, or
+// to exit rather than carry on without being able to upgrade.
+//
+// The channel is buffered, and errors are dropped, with a warning logged,
+// while it's full, so it needn't be read. It's never closed.
+func (u *Upgrader) Errs() <-chan error {
+	return u.errsC
+}
+
+// reportErr sends a background error on Errs, unless it's full.
+func (u *Upgrader) reportErr(op BackgroundOp, err error) {
+	select {
+	case u.errsC <- &BackgroundError{Op: op, Err: err}:
+	default:
+		u.logRepeated(u.l.Warn, "dropped a background error, nothing is reading Errs", "op", op, "err", err)
+	}
+}
@@ -0,0 +1,66 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestErrsReportsProtocolViolations(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	conn, err := net.Dial("unix", upgradeSockPath(coordDir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("not a hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	select {
+	case err := <-upg.Errs():
+		bgErr, ok := err.(*BackgroundError)
+		if !ok {
+			t.Fatalf("expected a *BackgroundError, got %T: %v", err, err)
+		}
+		if bgErr.Op != BackgroundOpProtocol {
+			t.Fatalf("expected a protocol error, got %v", bgErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a background error")
+	}
+}
+
+func TestErrsDropsWhenFull(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+
+	for i := 0; i < errsBufferSize+5; i++ {
+		upg.reportErr(BackgroundOpAccept, temporaryError{})
+	}
+	if n := len(upg.Errs()); n != errsBufferSize {
+		t.Fatalf("expected %d buffered errors, got %d", errsBufferSize, n)
+	}
+}
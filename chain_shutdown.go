@@ -0,0 +1,162 @@
+package tableroll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// ChainShutdownError is returned by New when the coordination directory was
+// marked as shut down with ShutdownChain, or when the owner it reached is
+// shutting it down. Use WithRestartAfterShutdown to start the service again.
+type ChainShutdownError struct {
+	// Pid is the process which shut the service down.
+	Pid int
+	// At is when it did so, if known.
+	At time.Time
+}
+
+func (e *ChainShutdownError) Error() string {
+	if e.At.IsZero() {
+		return fmt.Sprintf("the service was shut down by process %d", e.Pid)
+	}
+	return fmt.Sprintf("the service was shut down by process %d at %v", e.Pid, e.At.Format(time.RFC3339))
+}
+
+// WithRestartAfterShutdown allows starting in a coordination directory which
+// was shut down with ShutdownChain, rather than failing with a
+// *ChainShutdownError. The shutdown is forgotten, and this process becomes
+// the owner as on a first start.
+func WithRestartAfterShutdown() Option {
+	return func(u *Upgrader) {
+		u.restartAfterShutdown = true
+	}
+}
+
+// ShutdownChain turns the whole service off, rather than only this process.
+// It must be called by the owner. The owner refuses all further upgrades, a
+// predecessor which is still draining is told, and the coordination directory
+// is marked as shut down, so that processes started in it later fail with a
+// *ChainShutdownError instead of taking over. ChainShutdown is closed in this
+// process and its predecessor.
+//
+// ShutdownChain doesn't stop this process; it should go on to drain and exit
+// as usual. It fails with ErrUpgradeInProgress if a handoff has already
+// started, or ErrUpgradeCompleted if one has completed. ctx bounds waiting
+// for the coordination directory's lock.
+func (u *Upgrader) ShutdownChain(ctx context.Context) error {
+	u.stateLock.Lock()
+	switch u.state {
+	case upgraderStateOwner:
+	case upgraderStateTransferringOwnership:
+		u.stateLock.Unlock()
+		return ErrUpgradeInProgress
+	case upgraderStateDraining:
+		u.stateLock.Unlock()
+		return ErrUpgradeCompleted
+	case upgraderStateStopped:
+		u.stateLock.Unlock()
+		return ErrUpgraderStopped
+	default:
+		u.stateLock.Unlock()
+		return fmt.Errorf("cannot shut down the chain in state %v", u.state)
+	}
+	u.chainShutdown = true
+	predecessorConn := u.predecessorConn
+	coordinationErr := u.coordinationErr
+	u.stateLock.Unlock()
+	u.l.Info("shutting down the service")
+	u.closeChainShutdown()
+
+	if predecessorConn != nil && !isClosed(u.predecessorDrainedC) {
+		if err := u.writePredecessor(predecessorConn, proto.MessageChainShutdown); err != nil {
+			// it may have finished draining in the meantime
+			u.l.Debug("could not tell the previous owner the service is shutting down", "err", err)
+		}
+	}
+	if coordinationErr != nil {
+		return fmt.Errorf("could not mark the coordination dir as shut down: %w", coordinationErr)
+	}
+	if err := u.coord.Lock(ctx); err != nil {
+		return fmt.Errorf("could not mark the coordination dir as shut down: %w", err)
+	}
+	defer u.coord.Unlock()
+	return u.coord.markShutdown()
+}
+
+// ChainShutdown returns a channel which is closed once ShutdownChain has been
+// called, by this process or by the process which took over from it. A
+// process which is draining may use it to finish up sooner.
+func (u *Upgrader) ChainShutdown() <-chan struct{} {
+	return u.chainShutdownC
+}
+
+func (u *Upgrader) closeChainShutdown() {
+	u.chainShutdownOnce.Do(func() {
+		u.emit(Event{Type: EventChainShutdown})
+		close(u.chainShutdownC)
+	})
+}
+
+// rejectIfShutDown rejects the sibling if the service is shutting down.
+func (u *Upgrader) rejectIfShutDown(nextOwner *sibling) bool {
+	u.stateLock.Lock()
+	shutDown := u.chainShutdown
+	u.stateLock.Unlock()
+	if shutDown {
+		u.l.Info("rejecting upgrade while shutting down the service", "peer", nextOwner.peer)
+		nextOwner.rejectWithCode(proto.RejectionShutDown, "the service is shutting down")
+	}
+	return shutDown
+}
+
+// chainShutdownMarker is the contents of the file marking a coordination dir
+// as shut down.
+type chainShutdownMarker struct {
+	Pid int       `json:"pid"`
+	At  time.Time `json:"at"`
+}
+
+func (c *coordinator) shutdownFile() string {
+	return filepath.Join(c.dir, "shutdown")
+}
+
+// markShutdown marks the coordination dir as shut down. It should only be
+// called while the lock is held.
+func (c *coordinator) markShutdown() error {
+	data, err := json.Marshal(chainShutdownMarker{Pid: c.os.Getpid(), At: c.clock.Now()})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(c.shutdownFile(), data, 0644)
+	return classifyCoordinationErr(c.dir, "mark shut down", err)
+}
+
+// checkShutdown returns a *ChainShutdownError if the coordination dir was
+// shut down, unless restarting is allowed, in which case it forgets the
+// shutdown. It should only be called while the lock is held.
+func (c *coordinator) checkShutdown() error {
+	data, err := ioutil.ReadFile(c.shutdownFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return classifyCoordinationErr(c.dir, "check shut down", err)
+	}
+	var marker chainShutdownMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		c.l.Warn("could not parse the shutdown marker", "err", err)
+	}
+	if !c.restartAfterShutdown {
+		return &ChainShutdownError{Pid: marker.Pid, At: marker.At}
+	}
+	c.l.Info("restarting a service which was shut down", "pid", marker.Pid, "at", marker.At)
+	err = os.Remove(c.shutdownFile())
+	return classifyCoordinationErr(c.dir, "clear shut down", err)
+}
@@ -0,0 +1,85 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestShutdownChain(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	shutdownEvents := make(chan Event, 10)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithEventHandler(func(e Event) {
+		if e.Type == EventChainShutdown {
+			shutdownEvents <- e
+		}
+	}))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.ShutdownChain(ctx); err != ErrUpgradeCompleted {
+		t.Fatalf("expected a process which stepped down not to shut down the chain, got %v", err)
+	}
+
+	// upg1 is still draining when upg2 shuts the service down
+	if err := upg2.ShutdownChain(ctx); err != nil {
+		t.Fatalf("error shutting down the chain: %v", err)
+	}
+	for name, upg := range map[string]*Upgrader{"owner": upg2, "predecessor": upg1} {
+		select {
+		case <-upg.ChainShutdown():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the %s to be told the service is shutting down", name)
+		}
+	}
+	if len(shutdownEvents) != 1 {
+		t.Errorf("expected one chain shutdown event, got %d", len(shutdownEvents))
+	}
+
+	// upgrades from the owner are refused
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if shutDown, ok := err.(*ChainShutdownError); !ok || shutDown.Pid != 2 {
+		t.Fatalf("expected the upgrade to be refused, got %T %v", err, err)
+	}
+
+	// once it's gone, new processes don't start either
+	upg2.Stop()
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3, deadPids: map[int]bool{2: true}}, coordDir, WithLogger(l))
+	if shutDown, ok := err.(*ChainShutdownError); !ok || shutDown.Pid != 2 || shutDown.At.IsZero() {
+		t.Fatalf("expected starting in a shut down dir to fail, got %T %v", err, err)
+	}
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3, deadPids: map[int]bool{2: true}}, coordDir, WithLogger(l), WithRestartAfterShutdown())
+	if err != nil {
+		t.Fatalf("error restarting the service: %v", err)
+	}
+	defer upg3.Stop()
+	if upg3.Inherited() {
+		t.Errorf("expected the restarted service not to inherit fds")
+	}
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg4, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 4, deadPids: map[int]bool{2: true}}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected the restarted service to be upgradable, got %v", err)
+	}
+	upg4.Stop()
+}
@@ -0,0 +1,37 @@
+package tableroll
+
+import "time"
+
+// WithCloseGracePeriod delays closing the inherited fds Stop closes when it's
+// called before Ready, so goroutines which are still using them as shutdown
+// begins aren't cut off. They're closed once d has passed, or once every
+// connection accepted from a listener tracked with TrackListener has
+// finished, whichever is first. Stop itself doesn't wait.
+//
+// Until the fds are closed, the owner can't be told this process gave them
+// up, so it counts them as stray fds, see StrayFds, until this process exits.
+func WithCloseGracePeriod(d time.Duration) Option {
+	return func(u *Upgrader) {
+		u.closeGracePeriod = d
+	}
+}
+
+// closeInheritedAfterGrace closes the inherited fds in the background once
+// the close grace period is over, or there are no tracked connections left.
+func (u *Upgrader) closeInheritedAfterGrace() {
+	u.l.Info("closing inherited fds after the grace period", "gracePeriod", u.closeGracePeriod, "conns", u.ActiveConns())
+	deadline := u.clock.After(u.closeGracePeriod)
+	go func() {
+		for u.ActiveConns() > 0 {
+			select {
+			case <-deadline:
+				u.l.Warn("closing inherited fds with connections still open", "conns", u.ActiveConns())
+				u.Fds.closeInherited()
+				return
+			case <-u.clock.After(drainPollInterval):
+			}
+		}
+		u.Fds.closeInherited()
+		u.l.Debug("closed inherited fds")
+	}()
+}
@@ -0,0 +1,115 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestCloseGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	upg2, err := newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l), WithCloseGracePeriod(time.Minute))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	rawLn, err := upg2.Fds.Listener("ln")
+	if err != nil {
+		t.Fatalf("error getting listener: %v", err)
+	}
+	ln := upg2.TrackListener(rawLn)
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upg2.Stop()
+	// the connection is still open, so the inherited fds are too
+	stepWhenWaiting(t, fake, drainPollInterval)
+	if ids := upg2.Fds.ListPrefix(""); len(ids) != 1 {
+		t.Fatalf("expected the inherited fd to stay open during the grace period, got %v", ids)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(upg2.Fds.ListPrefix("")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the inherited fds to be closed once the connection finished")
+		}
+		fake.Step(drainPollInterval)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseGracePeriodExpires(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	upg2, err := newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l), WithCloseGracePeriod(time.Minute))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	rawLn, err := upg2.Fds.Listener("ln")
+	if err != nil {
+		t.Fatalf("error getting listener: %v", err)
+	}
+	ln := upg2.TrackListener(rawLn)
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	upg2.Stop()
+	stepWhenWaiting(t, fake, time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(upg2.Fds.ListPrefix("")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the inherited fds to be closed once the grace period was over")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,132 @@
+// Command tableroll inspects the state tableroll keeps in a coordination
+// directory.
+//
+// Usage:
+//
+//	tableroll history [-json] <coordination dir>
+//	tableroll status [-timeout d] <coordination dir>
+//	tableroll pause [-timeout d] [-reason r] <coordination dir>
+//	tableroll resume [-timeout d] <coordination dir>
+//	tableroll drain [-timeout d] <coordination dir>
+//	tableroll commit [-timeout d] <coordination dir>
+//	tableroll abort [-timeout d] [-reason r] <coordination dir>
+//
+// The other commands ask the owner of the coordination directory to act, and
+// print its status as json, including when its tracked listeners were last
+// used. drain makes it drain without passing on its fds.
+// commit and abort decide the upgrade an owner using WithManualCommit is
+// waiting on.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ngrok/tableroll"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s history [-json] <coordination dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s status|resume|drain|commit [-timeout d] <coordination dir>\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s pause|abort [-timeout d] [-reason r] <coordination dir>\n", os.Args[0])
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "history":
+		history(os.Args[2:])
+	case "status", "pause", "resume", "drain", "commit", "abort":
+		control(os.Args[1], os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func history(args []string) {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print one json object per entry")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	entries, err := tableroll.ReadHistory(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading history: %v\n", err)
+		if len(entries) == 0 {
+			os.Exit(1)
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			enc.Encode(entry)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tEVENT\tGENERATION\tPID\tPEER\tSTARTED\tIDENTITY\tEXE")
+	for _, entry := range entries {
+		peer, started, identity := "-", "-", "-"
+		if entry.PeerPid != 0 {
+			peer = fmt.Sprint(entry.PeerPid)
+		}
+		if !entry.StartTime.IsZero() {
+			started = entry.StartTime.Format(time.RFC3339)
+		}
+		if entry.Identity != "" {
+			identity = entry.Identity
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339Nano), entry.Type, entry.Generation, entry.Pid, peer, started, identity, entry.Exe)
+	}
+	w.Flush()
+}
+
+func control(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "how long to wait for the owner")
+	reason := flags.String("reason", "requested with the tableroll command", "why upgrades were paused or aborted")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	dir := flags.Arg(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var status *tableroll.OwnerStatus
+	var err error
+	switch command {
+	case "status":
+		status, err = tableroll.GetOwnerStatus(ctx, dir)
+	case "pause":
+		status, err = tableroll.PauseOwnerUpgrades(ctx, dir, *reason)
+	case "resume":
+		status, err = tableroll.ResumeOwnerUpgrades(ctx, dir)
+	case "drain":
+		status, err = tableroll.ForceOwnerDrain(ctx, dir)
+	case "commit":
+		err = tableroll.CommitUpgrade(ctx, dir)
+	case "abort":
+		err = tableroll.AbortUpgrade(ctx, dir, *reason)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if status != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(status)
+	}
+}
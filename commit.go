@@ -0,0 +1,150 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// ErrNoPendingCommit is returned by Commit and Abort when no upgrade is
+// awaiting a decision.
+var ErrNoPendingCommit = errors.New("no upgrade is awaiting commit")
+
+// WithManualCommit makes the owner wait, once the next owner has received its
+// fds and said it's ready, until Commit or Abort is called before stepping
+// down. There's no timeout while waiting, so a deployment system can decide
+// exactly when the handoff is done, e.g. after checking the new process's
+// health. The next owner's Ready doesn't return until then.
+//
+// Commit and Abort may also be sent by another process, such as the tableroll
+// command, with CommitUpgrade and AbortUpgrade; see WithControlAuthorization.
+//
+// If the next owner exits while awaiting a decision, the upgrade is aborted.
+// If Stop is called, it's committed, since this process is going away anyway.
+// Processes using older versions of tableroll which don't wait for the owner
+// to step down consider themselves the owner regardless.
+func WithManualCommit() Option {
+	return func(u *Upgrader) {
+		u.manualCommit = true
+	}
+}
+
+// pendingCommit is an upgrade awaiting Commit or Abort.
+type pendingCommit struct {
+	peer PeerInfo
+	// decided receives nil on commit, or the reason for aborting.
+	decided chan error
+}
+
+// Commit finishes the upgrade which is awaiting a decision, letting the next
+// owner take over. It returns ErrNoPendingCommit if there isn't one.
+func (u *Upgrader) Commit() error {
+	return u.decide(nil)
+}
+
+// Abort rejects the upgrade which is awaiting a decision, and this process
+// remains the owner. The next owner's Ready fails with an
+// UpgradeRejectedError, giving reason. It returns ErrNoPendingCommit if there
+// isn't an upgrade awaiting a decision.
+func (u *Upgrader) Abort(reason string) error {
+	return u.decide(fmt.Errorf("upgrade aborted: %s", reason))
+}
+
+func (u *Upgrader) decide(err error) error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.pendingCommit == nil {
+		return ErrNoPendingCommit
+	}
+	select {
+	case u.pendingCommit.decided <- err:
+		return nil
+	default:
+		return ErrNoPendingCommit
+	}
+}
+
+// AwaitingCommit returns the process which is waiting for this owner to
+// Commit or Abort its upgrade, if any.
+func (u *Upgrader) AwaitingCommit() (PeerInfo, bool) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.pendingCommit == nil {
+		return PeerInfo{}, false
+	}
+	return u.pendingCommit.peer, true
+}
+
+// awaitCommit waits for the upgrade to the given sibling, which has said it's
+// ready, to be committed, if manual commits are enabled.
+func (u *Upgrader) awaitCommit(nextOwner *sibling) error {
+	if !u.manualCommit {
+		return nil
+	}
+	pending := &pendingCommit{peer: nextOwner.peer, decided: make(chan error, 1)}
+	u.stateLock.Lock()
+	u.pendingCommit = pending
+	u.stateLock.Unlock()
+	defer func() {
+		u.stateLock.Lock()
+		u.pendingCommit = nil
+		u.stateLock.Unlock()
+	}()
+
+	// the sibling sends nothing until we step down, so a read only returns
+	// if it's gone
+	nextOwner.clearTimeout()
+	gone := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := nextOwner.conn.Read(b[:])
+		if err == nil {
+			err = errors.New("protocol error: unexpected data while awaiting commit")
+		}
+		gone <- err
+	}()
+	defer func() {
+		nextOwner.conn.SetReadDeadline(time.Unix(1, 0))
+		<-gone
+		nextOwner.conn.SetReadDeadline(time.Time{})
+	}()
+
+	peer := nextOwner.peer
+	u.l.Info("next owner is ready, awaiting commit", "peer", peer)
+	u.emit(Event{Type: EventAwaitingCommit, Peer: &peer})
+	select {
+	case err := <-pending.decided:
+		return err
+	case err := <-gone:
+		gone <- err
+		return fmt.Errorf("next owner went away while awaiting commit: %w", err)
+	case <-u.upgradeCompleteC:
+		u.l.Info("stopped while awaiting commit, committing")
+		return nil
+	}
+}
+
+// CommitUpgrade commits the upgrade the owner of the given coordination
+// directory is awaiting, as if it had called Commit. The owner must use
+// WithManualCommit. For the stable layout, pass the subdirectory holding the
+// upgrade socket.
+func CommitUpgrade(ctx context.Context, coordinationDir string) error {
+	return sendCommitDecision(ctx, coordinationDir, proto.IntentCommit, "")
+}
+
+// AbortUpgrade aborts the upgrade the owner of the given coordination
+// directory is awaiting, as if it had called Abort.
+func AbortUpgrade(ctx context.Context, coordinationDir, reason string) error {
+	return sendCommitDecision(ctx, coordinationDir, proto.IntentAbort, reason)
+}
+
+func sendCommitDecision(ctx context.Context, coordinationDir string, intent proto.Intent, reason string) error {
+	_, err := controlOwner(ctx, coordinationDir, intent, reason, proto.MessageDecided)
+	if rejected, ok := err.(*ControlRejectedError); ok && rejected.Reason == ErrNoPendingCommit.Error() {
+		return ErrNoPendingCommit
+	}
+	return err
+}
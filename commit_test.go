@@ -0,0 +1,107 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// startManualCommitUpgrade creates an owner using manual commits, and a
+// process upgrading from it whose Ready is awaiting a decision. The owner's
+// mock pid is our own, so CommitUpgrade and AbortUpgrade can find it.
+func startManualCommitUpgrade(t *testing.T, coordDir string) (*Upgrader, *Upgrader, chan error) {
+	ctx := context.Background()
+	awaiting := make(chan PeerInfo, 1)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l), WithManualCommit(), WithEventHandler(func(e Event) {
+		if e.Type == EventAwaitingCommit {
+			awaiting <- *e.Peer
+		}
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if err := upg1.Commit(); err != ErrNoPendingCommit {
+		t.Fatalf("expected nothing to commit before an upgrade, got %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- upg2.Ready()
+	}()
+	select {
+	case <-awaiting:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the owner didn't await a commit")
+	}
+	if _, ok := upg1.AwaitingCommit(); !ok {
+		t.Fatalf("expected the owner to report it's awaiting a commit")
+	}
+	select {
+	case err := <-readyErr:
+		t.Fatalf("expected Ready to wait for a commit, got %v", err)
+	case <-upg1.UpgradeComplete():
+		t.Fatalf("expected the owner not to step down before a commit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	return upg1, upg2, readyErr
+}
+
+func TestManualCommit(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	upg1, upg2, readyErr := startManualCommitUpgrade(t, coordDir)
+	defer upg1.Stop()
+	defer upg2.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := CommitUpgrade(ctx, coordDir); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if err := <-readyErr; err != nil {
+		t.Fatalf("expected Ready to succeed after the commit, got %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if _, ok := upg1.AwaitingCommit(); ok {
+		t.Fatalf("expected nothing to be awaiting a commit")
+	}
+}
+
+func TestManualCommitAbort(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	upg1, upg2, readyErr := startManualCommitUpgrade(t, coordDir)
+	defer upg1.Stop()
+	defer upg2.Stop()
+
+	if err := upg1.Abort("unhealthy"); err != nil {
+		t.Fatalf("error aborting: %v", err)
+	}
+	err := <-readyErr
+	rejected, ok := err.(*UpgradeRejectedError)
+	if !ok || !strings.Contains(rejected.Reason, "unhealthy") {
+		t.Fatalf("expected Ready to be rejected with the abort reason, got %T %v", err, err)
+	}
+	// still the owner
+	ln, err := upg1.Fds.Listen(context.Background(), "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected to remain the owner, got %v", err)
+	}
+	ln.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := AbortUpgrade(ctx, coordDir, "again"); err != ErrNoPendingCommit {
+		t.Fatalf("expected nothing to abort, got %v", err)
+	}
+}
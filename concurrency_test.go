@@ -0,0 +1,187 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+// hammer calls every read-only and mutating public method of upg in a loop,
+// from several goroutines, until stop is closed. It's meant to be run with
+// -race alongside upgrades and Stop.
+func hammer(upg *Upgrader, stop <-chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	getters := func() {
+		upg.Status()
+		upg.Health()
+		upg.StrayFds()
+		upg.AwaitingCommit()
+		upg.PeerIdentity()
+		upg.HandoffState()
+		upg.Generation()
+		upg.Inherited()
+		upg.NoOwnerReason()
+		upg.PreviousOwner()
+		upg.CoordinationError()
+		upg.ActiveConns()
+		upg.ActiveStreams()
+		upg.Store().Keys()
+		_ = upg.Fds.String()
+		upg.Fds.ListPrefix("")
+		if ln, _ := upg.Fds.Listener("shared"); ln != nil {
+			ln.Close()
+		}
+		upg.Fds.WasInherited("shared")
+		_ = upg.Fds.Dump()
+		upg.Fds.Subgroups("")
+	}
+	mutations := func(i int) {
+		id := fmt.Sprintf("scratch/%d", i%4)
+		if _, err := upg.Fds.Listen(context.Background(), id, nil, "tcp", "127.0.0.1:0"); err == nil {
+			upg.Fds.Remove(id)
+		}
+		upg.Store().Put("key", []byte("value"))
+	}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if g%2 == 0 {
+					getters()
+				} else {
+					mutations(i)
+				}
+			}
+		}(g)
+	}
+	return &wg
+}
+
+func TestConcurrentUseDuringHandoffAndStop(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	if _, err := upg1.Fds.Listen(ctx, "shared", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	stop1 := make(chan struct{})
+	wg1 := hammer(upg1, stop1)
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	stop2 := make(chan struct{})
+	wg2 := hammer(upg2, stop2)
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	var stops sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		stops.Add(2)
+		go func() {
+			defer stops.Done()
+			upg1.Stop()
+		}()
+		go func() {
+			defer stops.Done()
+			upg2.Stop()
+		}()
+	}
+	stops.Wait()
+	close(stop1)
+	close(stop2)
+	wg1.Wait()
+	wg2.Wait()
+}
+
+func TestConcurrentReadyAndStop(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	stop := make(chan struct{})
+	wg := hammer(upg2, stop)
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- upg2.Ready()
+	}()
+	upg2.Stop()
+	// either may win, but neither may race or deadlock
+	<-readyErr
+	close(stop)
+	wg.Wait()
+}
+
+func TestCallbacksMayUseUpgrader(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	statuses := make(chan OwnerStatus, 1)
+	var upg2 *Upgrader
+	upg2, err = newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l),
+		WithReadyDeadline(time.Minute, ReadyDeadlineWarn),
+		WithEventHandler(func(e Event) { statuses <- upg2.Status() }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	stepWhenWaiting(t, fake, time.Minute)
+	select {
+	case status := <-statuses:
+		if status.State != string(upgraderStateCheckingOwner) {
+			t.Fatalf("expected to still be checking the owner, got %q", status.State)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event handler deadlocked calling the Upgrader")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
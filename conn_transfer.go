@@ -0,0 +1,148 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Draining waits for connections to finish, which long-lived connections,
+// like IRC, MQTT or websocket ones, may never do by themselves. Instead, the
+// old owner may pass them to the new owner while it drains, along with a
+// little state describing each, over the connection it sends drain-complete
+// on. Each is sent as a "conn" frame followed by the connection's fd. The new
+// owner only accepts them if it said so in its hello, since older versions
+// would drop them.
+
+// ErrConnTransferUnsupported is returned by TransferConn when the next owner
+// can't receive connections, because it doesn't use WithConnReceiver or uses
+// an older version of tableroll.
+var ErrConnTransferUnsupported = errors.New("the next owner does not accept connections")
+
+// WithConnReceiver sets the function which is called with each connection the
+// previous owner passes to this process with TransferConn while it drains,
+// along with the id and state it was given. The function is called
+// synchronously, so it should return quickly, e.g. by starting a goroutine to
+// serve the connection. Without a receiver, the previous owner can't pass on
+// connections, and has to drain them.
+func WithConnReceiver(receive func(id string, conn net.Conn, state []byte)) Option {
+	return func(u *Upgrader) {
+		u.connReceiver = receive
+	}
+}
+
+// TransferConn passes conn to the process which took over from this one, for
+// it to serve from then on, and closes this process's copy of it. It may
+// only be called while draining, after UpgradeComplete is closed and before
+// NotifyDrainComplete. id and state are passed along with it to the next
+// owner's receiver, set with WithConnReceiver. id may be used to tell what
+// the connection is for, and state should describe anything else the next
+// owner needs to carry on serving it, such as any data this process has read
+// from it but not yet handled, since only the connection itself is passed.
+//
+// conn must be a *net.TCPConn, *net.UnixConn, or other connection with a
+// SyscallConn method, or a connection accepted from a listener wrapped with
+// TrackListener, in which case it stops being counted for draining. If the
+// next owner can't receive connections, ErrConnTransferUnsupported is
+// returned, and conn is left open.
+func (f *Fds) TransferConn(id string, conn net.Conn, state []byte) error {
+	if f.transferConn == nil {
+		return ErrConnTransferUnsupported
+	}
+	return f.transferConn(id, conn, state)
+}
+
+// transferConn implements TransferConn.
+func (u *Upgrader) transferConn(id string, conn net.Conn, state []byte) error {
+	raw := conn
+	if tc, ok := conn.(*trackedConn); ok {
+		raw = tc.Conn
+	}
+	sc, ok := raw.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't transfer a %T, which has no file descriptor", raw)
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.state != upgraderStateDraining {
+		return fmt.Errorf("cannot transfer connections in state %v", u.state)
+	}
+	successor := u.successor
+	if successor == nil || u.drainNotified || !successor.acceptsConns {
+		return ErrConnTransferUnsupported
+	}
+	if err := successor.frames.WriteFrame(proto.MessageConn, proto.Conn{ID: id, State: state}); err != nil {
+		return fmt.Errorf("could not pass connection to the next owner: %w", err)
+	}
+	connFile, closeConnFile, err := fdPassingFile(successor.conn)
+	if err != nil {
+		return fmt.Errorf("could not convert sibling connection to file: %w", err)
+	}
+	defer closeConnFile()
+	var sendErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sendErr = sendFd(connFile, id, fd)
+	}); err != nil {
+		return err
+	}
+	if sendErr != nil {
+		// the next owner is left waiting for an fd, so it can't make sense
+		// of anything else we send
+		successor.conn.Close()
+		u.successor = nil
+		return fmt.Errorf("could not pass connection to the next owner: %w", sendErr)
+	}
+	u.l.Debug("passed a connection to the next owner", "id", u.redactString(id), "remote", conn.RemoteAddr())
+	return conn.Close()
+}
+
+// receiveConn receives a connection passed with TransferConn, and hands it to
+// our receiver.
+func (u *Upgrader) receiveConn(conn *net.UnixConn, frame *proto.Frame) error {
+	var transferred proto.Conn
+	if err := frame.Decode(&transferred); err != nil {
+		return err
+	}
+	sockFile, closeSockFile, err := fdPassingFile(conn)
+	if err != nil {
+		return fmt.Errorf("could not convert connection to file: %w", err)
+	}
+	defer closeSockFile()
+	file, err := recvFd(sockFile)
+	if err != nil {
+		return fmt.Errorf("error getting connection: %w", err)
+	}
+	received, err := fileConn(file)
+	if err != nil {
+		u.l.Warn("could not use a connection passed by the previous owner", "id", u.redactString(transferred.ID), "err", err)
+		return nil
+	}
+	if u.connReceiver == nil {
+		// we said we'd accept conns, so this shouldn't happen
+		received.Close()
+		return nil
+	}
+	u.l.Debug("got a connection from the previous owner", "id", u.redactString(transferred.ID), "remote", received.RemoteAddr())
+	u.connReceiver(transferred.ID, received, transferred.State)
+	return nil
+}
+
+// fileConn converts a received file into a connection, closing the file.
+func fileConn(file *os.File) (net.Conn, error) {
+	defer file.Close()
+	return net.FileConn(file)
+}
+
+// redactString applies the redaction function, if any, to s for logging.
+func (u *Upgrader) redactString(s string) string {
+	return redactString(u.redact, s)
+}
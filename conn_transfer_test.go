@@ -0,0 +1,146 @@
+package tableroll
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+type receivedConn struct {
+	id    string
+	conn  net.Conn
+	state []byte
+}
+
+func TestTransferConn(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "chat", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	tracked := upg1.TrackListener(ln)
+	defer tracked.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer client.Close()
+	conn, err := tracked.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+	if _, err := client.Write([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	// the owner has read part of a message when it's upgraded
+	partial := make([]byte, 2)
+	if _, err := io.ReadFull(conn, partial); err != nil {
+		t.Fatal(err)
+	}
+	if err := upg1.Fds.TransferConn("chat", conn, partial); err == nil {
+		t.Fatal("expected transferring a connection before an upgrade to fail")
+	}
+
+	received := make(chan receivedConn, 1)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l), WithConnReceiver(func(id string, conn net.Conn, state []byte) {
+		received <- receivedConn{id, conn, state}
+	}))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	if err := upg1.Fds.TransferConn("chat", conn, partial); err != nil {
+		t.Fatalf("error transferring connection: %v", err)
+	}
+	if n := upg1.ActiveConns(); n != 0 {
+		t.Errorf("expected the transferred connection not to be drained, but %d are active", n)
+	}
+	var got receivedConn
+	select {
+	case got = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the next owner didn't receive the connection")
+	}
+	defer got.conn.Close()
+	if got.id != "chat" || string(got.state) != "ab" {
+		t.Fatalf("expected connection %q with state %q, got %q with %q", "chat", "ab", got.id, got.state)
+	}
+
+	// the client carries on talking to the new owner
+	if _, err := client.Write([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	rest := make([]byte, 1)
+	if _, err := io.ReadFull(got.conn, rest); err != nil || string(rest) != "c" {
+		t.Fatalf("expected to read %q from the transferred connection, got %q, %v", "c", rest, err)
+	}
+	if _, err := got.conn.Write([]byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "ok" {
+		t.Fatalf("expected the client to read %q, got %q, %v", "ok", reply, err)
+	}
+
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+}
+
+func TestTransferConnUnsupported(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	server, client, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer client.Close()
+	if err := upg1.Fds.TransferConn("chat", server, nil); err != ErrConnTransferUnsupported {
+		t.Fatalf("expected ErrConnTransferUnsupported, got %v", err)
+	}
+}
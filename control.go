@@ -0,0 +1,253 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Besides upgrades, the owner's upgrade socket serves requests from external
+// controllers, such as deployment systems or the tableroll command: reporting
+// status, pausing and resuming upgrades, forcing the owner to drain, and
+// committing or aborting upgrades with WithManualCommit. Controllers are
+// authenticated with the peer credentials of their connection.
+
+// OwnerStatus describes an owner, as reported to controllers.
+type OwnerStatus struct {
+	Pid        int    `json:"pid"`
+	Generation uint32 `json:"generation"`
+	// State is "owner", "transferring-ownership", "draining" or "stopped".
+	State string `json:"state"`
+	// Paused is set if upgrades are paused, with PauseReason.
+	Paused      bool   `json:"paused,omitempty"`
+	PauseReason string `json:"pauseReason,omitempty"`
+	// AwaitingCommit is the pid of the process awaiting Commit or Abort, if
+	// any.
+	AwaitingCommit int `json:"awaitingCommit,omitempty"`
+	// Fds are the ids of the owner's fds.
+	Fds []string `json:"fds"`
+	// StrayFds counts processes which may hold copies of the owner's fds; see
+	// StrayFds.
+	StrayFds int `json:"strayFds,omitempty"`
+	// Degraded describes why the owner's upgrade socket is degraded, if it
+	// is; see Health.
+	Degraded string `json:"degraded,omitempty"`
+	// Identity is what the owner set with WithIdentity, if anything.
+	Identity string `json:"identity,omitempty"`
+	// Quarantined are the ids of the owner's quarantined fds; see
+	// WithFdQuarantine.
+	Quarantined []string `json:"quarantined,omitempty"`
+	// Activity is when the owner's tracked listeners were last used, and
+	// LastActivity the latest of those times; see FdActivity and
+	// LastActivity.
+	Activity     []FdActivity `json:"activity,omitempty"`
+	LastActivity time.Time    `json:"lastActivity"`
+}
+
+// WithControlAuthorization configures which processes may send control
+// requests to this process's upgrade socket. authorize is called with each
+// controller's credentials, and the request is rejected if it returns an
+// error. By default, only processes running as root or as the same user as
+// this process are allowed.
+func WithControlAuthorization(authorize func(peer PeerInfo) error) Option {
+	return func(u *Upgrader) {
+		u.authorizeControl = authorize
+	}
+}
+
+// sameUserOrRoot is the default control authorization.
+func sameUserOrRoot(peer PeerInfo) error {
+	if peer.Pid == 0 {
+		return errors.New("could not determine the controller's credentials")
+	}
+	if peer.Uid != 0 && peer.Uid != os.Getuid() {
+		return fmt.Errorf("uid %d may not control this process", peer.Uid)
+	}
+	return nil
+}
+
+// Status returns this process's status, as reported to controllers.
+func (u *Upgrader) Status() OwnerStatus {
+	ids := u.Fds.IDs()
+	activity, lastActivity := u.FdActivity(), u.LastActivity()
+	var quarantined []string
+	for _, q := range u.Fds.Quarantined() {
+		quarantined = append(quarantined, q.ID)
+	}
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	status := OwnerStatus{
+		Pid:          u.os.Getpid(),
+		Generation:   u.generation,
+		State:        string(u.state),
+		Paused:       u.paused,
+		PauseReason:  u.pauseReason,
+		Fds:          ids,
+		StrayFds:     len(u.liveStrayFdsLocked()),
+		Identity:     u.identity,
+		Quarantined:  quarantined,
+		Activity:     activity,
+		LastActivity: lastActivity,
+	}
+	if u.pendingCommit != nil {
+		status.AwaitingCommit = u.pendingCommit.peer.Pid
+	}
+	if err := u.healthLocked(); err != nil {
+		status.Degraded = err.Error()
+	}
+	return status
+}
+
+// forceDrain steps down without passing our fds to anyone, and stops
+// listening for upgrades, so the next process cold-starts.
+func (u *Upgrader) forceDrain() error {
+	if err := u.transitionTo(upgraderStateDraining); err != nil {
+		return err
+	}
+	u.l.Warn("draining at a controller's request, without passing on fds")
+	u.Fds.lockMutations(ErrUpgradeCompleted)
+	u.closeFallbackSock()
+	u.closeUpgradeSocks()
+	u.recordHistory(HistoryForceDrained, 0)
+	u.closeUpgradeComplete()
+	return nil
+}
+
+// handleControlRequest serves a request from a controller.
+func (u *Upgrader) handleControlRequest(controller *sibling, hello *proto.Hello) {
+	authorize := u.authorizeControl
+	if authorize == nil {
+		authorize = sameUserOrRoot
+	}
+	if err := authorize(controller.peer); err != nil {
+		u.l.Warn("unauthorized control request", "intent", hello.Intent, "peer", controller.peer, "err", err)
+		controller.reject(err.Error())
+		return
+	}
+	u.l.Info("control request", "intent", hello.Intent, "peer", controller.peer, "reason", hello.Reason)
+
+	var err error
+	reply := proto.MessageStatus
+	switch hello.Intent {
+	case proto.IntentStatus:
+	case proto.IntentPause:
+		err = u.PauseUpgrades(hello.Reason)
+	case proto.IntentResume:
+		u.ResumeUpgrades()
+	case proto.IntentForceDrain:
+		err = u.forceDrain()
+	case proto.IntentCommit:
+		err = u.Commit()
+		reply = proto.MessageDecided
+	case proto.IntentAbort:
+		err = u.Abort(hello.Reason)
+		reply = proto.MessageDecided
+	}
+	if err != nil {
+		controller.reject(err.Error())
+		return
+	}
+	var body interface{}
+	if reply == proto.MessageStatus {
+		body = u.Status()
+	}
+	if err := controller.frames.WriteFrame(reply, body); err != nil {
+		u.l.Warn("could not reply to control request", "err", err)
+	}
+}
+
+// isControlIntent returns true for requests from controllers, rather than
+// processes taking part in upgrades.
+func isControlIntent(intent proto.Intent) bool {
+	switch intent {
+	case proto.IntentStatus, proto.IntentPause, proto.IntentResume, proto.IntentForceDrain, proto.IntentCommit, proto.IntentAbort:
+		return true
+	}
+	return false
+}
+
+// GetOwnerStatus asks the owner of the given coordination directory for its
+// status. For the stable layout, pass the subdirectory holding the upgrade
+// socket.
+func GetOwnerStatus(ctx context.Context, coordinationDir string) (*OwnerStatus, error) {
+	return controlStatus(ctx, coordinationDir, proto.IntentStatus, "")
+}
+
+// PauseOwnerUpgrades asks the owner of the given coordination directory to
+// reject upgrades, giving reason, until ResumeOwnerUpgrades is called.
+func PauseOwnerUpgrades(ctx context.Context, coordinationDir, reason string) (*OwnerStatus, error) {
+	return controlStatus(ctx, coordinationDir, proto.IntentPause, reason)
+}
+
+// ResumeOwnerUpgrades undoes PauseOwnerUpgrades.
+func ResumeOwnerUpgrades(ctx context.Context, coordinationDir string) (*OwnerStatus, error) {
+	return controlStatus(ctx, coordinationDir, proto.IntentResume, "")
+}
+
+// ForceOwnerDrain asks the owner of the given coordination directory to step
+// down and drain without passing its fds to anyone, as if it had been
+// upgraded. The next process to start will cold-start.
+func ForceOwnerDrain(ctx context.Context, coordinationDir string) (*OwnerStatus, error) {
+	return controlStatus(ctx, coordinationDir, proto.IntentForceDrain, "")
+}
+
+func controlStatus(ctx context.Context, coordinationDir string, intent proto.Intent, reason string) (*OwnerStatus, error) {
+	frame, err := controlOwner(ctx, coordinationDir, intent, reason, proto.MessageStatus)
+	if err != nil {
+		return nil, err
+	}
+	var status OwnerStatus
+	if err := frame.Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// controlOwner sends a control request to the owner of the given
+// coordination directory, and returns its reply, which must be of the
+// expected type.
+func controlOwner(ctx context.Context, coordinationDir string, intent proto.Intent, reason string, expect proto.MessageType) (*proto.Frame, error) {
+	coord := newCoordinator(clock.RealClock{}, realOS{}, discardLogger{}, coordinationDir)
+	if _, err := os.Stat(filepath.Join(coordinationDir, StableSocketName)); err == nil {
+		coord.stable = true
+	}
+	conn, legacy, err := coord.ConnectOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if legacy {
+		return nil, errors.New("the owner is too old to be controlled")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	frames := proto.NewStream(conn, proto.RoleOwner)
+	hello := proto.Hello{Version: proto.Version, Intent: intent, Reason: reason}
+	if err := frames.WriteFrame(proto.MessageHello, hello); err != nil {
+		return nil, err
+	}
+	frame, err := frames.ReadFrameOfType(expect)
+	if err != nil {
+		if rejected, ok := err.(*proto.RejectedError); ok {
+			return nil, &ControlRejectedError{Reason: rejected.Reason}
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ControlRejectedError is returned when the owner refused a control request.
+type ControlRejectedError struct {
+	Reason string
+}
+
+func (e *ControlRejectedError) Error() string {
+	return "the owner refused: " + e.Reason
+}
@@ -0,0 +1,144 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestControlPauseResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	// the owner's mock pid is our own, so controllers can find it
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	status, err := GetOwnerStatus(ctx, coordDir)
+	if err != nil {
+		t.Fatalf("error getting status: %v", err)
+	}
+	if status.Pid != os.Getpid() || status.State != "owner" || status.Paused || len(status.Fds) != 1 || status.Fds[0] != "ln" {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	status, err = PauseOwnerUpgrades(ctx, coordDir, "migrating")
+	if err != nil {
+		t.Fatalf("error pausing: %v", err)
+	}
+	if !status.Paused || status.PauseReason != "migrating" {
+		t.Fatalf("expected upgrades to be paused, got %+v", status)
+	}
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if paused, ok := err.(*UpgradesPausedError); !ok || paused.Reason != "migrating" || paused.Pid != os.Getpid() {
+		t.Fatalf("expected the upgrade to be rejected while paused, got %v", err)
+	}
+
+	if _, err := ResumeOwnerUpgrades(ctx, coordDir); err != nil {
+		t.Fatalf("error resuming: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading after resuming: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestControlForceDrain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	status, err := ForceOwnerDrain(ctx, coordDir)
+	if err != nil {
+		t.Fatalf("error forcing drain: %v", err)
+	}
+	if status.State != "draining" {
+		t.Fatalf("expected the owner to be draining, got %+v", status)
+	}
+	<-upg1.UpgradeComplete()
+	if _, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0"); err != ErrUpgradeCompleted {
+		t.Fatalf("expected the fds to be locked, got %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid() + 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if upg2.Inherited() {
+		t.Fatalf("expected the next process to cold-start")
+	}
+	entries, _ := upg2.History()
+	if len(entries) < 2 || entries[1].Type != HistoryForceDrained {
+		t.Fatalf("expected the forced drain in the history, got %+v", entries)
+	}
+}
+
+func TestControlAuthorization(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: os.Getpid()}, coordDir, WithLogger(l), WithControlAuthorization(func(peer PeerInfo) error {
+		return errors.New("no controllers allowed")
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	_, err = PauseOwnerUpgrades(ctx, coordDir, "nope")
+	if rejected, ok := err.(*ControlRejectedError); !ok || rejected.Reason != "no controllers allowed" {
+		t.Fatalf("expected the request to be rejected, got %v", err)
+	}
+	if upg.Status().Paused {
+		t.Fatalf("expected an unauthorized pause to be ignored")
+	}
+
+	if err := sameUserOrRoot(PeerInfo{Pid: 1, Uid: os.Getuid()}); err != nil {
+		t.Fatalf("expected the same user to be allowed, got %v", err)
+	}
+	if os.Getuid() != 0 {
+		if err := sameUserOrRoot(PeerInfo{Pid: 1, Uid: os.Getuid() + 1}); err == nil {
+			t.Fatalf("expected another user to be refused")
+		}
+	}
+	if err := sameUserOrRoot(PeerInfo{}); err == nil {
+		t.Fatalf("expected unknown credentials to be refused")
+	}
+}
@@ -8,18 +8,98 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/inconshreveable/log15"
-	"github.com/pkg/errors"
-	"github.com/rkt/rkt/pkg/lock"
-	"k8s.io/utils/clock"
+	"github.com/ngrok/tableroll/internal/clock"
 )
 
-// errNoOwner indicates that either no process currently is marked as
+// NoOwnerReason describes why no owner was found in the coordination
+// directory. This lets callers distinguish the very first start of a service
+// from a previous owner having crashed.
+type NoOwnerReason string
+
+const (
+	// NoOwnerReasonNone indicates an owner was found, or that no attempt to
+	// find one has completed.
+	NoOwnerReasonNone NoOwnerReason = ""
+	// NoOwnerReasonFirstStart indicates no process has ever become the owner
+	// in this coordination directory.
+	NoOwnerReasonFirstStart NoOwnerReason = "first-start"
+	// NoOwnerReasonOwnerDead indicates the recorded owner process is no longer
+	// running, e.g. because it crashed.
+	NoOwnerReasonOwnerDead NoOwnerReason = "owner-dead"
+	// NoOwnerReasonLockHolderDead indicates the recorded owner process is no
+	// longer running, and neither was the process recorded as holding the
+	// coordination lock while we waited for it. Most likely the owner
+	// crashed and its lock leaked to a process it started, which has since
+	// released it.
+	NoOwnerReasonLockHolderDead NoOwnerReason = "lock-holder-dead"
+	// NoOwnerReasonSocketMissing indicates the recorded owner pid is alive, but
+	// it has no upgrade socket. Most likely the pid has been reused by an
+	// unrelated process.
+	NoOwnerReasonSocketMissing NoOwnerReason = "socket-missing"
+	// NoOwnerReasonConnectionRefused indicates the recorded owner's upgrade
+	// socket exists, but nothing accepted our connection.
+	NoOwnerReasonConnectionRefused NoOwnerReason = "connection-refused"
+	// NoOwnerReasonForcedColdStart indicates an owner existed, but it was
+	// asked to step down without passing its file descriptors because
+	// WithForceColdStart was used.
+	NoOwnerReasonForcedColdStart NoOwnerReason = "forced-cold-start"
+	// NoOwnerReasonLeaseExpired indicates the recorded owner is running, but
+	// stopped renewing its ownership lease, so it was presumed hung and
+	// ownership was seized; see WithOwnershipLease.
+	NoOwnerReasonLeaseExpired NoOwnerReason = "lease-expired"
+)
+
+// NoOwnerError indicates that either no process currently is marked as
 // controlling the upgradeable file descriptors (e.g. initial startup case), or
 // a process is supposed to own them but is dead (e.g. it crashed).
-var errNoOwner = errors.New("no owner process exists")
+type NoOwnerError struct {
+	Reason NoOwnerReason
+}
+
+func (e *NoOwnerError) Error() string {
+	return fmt.Sprintf("no owner process exists: %s", e.Reason)
+}
+
+// DefaultLockRetryInterval is how often an Upgrader checks if the
+// coordination directory's lock has been released while waiting for it.
+const DefaultLockRetryInterval = 100 * time.Millisecond
+
+// LockHolder describes which process is holding the coordination directory's
+// lock while another process waits for it.
+type LockHolder string
+
+const (
+	// LockHeldByUnknown indicates the lock holder could not be determined.
+	LockHeldByUnknown LockHolder = "unknown"
+	// LockHeldByOwner indicates the current owner holds the lock, e.g.
+	// because it is in the process of becoming the owner. This is normal and
+	// brief.
+	LockHeldByOwner LockHolder = "owner"
+	// LockHeldByNewcomer indicates another new process holds the lock because
+	// it is in the middle of an upgrade. Only one new process may upgrade at a
+	// time.
+	LockHeldByNewcomer LockHolder = "newcomer"
+	// LockHeldByDeadProcess indicates the process recorded as holding the lock
+	// is no longer running, but the lock is still held. This most likely
+	// means the lock's file descriptor was leaked to a child process.
+	LockHeldByDeadProcess LockHolder = "dead-process"
+)
+
+// LockTimeoutError is returned when the coordination directory's lock could
+// not be acquired before the lock timeout.
+type LockTimeoutError struct {
+	Holder    LockHolder
+	HolderPid int
+	Waited    time.Duration
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v waiting for coordination lock held by %s (pid %d)", e.Waited, e.Holder, e.HolderPid)
+}
 
 // coordination is used to coordinate between N processes, one of which is the
 // current owner.
@@ -28,30 +108,94 @@ var errNoOwner = errors.New("no owner process exists")
 // between a read and update.
 // It is implemented in this case with unix locks on a file.
 type coordinator struct {
-	lock *lock.FileLock
+	lock *fileLock
 	dir  string
-	l    log15.Logger
+	l    Logger
+
+	// lockTimeout is how long to wait for the lock before giving up, or 0 to
+	// wait forever.
+	lockTimeout       time.Duration
+	lockRetryInterval time.Duration
+	// lockHeldByDead is set if, when Lock last waited for the lock, it was
+	// held by a process which wasn't running.
+	lockHeldByDead bool
+
+	// sockName is the name of the upgrade socket, if not the default, and
+	// sockMode and sockGid are the permissions it's given, if set.
+	sockName string
+	sockMode *os.FileMode
+	sockGid  int
+	// stable is set if the coordinator uses the stable layout, in which
+	// case dir is the stable layout's subdirectory.
+	stable bool
+	// restartAfterShutdown is set to start despite the dir being shut down;
+	// see WithRestartAfterShutdown.
+	restartAfterShutdown bool
+	// leases is set if an owner whose ownership lease has expired may be
+	// taken over from; see WithOwnershipLease.
+	leases bool
+
+	tracer Tracer
 
 	// mocks
-	os    osIface
+	os    OS
 	clock clock.Clock
 }
 
-func newCoordinator(clock clock.Clock, os osIface, l log15.Logger, dir string) *coordinator {
-	l = l.New("dir", dir)
-	coord := &coordinator{dir: dir, l: l, clock: clock, os: os}
+func newCoordinator(clock clock.Clock, os OS, l Logger, dir string) *coordinator {
+	l = withLogContext(l, "dir", dir)
+	coord := &coordinator{
+		dir:               dir,
+		l:                 l,
+		lockRetryInterval: DefaultLockRetryInterval,
+		tracer:            noopTracer{},
+		clock:             clock,
+		os:                os,
+	}
 	return coord
 }
 
+// Listen listens on this process's upgrade socket, which speaks the v2+
+// protocol.
 func (c *coordinator) Listen(ctx context.Context) (*net.UnixListener, error) {
-	listenpath := upgradeSockPath(c.dir, c.os.Getpid())
+	return c.listen(ctx, c.upgradeSockPath(c.os.Getpid()))
+}
+
+// ListenLegacy listens on this process's legacy upgrade socket, which speaks
+// the v0 and v1 protocol, so that older processes can still upgrade from us.
+func (c *coordinator) ListenLegacy(ctx context.Context) (*net.UnixListener, error) {
+	return c.listen(ctx, legacyUpgradeSockPath(c.dir, c.os.Getpid()))
+}
+
+func (c *coordinator) listen(ctx context.Context, listenpath string) (*net.UnixListener, error) {
 	l, err := (&net.ListenConfig{}).Listen(ctx, "unix", listenpath)
 	if err != nil {
+		return nil, classifyCoordinationErr(c.dir, "listen", err)
+	}
+	if err := c.setSockPermissions(listenpath); err != nil {
+		l.Close()
 		return nil, err
 	}
 	return l.(*net.UnixListener), nil
 }
 
+// setSockPermissions applies the permissions configured with
+// WithSocketPermissions to an upgrade socket.
+func (c *coordinator) setSockPermissions(path string) error {
+	if c.sockMode == nil {
+		return nil
+	}
+	if err := os.Chmod(path, *c.sockMode); err != nil {
+		return classifyCoordinationErr(c.dir, "chmod socket", err)
+	}
+	if c.sockGid != -1 {
+		if err := os.Chown(path, -1, c.sockGid); err != nil {
+			return classifyCoordinationErr(c.dir, "chown socket", err)
+		}
+	}
+	return nil
+}
+
 func touchFile(path string) error {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0755)
 	f.Close()
@@ -60,32 +204,86 @@ func touchFile(path string) error {
 
 // Lock takes an exclusive lock on the given coordination directory.  If the
 // directory is already locked, the function will block until the lock can be
-// acquired, or until the passed context is cancelled.
-func (c *coordinator) Lock(ctx context.Context) error {
+// acquired, until the passed context is cancelled, or until the lock timeout
+// (if any) elapses, in which case a *LockTimeoutError is returned.
+func (c *coordinator) Lock(ctx context.Context) (err error) {
+	_, span := c.tracer.Start(ctx, "tableroll.lock")
+	defer func() { endSpan(span, err) }()
 	pidPath := c.pidFile()
 	if err := touchFile(pidPath); err != nil {
-		return err
+		return classifyCoordinationErr(c.dir, "lock", err)
 	}
 	c.l.Info("taking lock on coordination dir")
-	flock, err := lock.NewLock(pidPath, lock.RegFile)
+	flock, err := newFileLock(pidPath)
+	if err == errLockPermission {
+		return &CoordinationDirError{Dir: c.dir, Op: "lock", Failure: CoordinationPermissionDenied, Err: err}
+	}
 	if err != nil {
 		return err
 	}
-	for ctx.Err() == nil {
-		err := flock.TryExclusiveLock()
+	start := c.clock.Now()
+	var lastHolder LockHolder
+	c.lockHeldByDead = false
+	for {
+		if err := ctx.Err(); err != nil {
+			flock.close()
+			return err
+		}
+		err := flock.tryExclusiveLock()
 		if err == nil {
 			// lock get
 			break
 		}
-		if err != lock.ErrLocked {
-			return errors.Wrap(err, "error trying to lock coordination directory")
+		if err != errLocked {
+			flock.close()
+			return fmt.Errorf("error trying to lock coordination directory: %w", err)
+		}
+		holder, holderPid := c.lockHolder()
+		if holder != lastHolder {
+			c.l.Info("coordination dir is locked, waiting", "holder", holder, "holderPid", holderPid)
+			if holder == LockHeldByDeadProcess {
+				c.lockHeldByDead = true
+				c.l.Warn("coordination dir is locked by a process which is not running; its lock may have leaked to a child process", "holderPid", holderPid)
+			}
+			lastHolder = holder
+		}
+		if waited := c.clock.Since(start); c.lockTimeout > 0 && waited >= c.lockTimeout {
+			flock.close()
+			return &LockTimeoutError{Holder: holder, HolderPid: holderPid, Waited: waited}
 		}
 		// lock busy, wait and try again
-		c.clock.Sleep(100 * time.Millisecond)
+		c.clock.Sleep(c.lockRetryInterval)
 	}
 	c.l.Info("took lock on coordination dir")
 	c.lock = flock
-	return ctx.Err()
+	if err := ioutil.WriteFile(c.lockHolderFile(), []byte(strconv.Itoa(c.os.Getpid())), 0755); err != nil {
+		// this is purely informational, so don't fail
+		c.l.Warn("could not record ourselves as the lock holder", "err", err)
+	}
+	return nil
+}
+
+// lockHolder makes a best-effort guess as to who holds the coordination lock.
+func (c *coordinator) lockHolder() (LockHolder, int) {
+	data, err := ioutil.ReadFile(c.lockHolderFile())
+	if err != nil || len(data) == 0 {
+		return LockHeldByUnknown, 0
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		return LockHeldByUnknown, 0
+	}
+	if pidIsDead(c.os, pid) {
+		return LockHeldByDeadProcess, pid
+	}
+	if owner, err := c.GetOwnerPID(); err == nil && owner == pid {
+		return LockHeldByOwner, pid
+	}
+	return LockHeldByNewcomer, pid
+}
+
+func (c *coordinator) lockHolderFile() string {
+	return filepath.Join(c.dir, "lock-holder")
 }
 
 func (c *coordinator) pidFile() string {
@@ -97,7 +295,8 @@ func (c *coordinator) pidFile() string {
 func (c *coordinator) BecomeOwner() error {
 	pid := c.os.Getpid()
 	c.l.Info("writing pid to become owner", "pid", pid)
-	return ioutil.WriteFile(c.pidFile(), []byte(strconv.Itoa(pid)), 0755)
+	err := ioutil.WriteFile(c.pidFile(), []byte(strconv.Itoa(pid)), 0755)
+	return classifyCoordinationErr(c.dir, "write pid", err)
 }
 
 // Unlock unlocks the coordination pid file
@@ -107,13 +306,29 @@ func (c *coordinator) Unlock() error {
 		return nil
 	}
 	c.l.Info("unlocking coordination dir")
-	return c.lock.Unlock()
+	if err := ioutil.WriteFile(c.lockHolderFile(), nil, 0755); err != nil {
+		c.l.Warn("could not clear lock holder", "err", err)
+	}
+	err := c.lock.unlock()
+	c.lock.close()
+	c.lock = nil
+	return err
 }
 
 // GetOwnerPID returns the current 'owner' for this coordination directory.
 // It will return '0' as the PID if there is no owner.
 func (c *coordinator) GetOwnerPID() (int, error) {
 	c.l.Info("discovering current owner")
+	pid, err := c.readOwnerPID()
+	if err != nil || pid == 0 {
+		return pid, err
+	}
+	c.l.Info("found owner", "owner", pid)
+	return pid, nil
+}
+
+// readOwnerPID is GetOwnerPID without logging, for periodic checks.
+func (c *coordinator) readOwnerPID() (int, error) {
 	data, err := ioutil.ReadFile(c.pidFile())
 	if err != nil {
 		return 0, err
@@ -126,26 +341,48 @@ func (c *coordinator) GetOwnerPID() (int, error) {
 	if err != nil {
 		return 0, fmt.Errorf("unable to parse pid out of data %q: %v", string(data), err)
 	}
-	c.l.Info("found owner", "owner", pid)
 	return pid, nil
 }
 
-func (c *coordinator) ConnectOwner(ctx context.Context) (*net.UnixConn, error) {
+// ConnectOwner connects to the current owner's upgrade socket. If the owner
+// does not have a v2 upgrade socket, the legacy socket is used and 'legacy'
+// will be true.
+func (c *coordinator) ConnectOwner(ctx context.Context) (conn *net.UnixConn, legacy bool, err error) {
+	if err := c.checkLease(); err != nil {
+		return nil, false, err
+	}
+	if c.stable {
+		conn, err := c.connectStableOwner(ctx)
+		return conn, false, err
+	}
 	ppid, err := c.GetOwnerPID()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	c.l.Info("connecting to owner", "owner", ppid)
-	if ppid == 0 || pidIsDead(c.os, ppid) {
-		c.l.Info("owner does not exist or is dead", "owner", ppid)
-		return nil, errNoOwner
+	if ppid == 0 {
+		c.l.Info("owner does not exist")
+		return nil, false, &NoOwnerError{NoOwnerReasonFirstStart}
+	}
+	if pidIsDead(c.os, ppid) {
+		reason := NoOwnerReasonOwnerDead
+		if c.lockHeldByDead {
+			reason = NoOwnerReasonLockHolderDead
+		}
+		c.l.Info("owner is dead", "owner", ppid, "reason", reason)
+		return nil, false, &NoOwnerError{reason}
 	}
 
-	sockPath := upgradeSockPath(c.dir, ppid)
-	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+	dialer := &net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "unix", c.upgradeSockPath(ppid))
+	if err != nil && isNotExistDialErr(err) {
+		c.l.Info("owner has no v2 upgrade socket, trying legacy socket", "owner", ppid)
+		legacy = true
+		rawConn, err = dialer.DialContext(ctx, "unix", legacyUpgradeSockPath(c.dir, ppid))
+	}
 	if err != nil {
 		if isContextDialErr(err) {
-			return nil, err
+			return nil, false, err
 		}
 		// Otherwise assume this is ECONNREFUSED even though we can't reliably
 		// detect it.
@@ -155,11 +392,15 @@ func (c *coordinator) ConnectOwner(ctx context.Context) (*net.UnixConn, error) {
 		// have let us grab the pid lock unless it was also already listening on
 		// its socket.  Our best bet is thus to assume that process is not a
 		// tableroll process and just take over.
-		c.l.Warn("found living pid in coordination dir, but it wasn't listening for us", "pid", ppid, "dialErr", err)
-		return nil, errNoOwner
+		reason := NoOwnerReasonConnectionRefused
+		if isNotExistDialErr(err) {
+			reason = NoOwnerReasonSocketMissing
+		}
+		c.l.Warn("found living pid in coordination dir, but it wasn't listening for us", "pid", ppid, "reason", reason, "dialErr", err)
+		return nil, false, &NoOwnerError{reason}
 	}
 
-	return conn.(*net.UnixConn), nil
+	return rawConn.(*net.UnixConn), legacy, nil
 }
 
 func isContextDialErr(err error) bool {
@@ -169,6 +410,34 @@ func isContextDialErr(err error) bool {
 	return err == context.Canceled || err == context.DeadlineExceeded
 }
 
+func isNotExistDialErr(err error) bool {
+	return errnoOf(err) == syscall.ENOENT
+}
+
+// DefaultSocketName is the name of each process's upgrade socket in the
+// coordination directory, unless WithSocketName is used.
+const DefaultSocketName = "{pid}.v2.sock"
+
+// upgradeSockPath returns the path of the upgrade socket of the process with
+// the given pid.
+func (c *coordinator) upgradeSockPath(pid int) string {
+	if c.stable {
+		return filepath.Join(c.dir, StableSocketName)
+	}
+	if c.sockName == "" {
+		return upgradeSockPath(c.dir, pid)
+	}
+	name := strings.Replace(c.sockName, "{pid}", strconv.Itoa(pid), -1)
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.dir, name)
+}
+
 func upgradeSockPath(coordinationDir string, pid int) string {
+	return filepath.Join(coordinationDir, fmt.Sprintf("%d.v2.sock", pid))
+}
+
+func legacyUpgradeSockPath(coordinationDir string, pid int) string {
 	return filepath.Join(coordinationDir, fmt.Sprintf("%d.sock", pid))
 }
@@ -0,0 +1,71 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNoRuntimeDir is returned by DefaultCoordinationDir when it's run by a
+// user other than root and XDG_RUNTIME_DIR isn't set.
+var ErrNoRuntimeDir = errors.New("XDG_RUNTIME_DIR is not set")
+
+// DefaultCoordinationDir returns the conventional coordination directory for
+// the named program, creating it if needed: /run/<programName>/tableroll when
+// run as root, and $XDG_RUNTIME_DIR/<programName>/tableroll otherwise. The
+// program's directory is created with mode 0755, and the coordination
+// directory with mode 0700, since it shouldn't be accessible to other users;
+// see WithSocketPermissions. Existing directories are left as they are.
+func DefaultCoordinationDir(programName string) (string, error) {
+	dir, err := resolveCoordinationDir(programName, os.Geteuid(), os.Getenv)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return "", classifyCoordinationErr(dir, "create coordination dir", err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", classifyCoordinationErr(dir, "create coordination dir", err)
+	}
+	return dir, nil
+}
+
+// resolveCoordinationDir returns the coordination directory
+// DefaultCoordinationDir uses for a user, without touching the filesystem.
+func resolveCoordinationDir(programName string, euid int, getenv func(string) string) (string, error) {
+	if programName == "" || programName == "." || programName == ".." || strings.ContainsRune(programName, filepath.Separator) {
+		return "", fmt.Errorf("invalid program name %q", programName)
+	}
+	if euid == 0 {
+		return filepath.Join("/run", programName, "tableroll"), nil
+	}
+	runtimeDir := getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return "", ErrNoRuntimeDir
+	}
+	if !filepath.IsAbs(runtimeDir) {
+		return "", fmt.Errorf("XDG_RUNTIME_DIR %q is not an absolute path", runtimeDir)
+	}
+	return filepath.Join(runtimeDir, programName, "tableroll"), nil
+}
+
+// WithCreateCoordinationDir makes New create the coordination directory,
+// and any missing parents, with mode 0700 if it doesn't exist, rather than
+// failing. If it can't be created because of a problem with the filesystem,
+// New returns a *CoordinationDirError, or degrades as described by
+// WithBestEffortCoordination.
+func WithCreateCoordinationDir() Option {
+	return func(u *Upgrader) {
+		u.createCoordDir = true
+	}
+}
+
+// createDir creates the coordination directory if it doesn't exist.
+func (c *coordinator) createDir() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return classifyCoordinationErr(c.dir, "create coordination dir", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestResolveCoordinationDir(t *testing.T) {
+	env := func(runtimeDir string) func(string) string {
+		return func(key string) string {
+			if key == "XDG_RUNTIME_DIR" {
+				return runtimeDir
+			}
+			return ""
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		prog    string
+		euid    int
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "root", prog: "app", euid: 0, env: "/run/user/1000", want: "/run/app/tableroll"},
+		{name: "user", prog: "app", euid: 1000, env: "/run/user/1000", want: "/run/user/1000/app/tableroll"},
+		{name: "no runtime dir", prog: "app", euid: 1000, wantErr: true},
+		{name: "relative runtime dir", prog: "app", euid: 1000, env: "run", wantErr: true},
+		{name: "empty name", prog: "", euid: 0, wantErr: true},
+		{name: "parent name", prog: "..", euid: 0, wantErr: true},
+		{name: "nested name", prog: "a/b", euid: 0, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := resolveCoordinationDir(tc.prog, tc.euid, env(tc.env))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", dir)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if dir != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, dir)
+			}
+		})
+	}
+}
+
+func TestDefaultCoordinationDir(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("would create a directory under /run")
+	}
+	runtimeDir, cleanup := tmpDir()
+	defer cleanup()
+	os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+
+	dir, err := DefaultCoordinationDir("app")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := filepath.Join(runtimeDir, "app", "tableroll"); dir != want {
+		t.Fatalf("expected %q, got %q", want, dir)
+	}
+	st, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := st.Mode().Perm(); mode != 0700 {
+		t.Fatalf("expected mode 0700, got %v", mode)
+	}
+	if _, err := DefaultCoordinationDir("app"); err != nil {
+		t.Fatalf("expected an existing dir to be reused, got %v", err)
+	}
+}
+
+func TestCreateCoordinationDir(t *testing.T) {
+	ctx := context.Background()
+	parent, cleanup := tmpDir()
+	defer cleanup()
+	coordDir := filepath.Join(parent, "app", "tableroll")
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l)); err == nil {
+		t.Fatalf("expected a missing coordination dir to fail without WithCreateCoordinationDir")
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithCreateCoordinationDir())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	st, err := os.Stat(coordDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := st.Mode().Perm(); mode != 0700 {
+		t.Fatalf("expected mode 0700, got %v", mode)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithCreateCoordinationDir())
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if upg2.NoOwnerReason() != NoOwnerReasonNone {
+		t.Fatalf("expected to upgrade from the first upgrader, got %q", upg2.NoOwnerReason())
+	}
+}
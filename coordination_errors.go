@@ -0,0 +1,70 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// CoordinationFailure classifies why the coordination directory couldn't be
+// used.
+type CoordinationFailure string
+
+const (
+	// CoordinationReadOnly indicates the coordination directory is on a
+	// read-only filesystem.
+	CoordinationReadOnly CoordinationFailure = "read-only"
+	// CoordinationNoSpace indicates the coordination directory's filesystem is
+	// full, or a quota has been exceeded.
+	CoordinationNoSpace CoordinationFailure = "no-space"
+	// CoordinationPermissionDenied indicates this process is not allowed to
+	// write to the coordination directory.
+	CoordinationPermissionDenied CoordinationFailure = "permission-denied"
+)
+
+// CoordinationDirError is returned when the coordination directory cannot be
+// used because of a problem with the filesystem it is on.
+type CoordinationDirError struct {
+	Dir     string
+	Op      string
+	Failure CoordinationFailure
+	Err     error
+}
+
+func (e *CoordinationDirError) Error() string {
+	return fmt.Sprintf("coordination dir %q is unusable (%s) during %s: %v", e.Dir, e.Failure, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error, for use with errors.Is and errors.As.
+func (e *CoordinationDirError) Unwrap() error {
+	return e.Err
+}
+
+// classifyCoordinationErr wraps filesystem errors which indicate the
+// coordination directory is unusable in a CoordinationDirError. Any other
+// error is returned unchanged.
+func classifyCoordinationErr(dir, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var failure CoordinationFailure
+	switch errnoOf(err) {
+	case syscall.EROFS:
+		failure = CoordinationReadOnly
+	case syscall.ENOSPC, syscall.EDQUOT:
+		failure = CoordinationNoSpace
+	case syscall.EACCES, syscall.EPERM:
+		failure = CoordinationPermissionDenied
+	default:
+		return err
+	}
+	return &CoordinationDirError{Dir: dir, Op: op, Failure: failure, Err: err}
+}
+
+// errnoOf unwraps the errno from the errors the net and os packages return.
+// It returns 0 if there is no errno.
+func errnoOf(err error) syscall.Errno {
+	var errno syscall.Errno
+	errors.As(err, &errno)
+	return errno
+}
@@ -0,0 +1,64 @@
+package tableroll
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestClassifyCoordinationErr(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected CoordinationFailure
+	}{
+		{&os.PathError{Op: "open", Path: "pid", Err: syscall.EROFS}, CoordinationReadOnly},
+		{&net.OpError{Op: "listen", Err: os.NewSyscallError("bind", syscall.ENOSPC)}, CoordinationNoSpace},
+		{&os.PathError{Op: "open", Path: "pid", Err: syscall.EACCES}, CoordinationPermissionDenied},
+		{errors.New("unrelated"), ""},
+		{&os.PathError{Op: "open", Path: "pid", Err: syscall.ENOENT}, ""},
+	}
+	for _, tc := range cases {
+		err := classifyCoordinationErr("/dir", "op", tc.err)
+		coordErr, ok := err.(*CoordinationDirError)
+		if tc.expected == "" {
+			if ok || err != tc.err {
+				t.Errorf("expected %v to be returned unchanged, got %v", tc.err, err)
+			}
+			continue
+		}
+		if !ok || coordErr.Failure != tc.expected {
+			t.Errorf("expected %v to be classified as %v, got %v", tc.err, tc.expected, err)
+		}
+	}
+}
+
+func TestBestEffortCoordination(t *testing.T) {
+	l := newTestLogger()
+	coordErr := &CoordinationDirError{Dir: "/dir", Op: "listen", Failure: CoordinationReadOnly, Err: syscall.EROFS}
+
+	strict := &Upgrader{l: l, state: upgraderStateCheckingOwner, upgradeCompleteC: make(chan struct{})}
+	if _, err := strict.degradeOr(coordErr); err != coordErr {
+		t.Fatalf("expected coordination error without best effort, got %v", err)
+	}
+
+	upg := &Upgrader{l: l, state: upgraderStateCheckingOwner, upgradeCompleteC: make(chan struct{}), predecessorDrainedC: make(chan struct{}), predecessorExitedC: make(chan struct{}), bestEffort: true, clock: clock.RealClock{}}
+	upg, err := upg.degradeOr(coordErr)
+	if err != nil {
+		t.Fatalf("expected best effort coordination to succeed: %v", err)
+	}
+	if upg.CoordinationError() != coordErr {
+		t.Fatalf("expected coordination error to be exposed, got %v", upg.CoordinationError())
+	}
+	if _, err := upg.Fds.OpenFileWith("f", "f", memoryOpenFile); err != nil {
+		t.Fatalf("expected fds to be usable: %v", err)
+	}
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("expected to become ready: %v", err)
+	}
+	upg.Stop()
+	<-upg.UpgradeComplete()
+}
@@ -0,0 +1,116 @@
+package tableroll
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Some deployments can't share a coordination directory between every
+// process, for example when a containerized new version replaces a version
+// running directly on the host, and the two see different filesystems. They
+// may still share a network namespace, and so an abstract unix socket.
+//
+// With WithCoordinationFallback, the owner also listens on an abstract socket
+// named after the coordination directory's path, and a new process which
+// finds no owner through the filesystem tries that socket before concluding
+// there is none. Only one process can listen on it at a time, so the owner
+// releases it as soon as it steps down, and the next owner takes it over.
+// Filesystem coordination is always tried first, since the abstract socket
+// isn't covered by the coordination lock.
+
+// WithCoordinationFallback causes the Upgrader to also coordinate over an
+// abstract unix socket, so that processes which use the same coordination
+// directory path but can't see each other's coordination directory, e.g.
+// because one of them runs in a container, can still find each other.
+// Both processes must be in the same network namespace. This is only
+// supported on linux.
+func WithCoordinationFallback() Option {
+	return func(u *Upgrader) {
+		u.coordinationFallback = true
+	}
+}
+
+// fallbackAddr returns the name of the abstract socket used to find the
+// owner if the coordination directory isn't shared.
+func (c *coordinator) fallbackAddr() string {
+	dir, err := filepath.Abs(c.dir)
+	if err != nil {
+		dir = c.dir
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(dir)))
+	// a leading '@' is an abstract socket for the net package
+	return "@tableroll-" + hex.EncodeToString(sum[:16])
+}
+
+func (c *coordinator) ListenFallback() (*net.UnixListener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("coordination fallback is only supported on linux")
+	}
+	return net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: c.fallbackAddr()})
+}
+
+// ConnectFallbackOwner connects to the owner's abstract socket. It returns a
+// *NoOwnerError if no owner is listening on it.
+func (c *coordinator) ConnectFallbackOwner(ctx context.Context) (*net.UnixConn, error) {
+	if runtime.GOOS != "linux" {
+		return nil, &NoOwnerError{NoOwnerReasonFirstStart}
+	}
+	dialer := &net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "unix", c.fallbackAddr())
+	if err != nil {
+		if isContextDialErr(err) {
+			return nil, err
+		}
+		c.l.Debug("no owner listening on the fallback socket", "err", err)
+		return nil, &NoOwnerError{NoOwnerReasonFirstStart}
+	}
+	return rawConn.(*net.UnixConn), nil
+}
+
+// listenFallback starts listening for upgrades on the fallback socket once
+// we're the owner. The previous owner may not have released it yet, in which
+// case we keep trying until it does, or until we stop being the owner.
+func (u *Upgrader) listenFallback() {
+	for {
+		sock, err := u.coord.ListenFallback()
+		if err == nil {
+			u.stateLock.Lock()
+			if u.state != upgraderStateOwner {
+				u.stateLock.Unlock()
+				sock.Close()
+				return
+			}
+			u.fallbackSock = sock
+			u.stateLock.Unlock()
+			u.l.Info("listening for upgrades on the fallback socket", "addr", u.coord.fallbackAddr())
+			u.serveUpgrades(sock, false)
+			return
+		}
+		if errnoOf(err) != syscall.EADDRINUSE {
+			u.l.Warn("cannot listen on the fallback coordination socket", "err", err)
+			return
+		}
+		select {
+		case <-u.upgradeCompleteC:
+			return
+		case <-u.clock.After(u.lockRetryInterval):
+		}
+	}
+}
+
+// closeFallbackSock stops listening on the fallback socket, so that the next
+// owner may take it over.
+func (u *Upgrader) closeFallbackSock() {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.fallbackSock != nil {
+		u.fallbackSock.Close()
+		u.fallbackSock = nil
+	}
+}
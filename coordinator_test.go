@@ -5,14 +5,15 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
-	"github.com/inconshreveable/log15"
-	"k8s.io/utils/clock"
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
 )
 
 // TestConnectOwner is a happy-path test of using the coordinator
 func TestConnectOwner(t *testing.T) {
-	l := log15.New()
+	l := newTestLogger()
 	ctx := context.Background()
 	tmpdir, err := ioutil.TempDir("", "tableroll_coord_test")
 	if err != nil {
@@ -31,7 +32,7 @@ func TestConnectOwner(t *testing.T) {
 	coord1.BecomeOwner()
 	coord1.Unlock()
 
-	connw, err := coord2.ConnectOwner(ctx)
+	connw, _, err := coord2.ConnectOwner(ctx)
 	if err != nil {
 		t.Fatalf("unable to connect to owner")
 	}
@@ -57,7 +58,7 @@ func TestConnectOwner(t *testing.T) {
 // TestLockCoordinationDirCtxCancel tests that a call to `lockCoordinationDir` can be
 // canceled by canceling the passed in context.
 func TestLockCoordinationDirCtxCancel(t *testing.T) {
-	l := log15.New()
+	l := newTestLogger()
 	ctx := context.Background()
 	tmpdir, err := ioutil.TempDir("", "tableroll_coord_test")
 	if err != nil {
@@ -90,3 +91,101 @@ func TestLockCoordinationDirCtxCancel(t *testing.T) {
 		t.Errorf("expected context cancel, got %v", err)
 	}
 }
+
+// TestConnectOwnerNoOwnerReason verifies that each way of failing to find an
+// owner is reported distinctly.
+func TestConnectOwnerNoOwnerReason(t *testing.T) {
+	l := newTestLogger()
+	ctx := context.Background()
+	tmpdir, err := ioutil.TempDir("", "tableroll_coord_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	expectReason := func(coord *coordinator, expected NoOwnerReason) {
+		t.Helper()
+		_, _, err := coord.ConnectOwner(ctx)
+		noOwner, ok := err.(*NoOwnerError)
+		if !ok {
+			t.Fatalf("expected no owner error, got %v", err)
+		}
+		if noOwner.Reason != expected {
+			t.Fatalf("expected reason %q, got %q", expected, noOwner.Reason)
+		}
+	}
+
+	coord1 := newCoordinator(clock.RealClock{}, mockOS{pid: 1}, l, tmpdir)
+	coord2 := newCoordinator(clock.RealClock{}, mockOS{pid: 2}, l, tmpdir)
+	if err := coord2.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectReason(coord2, NoOwnerReasonFirstStart)
+	coord2.Unlock()
+
+	coord1.Lock(ctx)
+	coord1.BecomeOwner()
+	coord1.Unlock()
+	// pid 1 is alive, but never listened
+	expectReason(coord2, NoOwnerReasonSocketMissing)
+
+	deadCoord := newCoordinator(clock.RealClock{}, mockOS{pid: 2, deadPids: map[int]bool{1: true}}, l, tmpdir)
+	expectReason(deadCoord, NoOwnerReasonOwnerDead)
+
+	// a socket that exists but isn't being listened on
+	ln, err := coord1.Listen(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+	expectReason(coord2, NoOwnerReasonConnectionRefused)
+}
+
+// TestLockTimeoutHolder verifies that timing out on the coordination lock
+// reports who is holding it.
+func TestLockTimeoutHolder(t *testing.T) {
+	l := newTestLogger()
+	ctx := context.Background()
+	tmpdir, err := ioutil.TempDir("", "tableroll_coord_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	expectTimeout := func(osi OS, expected LockHolder) {
+		t.Helper()
+		coord := newCoordinator(fakeclock.NewFakeClock(time.Now()), osi, l, tmpdir)
+		coord.lockTimeout = time.Second
+		err := coord.Lock(ctx)
+		timeoutErr, ok := err.(*LockTimeoutError)
+		if !ok {
+			t.Fatalf("expected lock timeout error, got %v", err)
+		}
+		if timeoutErr.Holder != expected || timeoutErr.HolderPid != 1 {
+			t.Fatalf("expected lock to be held by %s pid 1, got %s pid %d", expected, timeoutErr.Holder, timeoutErr.HolderPid)
+		}
+		if timeoutErr.Waited < time.Second {
+			t.Fatalf("expected to wait for at least the timeout, waited %v", timeoutErr.Waited)
+		}
+	}
+
+	coord1 := newCoordinator(clock.RealClock{}, mockOS{pid: 1}, l, tmpdir)
+	if err := coord1.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectTimeout(mockOS{pid: 2}, LockHeldByNewcomer)
+	expectTimeout(mockOS{pid: 2, deadPids: map[int]bool{1: true}}, LockHeldByDeadProcess)
+	if err := coord1.BecomeOwner(); err != nil {
+		t.Fatal(err)
+	}
+	expectTimeout(mockOS{pid: 2}, LockHeldByOwner)
+	coord1.Unlock()
+
+	coord2 := newCoordinator(clock.RealClock{}, mockOS{pid: 2}, l, tmpdir)
+	coord2.lockTimeout = time.Second
+	if err := coord2.Lock(ctx); err != nil {
+		t.Fatalf("expected to get the lock once released: %v", err)
+	}
+	coord2.Unlock()
+}
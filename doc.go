@@ -18,4 +18,30 @@
 // of this library. Both copies of the process must have access to the same
 // coordination directory, but apart from that, there are no stringent
 // requirements.
+//
+// Concurrency
+//
+// An Upgrader, its Fds and its Store are safe for concurrent use by multiple
+// goroutines. Any of their exported methods may be called at any time,
+// including while an upgrade is being served in the background, and
+// concurrently with Stop, which may itself be called more than once. Getters
+// keep working after Stop, while mutations fail with ErrUpgraderStopped, or
+// ErrUpgradeCompleted once the fds have been passed on. While the fds are
+// being passed on, mutations fail with ErrUpgradeInProgress, or wait with the
+// Context variants of the Fds methods; getters don't wait for the handoff.
+//
+// Slices and maps returned by these methods are copies, which the caller may
+// keep and modify. The channels returned by UpgradeComplete,
+// PredecessorDrained, PredecessorExited, SuccessorExited, ChainShutdown and
+// Errs are the same for the life of the Upgrader.
+//
+// Functions passed in options, such as the event handler and the upgrade
+// approval function, and to Fds.OnTransfer, are called from background
+// goroutines without any of the Upgrader's locks held, so they may call the
+// Upgrader, though the work they're part of waits for them to return. The
+// exception is the function passed to WithRedaction, which is called while
+// the Fds are locked and must not call them.
+//
+// Everything above is checked by tests run with the race detector, and
+// tableroll doesn't reach into the runtime with go:linkname.
 package tableroll
@@ -0,0 +1,407 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// DefaultDrainGracePeriod is how long DrainThen waits for connections to
+// finish by themselves before closing idle ones, unless
+// WithDrainGracePeriod is used.
+const DefaultDrainGracePeriod = 5 * time.Second
+
+// DefaultDrainIdleTimeout is how long a connection must have gone without
+// reading or writing anything to be considered idle by DrainThen, unless
+// WithDrainIdleTimeout is used.
+const DefaultDrainIdleTimeout = time.Second
+
+// drainPollInterval is how often DrainThen checks on connections.
+const drainPollInterval = 50 * time.Millisecond
+
+// WithDrainGracePeriod sets how long DrainThen waits for connections to
+// finish by themselves before closing idle ones.
+func WithDrainGracePeriod(d time.Duration) Option {
+	return func(u *Upgrader) {
+		u.drainGracePeriod = d
+	}
+}
+
+// WithDrainIdleTimeout sets how long a connection must have gone without
+// reading or writing anything to be considered idle by DrainThen.
+func WithDrainIdleTimeout(d time.Duration) Option {
+	return func(u *Upgrader) {
+		u.drainIdleTimeout = d
+	}
+}
+
+// connTracker counts the connections accepted from tracked listeners, so
+// they can be drained.
+type connTracker struct {
+	// streams counts in-flight requests or streams; see TrackStream. It's
+	// first so it's 64-bit aligned for atomic access.
+	streams   int64
+	clock     clock.Clock
+	mu        sync.Mutex
+	listeners map[*trackedListener]struct{}
+	conns     map[*trackedConn]struct{}
+	servers   []drainServer
+	// strategies holds the listeners with drain strategies, in the order
+	// they were tracked.
+	strategies []*trackedListener
+	// acceptsResumed is set while accepts are paused, and closed when they
+	// resume; see WithAcceptPauseDuringHandoff.
+	acceptsResumed chan struct{}
+	// activity holds when the listeners tracked with each address were last
+	// used, including ones which have since been closed; see FdActivity.
+	activity map[string]*listenerActivity
+}
+
+// drainServer is told to go away once DrainThen's grace period is over.
+type drainServer struct {
+	// goAway drains the server, returning once it's done or ctx is.
+	goAway func(ctx context.Context)
+	// stop is called, if set, once DrainThen's context is done.
+	stop func()
+	// streamAware is set for servers which drain connections by their
+	// streams, so connections which are idle at the TCP level must not be
+	// closed while they're draining.
+	streamAware bool
+}
+
+func newConnTracker(clock clock.Clock) *connTracker {
+	return &connTracker{
+		clock:     clock,
+		listeners: make(map[*trackedListener]struct{}),
+		conns:     make(map[*trackedConn]struct{}),
+		activity:  make(map[string]*listenerActivity),
+	}
+}
+
+// TrackListener wraps ln so that the connections accepted from it are
+// counted, and drained by DrainThen. DrainThen closes ln when it starts. The
+// returned listener is a plain net.Listener, so use ln itself for anything
+// which needs its concrete type.
+func (u *Upgrader) TrackListener(ln net.Listener) net.Listener {
+	t := u.conns()
+	tl := &trackedListener{Listener: ln, tracker: t, closedC: make(chan struct{})}
+	t.mu.Lock()
+	t.listeners[tl] = struct{}{}
+	tl.activity = t.activityLocked(ln.Addr().String())
+	t.mu.Unlock()
+	return tl
+}
+
+// OnGoAway registers a function DrainThen calls once the grace period is
+// over, before closing idle connections, e.g. to tell clients to go away at
+// the protocol level.
+func (u *Upgrader) OnGoAway(goAway func()) {
+	u.conns().addServer(drainServer{goAway: func(context.Context) { goAway() }})
+}
+
+func (t *connTracker) addServer(s drainServer) {
+	t.mu.Lock()
+	t.servers = append(t.servers, s)
+	t.mu.Unlock()
+}
+
+// ActiveConns returns how many connections accepted from tracked listeners
+// are open.
+func (u *Upgrader) ActiveConns() int {
+	t := u.conns()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (u *Upgrader) conns() *connTracker {
+	u.connTrackerOnce.Do(func() {
+		u.connTracker = newConnTracker(u.clock)
+	})
+	return u.connTracker
+}
+
+// DrainThen drains the connections accepted from tracked listeners, and any
+// servers registered with DrainHTTPServer or DrainGRPCServer, and then calls
+// then. It's intended for use by an old owner once UpgradeComplete is closed.
+// It escalates in phases:
+//
+//  1. Tracked listeners are closed, and open connections are given the
+//     grace period to finish by themselves.
+//  2. Functions registered with OnGoAway are called, registered servers are
+//     shut down gracefully, and idle connections are closed as soon as they
+//     become idle.
+//  3. Once ctx is done, any remaining connections and servers are closed.
+//
+// Drain strategies registered with TrackListenerWithDrain are called at the
+// start of each phase. An event is emitted at each phase with the number of
+// connections and streams involved.
+func (u *Upgrader) DrainThen(ctx context.Context, then func()) {
+	t := u.conns()
+	t.mu.Lock()
+	listeners := make([]*trackedListener, 0, len(t.listeners))
+	for tl := range t.listeners {
+		listeners = append(listeners, tl)
+	}
+	servers := append([]drainServer{}, t.servers...)
+	strategies := append([]*trackedListener{}, t.strategies...)
+	t.mu.Unlock()
+	for _, tl := range listeners {
+		tl.Close()
+	}
+
+	grace := u.drainGracePeriod
+	if grace == 0 {
+		grace = DefaultDrainGracePeriod
+	}
+	idleTimeout := u.drainIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = DefaultDrainIdleTimeout
+	}
+
+	open := u.ActiveConns()
+	u.l.Info("draining connections", "conns", open, "streams", u.ActiveStreams(), "grace", grace)
+	u.emit(Event{Type: EventDrainStarted, Conns: open, Streams: u.ActiveStreams()})
+	u.runDrainStrategies(ctx, strategies, DrainPhaseStarted)
+
+	graceOver := u.clock.After(grace)
+	escalated, forced := false, false
+	// serversDone is closed once every server has gone away
+	serversDone := make(chan struct{})
+	var streamAwareDraining int32
+	if len(servers) == 0 {
+		close(serversDone)
+	}
+	for open > 0 || !isClosed(serversDone) {
+		select {
+		case <-ctx.Done():
+			if forced {
+				// wait for the servers to notice they've been stopped
+				<-serversDone
+				continue
+			}
+			forced = true
+			if !escalated {
+				// the servers must still be told to go away, so they
+				// don't block on each other
+				escalated = true
+				u.goAwayServers(ctx, servers, serversDone, &streamAwareDraining)
+			}
+			u.runDrainStrategies(ctx, strategies, DrainPhaseForced)
+			for _, s := range servers {
+				if s.stop != nil {
+					s.stop()
+				}
+			}
+			streams := u.ActiveStreams()
+			closed := t.closeConns(func(*trackedConn) bool { return true })
+			u.l.Warn("drain deadline reached, closed remaining connections", "conns", closed, "streams", streams)
+			u.emit(Event{Type: EventDrainForceClosed, Conns: closed, Streams: streams, Err: ctx.Err()})
+		case <-graceOver:
+			graceOver = nil
+			escalated = true
+			u.runDrainStrategies(ctx, strategies, DrainPhaseGoAway)
+			u.goAwayServers(ctx, servers, serversDone, &streamAwareDraining)
+		case <-serversDone:
+		case <-u.clock.After(drainPollInterval):
+		}
+		if escalated && !forced {
+			now := u.clock.Now()
+			skipUnknown := atomic.LoadInt32(&streamAwareDraining) > 0
+			closed := t.closeConns(func(c *trackedConn) bool { return c.closeWhenIdle(now, idleTimeout, skipUnknown) })
+			if closed > 0 {
+				u.l.Info("closed idle connections", "conns", closed)
+				u.emit(Event{Type: EventDrainIdleClosed, Conns: closed})
+			}
+		}
+		open = u.ActiveConns()
+		if forced {
+			// anything still open was accepted from an untracked listener,
+			// or is hijacked and no longer ours to close
+			open = 0
+		}
+	}
+	u.l.Info("connections drained")
+	u.emit(Event{Type: EventDrainFinished})
+	if then != nil {
+		then()
+	}
+}
+
+// goAwayServers starts telling each server to go away, and closes done once
+// they all have.
+func (u *Upgrader) goAwayServers(ctx context.Context, servers []drainServer, done chan struct{}, streamAwareDraining *int32) {
+	if len(servers) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		s := s
+		if s.streamAware {
+			atomic.AddInt32(streamAwareDraining, 1)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.goAway(ctx)
+			if s.streamAware {
+				atomic.AddInt32(streamAwareDraining, -1)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeConns closes the connections matching close, and returns how many it
+// closed.
+func (t *connTracker) closeConns(close func(*trackedConn) bool) int {
+	t.mu.Lock()
+	var toClose []*trackedConn
+	for c := range t.conns {
+		if close(c) {
+			toClose = append(toClose, c)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range toClose {
+		c.Close()
+	}
+	return len(toClose)
+}
+
+type trackedListener struct {
+	net.Listener
+	tracker   *connTracker
+	closeOnce sync.Once
+	closeErr  error
+	closedC   chan struct{}
+	// strategy drains the connections accepted from the listener, if set;
+	// see TrackListenerWithDrain.
+	strategy DrainStrategy
+	// interrupted is set when a pause has set a deadline to interrupt
+	// Accept. It's guarded by the tracker's mutex.
+	interrupted bool
+	// activity is shared by the listeners tracked with the same address.
+	activity *listenerActivity
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	for {
+		l.awaitAccepts()
+		var err error
+		conn, err = l.Listener.Accept()
+		if err == nil {
+			break
+		}
+		if !l.clearInterrupt(err) {
+			return nil, err
+		}
+	}
+	tc := &trackedConn{Conn: conn, tracker: l.tracker, listener: l}
+	atomic.StoreInt64(&l.activity.lastAccept, tc.touch())
+	l.tracker.mu.Lock()
+	l.tracker.conns[tc] = struct{}{}
+	l.tracker.mu.Unlock()
+	return tc, nil
+}
+
+func (l *trackedListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.Listener.Close()
+		close(l.closedC)
+		l.tracker.mu.Lock()
+		delete(l.tracker.listeners, l)
+		l.tracker.mu.Unlock()
+	})
+	return l.closeErr
+}
+
+// trackedConn is a connection accepted from a tracked listener. It records
+// when it last read or wrote anything, to tell whether it's idle.
+type trackedConn struct {
+	// lastActive is in unix nanoseconds. It's first so it's 64-bit aligned
+	// for atomic access.
+	lastActive int64
+	// serverState is the state reported by the server using the connection,
+	// if any; see DrainHTTPServer.
+	serverState int32
+	net.Conn
+	tracker *connTracker
+	// listener is the listener the connection was accepted from.
+	listener  *trackedListener
+	closeOnce sync.Once
+	closeErr  error
+}
+
+const (
+	connStateUnknown int32 = iota
+	connStateActive
+	connStateIdle
+)
+
+// touch records that the connection is active, and returns the time it did
+// so in unix nanoseconds.
+func (c *trackedConn) touch() int64 {
+	now := c.tracker.clock.Now().UnixNano()
+	atomic.StoreInt64(&c.lastActive, now)
+	return now
+}
+
+// closeWhenIdle returns true if the connection should be closed for being
+// idle. If a server reports its state, it decides; otherwise connections are
+// idle once they've done nothing for idleTimeout, unless skipUnknown is set.
+func (c *trackedConn) closeWhenIdle(now time.Time, idleTimeout time.Duration, skipUnknown bool) bool {
+	switch atomic.LoadInt32(&c.serverState) {
+	case connStateIdle:
+		return true
+	case connStateActive:
+		return false
+	}
+	if skipUnknown {
+		return false
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&c.lastActive))) >= idleTimeout
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.listener.activity.lastRead, c.touch())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.listener.activity.lastWrite, c.touch())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.tracker.mu.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.mu.Unlock()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,124 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Connections which multiplex requests, such as HTTP/2 and gRPC connections,
+// can't be drained by waiting for them to go idle at the TCP level: a
+// long-lived stream may be quiet for minutes. Servers registered here are
+// instead shut down gracefully once DrainThen's grace period is over, which
+// tells clients to go away (a GOAWAY frame, for HTTP/2) and waits for the
+// in-flight streams to finish.
+
+// GracefulServer is a server which can stop gracefully, such as
+// *grpc.Server.
+type GracefulServer interface {
+	// GracefulStop stops accepting new streams, tells clients to go away,
+	// and blocks until the in-flight streams have finished.
+	GracefulStop()
+	// Stop closes all connections, ending any in-flight streams.
+	Stop()
+}
+
+// DrainHTTPServer registers srv to be drained by DrainThen. Once the grace
+// period is over, srv is shut down with Shutdown, which closes idle
+// connections and sends GOAWAY frames over HTTP/2; DrainThen then waits for
+// its in-flight requests, and closes it once its context is done.
+//
+// DrainHTTPServer hooks srv's Handler and ConnState, so it must be called
+// before srv starts serving. For connections accepted from a tracked
+// listener, srv decides when they're idle, so an HTTP/2 connection carrying a
+// quiet stream isn't closed.
+func (u *Upgrader) DrainHTTPServer(srv *http.Server) {
+	t := u.conns()
+	handler := srv.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer t.trackStream()()
+		handler.ServeHTTP(w, r)
+	})
+	connState := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		if tc := findTrackedConn(conn); tc != nil {
+			switch state {
+			case http.StateActive, http.StateHijacked:
+				atomic.StoreInt32(&tc.serverState, connStateActive)
+			case http.StateIdle:
+				atomic.StoreInt32(&tc.serverState, connStateIdle)
+			}
+		}
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+	t.addServer(drainServer{
+		goAway: func(ctx context.Context) {
+			if err := srv.Shutdown(ctx); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+				u.l.Warn("error shutting down http server", "err", err)
+			}
+		},
+		stop: func() { srv.Close() },
+	})
+}
+
+// DrainGRPCServer registers srv, typically a *grpc.Server, to be drained by
+// DrainThen. Once the grace period is over, srv is stopped with GracefulStop,
+// and while it's stopping, connections accepted from tracked listeners are
+// not closed for being idle, since srv closes its own connections once their
+// streams have finished. srv is stopped with Stop once DrainThen's context is
+// done.
+//
+// To count srv's streams in ActiveStreams and drain events, call TrackStream
+// from a stream interceptor.
+func (u *Upgrader) DrainGRPCServer(srv GracefulServer) {
+	u.conns().addServer(drainServer{
+		goAway:      func(context.Context) { srv.GracefulStop() },
+		stop:        srv.Stop,
+		streamAware: true,
+	})
+}
+
+// TrackStream counts an in-flight request or stream in ActiveStreams until
+// the returned function is called. Requests to servers registered with
+// DrainHTTPServer are counted automatically.
+func (u *Upgrader) TrackStream() (done func()) {
+	return u.conns().trackStream()
+}
+
+// ActiveStreams returns how many requests or streams are in flight; see
+// TrackStream.
+func (u *Upgrader) ActiveStreams() int {
+	return int(atomic.LoadInt64(&u.conns().streams))
+}
+
+func (t *connTracker) trackStream() func() {
+	atomic.AddInt64(&t.streams, 1)
+	var once int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&once, 0, 1) {
+			atomic.AddInt64(&t.streams, -1)
+		}
+	}
+}
+
+// findTrackedConn returns the tracked connection underlying conn, if any,
+// looking through wrappers such as *tls.Conn.
+func findTrackedConn(conn net.Conn) *trackedConn {
+	for conn != nil {
+		switch c := conn.(type) {
+		case *trackedConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+)
+
+// Waiting for connections to go idle doesn't suit every protocol: a websocket
+// may stay open indefinitely, and a long-poll only finishes once there's
+// something to say. A DrainStrategy lets the application end them in a way
+// its protocol understands, while DrainThen decides when: strategies are
+// called at each phase of the drain, in the order their listeners were
+// tracked, with the connections accepted from their listener which are still
+// open.
+
+// DrainPhase identifies the phase of DrainThen a DrainStrategy is called for.
+type DrainPhase string
+
+const (
+	// DrainPhaseStarted is when DrainThen starts, just after the listeners
+	// are closed, at the start of the grace period. Strategies may ask
+	// clients to reconnect early, e.g. by completing long-polls.
+	DrainPhaseStarted DrainPhase = "started"
+	// DrainPhaseGoAway is when the grace period is over, before servers are
+	// told to go away and idle connections are closed. Strategies should ask
+	// clients to go away, e.g. by sending websocket close frames.
+	DrainPhaseGoAway DrainPhase = "go-away"
+	// DrainPhaseForced is when DrainThen's context is done, just before the
+	// remaining connections are closed.
+	DrainPhaseForced DrainPhase = "forced"
+)
+
+// DrainStrategy ends connections accepted from a tracked listener in a
+// protocol-specific way; see TrackListenerWithDrain.
+type DrainStrategy interface {
+	// Drain is called at each phase of DrainThen with the connections
+	// accepted from the listener which are still open, as returned by its
+	// Accept. It's called from DrainThen's goroutine, so it should return
+	// quickly, leaving the connections to close once their clients have
+	// gone away. It isn't called for a phase if there are no connections.
+	Drain(ctx context.Context, phase DrainPhase, conns []net.Conn)
+}
+
+// DrainStrategyFunc adapts a function to a DrainStrategy.
+type DrainStrategyFunc func(ctx context.Context, phase DrainPhase, conns []net.Conn)
+
+// Drain calls f.
+func (f DrainStrategyFunc) Drain(ctx context.Context, phase DrainPhase, conns []net.Conn) {
+	f(ctx, phase, conns)
+}
+
+// TrackListenerWithDrain is like TrackListener, but DrainThen also calls
+// strategy at each phase with the connections accepted from ln.
+func (u *Upgrader) TrackListenerWithDrain(ln net.Listener, strategy DrainStrategy) net.Listener {
+	tl := u.TrackListener(ln).(*trackedListener)
+	t := u.conns()
+	t.mu.Lock()
+	tl.strategy = strategy
+	t.strategies = append(t.strategies, tl)
+	t.mu.Unlock()
+	return tl
+}
+
+// runDrainStrategies calls each listener's strategy for the phase, in the
+// order they were tracked.
+func (u *Upgrader) runDrainStrategies(ctx context.Context, listeners []*trackedListener, phase DrainPhase) {
+	for _, tl := range listeners {
+		conns := u.conns().connsFrom(tl)
+		if len(conns) == 0 {
+			continue
+		}
+		u.l.Debug("running drain strategy", "phase", phase, "conns", len(conns), "addr", tl.Addr())
+		tl.strategy.Drain(ctx, phase, conns)
+	}
+}
+
+// connsFrom returns the open connections accepted from tl.
+func (t *connTracker) connsFrom(tl *trackedListener) []net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var conns []net.Conn
+	for c := range t.conns {
+		if c.listener == tl {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
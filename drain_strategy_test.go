@@ -0,0 +1,88 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestDrainStrategy(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithDrainGracePeriod(50*time.Millisecond), WithDrainIdleTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string, phase DrainPhase, conns []net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name+":"+string(phase))
+		if len(conns) != 1 {
+			t.Errorf("expected %s to drain 1 connection, got %d", name, len(conns))
+		}
+	}
+	listen := func(id string, strategy DrainStrategyFunc) (net.Listener, net.Conn) {
+		rawLn, err := upg.Fds.Listen(ctx, id, nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		ln := upg.TrackListenerWithDrain(rawLn, strategy)
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ln.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		return ln, client
+	}
+	// websockets are told to go away once the grace period is over
+	_, ws := listen("ws", func(ctx context.Context, phase DrainPhase, conns []net.Conn) {
+		record("ws", phase, conns)
+		if phase == DrainPhaseGoAway {
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+	})
+	defer ws.Close()
+	// long-polls are completed as soon as the drain starts
+	_, poll := listen("poll", func(ctx context.Context, phase DrainPhase, conns []net.Conn) {
+		record("poll", phase, conns)
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	defer poll.Close()
+
+	done := make(chan struct{})
+	go upg.DrainThen(ctx, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't finish")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"ws:started", "poll:started", "ws:go-away"}
+	if len(calls) != len(expected) {
+		t.Fatalf("expected strategies to be called %v, got %v", expected, calls)
+	}
+	for i := range calls {
+		if calls[i] != expected[i] {
+			t.Fatalf("expected strategies to be called %v, got %v", expected, calls)
+		}
+	}
+}
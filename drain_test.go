@@ -0,0 +1,258 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestDrainThen(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var mu sync.Mutex
+	var events []Event
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithDrainGracePeriod(50*time.Millisecond), WithDrainIdleTimeout(200*time.Millisecond),
+		WithEventHandler(func(e Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	rawLn, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln := upg.TrackListener(rawLn)
+
+	// one connection which keeps sending, and one which goes idle
+	busy, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	idle, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			buf := make([]byte, 16)
+			for {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	stopSending := make(chan struct{})
+	defer close(stopSending)
+	go func() {
+		for {
+			select {
+			case <-stopSending:
+				return
+			case <-time.After(10 * time.Millisecond):
+				busy.Write([]byte("x"))
+			}
+		}
+	}()
+	if n := upg.ActiveConns(); n != 2 {
+		t.Fatalf("expected 2 active connections, got %d", n)
+	}
+
+	wentAway := make(chan struct{})
+	upg.OnGoAway(func() { close(wentAway) })
+	drainCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	done := false
+	upg.DrainThen(drainCtx, func() { done = true })
+	if !done {
+		t.Fatalf("expected then to be called")
+	}
+	select {
+	case <-wentAway:
+	default:
+		t.Fatalf("expected go away functions to be called")
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Fatalf("expected the listener to be closed")
+	}
+	if n := upg.ActiveConns(); n != 0 {
+		t.Fatalf("expected no active connections, got %d", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var types []EventType
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	expected := []EventType{EventDrainStarted, EventDrainIdleClosed, EventDrainForceClosed, EventDrainFinished}
+	if len(types) != len(expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+	for i := range expected {
+		if types[i] != expected[i] {
+			t.Fatalf("expected events %v, got %v", expected, types)
+		}
+	}
+	if events[0].Conns != 2 || events[1].Conns != 1 || events[2].Conns != 1 {
+		t.Fatalf("unexpected connection counts: %+v", events)
+	}
+}
+
+func TestDrainHTTPServer(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var mu sync.Mutex
+	var events []Event
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithDrainGracePeriod(50*time.Millisecond), WithDrainIdleTimeout(50*time.Millisecond),
+		WithEventHandler(func(e Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	rawLn, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln := upg.TrackListener(rawLn)
+
+	// the request is quiet for longer than the idle timeout, but must not
+	// be cut off
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	upg.DrainHTTPServer(srv)
+	go srv.Serve(ln)
+
+	resC := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			resC <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		resC <- string(body)
+	}()
+	<-started
+	if n := upg.ActiveStreams(); n != 1 {
+		t.Fatalf("expected 1 active stream, got %d", n)
+	}
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		close(release)
+	}()
+
+	drainCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	upg.DrainThen(drainCtx, nil)
+	if res := <-resC; res != "done" {
+		t.Fatalf("expected the request to finish, got %q", res)
+	}
+	if n := upg.ActiveStreams(); n != 0 {
+		t.Fatalf("expected no active streams, got %d", n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range events {
+		if e.Type == EventDrainForceClosed {
+			t.Fatalf("expected the drain to finish without closing connections by force: %+v", events)
+		}
+	}
+	if events[0].Type != EventDrainStarted || events[0].Streams != 1 {
+		t.Fatalf("expected the drain to start with 1 stream, got %+v", events)
+	}
+}
+
+type fakeGRPCServer struct {
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func (s *fakeGRPCServer) GracefulStop() { <-s.stopped }
+
+func (s *fakeGRPCServer) Stop() { s.once.Do(func() { close(s.stopped) }) }
+
+func TestDrainGRPCServer(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithDrainGracePeriod(10*time.Millisecond), WithDrainIdleTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	rawLn, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln := upg.TrackListener(rawLn)
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stream which outlives the drain
+	srv := &fakeGRPCServer{stopped: make(chan struct{})}
+	upg.DrainGRPCServer(srv)
+	done := upg.TrackStream()
+	defer done()
+
+	drainCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	go func() {
+		// the idle connection is left to the server while it stops
+		time.Sleep(100 * time.Millisecond)
+		if n := upg.ActiveConns(); n != 1 {
+			t.Errorf("expected the connection to stay open, got %d", n)
+		}
+	}()
+	upg.DrainThen(drainCtx, nil)
+	select {
+	case <-srv.stopped:
+	default:
+		t.Fatalf("expected the server to be stopped")
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,141 @@
+package tableroll
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Upgrade elections decide which process inherits file descriptors when
+// several new processes start at about the same time, e.g. due to an
+// orchestrator bug. Without an election, each process would inherit in turn
+// as they acquire the coordination lock, each upgrading from the last.
+//
+// Every participating process registers itself as a candidate by writing a
+// "${pid}.candidate" file to the coordination directory before waiting for
+// the lock. Once it holds the lock, it compares itself against all other
+// running candidates. If any outranks it, it has lost. Otherwise it has won,
+// and remembers the candidates it beat so it can reject them once it is the
+// owner, since they may only acquire the lock after it is done.
+
+// ElectionLostError is returned by New when another process which started at
+// the same time won the upgrade election. The process which received it
+// should generally exit.
+type ElectionLostError struct {
+	// WinnerPid is the pid of the winning process.
+	WinnerPid int
+}
+
+func (e *ElectionLostError) Error() string {
+	return fmt.Sprintf("lost the upgrade election to pid %d", e.WinnerPid)
+}
+
+// WithUpgradePriority causes New to take part in an upgrade election against
+// any other new processes that are trying to upgrade at the same time.
+// Exactly one of them will inherit file descriptors, and the rest will fail
+// with an *ElectionLostError.
+// The process with the highest priority wins. Ties are broken in favor of the
+// process which called New first, and then by the lowest pid.
+// Processes which don't use this option do not take part in elections.
+func WithUpgradePriority(priority int) Option {
+	return func(u *Upgrader) {
+		u.electionPriority = &priority
+	}
+}
+
+// outranks returns true if candidate a should win an election against b.
+func outranks(a, b proto.Candidate) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if !a.StartTime.Equal(b.StartTime) {
+		return a.StartTime.Before(b.StartTime)
+	}
+	return a.Pid < b.Pid
+}
+
+func (c *coordinator) candidateFile(pid int) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%d.candidate", pid))
+}
+
+// registerCandidate records that we're taking part in an upgrade election.
+func (c *coordinator) registerCandidate(self proto.Candidate) error {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.candidateFile(self.Pid), data, 0755); err != nil {
+		return classifyCoordinationErr(c.dir, "register election candidate", err)
+	}
+	return nil
+}
+
+func (c *coordinator) withdrawCandidate(pid int) {
+	if err := os.Remove(c.candidateFile(pid)); err != nil && !os.IsNotExist(err) {
+		c.l.Warn("could not withdraw from upgrade election", "err", err)
+	}
+}
+
+// candidates returns all running candidates other than ourselves.
+func (c *coordinator) candidates() ([]proto.Candidate, error) {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	self := c.os.Getpid()
+	var candidates []proto.Candidate
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".candidate") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(c.dir, entry.Name()))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				c.l.Warn("could not read election candidate", "file", entry.Name(), "err", err)
+			}
+			continue
+		}
+		var candidate proto.Candidate
+		if err := json.Unmarshal(data, &candidate); err != nil {
+			c.l.Warn("ignoring invalid election candidate", "file", entry.Name(), "err", err)
+			continue
+		}
+		if candidate.Pid == self {
+			continue
+		}
+		if pidIsDead(c.os, candidate.Pid) {
+			c.l.Debug("removing stale election candidate", "pid", candidate.Pid)
+			c.withdrawCandidate(candidate.Pid)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	return candidates, nil
+}
+
+// runElection decides whether self wins the upgrade election. It must only be
+// called while holding the coordination lock. On success, it returns the pids
+// of the candidates we beat.
+func (c *coordinator) runElection(self proto.Candidate) (map[int]bool, error) {
+	others, err := c.candidates()
+	if err != nil {
+		return nil, err
+	}
+	beaten := make(map[int]bool, len(others))
+	for _, other := range others {
+		if outranks(other, self) {
+			c.l.Info("lost upgrade election", "winner", other.Pid, "winnerPriority", other.Priority)
+			return nil, &ElectionLostError{WinnerPid: other.Pid}
+		}
+		beaten[other.Pid] = true
+	}
+	if len(beaten) > 0 {
+		c.l.Info("won upgrade election", "candidates", len(beaten)+1)
+	}
+	return beaten, nil
+}
@@ -0,0 +1,24 @@
+package tableroll
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+func TestElectionOutranks(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		a, b proto.Candidate
+	}{
+		{proto.Candidate{Pid: 2, Priority: 1, StartTime: now}, proto.Candidate{Pid: 1, Priority: 0, StartTime: now.Add(-time.Second)}},
+		{proto.Candidate{Pid: 2, StartTime: now.Add(-time.Second)}, proto.Candidate{Pid: 1, StartTime: now}},
+		{proto.Candidate{Pid: 1, StartTime: now}, proto.Candidate{Pid: 2, StartTime: now}},
+	}
+	for _, c := range cases {
+		if !outranks(c.a, c.b) || outranks(c.b, c.a) {
+			t.Errorf("expected %+v to outrank %+v", c.a, c.b)
+		}
+	}
+}
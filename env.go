@@ -0,0 +1,160 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// The environment variables NewFromEnv reads. Durations are parsed with
+// time.ParseDuration, and booleans with strconv.ParseBool. Unset or empty
+// variables are ignored.
+const (
+	// EnvCoordinationDir is the coordination directory.
+	EnvCoordinationDir = "TABLEROLL_COORD_DIR"
+	// EnvProgramName is used to find the coordination directory with
+	// DefaultCoordinationDir if EnvCoordinationDir isn't set.
+	EnvProgramName = "TABLEROLL_PROGRAM"
+	// EnvCreateCoordinationDir enables WithCreateCoordinationDir.
+	EnvCreateCoordinationDir = "TABLEROLL_CREATE_COORD_DIR"
+	// EnvUpgradeTimeout sets WithUpgradeTimeout.
+	EnvUpgradeTimeout = "TABLEROLL_UPGRADE_TIMEOUT"
+	// EnvLockTimeout sets WithLockTimeout.
+	EnvLockTimeout = "TABLEROLL_LOCK_TIMEOUT"
+	// EnvLockRetryInterval sets WithLockRetryInterval.
+	EnvLockRetryInterval = "TABLEROLL_LOCK_RETRY_INTERVAL"
+	// EnvCloseGracePeriod sets WithCloseGracePeriod.
+	EnvCloseGracePeriod = "TABLEROLL_CLOSE_GRACE_PERIOD"
+	// EnvMaxTransferDuration sets WithMaxTransferDuration.
+	EnvMaxTransferDuration = "TABLEROLL_MAX_TRANSFER_DURATION"
+	// EnvLogLevel sets WithLogLevel, to one of "error", "warn", "info" or
+	// "debug".
+	EnvLogLevel = "TABLEROLL_LOG_LEVEL"
+	// EnvIdentity sets WithIdentity.
+	EnvIdentity = "TABLEROLL_IDENTITY"
+	// EnvImageDigest sets WithImageDigest.
+	EnvImageDigest = "TABLEROLL_IMAGE_DIGEST"
+	// EnvPlatformPolicy sets WithPlatformPolicy, to one of "warn", "reject"
+	// or "ignore".
+	EnvPlatformPolicy = "TABLEROLL_PLATFORM_POLICY"
+	// EnvBestEffortCoordination enables WithBestEffortCoordination.
+	EnvBestEffortCoordination = "TABLEROLL_BEST_EFFORT_COORDINATION"
+)
+
+// ErrNoCoordinationDir is returned by NewFromEnv when neither
+// EnvCoordinationDir nor EnvProgramName is set.
+var ErrNoCoordinationDir = errors.New(EnvCoordinationDir + " and " + EnvProgramName + " are not set")
+
+// NewFromEnv creates an Upgrader as New does, with the coordination directory
+// and options read from the environment variables above, so that upgrade
+// behavior may be tuned per deployment without code changes. The options
+// passed to it are applied after those read from the environment, so take
+// precedence. It fails if a variable's value is invalid.
+func NewFromEnv(ctx context.Context, opts ...Option) (*Upgrader, error) {
+	return newFromEnv(ctx, clock.RealClock{}, realOS{}, os.Getenv, opts...)
+}
+
+func newFromEnv(ctx context.Context, clock clock.Clock, os OS, getenv func(string) string, opts ...Option) (*Upgrader, error) {
+	coordinationDir, envOpts, err := optionsFromEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	return newUpgrader(ctx, clock, os, coordinationDir, append(envOpts, opts...)...)
+}
+
+// optionsFromEnv reads the coordination directory and options from the
+// environment.
+func optionsFromEnv(getenv func(string) string) (string, []Option, error) {
+	var opts []Option
+	durations := []struct {
+		name string
+		opt  func(time.Duration) Option
+	}{
+		{EnvUpgradeTimeout, WithUpgradeTimeout},
+		{EnvLockTimeout, WithLockTimeout},
+		{EnvLockRetryInterval, WithLockRetryInterval},
+		{EnvCloseGracePeriod, WithCloseGracePeriod},
+		{EnvMaxTransferDuration, WithMaxTransferDuration},
+	}
+	for _, d := range durations {
+		value := getenv(d.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s: %w", d.name, err)
+		}
+		opts = append(opts, d.opt(parsed))
+	}
+	flags := []struct {
+		name string
+		opt  func() Option
+	}{
+		{EnvCreateCoordinationDir, WithCreateCoordinationDir},
+		{EnvBestEffortCoordination, WithBestEffortCoordination},
+	}
+	for _, f := range flags {
+		value := getenv(f.name)
+		if value == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s: %w", f.name, err)
+		}
+		if enabled {
+			opts = append(opts, f.opt())
+		}
+	}
+	if value := getenv(EnvLogLevel); value != "" {
+		level, err := parseLogLevel(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s: %w", EnvLogLevel, err)
+		}
+		opts = append(opts, WithLogLevel(level))
+	}
+	if value := getenv(EnvPlatformPolicy); value != "" {
+		// an unknown policy is reported by New
+		opts = append(opts, WithPlatformPolicy(PlatformPolicy(value)))
+	}
+	if value := getenv(EnvIdentity); value != "" {
+		opts = append(opts, WithIdentity(value))
+	}
+	if value := getenv(EnvImageDigest); value != "" {
+		opts = append(opts, WithImageDigest(value))
+	}
+
+	if dir := getenv(EnvCoordinationDir); dir != "" {
+		return dir, opts, nil
+	}
+	program := getenv(EnvProgramName)
+	if program == "" {
+		return "", nil, ErrNoCoordinationDir
+	}
+	dir, err := DefaultCoordinationDir(program)
+	if err != nil {
+		return "", nil, err
+	}
+	return dir, opts, nil
+}
+
+func parseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LogLevelError, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
@@ -0,0 +1,62 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	env := map[string]string{
+		EnvCoordinationDir: coordDir,
+		EnvUpgradeTimeout:  "5s",
+		EnvLockTimeout:     "2s",
+		EnvLogLevel:        "warn",
+		EnvIdentity:        "from-env",
+		EnvImageDigest:     "sha256:a",
+	}
+	getenv := func(key string) string { return env[key] }
+
+	upg, err := newFromEnv(ctx, clock.RealClock{}, mockOS{pid: 1}, getenv, WithLogger(l), WithIdentity("from-code"))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if upg.coordinationDir != coordDir {
+		t.Fatalf("expected coordination dir %q, got %q", coordDir, upg.coordinationDir)
+	}
+	if upg.upgradeTimeout != 5*time.Second || upg.lockTimeout != 2*time.Second {
+		t.Fatalf("expected the timeouts from the environment, got %v and %v", upg.upgradeTimeout, upg.lockTimeout)
+	}
+	if upg.logLevel == nil || *upg.logLevel != LogLevelWarn {
+		t.Fatalf("expected the log level from the environment, got %v", upg.logLevel)
+	}
+	if upg.imageDigest != "sha256:a" {
+		t.Fatalf("expected the image digest from the environment, got %q", upg.imageDigest)
+	}
+	if upg.identity != "from-code" {
+		t.Fatalf("expected options passed in code to take precedence, got %q", upg.identity)
+	}
+}
+
+func TestOptionsFromEnvErrors(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"no dir":           {},
+		"bad duration":     {EnvCoordinationDir: "/tmp", EnvUpgradeTimeout: "soon"},
+		"bad bool":         {EnvCoordinationDir: "/tmp", EnvCreateCoordinationDir: "sure"},
+		"bad log level":    {EnvCoordinationDir: "/tmp", EnvLogLevel: "loud"},
+		"bad program name": {EnvProgramName: "a/b"},
+	} {
+		env := env
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := optionsFromEnv(func(key string) string { return env[key] }); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
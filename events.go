@@ -0,0 +1,110 @@
+package tableroll
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventUpgradeTimedOut is emitted by the owner when a process it was
+	// passing its fds to did not become ready within the upgrade timeout.
+	// The owner remains the owner.
+	EventUpgradeTimedOut EventType = "upgrade-timed-out"
+	// EventFdsStranded is emitted by the owner when an upgrade failed after
+	// fds were passed, and the other process did not confirm it closed them.
+	// See StrayFds.
+	EventFdsStranded EventType = "fds-stranded"
+	// EventAwaitingCommit is emitted by an owner using WithManualCommit when
+	// the next owner is ready, and it's waiting for Commit or Abort.
+	EventAwaitingCommit EventType = "awaiting-commit"
+	// EventDrainStarted is emitted when DrainThen starts, with the number of
+	// open connections.
+	EventDrainStarted EventType = "drain-started"
+	// EventDrainIdleClosed is emitted when DrainThen closes idle connections
+	// after the grace period, with the number closed.
+	EventDrainIdleClosed EventType = "drain-idle-closed"
+	// EventDrainForceClosed is emitted when DrainThen's context is done, with
+	// the number of connections it closed regardless of whether they were
+	// idle.
+	EventDrainForceClosed EventType = "drain-force-closed"
+	// EventDrainFinished is emitted once DrainThen has no connections left.
+	EventDrainFinished EventType = "drain-finished"
+	// EventUpgradeSocketDegraded is emitted when accepting connections on an
+	// upgrade socket keeps failing, with the last error. See Health.
+	EventUpgradeSocketDegraded EventType = "upgrade-socket-degraded"
+	// EventUpgradeSocketRecovered is emitted when a degraded upgrade socket
+	// accepts a connection again.
+	EventUpgradeSocketRecovered EventType = "upgrade-socket-recovered"
+	// EventChainShutdown is emitted when ShutdownChain is called, by this
+	// process or the one which took over from it.
+	EventChainShutdown EventType = "chain-shutdown"
+	// EventReadyDeadlineExceeded is emitted when Ready wasn't called within
+	// the deadline set with WithReadyDeadline. Peer is the previous owner, if
+	// there is one.
+	EventReadyDeadlineExceeded EventType = "ready-deadline-exceeded"
+	// EventReadyRepeated is emitted when Ready is called more than once,
+	// which is always a bug in the application, even when it's harmless.
+	EventReadyRepeated EventType = "ready-repeated"
+	// EventUpgradePanicked is emitted when serving an upgrade request
+	// panicked, with an *UpgradePanicError. The owner remains the owner
+	// unless it had already handed off.
+	EventUpgradePanicked EventType = "upgrade-panicked"
+	// EventFdsQuarantined is emitted by a process using WithFdQuarantine when
+	// fds it received failed verification, with an *FdMismatchError
+	// describing them. Peer is the owner which sent them, if known.
+	EventFdsQuarantined EventType = "fds-quarantined"
+	// EventUpgradeCircuitOpened is emitted by an owner using
+	// WithUpgradeCircuitBreaker when upgrades from an executable have failed
+	// too many times in a row, with the last failure. Peer is the process
+	// whose upgrade failed last.
+	EventUpgradeCircuitOpened EventType = "upgrade-circuit-opened"
+	// EventUpgradeCircuitRejected is emitted when an owner using
+	// WithUpgradeCircuitBreaker refuses an upgrade because the circuit for
+	// the peer's executable is open, with an *UpgradeCircuitOpenError.
+	EventUpgradeCircuitRejected EventType = "upgrade-circuit-rejected"
+	// EventOwnershipLeaseLost is emitted by an owner using WithOwnershipLease
+	// when it finds another process seized ownership after its lease
+	// expired. Peer is the new owner.
+	EventOwnershipLeaseLost EventType = "ownership-lease-lost"
+	// EventSuccessorExited is emitted by a process which has handed off when
+	// the process which took over from it exits, or, with a
+	// *HeartbeatTimeoutError, stops answering heartbeats; see
+	// SuccessorExited. Peer is the process which took over.
+	EventSuccessorExited EventType = "successor-exited"
+	// EventPlatformMismatch is emitted by an owner when a process on an
+	// incompatible platform asks for its fds, with a *PlatformMismatchError,
+	// whether or not it's refused; see WithPlatformPolicy.
+	EventPlatformMismatch EventType = "platform-mismatch"
+	// EventHandedBack is emitted by an owner when the process it was passing
+	// its fds to gave up before becoming ready, e.g. with Handback, and
+	// confirmed it closed them. The owner remains the owner.
+	EventHandedBack EventType = "handed-back"
+)
+
+// Event describes something notable which happened to an Upgrader. Events
+// are intended for metrics and alerting; each has a corresponding log line.
+type Event struct {
+	Type EventType
+	// Peer is the other process involved, if known.
+	Peer *PeerInfo
+	// Err is the error which caused the event, if any.
+	Err error
+	// Conns is the number of connections involved, for drain events.
+	Conns int
+	// Streams is the number of in-flight requests or streams, for drain
+	// events; see TrackStream.
+	Streams int
+}
+
+// WithEventHandler configures a function which is called with each Event as
+// it happens. The function is called synchronously, so it should return
+// quickly.
+func WithEventHandler(handler func(Event)) Option {
+	return func(u *Upgrader) {
+		u.eventHandler = handler
+	}
+}
+
+func (u *Upgrader) emit(e Event) {
+	if u.eventHandler != nil {
+		u.eventHandler(e)
+	}
+}
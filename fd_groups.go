@@ -0,0 +1,150 @@
+package tableroll
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Ids may be paths, such as "tenant/acme/http", made of groups separated by
+// GroupSeparator. A group holds every fd whose id starts with the group and a
+// separator, including those in its subgroups, so a multi-tenant daemon can
+// keep each tenant's fds in a group and add, remove, or withhold a whole
+// tenant at once. Ids which contain no separator aren't in any group.
+
+// GroupSeparator separates the groups in an id.
+const GroupSeparator = "/"
+
+// GroupID joins groups and an id with GroupSeparator, e.g.
+// GroupID("tenant", "acme", "http") returns "tenant/acme/http".
+func GroupID(parts ...string) string {
+	return strings.Join(parts, GroupSeparator)
+}
+
+// inGroup returns whether id is in group or one of its subgroups.
+func inGroup(id, group string) bool {
+	return strings.HasPrefix(id, group+GroupSeparator)
+}
+
+// GroupLockedError is returned when adding, replacing or removing an fd in a
+// group locked with LockGroup.
+type GroupLockedError struct {
+	Group string
+	ID    string
+}
+
+func (e *GroupLockedError) Error() string {
+	return fmt.Sprintf("fd %q can't be changed, group %q is locked", e.ID, e.Group)
+}
+
+// Group returns the ids of all fds in group, including its subgroups, sorted.
+func (f *Fds) Group(group string) []string {
+	return f.ListPrefix(group + GroupSeparator)
+}
+
+// Subgroups returns the names of the groups directly within group, sorted,
+// e.g. the tenants in "tenant". An empty group lists the top-level groups.
+func (f *Fds) Subgroups(group string) []string {
+	prefix := ""
+	if group != "" {
+		prefix = group + GroupSeparator
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[string]bool)
+	for id := range f.fds {
+		if !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(id, prefix)
+		if i := strings.Index(rest, GroupSeparator); i > 0 {
+			seen[prefix+rest[:i]] = true
+		}
+	}
+	groups := make([]string, 0, len(seen))
+	for g := range seen {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// RemoveGroup removes and closes all fds in group, including its subgroups,
+// as Remove does for one. Either all are removed or, if mutations are locked
+// or the group or an enclosing one is locked, none are. The first error from
+// closing them is returned once they're all removed.
+func (f *Fds) RemoveGroup(group string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.locked && f.lockedReason == ErrUpgradeInProgress {
+		return f.rejectMutationLocked()
+	}
+	ids := f.idsWithPrefixLocked(group+GroupSeparator, "")
+	for _, id := range ids {
+		if err := f.groupLockedLocked(id); err != nil {
+			return err
+		}
+	}
+	var firstErr error
+	for _, id := range ids {
+		item := f.fds[id]
+		delete(f.fds, id)
+		delete(f.onTransfer, id)
+		if item.file != nil {
+			if err := item.file.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// LockGroup prevents fds in group, including its subgroups, from being added,
+// replaced or removed, e.g. while a tenant is being set up or torn down,
+// until UnlockGroup is called. Such changes fail with a *GroupLockedError.
+// Existing fds in the group may still be retrieved, and are passed on to the
+// next owner as usual. Locks are local to this process.
+func (f *Fds) LockGroup(group string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lockedGroups == nil {
+		f.lockedGroups = make(map[string]bool)
+	}
+	f.lockedGroups[group] = true
+}
+
+// UnlockGroup undoes LockGroup. Enclosing groups which are locked remain so.
+func (f *Fds) UnlockGroup(group string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.lockedGroups, group)
+}
+
+// groupLockedLocked returns a *GroupLockedError if id is in a locked group.
+func (f *Fds) groupLockedLocked(id string) error {
+	for group := range f.lockedGroups {
+		if inGroup(id, group) {
+			return &GroupLockedError{Group: group, ID: id}
+		}
+	}
+	return nil
+}
+
+// checkMutationLocked returns the error a mutation of the fd with the given
+// id should fail with, if any.
+func (f *Fds) checkMutationLocked(id string) error {
+	if f.locked {
+		return f.rejectMutationLocked()
+	}
+	return f.groupLockedLocked(id)
+}
+
+// VetoGroup withholds every fd in group, including its subgroups, from the
+// next owner, as Veto does for one.
+func (t *Transfer) VetoGroup(group, reason string) {
+	for _, fd := range t.Fds {
+		if inGroup(fd.ID, group) {
+			t.Veto(fd.ID, reason)
+		}
+	}
+}
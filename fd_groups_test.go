@@ -0,0 +1,102 @@
+package tableroll
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestFdGroups(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+	for _, id := range []string{
+		GroupID("tenant", "acme", "http"),
+		GroupID("tenant", "acme", "admin", "http"),
+		GroupID("tenant", "initech", "http"),
+		"tenantless",
+	} {
+		ln, err := fds.Listen(ctx, id, nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.Close()
+	}
+
+	if got, want := fds.Group("tenant/acme"), []string{"tenant/acme/admin/http", "tenant/acme/http"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected group %v, got %v", want, got)
+	}
+	if got, want := fds.Subgroups("tenant"), []string{"tenant/acme", "tenant/initech"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected subgroups %v, got %v", want, got)
+	}
+	if got, want := fds.Subgroups(""), []string{"tenant"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected top-level groups %v, got %v", want, got)
+	}
+
+	fds.LockGroup("tenant/acme")
+	_, err := fds.Listen(ctx, "tenant/acme/admin/https", nil, "tcp", "127.0.0.1:0")
+	if _, ok := err.(*GroupLockedError); !ok {
+		t.Fatalf("expected a *GroupLockedError adding to a locked subgroup, got %v", err)
+	}
+	if err := fds.Remove("tenant/acme/http"); err == nil {
+		t.Fatalf("expected removing from a locked group to fail")
+	}
+	if err := fds.RemoveGroup("tenant"); err == nil {
+		t.Fatalf("expected removing a group enclosing a locked one to fail")
+	}
+	if got := fds.Group("tenant"); len(got) != 3 {
+		t.Fatalf("expected a failed RemoveGroup to remove nothing, got %v", got)
+	}
+	if ln, err := fds.Listener("tenant/acme/http"); err != nil || ln == nil {
+		t.Fatalf("expected fds in a locked group to be retrievable, got %v, %v", ln, err)
+	} else {
+		ln.Close()
+	}
+	if ln, err := fds.Listen(ctx, "tenant/initech/https", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("expected other groups to be unaffected, got %v", err)
+	} else {
+		ln.Close()
+	}
+	fds.UnlockGroup("tenant/acme")
+
+	if err := fds.RemoveGroup("tenant/acme"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fds.IDs(), []string{"tenant/initech/http", "tenant/initech/https", "tenantless"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v to remain, got %v", want, got)
+	}
+}
+
+func TestTransferVetoGroup(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithTransferInterceptors(func(tr *Transfer) error {
+			tr.VetoGroup("tenant/acme", "tenant is being deleted")
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	for _, id := range []string{"tenant/acme/http", "tenant/initech/http"} {
+		if _, err := upg1.Fds.Listen(ctx, id, nil, "tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if got, want := upg2.Fds.Group("tenant"), []string{"tenant/initech/http"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected only %v to be passed on, got %v", want, got)
+	}
+}
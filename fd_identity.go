@@ -0,0 +1,163 @@
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"syscall"
+)
+
+// fdIdentity describes the kernel object an fd refers to. The owner sends it
+// along with each fd so that the receiver can check it got what the owner
+// meant to send.
+type fdIdentity struct {
+	Dev uint64 `json:"dev"`
+	Ino uint64 `json:"ino"`
+	// Mode is the file type portion of st_mode
+	Mode uint32 `json:"mode"`
+
+	// for sockets only
+	SockType int    `json:"sockType,omitempty"`
+	SockAddr string `json:"sockAddr,omitempty"`
+}
+
+func identify(fd uintptr) (*fdIdentity, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); err != nil {
+		return nil, fmt.Errorf("could not stat fd: %w", err)
+	}
+	id := &fdIdentity{
+		Dev:  uint64(st.Dev),
+		Ino:  uint64(st.Ino),
+		Mode: uint32(st.Mode) & syscall.S_IFMT,
+	}
+	if id.Mode != syscall.S_IFSOCK {
+		return id, nil
+	}
+	sockType, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("could not get socket type: %w", err)
+	}
+	id.SockType = sockType
+	sa, err := syscall.Getsockname(int(fd))
+	if err == syscall.EAFNOSUPPORT {
+		// the syscall package can't decode every family's addresses, such as
+		// AF_VSOCK's, so those sockets are identified without them
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get socket address: %w", err)
+	}
+	id.SockAddr = sockaddrString(sa)
+	return id, nil
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrUnix:
+		return sa.Name
+	case nil:
+		return ""
+	default:
+		if s, ok := platformSockaddrString(sa); ok {
+			return s
+		}
+		return fmt.Sprintf("%T", sa)
+	}
+}
+
+// diff returns a description of each way in which actual differs from id.
+func (id *fdIdentity) diff(actual *fdIdentity) []string {
+	var diffs []string
+	add := func(field string, expected, got interface{}) {
+		if expected != got {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %v, got %v", field, expected, got))
+		}
+	}
+	add("device", id.Dev, actual.Dev)
+	add("inode", id.Ino, actual.Ino)
+	add("file type", id.Mode, actual.Mode)
+	add("socket type", id.SockType, actual.SockType)
+	add("socket address", id.SockAddr, actual.SockAddr)
+	return diffs
+}
+
+// FdMismatchError is returned by New when WithFdVerification is used, and the
+// file descriptors received from the owner don't match what it described.
+type FdMismatchError struct {
+	// Mismatches maps the id of each mismatched fd to a description of each
+	// difference.
+	Mismatches map[string][]string
+}
+
+func (e *FdMismatchError) Error() string {
+	ids := make([]string, 0, len(e.Mismatches))
+	for id := range e.Mismatches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	descriptions := make([]string, 0, len(ids))
+	for _, id := range ids {
+		descriptions = append(descriptions, fmt.Sprintf("%q (%s)", id, strings.Join(e.Mismatches[id], ", ")))
+	}
+	return "received fds did not match the owner's description: " + strings.Join(descriptions, "; ")
+}
+
+// fdVerification is how received fds are checked against their identities;
+// see WithFdVerification and WithFdQuarantine.
+type fdVerification int
+
+const (
+	fdVerificationOff fdVerification = iota
+	// fdVerificationReject fails the upgrade if any fd doesn't match.
+	fdVerificationReject
+	// fdVerificationQuarantine quarantines the fds which don't match.
+	fdVerificationQuarantine
+)
+
+// verifyFds checks each received fd against the identity the owner sent for
+// it. Fds sent without an identity, e.g. by older owners, are not checked.
+func verifyFds(fds []*fd) error {
+	if mismatches := checkFds(fds); len(mismatches) > 0 {
+		return &FdMismatchError{Mismatches: mismatches}
+	}
+	return nil
+}
+
+// checkFds returns a description of each way in which each received fd
+// differs from the identity the owner sent for it, by id.
+func checkFds(fds []*fd) map[string][]string {
+	mismatches := make(map[string][]string)
+	for _, f := range fds {
+		if f.Identity == nil || f.file == nil {
+			continue
+		}
+		actual, err := identify(f.file.fd)
+		if err != nil {
+			mismatches[f.ID] = []string{err.Error()}
+			continue
+		}
+		diffs := f.Identity.diff(actual)
+		if f.Kind != fdKindFile && actual.Mode != syscall.S_IFSOCK {
+			diffs = append(diffs, fmt.Sprintf("kind: expected a socket for a %s", f.Kind))
+		}
+		if actual.Mode == syscall.S_IFSOCK {
+			if errno, err := syscall.GetsockoptInt(int(f.file.fd), syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil {
+				diffs = append(diffs, fmt.Sprintf("socket error: %v", err))
+			} else if errno != 0 {
+				diffs = append(diffs, fmt.Sprintf("socket error: %v", syscall.Errno(errno)))
+			}
+		}
+		if len(diffs) > 0 {
+			mismatches[f.ID] = diffs
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,80 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestVerifyFds(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dup, err := dupConn(ln.(Listener), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dup.Close()
+
+	identity, err := identify(dup.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.SockAddr != ln.Addr().String() {
+		t.Fatalf("expected socket address %v, got %v", ln.Addr(), identity.SockAddr)
+	}
+	received := &fd{ID: "web", Kind: fdKindListener, Identity: identity, file: dup}
+	if err := verifyFds([]*fd{received}); err != nil {
+		t.Fatalf("expected fd to match its own identity: %v", err)
+	}
+
+	wrong := *identity
+	wrong.Ino++
+	wrong.SockAddr = "127.0.0.1:1"
+	received.Identity = &wrong
+	err = verifyFds([]*fd{received})
+	mismatch, ok := err.(*FdMismatchError)
+	if !ok {
+		t.Fatalf("expected mismatch error, got %v", err)
+	}
+	if len(mismatch.Mismatches["web"]) != 2 {
+		t.Fatalf("expected inode and address to mismatch, got %v", mismatch)
+	}
+}
+
+func TestUpgradeWithFdVerification(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithFdVerification())
+	if err != nil {
+		t.Fatalf("expected verified upgrade to succeed: %v", err)
+	}
+	defer upg2.Stop()
+	if upg2.Fds.fds["web"].Identity == nil {
+		t.Fatalf("expected the owner to describe the fd")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
@@ -0,0 +1,55 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// FdInfo describes an fd returned by one of the Info variants of the methods
+// which inherit or create fds, such as ListenInfo. Callers may use it to skip
+// initialization which was already done for a resource the previous owner
+// created, such as writing a header to a new file.
+type FdInfo struct {
+	// Inherited is set if the fd was passed on by a previous owner, rather
+	// than created by this process.
+	Inherited bool
+	// Generation is the generation of the process which created the fd.
+	Generation uint32
+}
+
+// ListenInfo is like Listen, but also describes whether the listener was
+// inherited.
+func (f *Fds) ListenInfo(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, FdInfo, error) {
+	var info FdInfo
+	ln, err := f.listen(ctx, id, cfg, network, addr, &info)
+	return ln, info, err
+}
+
+// ListenPacketInfo is like ListenPacket, but also describes whether the
+// packet conn was inherited.
+func (f *Fds) ListenPacketInfo(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.PacketConn, FdInfo, error) {
+	var info FdInfo
+	conn, err := f.listenPacket(ctx, id, cfg, network, addr, &info)
+	return conn, info, err
+}
+
+// OpenFileInfo is like OpenFile, but also describes whether the file was
+// inherited.
+func (f *Fds) OpenFileInfo(id string, path string, flag int, perm os.FileMode) (*os.File, FdInfo, error) {
+	var info FdInfo
+	fi, err := f.openFile(id, path, flag, perm, &info)
+	return fi, info, err
+}
+
+// describeLocked fills in info for the fd with the given id, if info is set
+// and *err is nil. It's deferred by the methods which fill in an FdInfo, so
+// that it describes the fd they return.
+func (f *Fds) describeLocked(id string, info *FdInfo, err *error) {
+	if info == nil || *err != nil {
+		return
+	}
+	if fi, ok := f.fds[id]; ok {
+		*info = FdInfo{Inherited: fi.inherited, Generation: fi.Generation}
+	}
+}
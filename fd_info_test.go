@@ -0,0 +1,78 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFdsInfo(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+
+	parent := newFds(l, nil)
+	parent.generation = 1
+	ln, info, err := parent.ListenInfo(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if info != (FdInfo{Generation: 1}) {
+		t.Errorf("expected a new listener, got %+v", info)
+	}
+	conn, info, err := parent.ListenPacketInfo(ctx, "pc", nil, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+	if info != (FdInfo{Generation: 1}) {
+		t.Errorf("expected a new packet conn, got %+v", info)
+	}
+	fi, info, err := parent.OpenFileInfo("journal", path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	fi.Close()
+	if info != (FdInfo{Generation: 1}) {
+		t.Errorf("expected a new file, got %+v", info)
+	}
+
+	inherited := make(map[string]*fd)
+	for id, fi := range parent.fds {
+		cp := *fi
+		cp.inherited = true
+		inherited[id] = &cp
+	}
+	child := newFds(l, inherited)
+	child.generation = 2
+	ln, info, err = child.ListenInfo(ctx, "ln", nil, "tcp", parent.fds["ln"].Addr)
+	if err != nil {
+		t.Fatalf("error inheriting listener: %v", err)
+	}
+	ln.Close()
+	if info != (FdInfo{Inherited: true, Generation: 1}) {
+		t.Errorf("expected an inherited listener, got %+v", info)
+	}
+	conn, info, err = child.ListenPacketInfo(ctx, "pc", nil, "udp", parent.fds["pc"].Addr)
+	if err != nil {
+		t.Fatalf("error inheriting packet conn: %v", err)
+	}
+	conn.Close()
+	if info != (FdInfo{Inherited: true, Generation: 1}) {
+		t.Errorf("expected an inherited packet conn, got %+v", info)
+	}
+	fi, info, err = child.OpenFileInfo("journal", path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("error inheriting file: %v", err)
+	}
+	fi.Close()
+	if info != (FdInfo{Inherited: true, Generation: 1}) {
+		t.Errorf("expected an inherited file, got %+v", info)
+	}
+	for _, id := range []string{"ln", "pc", "journal"} {
+		parent.Remove(id)
+	}
+}
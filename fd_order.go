@@ -0,0 +1,29 @@
+package tableroll
+
+import "sort"
+
+// Fds are always iterated in the same order: sorted by id, comparing ids
+// bytewise as sort.Strings does. That's the order of IDs and ListPrefix, of
+// String and Dump, of the fds a TransferInterceptor sees, and the order in
+// which they're passed to the next owner, exclusive fds included. Since it
+// depends only on the ids, and not on the order the fds were created in or
+// which process created them, it's the same in every process in an upgrade
+// chain, and after a cold start. Applications which derive anything from fd
+// order, such as which worker serves which listener, should iterate IDs or
+// ListPrefix rather than the maps returned by the WithPrefix methods.
+
+// IDs returns the ids of all fds, in iteration order.
+func (f *Fds) IDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := make([]string, 0, len(f.fds))
+	for _, fi := range f.sortedLocked() {
+		ids = append(ids, fi.ID)
+	}
+	return ids
+}
+
+// sortFds sorts fds into iteration order.
+func sortFds(fds []*fd) {
+	sort.Slice(fds, func(i, j int) bool { return fds[i].ID < fds[j].ID })
+}
@@ -0,0 +1,71 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestFdOrder(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	// created out of order
+	for _, id := range []string{"web/2", "web/10", "api", "web/1"} {
+		if _, err := upg1.Fds.Listen(ctx, id, nil, "tcp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+	}
+	want := []string{"api", "web/1", "web/10", "web/2"}
+	if got := upg1.Fds.IDs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected ids %v, got %v", want, got)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if got := upg2.Fds.IDs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected the same order after upgrading, got %v", got)
+	}
+	if got := upg2.Fds.ListPrefix("web/"); !reflect.DeepEqual(got, want[1:]) {
+		t.Fatalf("expected prefixed ids %v, got %v", want[1:], got)
+	}
+}
+
+func TestExclusiveFdOrder(t *testing.T) {
+	fds := newFds(l, nil)
+	for _, id := range []string{"c", "a", "b"} {
+		f, err := ioutil.TempFile("", "tableroll_order")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if err := fds.AddExclusive(id, f); err != nil {
+			t.Fatalf("error adding exclusive fd: %v", err)
+		}
+	}
+	var ids []string
+	for _, fi := range fds.takeExclusive() {
+		ids = append(ids, fi.ID)
+		fi.file.Close()
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("expected exclusive fds to be passed in order %v, got %v", want, ids)
+	}
+}
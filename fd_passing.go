@@ -0,0 +1,51 @@
+package tableroll
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// sendFd sends fd over the unix socket, with name as the message's data so the
+// receiver can name the file it makes of it.
+func sendFd(socket *os.File, name string, fd uintptr) error {
+	if len(name) >= maxFdNameLength {
+		return fmt.Errorf("fd name too long: %d bytes", len(name))
+	}
+	oob := syscall.UnixRights(int(fd))
+	return syscall.Sendmsg(int(socket.Fd()), []byte(name), oob, nil, 0)
+}
+
+// recvFd receives a single fd sent by sendFd over the unix socket.
+func recvFd(socket *os.File) (*os.File, error) {
+	name := make([]byte, maxFdNameLength)
+	oobSpace := syscall.CmsgSpace(4)
+	oob := make([]byte, oobSpace)
+
+	n, oobn, _, _, err := syscall.Recvmsg(int(socket.Fd()), name, oob, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n >= maxFdNameLength || oobn != oobSpace {
+		return nil, fmt.Errorf("recvfd: incorrect number of bytes read (n=%d oobn=%d)", n, oobn)
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("recvfd: got %d control messages, expected 1", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("recvfd: got %d fds, expected 1", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
@@ -1,16 +1,18 @@
 package tableroll
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"sync"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
-	"github.com/inconshreveable/log15"
-	"github.com/pkg/errors"
-	"golang.org/x/sys/unix"
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/proto"
 )
 
 var (
@@ -30,8 +32,55 @@ var (
 	// This error will be returned if an atttempt is made to mutate the file
 	// descriptor store after stopping the upgrader.
 	ErrUpgraderStopped = errors.New("the upgrader has been marked as stopped")
+	// ErrIdExists indicates an attempt was made to register an fd with an id
+	// which is already in use by a different resource. The error returned will
+	// be an *IdExistsError, which wraps ErrIdExists.
+	ErrIdExists = errors.New("an fd with this id already exists")
 )
 
+// IdExistsError is returned when registering an fd with an id that's already
+// in use for a different kind of fd or a different address or file name. It
+// describes the existing fd.
+// If the resource for an id is expected to change between versions, the
+// Upsert variants may be used to replace it instead.
+type IdExistsError struct {
+	ID         string
+	Kind       string
+	Network    string
+	Addr       string
+	Name       string
+	Generation uint32
+	Inherited  bool
+}
+
+func newIdExistsError(existing *fd) *IdExistsError {
+	return &IdExistsError{
+		ID:         existing.ID,
+		Kind:       string(existing.Kind),
+		Network:    existing.Network,
+		Addr:       existing.Addr,
+		Name:       existing.Name,
+		Generation: existing.Generation,
+		Inherited:  existing.inherited,
+	}
+}
+
+func (e *IdExistsError) Error() string {
+	origin := "created"
+	if e.Inherited {
+		origin = "inherited"
+	}
+	if e.Kind == fdKindFile {
+		return fmt.Sprintf("%v: %q is a %s for %q (%s, generation %d)", ErrIdExists, e.ID, e.Kind, e.Name, origin, e.Generation)
+	}
+	return fmt.Sprintf("%v: %q is a %s for %s:%s (%s, generation %d)", ErrIdExists, e.ID, e.Kind, e.Network, e.Addr, origin, e.Generation)
+}
+
+// Unwrap returns ErrIdExists.
+func (e *IdExistsError) Unwrap() error {
+	return ErrIdExists
+}
+
 // Listener can be shared between processes.
 type Listener interface {
 	net.Listener
@@ -47,9 +96,10 @@ type Conn interface {
 type fdKind string
 
 const (
-	fdKindListener fdKind = "listener"
-	fdKindConn            = "conn"
-	fdKindFile            = "file"
+	fdKindListener   fdKind = "listener"
+	fdKindConn              = "conn"
+	fdKindFile              = "file"
+	fdKindPacketConn        = "packetconn"
 )
 
 // file works around the fact that it's not possible
@@ -94,14 +144,83 @@ type fd struct {
 	// for conns/listeners, stored just for pretty-printing
 	Network string `json:"network,omitEmpty"`
 	Addr    string `json:"addr,omitEmpty"`
+	// LocalAddr and RemoteAddr are the addresses the socket reported when it
+	// was added, for sockets whose addresses can't be recomputed once
+	// inherited; see recordAddrs.
+	LocalAddr  string `json:"localAddr,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+
+	// Generation is the generation of the process which created this fd.
+	Generation uint32 `json:"generation,omitempty"`
+	// Identity is sent along with the fd so the receiver can verify it.
+	Identity *fdIdentity `json:"identity,omitempty"`
+	// Exclusive fds may only be used by one process at a time, and so are
+	// only passed on once the owner has drained.
+	Exclusive bool `json:"exclusive,omitempty"`
+	// SocketOptions are the options the socket had when it was added, and
+	// PinnedSocketOptions those set with SetSocketOptions, which are
+	// re-applied after inheritance.
+	SocketOptions       *SocketOptions `json:"socketOptions,omitempty"`
+	PinnedSocketOptions *SocketOptions `json:"pinnedSocketOptions,omitempty"`
+	// TLS is set for listeners served with TLS; see TLSListener.
+	TLS bool `json:"tls,omitempty"`
+	// FileState is the state of a regular file when it was sent; see FileAt.
+	FileState *FileState `json:"fileState,omitempty"`
+	// TransferState is what the sender's OnTransfer callback returned; see
+	// TransferState.
+	TransferState []byte `json:"transferState,omitempty"`
+	// inherited is true if this fd was passed to us by a previous owner.
+	inherited bool
+	// tlsWrapped is true once this process has used TLSListener for this fd.
+	tlsWrapped bool
+	// quarantine describes why the fd failed verification, if it did; see
+	// WithFdQuarantine.
+	quarantine []string
+}
+
+// fdTable is the body of a v2 fds message.
+type fdTable struct {
+	// Generation is the generation of the sending owner.
+	Generation uint32 `json:"generation"`
+	Fds        []*fd  `json:"fds"`
+	// Identity is the sending owner's identity, if it set one.
+	Identity string `json:"identity,omitempty"`
+	// State is the opaque state provided with WithHandoffState, if any.
+	State []byte `json:"state,omitempty"`
+	// Store is the contents of the owner's Store, if it has any.
+	Store *storeSnapshot `json:"store,omitempty"`
+	// Heartbeats is set if the sending owner answers heartbeats once it's
+	// stepped down, and keeps the connection open until it exits.
+	Heartbeats bool `json:"heartbeats,omitempty"`
+	// Handback is set if the sending owner acknowledges MessageFdsReleased
+	// once it has resumed ownership; see Upgrader.Handback.
+	Handback bool `json:"handback,omitempty"`
+	// Platform is the sending owner's platform.
+	Platform *proto.Platform `json:"platform,omitempty"`
+	// ReadyTimeout is the sending owner's upgrade timeout, and
+	// ReadyRemaining how much of it was left when the table was sent.
+	ReadyTimeout   time.Duration `json:"readyTimeout,omitempty"`
+	ReadyRemaining time.Duration `json:"readyRemaining,omitempty"`
 }
 
-func (f *fd) associateFile(name string, osFile *os.File) {
+func (f *fd) associateFile(osFile *os.File) {
 	f.file = &file{
 		osFile,
 		osFile.Fd(),
 	}
-	f.Name = name
+	f.inherited = true
+}
+
+// sameResource returns true if other describes the same resource as f, even
+// if they are not the same fd.
+func (f *fd) sameResource(other *fd) bool {
+	if f.Kind != other.Kind {
+		return false
+	}
+	if f.Kind == fdKindFile {
+		return f.Name == other.Name
+	}
+	return f.Network == other.Network && f.Addr == other.Addr
 }
 
 func (f *fd) String() string {
@@ -109,9 +228,14 @@ func (f *fd) String() string {
 	case fdKindFile:
 		return fmt.Sprintf("file(%v): %v", f.ID, f.Name)
 	case fdKindListener:
+		if f.TLS {
+			return fmt.Sprintf("listener(%v): %v:%v (tls)", f.ID, f.Network, f.Addr)
+		}
 		return fmt.Sprintf("listener(%v): %v:%v", f.ID, f.Network, f.Addr)
 	case fdKindConn:
 		return fmt.Sprintf("conn(%v): %v:%v", f.ID, f.Network, f.Addr)
+	case fdKindPacketConn:
+		return fmt.Sprintf("packetconn(%v): %v:%v", f.ID, f.Network, f.Addr)
 	default:
 		return fmt.Sprintf("unknown: %#v", f)
 	}
@@ -121,7 +245,7 @@ func (f *fd) String() string {
 // inherited from a previous one.  It provides methods for adding and removing
 // file descriptors from the store.
 type Fds struct {
-	mu sync.Mutex
+	mu ctxMutex
 	// NB: Files in these maps may be in blocking mode.
 	fds map[string]*fd
 
@@ -129,26 +253,156 @@ type Fds struct {
 	// When true, all mutations will result in an error with the error 'lockedReason'
 	locked       bool
 	lockedReason error
-
-	l log15.Logger
+	// upgradeDoneC is closed once mutations are no longer locked with
+	// ErrUpgradeInProgress, to wake callers waiting for the upgrade to finish.
+	upgradeDoneC chan struct{}
+	// storedC is closed whenever an fd is stored, to wake callers waiting for
+	// an id to appear.
+	storedC chan struct{}
+	// stats counts how mutations were held up by upgrades, and upgradeLockedAt
+	// is when the upgrade in progress, if any, locked them.
+	stats           MutationLockStats
+	upgradeLockedAt time.Time
+	clock           clock.Clock
+
+	// generation is the generation of this process, and is recorded on fds it
+	// creates.
+	generation uint32
+	// redact is applied to ids, names, and addresses when rendering fds.
+	redact func(string) string
+
+	// reusePortJoined holds the ids of the SO_REUSEPORT groups this process
+	// has joined, and pendingSteering steers each inherited group to this
+	// process once it's the owner.
+	reusePortJoined map[string]bool
+	pendingSteering []func() error
+
+	// transferConn passes a connection to the next owner; see TransferConn.
+	transferConn func(id string, conn net.Conn, state []byte) error
+
+	// lockedGroups holds the groups locked with LockGroup.
+	lockedGroups map[string]bool
+	// onTransfer holds the callbacks registered with OnTransfer.
+	onTransfer map[string]func() []byte
+	// quarantined holds the inherited fds which failed verification, by id;
+	// see WithFdQuarantine.
+	quarantined map[string]*fd
+	// retiring holds the listeners DeclareListeners removed, until they're
+	// closed once the previous owner has drained.
+	retiring []*fd
+
+	l Logger
 }
 
+// String returns a summary of all fds on a single line.
 func (f *Fds) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	res := make([]string, 0, len(f.fds))
-	for _, fi := range f.fds {
-		res = append(res, fi.String())
+	for _, fi := range f.sortedLocked() {
+		res = append(res, f.redacted(fi).String())
 	}
 	return fmt.Sprintf("fds: %v", res)
 }
 
-func newFds(l log15.Logger, inherited map[string]*fd) *Fds {
+// Dump returns a human-readable table of all fds, one per line, including
+// whether each was inherited or created by this process and the generation
+// of the process which created it. Sensitive values may be hidden using
+// WithRedaction.
+func (f *Fds) Dump() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tADDRESS\tORIGIN\tGENERATION")
+	for _, fi := range f.sortedLocked() {
+		fi = f.redacted(fi)
+		address := fi.Name
+		if fi.Kind != fdKindFile {
+			address = fi.Network + ":" + fi.Addr
+		}
+		origin := "created"
+		if fi.inherited {
+			origin = "inherited"
+		}
+		if fi.Exclusive {
+			origin += ",exclusive"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", fi.ID, fi.Kind, address, origin, fi.Generation)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// sortedLocked returns all fds in their iteration order.
+func (f *Fds) sortedLocked() []*fd {
+	sorted := make([]*fd, 0, len(f.fds))
+	for _, fi := range f.fds {
+		sorted = append(sorted, fi)
+	}
+	sortFds(sorted)
+	return sorted
+}
+
+// redacted returns a copy of the fd's metadata for display, with the
+// redaction function applied.
+func (f *Fds) redacted(fi *fd) *fd {
+	return redactFd(f.redact, fi)
+}
+
+// redactFd returns a copy of fi's metadata for display, with redact, if set,
+// applied to its id, name and addresses.
+func redactFd(redact func(string) string, fi *fd) *fd {
+	if redact == nil || fi == nil {
+		return fi
+	}
+	cp := *fi
+	cp.ID = redact(fi.ID)
+	cp.Name = redact(fi.Name)
+	cp.Addr = redact(fi.Addr)
+	cp.LocalAddr = redact(fi.LocalAddr)
+	cp.RemoteAddr = redact(fi.RemoteAddr)
+	return &cp
+}
+
+// redactFds applies redactFd to each of fds.
+func redactFds(redact func(string) string, fds []*fd) []*fd {
+	if redact == nil {
+		return fds
+	}
+	redacted := make([]*fd, len(fds))
+	for i, fi := range fds {
+		redacted[i] = redactFd(redact, fi)
+	}
+	return redacted
+}
+
+// redactString applies redact, if set, to s for logging.
+func redactString(redact func(string) string, s string) string {
+	if redact == nil {
+		return s
+	}
+	return redact(s)
+}
+
+func newFds(l Logger, inherited map[string]*fd) *Fds {
 	if inherited == nil {
 		inherited = make(map[string]*fd)
 	}
-	return &Fds{
-		fds: inherited,
-		l:   l,
+	f := &Fds{
+		fds:   inherited,
+		clock: clock.RealClock{},
+		l:     l,
 	}
+	for id, fi := range inherited {
+		if fi.quarantine != nil {
+			f.quarantineLocked(fi)
+			delete(inherited, id)
+			continue
+		}
+		f.restoreSocketOptionsLocked(fi)
+	}
+	return f
 }
 
 func (f *Fds) lockMutations(reason error) {
@@ -156,6 +410,14 @@ func (f *Fds) lockMutations(reason error) {
 	defer f.mu.Unlock()
 	f.locked = true
 	f.lockedReason = reason
+	if reason == ErrUpgradeInProgress {
+		if f.upgradeDoneC == nil {
+			f.upgradeDoneC = make(chan struct{})
+			f.upgradeLockedLocked()
+		}
+	} else {
+		f.upgradeDoneLocked()
+	}
 }
 
 func (f *Fds) unlockMutations() {
@@ -163,42 +425,102 @@ func (f *Fds) unlockMutations() {
 	defer f.mu.Unlock()
 	f.locked = false
 	f.lockedReason = nil
+	f.upgradeDoneLocked()
+}
+
+// unlockMutationsIf unlocks mutations only if they were locked for reason.
+func (f *Fds) unlockMutationsIf(reason error) {
+	f.mu.Lock()
+	locked := f.locked && f.lockedReason == reason
+	f.mu.Unlock()
+	if locked {
+		f.unlockMutations()
+	}
+}
+
+func (f *Fds) upgradeDoneLocked() {
+	if f.upgradeDoneC != nil {
+		close(f.upgradeDoneC)
+		f.upgradeDoneC = nil
+		f.upgradeUnlockedLocked()
+	}
+}
+
+// storeLocked stores fi under its id, and wakes anyone waiting for an fd to
+// be stored.
+func (f *Fds) storeLocked(fi *fd) {
+	f.fds[fi.ID] = fi
+	if f.storedC != nil {
+		close(f.storedC)
+		f.storedC = nil
+	}
+}
+
+// conflictLocked returns an *IdExistsError if want's id is already in use by
+// a different resource.
+func (f *Fds) conflictLocked(want *fd) error {
+	if q, ok := f.quarantined[want.ID]; ok {
+		return &QuarantinedError{ID: q.ID, Reasons: q.quarantine}
+	}
+	existing, ok := f.fds[want.ID]
+	if !ok || existing.sameResource(want) {
+		return nil
+	}
+	return newIdExistsError(existing)
 }
 
 // Listen returns a listener inherited from the parent process, or creates a
 // new one. It is expected that the caller will close the returned listener
 // once the Upgrader indicates draining is desired.
 // The arguments are passed to net.Listen, and their meaning is described
-// there.
+// there. On linux, network may also be "sctp", "sctp4" or "sctp6" for a
+// one-to-one style SCTP socket, whose connections are accepted as
+// *net.TCPConns.
 func (f *Fds) Listen(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
-	f.mu.Lock()
+	return f.listen(ctx, id, cfg, network, addr, nil)
+}
+
+func (f *Fds) listen(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string, info *FdInfo) (_ net.Listener, err error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
+	defer f.describeLocked(id, info, &err)
 	if cfg == nil {
 		cfg = &net.ListenConfig{}
 	}
 
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindListener, Network: network, Addr: addr}); err != nil {
+		return nil, err
+	}
 	ln, err := f.listenerLocked(id)
 	if err != nil {
 		return nil, err
 	}
 	if ln != nil {
-		f.l.Debug("found existing listener in store", "network", network, "addr", addr)
+		f.l.Debug("found existing listener in store", "network", network, "addr", redactString(f.redact, addr))
 		return ln, nil
 	}
 
-	if f.locked {
-		return nil, f.lockedReason
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
 	}
 
-	ln, err = cfg.Listen(ctx, network, addr)
+	return f.newListenerLocked(ctx, id, cfg, network, addr)
+}
+
+// newListenerLocked creates a listener and stores it with the given id,
+// overwriting any existing entry.
+func (f *Fds) newListenerLocked(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	ln, err := listenNetwork(ctx, cfg, network, addr)
 	if err != nil {
-		return nil, errors.Wrap(err, "can't create new listener")
+		return nil, fmt.Errorf("can't create new listener: %w", err)
 	}
 
 	fdLn, ok := ln.(Listener)
 	if !ok {
 		ln.Close()
-		return nil, errors.Errorf("%T doesn't implement tableroll.Listener", ln)
+		return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
 	}
 
 	err = f.addListenerLocked(id, network, addr, fdLn)
@@ -218,9 +540,18 @@ func (f *Fds) Listen(ctx context.Context, id string, cfg *net.ListenConfig, netw
 // them. Callers may choose to switch them back to 'true' if appropriate.
 // The listener function is compatible with net.Listen.
 func (f *Fds) ListenWith(id, network, addr string, listenerFunc func(network, addr string) (net.Listener, error)) (net.Listener, error) {
-	f.mu.Lock()
+	return f.listenWithContext(context.Background(), id, network, addr, listenerFunc)
+}
+
+func (f *Fds) listenWithContext(ctx context.Context, id, network, addr string, listenerFunc func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
 
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindListener, Network: network, Addr: addr}); err != nil {
+		return nil, err
+	}
 	ln, err := f.listenerLocked(id)
 	if err != nil {
 		return nil, err
@@ -228,8 +559,8 @@ func (f *Fds) ListenWith(id, network, addr string, listenerFunc func(network, ad
 	if ln != nil {
 		return ln, nil
 	}
-	if f.locked {
-		return nil, f.lockedReason
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
 	}
 
 	ln, err = listenerFunc(network, addr)
@@ -237,7 +568,7 @@ func (f *Fds) ListenWith(id, network, addr string, listenerFunc func(network, ad
 		return nil, err
 	}
 	if _, ok := ln.(Listener); !ok {
-		return nil, errors.Errorf("%T doesn't implement tableroll.Listener", ln)
+		return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
 	}
 	err = f.addListenerLocked(id, network, addr, ln.(Listener))
 	return ln, err
@@ -248,23 +579,122 @@ func (f *Fds) ListenWith(id, network, addr string, listenerFunc func(network, ad
 // It is the caller's responsibility to close the returned listener once
 // connections should be drained.
 func (f *Fds) Listener(id string) (net.Listener, error) {
-	f.mu.Lock()
+	return f.listenerContext(context.Background(), id)
+}
+
+func (f *Fds) listenerContext(ctx context.Context, id string) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
 
 	return f.listenerLocked(id)
 }
 
 func (f *Fds) listenerLocked(id string) (net.Listener, error) {
+	if fi, ok := f.fds[id]; ok && fi.TLS && fi.inherited && !fi.tlsWrapped {
+		return nil, &TLSMismatchError{ID: id}
+	}
+	return f.rawListenerLocked(id)
+}
+
+func (f *Fds) rawListenerLocked(id string) (net.Listener, error) {
 	file, ok := f.fds[id]
 	if !ok || file.file == nil {
 		return nil, nil
 	}
+	if file.Network == vsockNetwork {
+		return newVsockListener(file.file)
+	}
 
 	ln, err := net.FileListener(file.file.File)
 	if err != nil {
-		return nil, errors.Wrapf(err, "can't inherit listener %s", file.file)
+		return nil, fmt.Errorf("can't inherit listener %s: %w", file.file, err)
 	}
-	return ln, nil
+	return file.listenerWithRecordedAddr(ln), nil
+}
+
+// ListenPacket returns a packet conn inherited from the previous owner, or
+// creates a new one. The arguments are passed to net.ListenPacket, and their
+// meaning is described there; for "unixgram" sockets, the socket file is
+// left in place when the packet conn is closed, as it is for listeners.
+// Unlike with a listener, every process holding a packet conn receives
+// packets from the same queue, so once the next owner starts reading from it,
+// packets meant for the previous owner may be delivered to the next owner and
+// vice versa. Protocols with long-lived sessions, such as QUIC, need to route
+// those packets themselves; see docs/quic.md.
+func (f *Fds) ListenPacket(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	return f.listenPacket(ctx, id, cfg, network, addr, nil)
+}
+
+func (f *Fds) listenPacket(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string, info *FdInfo) (_ net.PacketConn, err error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	defer f.describeLocked(id, info, &err)
+	if cfg == nil {
+		cfg = &net.ListenConfig{}
+	}
+
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindPacketConn, Network: network, Addr: addr}); err != nil {
+		return nil, err
+	}
+	conn, err := f.packetConnLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if conn != nil {
+		f.l.Debug("found existing packet conn in store", "network", network, "addr", redactString(f.redact, addr))
+		return conn, nil
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+
+	conn, err = cfg.ListenPacket(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("can't create new packet conn: %w", err)
+	}
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("%T doesn't implement syscall.Conn", conn)
+	}
+	if err := f.addConnLocked(id, fdKindPacketConn, network, addr, sysConn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// PacketConn returns an inherited packet conn with the given ID, or nil.
+//
+// It is the caller's responsibility to close the returned conn once it should
+// no longer be read from.
+func (f *Fds) PacketConn(id string) (net.PacketConn, error) {
+	return f.packetConnContext(context.Background(), id)
+}
+
+func (f *Fds) packetConnContext(ctx context.Context, id string) (net.PacketConn, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	return f.packetConnLocked(id)
+}
+
+func (f *Fds) packetConnLocked(id string) (net.PacketConn, error) {
+	file, ok := f.fds[id]
+	if !ok || file.file == nil {
+		return nil, nil
+	}
+
+	conn, err := net.FilePacketConn(file.file.File)
+	if err != nil {
+		return nil, fmt.Errorf("can't inherit packet conn %s: %w", file.file, err)
+	}
+	return file.packetConnWithRecordedAddr(conn), nil
 }
 
 type unlinkOnCloser interface {
@@ -284,9 +714,18 @@ func (f *Fds) addListenerLocked(id, addr, network string, ln Listener) error {
 // returned. Otherwise, the provided function will be called and the resulting
 // connection stored with that id and returned.
 func (f *Fds) DialWith(id, network, address string, dialFn func(network, address string) (net.Conn, error)) (net.Conn, error) {
-	f.mu.Lock()
+	return f.dialWithContext(context.Background(), id, network, address, dialFn)
+}
+
+func (f *Fds) dialWithContext(ctx context.Context, id, network, address string, dialFn func(network, address string) (net.Conn, error)) (net.Conn, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
 
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindConn, Network: network, Addr: address}); err != nil {
+		return nil, err
+	}
 	conn, err := f.connLocked(id)
 	if err != nil {
 		return conn, err
@@ -294,8 +733,8 @@ func (f *Fds) DialWith(id, network, address string, dialFn func(network, address
 	if conn != nil {
 		return conn, nil
 	}
-	if f.locked {
-		return nil, f.lockedReason
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
 	}
 
 	newConn, err := dialFn(network, address)
@@ -305,7 +744,7 @@ func (f *Fds) DialWith(id, network, address string, dialFn func(network, address
 	fdConn, ok := newConn.(Conn)
 	if !ok {
 		newConn.Close()
-		return nil, errors.Errorf("%T doesn't implement tableroll.Conn", newConn)
+		return nil, fmt.Errorf("%T doesn't implement tableroll.Conn", newConn)
 	}
 
 	if err := f.addConnLocked(id, fdKindConn, network, address, fdConn); err != nil {
@@ -321,7 +760,13 @@ func (f *Fds) DialWith(id, network, address string, dialFn func(network, address
 // appropriate time, typically when the Upgrader indicates draining and exiting
 // is expected.
 func (f *Fds) Conn(id string) (net.Conn, error) {
-	f.mu.Lock()
+	return f.connContext(context.Background(), id)
+}
+
+func (f *Fds) connContext(ctx context.Context, id string) (net.Conn, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
 	return f.connLocked(id)
 }
@@ -334,42 +779,74 @@ func (f *Fds) connLocked(id string) (net.Conn, error) {
 
 	conn, err := net.FileConn(file.file.File)
 	if err != nil {
-		return nil, errors.Wrapf(err, "can't inherit connection %s", file.file)
+		return nil, fmt.Errorf("can't inherit connection %s: %w", file.file, err)
 	}
-	return conn, nil
+	return file.connWithRecordedAddrs(conn), nil
 }
 
 func (f *Fds) addConnLocked(id string, kind fdKind, network, addr string, conn syscall.Conn) error {
+	fdObj, err := f.dupConnFd(id, kind, network, addr, conn)
+	if err != nil {
+		return err
+	}
+	f.storeLocked(fdObj)
+	return nil
+}
+
+// dupConnFd returns an fd holding a duplicate of conn, ready to be stored.
+func (f *Fds) dupConnFd(id string, kind fdKind, network, addr string, conn syscall.Conn) (*fd, error) {
 	fdObj := &fd{
-		Kind:    kind,
-		ID:      id,
-		Network: network,
-		Addr:    addr,
+		Kind:       kind,
+		ID:         id,
+		Network:    network,
+		Addr:       addr,
+		Generation: f.generation,
 	}
 	file, err := dupConn(conn, fdObj.String())
 	if err != nil {
-		return errors.Wrapf(err, "can't dup listener %s %s", network, addr)
+		return nil, fmt.Errorf("can't dup listener %s %s: %w", network, addr, err)
 	}
 	fdObj.file = file
-	f.fds[id] = fdObj
-	return nil
+	fdObj.SocketOptions = readSocketOptions(file.fd)
+	fdObj.recordAddrs(conn)
+	return fdObj, nil
 }
 
 // OpenFileWith retrieves the given file from the store, and if it's not present opens and adds it.
 // The required openFunc is compatible with `os.Open`.
 func (f *Fds) OpenFileWith(id string, name string, openFunc func(name string) (*os.File, error)) (*os.File, error) {
-	f.mu.Lock()
+	return f.openFileWithContext(context.Background(), id, name, openFunc, nil, nil)
+}
+
+// openFileWithContext does the work of OpenFileWith. If verifyInherited is
+// set, it's called with an inherited file before it's returned, and the file
+// is closed if it returns an error. If info is set, it's filled in on
+// success.
+func (f *Fds) openFileWithContext(ctx context.Context, id string, name string, openFunc func(name string) (*os.File, error), verifyInherited func(fi *os.File) error, info *FdInfo) (_ *os.File, err error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
+	defer f.describeLocked(id, info, &err)
 
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindFile, Name: name}); err != nil {
+		return nil, err
+	}
 	fi, err := f.fileLocked(id)
 	if err != nil {
 		return nil, err
 	}
 	if fi != nil {
+		if verifyInherited != nil && f.fds[id].inherited {
+			if err := verifyInherited(fi); err != nil {
+				fi.Close()
+				return nil, err
+			}
+		}
 		return fi, nil
 	}
-	if f.locked {
-		return nil, f.lockedReason
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
 	}
 
 	newFi, err := openFunc(name)
@@ -384,48 +861,333 @@ func (f *Fds) OpenFileWith(id string, name string, openFunc func(name string) (*
 	}
 
 	newFd := &fd{
-		ID:   id,
-		Name: name,
-		Kind: fdKindFile,
-		file: dup,
+		ID:         id,
+		Name:       name,
+		Kind:       fdKindFile,
+		Generation: f.generation,
+		file:       dup,
 	}
-	f.fds[id] = newFd
+	f.storeLocked(newFd)
 
 	return newFi, nil
 }
 
 // File returns an inherited file or nil.
 //
-// The descriptor may be in blocking mode.
+// The descriptor may be in blocking mode. An inherited file shares its offset
+// with the previous owner's; see FileAt.
 func (f *Fds) File(id string) (*os.File, error) {
-	f.mu.Lock()
+	return f.fileContext(context.Background(), id)
+}
+
+func (f *Fds) fileContext(ctx context.Context, id string) (*os.File, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
 	defer f.mu.Unlock()
 	return f.fileLocked(id)
 }
 
+// WasInherited returns whether the fd with the given id was passed to us by
+// a previous owner. It returns false if this process created the fd, or if
+// there is no fd with that id.
+func (f *Fds) WasInherited(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.fds[id]
+	return ok && fi.inherited
+}
+
 // Remove removes the given file descriptor from the fds store.
 func (f *Fds) Remove(id string) error {
-	f.mu.Lock()
+	return f.removeContext(context.Background(), id)
+}
+
+func (f *Fds) removeContext(ctx context.Context, id string) error {
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
 	defer f.mu.Unlock()
 
 	// It's unsafe to close a file descriptor during an upgrade, but it's safe to
 	// close it after an upgrade is complete, and it's necessary to do so to
 	// avoid leaking fds.
 	if f.locked && f.lockedReason == ErrUpgradeInProgress {
-		return f.lockedReason
+		return f.rejectMutationLocked()
+	}
+	if err := f.groupLockedLocked(id); err != nil {
+		return err
 	}
 
 	item, ok := f.fds[id]
 	if !ok {
-		return errors.Errorf("no element in map with id %v", id)
+		return fmt.Errorf("no element in map with id %v", id)
 	}
 	delete(f.fds, id)
+	delete(f.onTransfer, id)
 	if item.file != nil {
 		return item.file.Close()
 	}
 	return nil
 }
 
+// AddExclusive adds a file which only one process may use at a time, such as
+// a single-writer log or a file holding an flock.
+// Unlike other fds, exclusive fds are not passed to the next owner as part of
+// an upgrade. Instead, they are passed once this process calls
+// Upgrader.NotifyDrainComplete, after which this process must no longer use
+// them. The next owner may retrieve them with File once its Upgrader's
+// PredecessorDrained channel is closed. If this process exits without
+// calling NotifyDrainComplete, its exclusive fds are not passed on.
+// As with OpenFileWith, the caller remains responsible for closing the passed
+// in file.
+func (f *Fds) AddExclusive(id string, fi *os.File) error {
+	return f.addExclusiveContext(context.Background(), id, fi)
+}
+
+func (f *Fds) addExclusiveContext(ctx context.Context, id string, fi *os.File) error {
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	want := &fd{ID: id, Kind: fdKindFile, Name: fi.Name(), Exclusive: true}
+	if existing, ok := f.fds[id]; ok {
+		return newIdExistsError(existing)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return err
+	}
+	dup, err := dupFile(fi, id)
+	if err != nil {
+		return err
+	}
+	want.Generation = f.generation
+	want.file = dup
+	f.storeLocked(want)
+	return nil
+}
+
+// closeInherited closes and removes all inherited fds, including quarantined
+// ones and those DeclareListeners removed.
+func (f *Fds) closeInherited() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.discardQuarantinedLocked()
+	for _, fi := range f.retiring {
+		if fi.file != nil {
+			fi.file.Close()
+		}
+	}
+	f.retiring = nil
+	for id, fi := range f.fds {
+		if !fi.inherited {
+			continue
+		}
+		if fi.file != nil {
+			fi.file.Close()
+		}
+		delete(f.fds, id)
+	}
+}
+
+// takeExclusive removes all exclusive fds from the store and returns them,
+// so that they may be passed on. The caller is responsible for closing them.
+func (f *Fds) takeExclusive() []*fd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var exclusive []*fd
+	for _, fi := range f.sortedLocked() {
+		if fi.Exclusive {
+			exclusive = append(exclusive, fi)
+			delete(f.fds, fi.ID)
+		}
+	}
+	return exclusive
+}
+
+// addExclusive adds exclusive fds received from our predecessor. Any which
+// have been created in the meantime take precedence.
+func (f *Fds) addExclusive(fds []*fd) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fi := range fds {
+		if existing, ok := f.fds[fi.ID]; ok {
+			f.l.Warn("ignoring exclusive fd from the previous owner, it was already added", "fd", f.redacted(existing))
+			if fi.file != nil {
+				fi.file.Close()
+			}
+			continue
+		}
+		if fi.quarantine != nil {
+			f.quarantineLocked(fi)
+			continue
+		}
+		f.restoreSocketOptionsLocked(fi)
+		f.storeLocked(fi)
+	}
+}
+
+// UpsertListen is like Listen, except that if the given id is in use for a
+// different network or address, a new listener is created and atomically
+// replaces it, rather than an *IdExistsError being returned. The replaced fd
+// is closed as with Relisten.
+func (f *Fds) UpsertListen(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	if cfg == nil {
+		cfg = &net.ListenConfig{}
+	}
+
+	existing, ok := f.fds[id]
+	if ok && existing.sameResource(&fd{ID: id, Kind: fdKindListener, Network: network, Addr: addr}) {
+		return f.listenerLocked(id)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+	ln, err := f.newListenerLocked(ctx, id, cfg, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		f.closeReplacedLocked(existing)
+	}
+	return ln, nil
+}
+
+// UpsertFileWith is like OpenFileWith, except that if a file with the given
+// id exists with a different name, the file is opened and atomically replaces
+// it, rather than an *IdExistsError being returned. The replaced fd is closed
+// as with Replace.
+func (f *Fds) UpsertFileWith(id string, name string, openFunc func(name string) (*os.File, error)) (*os.File, error) {
+	return f.upsertFileWithContext(context.Background(), id, name, openFunc)
+}
+
+func (f *Fds) upsertFileWithContext(ctx context.Context, id string, name string, openFunc func(name string) (*os.File, error)) (*os.File, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	want := &fd{ID: id, Kind: fdKindFile, Name: name}
+	existing, ok := f.fds[id]
+	if ok && existing.sameResource(want) {
+		return f.fileLocked(id)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+
+	newFi, err := openFunc(name)
+	if err != nil {
+		return newFi, err
+	}
+	dup, err := dupFile(newFi, id)
+	if err != nil {
+		newFi.Close()
+		return nil, err
+	}
+	want.Generation = f.generation
+	want.file = dup
+	if ok {
+		want.Exclusive = existing.Exclusive
+	}
+	f.storeLocked(want)
+	if ok {
+		f.closeReplacedLocked(existing)
+	}
+	return newFi, nil
+}
+
+// Replace atomically replaces the fd stored with the given id with a
+// duplicate of the given file, and then closes the previously stored fd. A
+// file with the given id must already exist; use Relisten for listeners.
+// This allows an owner to apply a configuration change, such as a new path,
+// without a window in which the id is missing. As with OpenFileWith, the
+// caller remains responsible for closing the passed in file.
+func (f *Fds) Replace(id string, fi *os.File) error {
+	return f.replaceContext(context.Background(), id, fi)
+}
+
+func (f *Fds) replaceContext(ctx context.Context, id string, fi *os.File) error {
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	if err := f.checkMutationLocked(id); err != nil {
+		return err
+	}
+	old, ok := f.fds[id]
+	if !ok {
+		return fmt.Errorf("no element in map with id %v", id)
+	}
+	if old.Kind != fdKindFile {
+		return fmt.Errorf("can't replace %s with id %v with a file", old.Kind, id)
+	}
+
+	dup, err := dupFile(fi, id)
+	if err != nil {
+		return err
+	}
+	// an exclusive fd's replacement must still be held back until we've
+	// drained
+	f.storeLocked(&fd{
+		ID:         id,
+		Name:       fi.Name(),
+		Kind:       fdKindFile,
+		Generation: f.generation,
+		Exclusive:  old.Exclusive,
+		file:       dup,
+	})
+	f.closeReplacedLocked(old)
+	return nil
+}
+
+// Relisten atomically replaces the listener stored with the given id with a
+// new one, and then closes the previously stored fd. A listener with the
+// given id must already exist. The arguments are passed to net.Listen, as
+// with Listen.
+// Only the copy held by Fds is closed; the caller remains responsible for
+// closing any listener previously returned for this id, typically once it
+// has started serving on the new one.
+func (f *Fds) Relisten(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	if cfg == nil {
+		cfg = &net.ListenConfig{}
+	}
+
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+	old, ok := f.fds[id]
+	if !ok || old.Kind != fdKindListener {
+		return nil, fmt.Errorf("no listener in map with id %v", id)
+	}
+
+	ln, err := f.newListenerLocked(ctx, id, cfg, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	f.closeReplacedLocked(old)
+	return ln, nil
+}
+
+func (f *Fds) closeReplacedLocked(old *fd) {
+	if old.file == nil {
+		return
+	}
+	if err := old.file.Close(); err != nil {
+		f.l.Warn("error closing replaced fd", "fd", f.redacted(old), "err", err)
+	}
+}
+
 func (f *Fds) fileLocked(id string) (*os.File, error) {
 	file, ok := f.fds[id]
 	if !ok || file.file == nil {
@@ -480,16 +1242,24 @@ func dupConn(conn syscall.Conn, name string) (*file, error) {
 		dup, duperr = dupFd(fd, name)
 	})
 	if err != nil {
-		return nil, errors.Wrap(err, "can't access fd")
+		return nil, fmt.Errorf("can't access fd: %w", err)
 	}
 	return dup, duperr
 }
 
 func dupFd(fd uintptr, name string) (*file, error) {
-	dupfd, _, errno := unix.Syscall(unix.SYS_FCNTL, fd, unix.F_DUPFD_CLOEXEC, 0)
-	if errno != 0 {
-		return nil, errors.Wrap(errno, "can't dup fd using fcntl")
+	dupfd, err := fcntlInt(fd, syscall.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can't dup fd using fcntl: %w", err)
 	}
 
-	return newFile(dupfd, name), nil
+	return newFile(uintptr(dupfd), name), nil
+}
+
+func fcntlInt(fd uintptr, cmd, arg int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, uintptr(cmd), uintptr(arg))
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
 }
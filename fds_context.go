@@ -0,0 +1,246 @@
+package tableroll
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// The Context variants of Fds methods wait for an upgrade in progress to
+// finish, rather than returning ErrUpgradeInProgress. They then behave as the
+// plain method would: if the upgrade succeeded, a mutation returns
+// ErrUpgradeCompleted, and if it failed, the process is still the owner and
+// the mutation goes ahead. If ctx is done first, they return an error which
+// wraps the context's error.
+//
+// Waiting for the store's lock is cancellable too, so a shutdown path using
+// them can't wedge behind a slow listen, open, or dial holding it, or behind a
+// stuck transfer. Methods which already take a ctx, such as Listen, also give
+// up waiting for the lock once it's done.
+
+// OpenFileWithContext is like OpenFileWith, but waits for any upgrade in
+// progress to finish.
+func (f *Fds) OpenFileWithContext(ctx context.Context, id string, name string, openFunc func(name string) (*os.File, error)) (*os.File, error) {
+	var fi *os.File
+	err := f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		fi, err = f.openFileWithContext(ctx, id, name, openFunc, nil, nil)
+		return err
+	})
+	return fi, err
+}
+
+// ListenWithContext is like ListenWith, but waits for any upgrade in progress
+// to finish.
+func (f *Fds) ListenWithContext(ctx context.Context, id, network, addr string, listenerFunc func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	var ln net.Listener
+	err := f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		ln, err = f.listenWithContext(ctx, id, network, addr, listenerFunc)
+		return err
+	})
+	return ln, err
+}
+
+// DialWithContext is like DialWith, but waits for any upgrade in progress to
+// finish.
+func (f *Fds) DialWithContext(ctx context.Context, id, network, address string, dialFn func(network, address string) (net.Conn, error)) (net.Conn, error) {
+	var conn net.Conn
+	err := f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		conn, err = f.dialWithContext(ctx, id, network, address, dialFn)
+		return err
+	})
+	return conn, err
+}
+
+// RemoveWithContext is like Remove, but waits for any upgrade in progress to
+// finish.
+func (f *Fds) RemoveWithContext(ctx context.Context, id string) error {
+	return f.retryDuringUpgrade(ctx, func() error {
+		return f.removeContext(ctx, id)
+	})
+}
+
+// ListenerWithContext is like Listener, but gives up waiting for the fds
+// lock once ctx is done.
+func (f *Fds) ListenerWithContext(ctx context.Context, id string) (net.Listener, error) {
+	return f.listenerContext(ctx, id)
+}
+
+// PacketConnWithContext is like PacketConn, but gives up waiting for the fds
+// lock once ctx is done.
+func (f *Fds) PacketConnWithContext(ctx context.Context, id string) (net.PacketConn, error) {
+	return f.packetConnContext(ctx, id)
+}
+
+// ConnWithContext is like Conn, but gives up waiting for the fds lock once
+// ctx is done.
+func (f *Fds) ConnWithContext(ctx context.Context, id string) (net.Conn, error) {
+	return f.connContext(ctx, id)
+}
+
+// FileWithContext is like File, but gives up waiting for the fds lock once
+// ctx is done.
+func (f *Fds) FileWithContext(ctx context.Context, id string) (*os.File, error) {
+	return f.fileContext(ctx, id)
+}
+
+// TLSListenerWithContext is like TLSListener, but gives up waiting for the fds
+// lock once ctx is done.
+func (f *Fds) TLSListenerWithContext(ctx context.Context, id string, config *tls.Config) (net.Listener, error) {
+	return f.tlsListenerContext(ctx, id, config)
+}
+
+// SessionTicketKeysWithContext is like SessionTicketKeys, but gives up
+// waiting for the fds lock once ctx is done.
+func (f *Fds) SessionTicketKeysWithContext(ctx context.Context, id string) ([][32]byte, error) {
+	return f.sessionTicketKeysContext(ctx, id)
+}
+
+// AddExclusiveWithContext is like AddExclusive, but waits for any upgrade in
+// progress to finish.
+func (f *Fds) AddExclusiveWithContext(ctx context.Context, id string, fi *os.File) error {
+	return f.retryDuringUpgrade(ctx, func() error {
+		return f.addExclusiveContext(ctx, id, fi)
+	})
+}
+
+// UpsertFileWithContext is like UpsertFileWith, but waits for any upgrade in
+// progress to finish.
+func (f *Fds) UpsertFileWithContext(ctx context.Context, id string, name string, openFunc func(name string) (*os.File, error)) (*os.File, error) {
+	var fi *os.File
+	err := f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		fi, err = f.upsertFileWithContext(ctx, id, name, openFunc)
+		return err
+	})
+	return fi, err
+}
+
+// ReplaceWithContext is like Replace, but waits for any upgrade in progress to
+// finish.
+func (f *Fds) ReplaceWithContext(ctx context.Context, id string, fi *os.File) error {
+	return f.retryDuringUpgrade(ctx, func() error {
+		return f.replaceContext(ctx, id, fi)
+	})
+}
+
+// PipeWithContext is like Pipe, but waits for any upgrade in progress to
+// finish.
+func (f *Fds) PipeWithContext(ctx context.Context, id string) (r, w *os.File, err error) {
+	err = f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		r, w, err = f.pipe(ctx, id, PipeReadEnd, PipeWriteEnd)
+		return err
+	})
+	return r, w, err
+}
+
+// PipeOneEndWithContext is like PipeOneEnd, but waits for any upgrade in
+// progress to finish.
+func (f *Fds) PipeOneEndWithContext(ctx context.Context, id string, keep PipeEnd) (r, w *os.File, err error) {
+	err = f.retryDuringUpgrade(ctx, func() error {
+		var err error
+		r, w, err = f.pipe(ctx, id, keep)
+		return err
+	})
+	return r, w, err
+}
+
+// SetSocketOptionsWithContext is like SetSocketOptions, but waits for any
+// upgrade in progress to finish.
+func (f *Fds) SetSocketOptionsWithContext(ctx context.Context, id string, opts SocketOptions) error {
+	return f.retryDuringUpgrade(ctx, func() error {
+		return f.setSocketOptionsContext(ctx, id, opts)
+	})
+}
+
+// SetSessionTicketKeysWithContext is like SetSessionTicketKeys, but waits for
+// any upgrade in progress to finish.
+func (f *Fds) SetSessionTicketKeysWithContext(ctx context.Context, id string, keys [][32]byte) error {
+	return f.retryDuringUpgrade(ctx, func() error {
+		return f.setSessionTicketKeysContext(ctx, id, keys)
+	})
+}
+
+// retryDuringUpgrade calls fn, and while it fails with ErrUpgradeInProgress,
+// waits for the upgrade to finish and calls it again.
+func (f *Fds) retryDuringUpgrade(ctx context.Context, fn func() error) error {
+	for {
+		err := fn()
+		if err != ErrUpgradeInProgress {
+			return err
+		}
+		if err := f.lockContext(ctx); err != nil {
+			return err
+		}
+		doneC := f.upgradeDoneC
+		f.mu.Unlock()
+		if doneC == nil {
+			// the upgrade finished since fn returned
+			continue
+		}
+		select {
+		case <-doneC:
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the upgrade in progress to finish: %w", ctx.Err())
+		}
+	}
+}
+
+// lockContext acquires the fds lock, unless ctx is done first.
+func (f *Fds) lockContext(ctx context.Context) error {
+	if err := f.mu.LockContext(ctx); err != nil {
+		return fmt.Errorf("gave up waiting for the fds lock: %w", err)
+	}
+	return nil
+}
+
+// ctxMutex is a mutex whose Lock may be abandoned once a context is done. Its
+// zero value is an unlocked mutex.
+type ctxMutex struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func (m *ctxMutex) init() {
+	m.once.Do(func() {
+		m.c = make(chan struct{}, 1)
+	})
+}
+
+// Lock locks m, waiting as long as necessary.
+func (m *ctxMutex) Lock() {
+	m.init()
+	m.c <- struct{}{}
+}
+
+// LockContext locks m, or returns ctx's error if it's done first.
+func (m *ctxMutex) LockContext(ctx context.Context) error {
+	m.init()
+	select {
+	case m.c <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case m.c <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks m. It panics if m isn't locked.
+func (m *ctxMutex) Unlock() {
+	m.init()
+	select {
+	case <-m.c:
+	default:
+		panic("tableroll: unlock of unlocked ctxMutex")
+	}
+}
@@ -0,0 +1,122 @@
+package tableroll
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// Applications which create fds dynamically, e.g. a listener per tenant, can
+// give them ids sharing a prefix, such as "tenant/", and fetch them all after
+// inheriting them without knowing the exact ids in advance.
+
+// ListPrefix returns the ids of all fds whose id starts with prefix, sorted.
+func (f *Fds) ListPrefix(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.idsWithPrefixLocked(prefix, "")
+}
+
+// idsWithPrefixLocked returns the sorted ids starting with prefix of fds of
+// the given kind, or of any kind if it's empty.
+func (f *Fds) idsWithPrefixLocked(prefix string, kind fdKind) []string {
+	var ids []string
+	for _, fi := range f.sortedLocked() {
+		if !strings.HasPrefix(fi.ID, prefix) {
+			continue
+		}
+		if kind != "" && fi.Kind != kind {
+			continue
+		}
+		ids = append(ids, fi.ID)
+	}
+	return ids
+}
+
+// ListenersWithPrefix is like Listener for each listener whose id starts with
+// prefix, returning them by id; ListPrefix gives their order. Fds of other
+// kinds are skipped. If any
+// listener can't be returned, those already created are closed and the error
+// is returned.
+func (f *Fds) ListenersWithPrefix(prefix string) (map[string]net.Listener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lns := make(map[string]net.Listener)
+	for _, id := range f.idsWithPrefixLocked(prefix, fdKindListener) {
+		ln, err := f.listenerLocked(id)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		if ln != nil {
+			lns[id] = ln
+		}
+	}
+	return lns, nil
+}
+
+// PacketConnsWithPrefix is like PacketConn for each packet conn whose id
+// starts with prefix, returning them by id, as ListenersWithPrefix does for
+// listeners.
+func (f *Fds) PacketConnsWithPrefix(prefix string) (map[string]net.PacketConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conns := make(map[string]net.PacketConn)
+	for _, id := range f.idsWithPrefixLocked(prefix, fdKindPacketConn) {
+		conn, err := f.packetConnLocked(id)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		if conn != nil {
+			conns[id] = conn
+		}
+	}
+	return conns, nil
+}
+
+// ConnsWithPrefix is like Conn for each connection whose id starts with
+// prefix, returning them by id, as ListenersWithPrefix does for listeners.
+func (f *Fds) ConnsWithPrefix(prefix string) (map[string]net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	conns := make(map[string]net.Conn)
+	for _, id := range f.idsWithPrefixLocked(prefix, fdKindConn) {
+		conn, err := f.connLocked(id)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		if conn != nil {
+			conns[id] = conn
+		}
+	}
+	return conns, nil
+}
+
+// FilesWithPrefix is like File for each file whose id starts with prefix,
+// returning them by id, as ListenersWithPrefix does for listeners.
+func (f *Fds) FilesWithPrefix(prefix string) (map[string]*os.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files := make(map[string]*os.File)
+	for _, id := range f.idsWithPrefixLocked(prefix, fdKindFile) {
+		file, err := f.fileLocked(id)
+		if err != nil {
+			for _, c := range files {
+				c.Close()
+			}
+			return nil, err
+		}
+		if file != nil {
+			files[id] = file
+		}
+	}
+	return files, nil
+}
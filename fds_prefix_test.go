@@ -0,0 +1,69 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFdsWithPrefix(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := tmpDir()
+	defer cleanup()
+
+	parent := newFds(l, nil)
+	for _, id := range []string{"tenant/a", "tenant/b", "other"} {
+		ln, err := parent.Listen(ctx, id, nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+	}
+	fi, err := parent.OpenFileWith("tenant/log", filepath.Join(dir, "log"), func(name string) (*os.File, error) {
+		return os.Create(name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi.Close()
+
+	if got, want := parent.ListPrefix("tenant/"), []string{"tenant/a", "tenant/b", "tenant/log"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected ids %v, got %v", want, got)
+	}
+	if got := parent.ListPrefix("missing/"); len(got) != 0 {
+		t.Fatalf("expected no ids, got %v", got)
+	}
+
+	lns, err := parent.ListenersWithPrefix("tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 2 || lns["tenant/a"] == nil || lns["tenant/b"] == nil {
+		t.Fatalf("expected the tenant listeners, got %v", lns)
+	}
+	for _, ln := range lns {
+		ln.Close()
+	}
+
+	files, err := parent.FilesWithPrefix("tenant/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["tenant/log"] == nil {
+		t.Fatalf("expected the tenant log, got %v", files)
+	}
+	if _, err := files["tenant/log"].WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+	files["tenant/log"].Close()
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "log")); err != nil || string(b) != "hello" {
+		t.Fatalf("expected to write through the returned file, got %q, %v", b, err)
+	}
+
+	if conns, err := parent.ConnsWithPrefix("tenant/"); err != nil || len(conns) != 0 {
+		t.Fatalf("expected no conns, got %v, %v", conns, err)
+	}
+}
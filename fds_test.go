@@ -2,11 +2,19 @@ package tableroll
 
 import (
 	"context"
+	"errors"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
 )
 
 func TestFdsListen(t *testing.T) {
@@ -18,8 +26,8 @@ func TestFdsListen(t *testing.T) {
 
 	fds := newFds(l, nil)
 
-	for _, addr := range addrs {
-		ln, err := fds.Listen(ctx, "1", nil, addr[0], addr[1])
+	for i, addr := range addrs {
+		ln, err := fds.Listen(ctx, strconv.Itoa(i), nil, addr[0], addr[1])
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -181,3 +189,556 @@ func TestFdsLock(t *testing.T) {
 		t.Fatalf("expected ErrUpgradeInProgress, got %T %q", err, err)
 	}
 }
+
+func TestFdsWaitForUpgrade(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	fds.lockMutations(ErrUpgradeInProgress)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := fds.OpenFileWithContext(timeoutCtx, "null", os.DevNull, os.Open); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	// a failed upgrade lets waiting callers go ahead
+	errC := make(chan error, 1)
+	go func() {
+		f, err := fds.OpenFileWithContext(ctx, "null", os.DevNull, os.Open)
+		if err == nil {
+			f.Close()
+		}
+		errC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fds.unlockMutations()
+	if err := <-errC; err != nil {
+		t.Fatalf("expected to open the file once the upgrade failed, got %v", err)
+	}
+
+	// a successful upgrade is reported as such
+	fds.lockMutations(ErrUpgradeInProgress)
+	go func() {
+		_, err := fds.OpenFileWithContext(ctx, "other", os.DevNull, os.Open)
+		errC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	fds.lockMutations(ErrUpgradeCompleted)
+	if err := <-errC; err != ErrUpgradeCompleted {
+		t.Fatalf("expected ErrUpgradeCompleted, got %v", err)
+	}
+}
+
+func TestFdsLockContext(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	// a listen which never returns holds the lock
+	listening := make(chan struct{})
+	release := make(chan struct{})
+	go fds.ListenWith("stuck", "tcp", "127.0.0.1:0", func(network, addr string) (net.Listener, error) {
+		close(listening)
+		<-release
+		return nil, errors.New("released")
+	})
+	<-listening
+
+	expectDeadline := func(name string, err error) {
+		t.Helper()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: expected a deadline error, got %v", name, err)
+		}
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := fds.FileWithContext(timeoutCtx, "f")
+	expectDeadline("FileWithContext", err)
+	expectDeadline("RemoveWithContext", fds.RemoveWithContext(timeoutCtx, "f"))
+	_, err = fds.UpsertFileWithContext(timeoutCtx, "f", os.DevNull, os.Open)
+	expectDeadline("UpsertFileWithContext", err)
+	_, err = fds.Listen(timeoutCtx, "ln", nil, "tcp", "127.0.0.1:0")
+	expectDeadline("Listen", err)
+
+	close(release)
+	f, err := fds.OpenFileWithContext(ctx, "f", os.DevNull, os.Open)
+	if err != nil {
+		t.Fatalf("expected to open the file once the lock was released, got %v", err)
+	}
+	f.Close()
+	if err := fds.RemoveWithContext(ctx, "f"); err != nil {
+		t.Fatalf("can't remove the file: %v", err)
+	}
+}
+
+func TestFdsWait(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := fds.WaitListener(timeoutCtx, "ln"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	lnC := make(chan net.Listener, 1)
+	errC := make(chan error, 1)
+	go func() {
+		ln, err := fds.WaitListener(ctx, "ln")
+		lnC <- ln
+		errC <- err
+	}()
+	fileC := make(chan *os.File, 1)
+	go func() {
+		f, err := fds.WaitFile(ctx, "null")
+		fileC <- f
+		errC <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	// the listener waiter keeps waiting when a different fd is stored
+	null, err := fds.OpenFileWith("null", os.DevNull, os.Open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	null.Close()
+	f := <-fileC
+	if err := <-errC; err != nil || f == nil {
+		t.Fatalf("expected to wait for the file, got %v", err)
+	}
+	f.Close()
+
+	ln, err := fds.ListenWith("ln", "tcp", "127.0.0.1:0", net.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	waited := <-lnC
+	if err := <-errC; err != nil || waited == nil {
+		t.Fatalf("expected to wait for the listener, got %v", err)
+	}
+	defer waited.Close()
+	if waited.Addr().String() != ln.Addr().String() {
+		t.Fatalf("expected the same listener, got %v and %v", waited.Addr(), ln.Addr())
+	}
+}
+
+func TestFdsDump(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	parent := newFds(l, nil)
+	parent.generation = 3
+	if _, err := parent.OpenFileWith("secret-file", "/var/lib/secret", func(_ string) (*os.File, error) {
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer parent.Remove("secret-file")
+
+	child := newFds(l, parent.copy())
+	child.generation = 4
+	ln, err := child.ListenWith("web", "tcp", "127.0.0.1:0", net.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	child.fds["secret-file"].inherited = true
+	child.redact = func(s string) string {
+		return strings.Replace(s, "secret", "xxx", -1)
+	}
+
+	dump := child.Dump()
+	if strings.Contains(dump, "secret") {
+		t.Errorf("expected dump to be redacted: %s", dump)
+	}
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a header and 2 fds, got:\n%s", dump)
+	}
+	for i, fields := range [][]string{
+		{"xxx-file", "file", "/var/lib/xxx", "inherited", "3"},
+		{"web", "listener", "tcp:127.0.0.1:0", "created", "4"},
+	} {
+		if got := strings.Fields(lines[i+1]); strings.Join(got, " ") != strings.Join(fields, " ") {
+			t.Errorf("expected line %d to be %v, got %v", i+1, fields, got)
+		}
+	}
+	if str := child.String(); strings.Contains(str, "secret") {
+		t.Errorf("expected String to be redacted: %s", str)
+	}
+}
+
+func TestFdsReplace(t *testing.T) {
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	defer w1.Close()
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+	defer w2.Close()
+
+	fds := newFds(l, nil)
+	if err := fds.Replace("test", w1); err == nil {
+		t.Fatal("expected an error replacing a missing id")
+	}
+	if _, err := fds.OpenFileWith("test", "test", func(_ string) (*os.File, error) {
+		return w1, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fds.Replace("test", w2); err != nil {
+		t.Fatalf("error replacing file: %v", err)
+	}
+	defer fds.Remove("test")
+
+	file, err := fds.File("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := r2.Read(buf); err != nil || string(buf) != "x" {
+		t.Fatalf("expected to read from the replacement pipe, got %q, %v", buf, err)
+	}
+
+	ln, err := fds.Listen(context.Background(), "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	defer fds.Remove("ln")
+	if err := fds.Replace("ln", w2); err == nil {
+		t.Fatal("expected an error replacing a listener with a file")
+	}
+	inherited, err := fds.Listener("ln")
+	if err != nil || inherited == nil {
+		t.Fatalf("expected the listener to be untouched, got %v, %v", inherited, err)
+	}
+	inherited.Close()
+}
+
+func TestFdsReplaceExclusive(t *testing.T) {
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	open := func(name string) *os.File {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	fds := newFds(l, nil)
+	for _, id := range []string{"wal", "log"} {
+		f := open(id)
+		defer f.Close()
+		if err := fds.AddExclusive(id, f); err != nil {
+			t.Fatalf("error adding exclusive fd: %v", err)
+		}
+	}
+	f := open("wal2")
+	defer f.Close()
+	if err := fds.Replace("wal", f); err != nil {
+		t.Fatalf("error replacing exclusive fd: %v", err)
+	}
+	upserted, err := fds.UpsertFileWith("log", filepath.Join(dir, "log2"), os.Create)
+	if err != nil {
+		t.Fatalf("error upserting exclusive fd: %v", err)
+	}
+	upserted.Close()
+
+	var ids []string
+	for _, fi := range fds.takeExclusive() {
+		ids = append(ids, fi.ID)
+		fi.file.Close()
+	}
+	if want := []string{"log", "wal"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("expected replaced exclusive fds to still be held back, got %v", ids)
+	}
+}
+
+func TestFdsRelisten(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	ln1, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	ln2, err := fds.Relisten(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error relistening: %v", err)
+	}
+	defer ln2.Close()
+
+	stored, err := fds.Listener("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+	if stored.Addr().String() != ln2.Addr().String() {
+		t.Fatalf("expected stored listener to be %v, got %v", ln2.Addr(), stored.Addr())
+	}
+
+	fds.lockMutations(ErrUpgradeInProgress)
+	if _, err := fds.Relisten(ctx, "web", nil, "tcp", "127.0.0.1:0"); err != ErrUpgradeInProgress {
+		t.Fatalf("expected ErrUpgradeInProgress, got %v", err)
+	}
+}
+
+func TestFdsIdExists(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	ln, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the same resource is fine, and returns the existing listener
+	ln2, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected no error for a matching listener: %v", err)
+	}
+	ln2.Close()
+
+	_, err = fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:1")
+	existsErr, ok := err.(*IdExistsError)
+	if !ok {
+		t.Fatalf("expected IdExistsError, got %v", err)
+	}
+	if existsErr.Kind != "listener" || existsErr.Addr != "127.0.0.1:0" || !errors.Is(err, ErrIdExists) {
+		t.Fatalf("unexpected error details: %+v", existsErr)
+	}
+	if _, err := fds.OpenFileWith("web", "/dev/null", os.Open); !errors.Is(err, ErrIdExists) {
+		t.Fatalf("expected ErrIdExists for a different kind, got %v", err)
+	}
+}
+
+func TestFdsUpsert(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+
+	ln1, err := fds.UpsertListen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln1.Close()
+	// a different address, so a new listener should replace the old one
+	port := ln1.Addr().(*net.TCPAddr).Port
+	ln2, err := fds.UpsertListen(ctx, "web", nil, "tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("error upserting listener: %v", err)
+	}
+	defer ln2.Close()
+	if ln2.Addr().(*net.TCPAddr).Port == port {
+		t.Fatalf("expected a new listener")
+	}
+
+	dir, err := ioutil.TempDir("", "tableroll_fds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "a", "b"} {
+		fi, err := fds.UpsertFileWith("file", filepath.Join(dir, name), os.Create)
+		if err != nil {
+			t.Fatalf("error upserting file: %v", err)
+		}
+		fi.Close()
+	}
+	if !strings.Contains(fds.String(), filepath.Join(dir, "b")) {
+		t.Fatalf("expected file to be replaced, got %v", fds)
+	}
+}
+
+func TestFdsListenPacket(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	conn, err := parent.ListenPacket(ctx, "udp", nil, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.ListenPacket(ctx, "udp", nil, "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error inheriting packet conn: %v", err)
+	}
+	defer inherited.Close()
+	if inherited.LocalAddr().String() != conn.LocalAddr().String() {
+		t.Fatalf("expected inherited conn on %v, got %v", conn.LocalAddr(), inherited.LocalAddr())
+	}
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, _, err := inherited.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected to read a packet from the inherited conn, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestFdsListenUnixPacket(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	path := filepath.Join(dir, "seqpacket.sock")
+
+	parent := newFds(l, nil)
+	ln, err := parent.Listen(ctx, "seq", nil, "unixpacket", path)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.Listen(ctx, "seq", nil, "unixpacket", path)
+	if err != nil {
+		t.Fatalf("error inheriting listener: %v", err)
+	}
+	defer inherited.Close()
+	if network := inherited.Addr().Network(); network != "unixpacket" {
+		t.Fatalf("expected a unixpacket listener, got %s", network)
+	}
+
+	client, err := net.Dial("unixpacket", path)
+	if err != nil {
+		t.Fatalf("expected the socket to outlive the parent's listener: %v", err)
+	}
+	defer client.Close()
+	conn, err := inherited.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected to read a packet from the inherited listener's conn, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestFdsListenUnixgram(t *testing.T) {
+	ctx := context.Background()
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	path := filepath.Join(dir, "dgram.sock")
+
+	parent := newFds(l, nil)
+	conn, err := parent.ListenPacket(ctx, "dgram", nil, "unixgram", path)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	conn.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.ListenPacket(ctx, "dgram", nil, "unixgram", path)
+	if err != nil {
+		t.Fatalf("error inheriting packet conn: %v", err)
+	}
+	defer inherited.Close()
+	if network := inherited.LocalAddr().Network(); network != "unixgram" {
+		t.Fatalf("expected a unixgram conn, got %s", network)
+	}
+
+	client, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("expected the socket to outlive the parent's conn: %v", err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, _, err := inherited.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected to read a packet from the inherited conn, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestFdsPipe(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	r, w, err := upg1.Fds.Pipe("both")
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	r.Close()
+	w.Close()
+	// the write end is given to a helper process, which outlives the upgrade
+	r, helper, err := upg1.Fds.PipeOneEnd("helper", PipeReadEnd)
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	r.Close()
+	defer helper.Close()
+	if stored, err := upg1.Fds.File(PipeEndID("helper", PipeWriteEnd)); err != nil || stored != nil {
+		t.Fatalf("expected the write end not to be stored: %v, %v", stored, err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+
+	r, w, err = upg2.Fds.Pipe("both")
+	if err != nil || r == nil || w == nil {
+		t.Fatalf("expected to inherit both ends: %v, %v, %v", r, w, err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if _, err := w.Write([]byte("both")); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "both" {
+		t.Fatalf("expected to read what was written, got %q, %v", buf, err)
+	}
+
+	r, w, err = upg2.Fds.Pipe("helper")
+	if err != nil || r == nil || w != nil {
+		t.Fatalf("expected to inherit only the read end: %v, %v, %v", r, w, err)
+	}
+	defer r.Close()
+	if _, err := helper.Write([]byte("help")); err != nil {
+		t.Fatalf("error writing: %v", err)
+	}
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "help" {
+		t.Fatalf("expected to read what the helper wrote, got %q, %v", buf, err)
+	}
+}
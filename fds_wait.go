@@ -0,0 +1,58 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+)
+
+// WaitFile is like File, but if there's no file with the given id yet, it
+// waits until one is stored, e.g. by another goroutine, or until ctx is done.
+func (f *Fds) WaitFile(ctx context.Context, id string) (*os.File, error) {
+	var fi *os.File
+	err := f.waitFor(ctx, id, func() (bool, error) {
+		var err error
+		fi, err = f.fileLocked(id)
+		return fi != nil, err
+	})
+	return fi, err
+}
+
+// WaitListener is like Listener, but if there's no listener with the given id
+// yet, it waits until one is stored, or until ctx is done.
+func (f *Fds) WaitListener(ctx context.Context, id string) (net.Listener, error) {
+	var ln net.Listener
+	err := f.waitFor(ctx, id, func() (bool, error) {
+		var err error
+		ln, err = f.listenerLocked(id)
+		return ln != nil, err
+	})
+	return ln, err
+}
+
+// waitFor calls getLocked with the lock held until it finds the fd or
+// returns an error, waiting for an fd to be stored between each call.
+func (f *Fds) waitFor(ctx context.Context, id string, getLocked func() (bool, error)) error {
+	for {
+		if err := f.lockContext(ctx); err != nil {
+			return err
+		}
+		found, err := getLocked()
+		if found || err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		if f.storedC == nil {
+			f.storedC = make(chan struct{})
+		}
+		storedC := f.storedC
+		f.mu.Unlock()
+
+		select {
+		case <-storedC:
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for %q: %w", id, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package tableroll
+
+import (
+	"io"
+	"os"
+
+	"syscall"
+)
+
+// File offsets are preserved across upgrades: an fd passed to the next owner
+// refers to the same open file as the previous owner's, so they share one
+// offset. Reading or writing with either moves it for both, which matters
+// while the previous owner drains. To let the next owner tell where the
+// previous one had got to when it passed the file on, the offset and size of
+// each regular file are recorded when it's sent.
+
+// FileState describes a regular file at the time the previous owner passed it
+// on.
+type FileState struct {
+	// Offset is the file's offset, which the previous owner would have read
+	// or written from next.
+	Offset int64 `json:"offset"`
+	// Size is the file's size.
+	Size int64 `json:"size"`
+}
+
+// FileAt returns an inherited file, like File, along with its state when the
+// previous owner passed it on. This suits write-ahead logs and similar files,
+// where the next owner must resume exactly where the previous one stopped:
+// if the file's offset or size has since changed, the previous owner used it
+// after handing it off.
+//
+// The state is nil if the file wasn't inherited, or was passed on by an owner
+// which didn't record it. Only regular files have their state recorded.
+func (f *Fds) FileAt(id string) (*os.File, *FileState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, err := f.fileLocked(id)
+	if fi == nil || err != nil {
+		return fi, nil, err
+	}
+	stored := f.fds[id]
+	if !stored.inherited || stored.FileState == nil {
+		return fi, nil, nil
+	}
+	state := *stored.FileState
+	return fi, &state, nil
+}
+
+// captureFileState returns the state of the regular file fd, or nil if it
+// isn't one.
+func captureFileState(fd uintptr) (*FileState, error) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, nil
+	}
+	offset, err := syscall.Seek(int(fd), 0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return &FileState{Offset: offset, Size: st.Size}, nil
+}
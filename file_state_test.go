@@ -0,0 +1,64 @@
+package tableroll
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestFileAt(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	path := filepath.Join(coordDir, "wal")
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	wal, err := upg1.Fds.OpenFile("wal", path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer wal.Close()
+	if _, err := wal.WriteString("0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if fi, state, err := upg1.Fds.FileAt("wal"); err != nil || state != nil {
+		t.Fatalf("expected no state for a file which wasn't inherited, got %v, %v", state, err)
+	} else {
+		fi.Close()
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	fi, state, err := upg2.Fds.FileAt("wal")
+	if err != nil || fi == nil {
+		t.Fatalf("expected to inherit the file, got %v, %v", fi, err)
+	}
+	defer fi.Close()
+	if state == nil || *state != (FileState{Offset: 4, Size: 10}) {
+		t.Fatalf("expected the file's state at handoff, got %+v", state)
+	}
+	// the offset is shared with the previous owner
+	if offset, err := fi.Seek(0, io.SeekCurrent); err != nil || offset != 4 {
+		t.Fatalf("expected the inherited offset to be 4, got %d, %v", offset, err)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
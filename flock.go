@@ -0,0 +1,50 @@
+package tableroll
+
+import (
+	"errors"
+	"syscall"
+)
+
+var (
+	errLocked           = errors.New("file already locked")
+	errLockPermission   = errors.New("permission denied")
+	errLockFileNotExist = errors.New("file does not exist")
+)
+
+// fileLock is an flock(2) on a file.
+type fileLock struct {
+	fd int
+}
+
+func newFileLock(path string) (*fileLock, error) {
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	switch err {
+	case nil:
+		return &fileLock{fd: fd}, nil
+	case syscall.ENOENT:
+		return nil, errLockFileNotExist
+	case syscall.EACCES:
+		return nil, errLockPermission
+	}
+	return nil, err
+}
+
+// tryExclusiveLock takes an exclusive lock without blocking, returning
+// errLocked if someone else holds it.
+func (l *fileLock) tryExclusiveLock() error {
+	err := syscall.Flock(l.fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errLocked
+	}
+	return err
+}
+
+func (l *fileLock) unlock() error {
+	return syscall.Flock(l.fd, syscall.LOCK_UN)
+}
+
+func (l *fileLock) close() error {
+	fd := l.fd
+	l.fd = -1
+	return syscall.Close(fd)
+}
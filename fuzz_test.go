@@ -0,0 +1,43 @@
+//go:build go1.18
+// +build go1.18
+
+package tableroll
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+func FuzzDecodeFdTable(f *testing.F) {
+	for _, table := range []fdTable{
+		{},
+		{Generation: 3, Fds: []*fd{{ID: "a", Kind: fdKindListener, Network: "tcp", Addr: "127.0.0.1:80"}}},
+		{Fds: []*fd{{ID: "a", Kind: fdKindFile}, {ID: "a", Kind: fdKindFile}}},
+		{State: []byte("state"), Store: &storeSnapshot{Version: 1, Entries: map[string]StoreEntry{"k": {Value: []byte("v"), Version: 1}}}},
+	} {
+		body, err := json.Marshal(table)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(body)
+	}
+	f.Add([]byte(`{"fds":[null]}`))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		table, err := decodeFdTable(&proto.Frame{Type: proto.MessageFds, Body: body})
+		if err != nil {
+			return
+		}
+		// anything accepted must be safe to use without further checks
+		if err := validateFdTable(table.Fds); err != nil {
+			t.Fatalf("accepted an invalid table: %v", err)
+		}
+		for _, fd := range table.Fds {
+			if fd.file != nil || fd.inherited {
+				t.Fatalf("decoding set unexported fields: %+v", fd)
+			}
+		}
+		newStore(nil, table.Store).Keys()
+	})
+}
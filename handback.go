@@ -0,0 +1,91 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// ErrNothingToHandBack is returned by Handback when this process didn't
+// receive its fds from a previous owner, which it could hand back to.
+var ErrNothingToHandBack = errors.New("there is no previous owner to hand back to")
+
+// Handback gives up on an upgrade after New returned, but before Ready is
+// called, e.g. because the application failed to initialize. It closes the
+// fds inherited from the previous owner, tells it this process has given up,
+// and waits until it confirms it's serving as the owner again or ctx is done,
+// before stopping this Upgrader as Stop does. The previous owner resumes at
+// once, rather than once its upgrade timeout passes, so a failed deploy
+// disrupts it for as short a time as possible.
+//
+// Owners using older versions of tableroll don't confirm they've resumed, so
+// Handback returns as soon as they've been told. It returns
+// ErrNothingToHandBack if there was no previous owner, and an error if Ready
+// or Stop has already been called; the Upgrader is stopped either way.
+// Unlike Stop, it may be called before Ready with WithStrictLifecycle.
+func (u *Upgrader) Handback(ctx context.Context) error {
+	u.stateLock.Lock()
+	state, sess := u.state, u.session
+	if state != upgraderStateCheckingOwner || u.readyCalled {
+		u.stateLock.Unlock()
+		return fmt.Errorf("can't hand back ownership once Ready or Stop has been called, in state %s", state)
+	}
+	// we're stopped from here on, so a concurrent Ready can't adopt the fds
+	// we're about to close
+	if err := u.state.transitionTo(upgraderStateStopped); err != nil {
+		u.stateLock.Unlock()
+		return err
+	}
+	u.stateLock.Unlock()
+	if sess == nil || !sess.hasOwner() {
+		u.stop()
+		return ErrNothingToHandBack
+	}
+	u.l.Warn("handing ownership back to the previous owner", "owner", sess.owner)
+	u.Fds.closeInherited()
+	err := sess.handback(ctx)
+	u.stop()
+	return err
+}
+
+// handback tells the owner we've given up on the upgrade and closed all the
+// fds it sent us, and waits for it to confirm it has resumed ownership, if it
+// can. The session no longer has an owner after this returns.
+func (s *upgradeSession) handback(ctx context.Context) error {
+	defer func() {
+		s.wr.Close()
+		s.wr = nil
+	}()
+	if s.legacy {
+		// legacy owners find out when the connection is closed
+		return nil
+	}
+	defer s.closeOnCancel(ctx)()
+	if err := s.frames().WriteFrame(proto.MessageFdsReleased, nil); err != nil {
+		return orContextErr(ctx, fmt.Errorf("can't tell the owner we released its fds: %w", err))
+	}
+	if !s.ownerHandback {
+		return nil
+	}
+	if _, err := s.frames().ReadFrameOfType(proto.MessageHandbackAck); err != nil {
+		return orContextErr(ctx, fmt.Errorf("the owner did not confirm it resumed ownership: %w", err))
+	}
+	s.l.Info("the previous owner resumed ownership")
+	return nil
+}
+
+// acceptHandback is called once we've resumed ownership after the sibling
+// gave up on an upgrade and released our fds, to tell it so if it's waiting.
+func (u *Upgrader) acceptHandback(nextOwner *sibling) {
+	u.l.Warn("the next owner gave up before becoming ready, resumed ownership", "peer", nextOwner.peer)
+	peer := nextOwner.peer
+	u.emit(Event{Type: EventHandedBack, Peer: &peer})
+	if !nextOwner.handback {
+		return
+	}
+	if err := nextOwner.frames.WriteFrame(proto.MessageHandbackAck, nil); err != nil {
+		u.l.Debug("could not confirm we resumed ownership", "peer", nextOwner.peer, "err", err)
+	}
+}
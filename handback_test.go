@@ -0,0 +1,89 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestHandback(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	events := make(chan EventType, 10)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithEventHandler(func(e Event) { events <- e.Type }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Handback(ctx); err != ErrNothingToHandBack {
+		t.Fatalf("expected ErrNothingToHandBack without a previous owner, got %v", err)
+	}
+	upg1.Stop()
+
+	upg1, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithEventHandler(func(e Event) { events <- e.Type }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithStrictLifecycle())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer func() {
+		// Stop may be called again after Handback, even in strict mode
+		upg2.Stop()
+	}()
+	if !upg2.Fds.WasInherited("ln") {
+		t.Fatalf("expected to inherit the listener")
+	}
+	handbackCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := upg2.Handback(handbackCtx); err != nil {
+		t.Fatalf("error handing back: %v", err)
+	}
+	// the owner has resumed by the time Handback returns
+	if state := upg1.Status().State; state != string(upgraderStateOwner) {
+		t.Fatalf("expected the previous owner to be the owner again, got %s", state)
+	}
+	select {
+	case e := <-events:
+		if e != EventHandedBack {
+			t.Fatalf("expected a handed back event, got %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a handed back event")
+	}
+	if upg2.Fds.WasInherited("ln") {
+		t.Fatalf("expected the inherited listener to be closed")
+	}
+	if err := upg2.Ready(); err == nil {
+		t.Fatalf("expected Ready to fail after handing back")
+	}
+	if err := upg2.Handback(ctx); err == nil {
+		t.Fatalf("expected handing back twice to fail")
+	}
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if !upg3.Fds.WasInherited("ln") {
+		t.Fatalf("expected a later upgrade to inherit the listener")
+	}
+}
@@ -0,0 +1,241 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// ErrHandleClosed is returned by the methods of a Handle once it's closed.
+var ErrHandleClosed = errors.New("handle is closed")
+
+// FdMetadata describes the fd behind a Handle.
+type FdMetadata struct {
+	ID      string
+	Kind    string
+	Network string
+	Addr    string
+	Name    string
+	// Generation is the generation of the process which created the fd.
+	Generation uint32
+	// Inherited is true if the fd was passed on by a previous owner, rather
+	// than created by this process.
+	Inherited bool
+	// Exclusive is true for fds added with AddExclusive.
+	Exclusive bool
+	// TLS is true for listeners served with TLS; see TLSListener.
+	TLS bool
+}
+
+// Handle is a reference to one fd in Fds, returned by Fds.Handle. It owns a
+// duplicate of the fd, made the first time it's needed, and everything
+// created from it: the *os.File from File and the listener or conn from
+// Listener, PacketConn or Conn are all closed by Close, and shouldn't be
+// closed otherwise. The fd in Fds is unaffected, and is still passed on to
+// the next owner.
+//
+// A Handle is safe for concurrent use.
+type Handle struct {
+	fds  *Fds
+	fd   *fd
+	meta FdMetadata
+
+	mu         sync.Mutex
+	closed     bool
+	file       *os.File
+	listener   net.Listener
+	packetConn net.PacketConn
+	conn       net.Conn
+}
+
+// Handle returns a Handle for the fd with the given id, or nil if there is
+// none.
+func (f *Fds) Handle(id string) *Handle {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.fds[id]
+	if !ok {
+		return nil
+	}
+	return &Handle{
+		fds: f,
+		fd:  fi,
+		meta: FdMetadata{
+			ID:         fi.ID,
+			Kind:       string(fi.Kind),
+			Network:    fi.Network,
+			Addr:       fi.Addr,
+			Name:       fi.Name,
+			Generation: fi.Generation,
+			Inherited:  fi.inherited,
+			Exclusive:  fi.Exclusive,
+			TLS:        fi.TLS,
+		},
+	}
+}
+
+// Metadata describes the fd as it was when the Handle was created.
+func (h *Handle) Metadata() FdMetadata {
+	return h.meta
+}
+
+// File returns the Handle's duplicate of the fd. It's closed by Close, and
+// shouldn't be closed otherwise.
+func (h *Handle) File() (*os.File, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fileLocked()
+}
+
+func (h *Handle) fileLocked() (*os.File, error) {
+	if h.closed {
+		return nil, ErrHandleClosed
+	}
+	if h.file != nil {
+		return h.file, nil
+	}
+	f := h.fds
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the fd may have been removed or replaced, and so closed, since the
+	// Handle was created
+	if f.fds[h.meta.ID] != h.fd || h.fd.file == nil {
+		return nil, fmt.Errorf("fd %q was removed or replaced", h.meta.ID)
+	}
+	if h.fd.Kind == fdKindListener && h.fd.TLS && h.fd.inherited && !h.fd.tlsWrapped {
+		return nil, &TLSMismatchError{ID: h.meta.ID}
+	}
+	dup, err := dupFd(h.fd.file.fd, h.fd.String())
+	if err != nil {
+		return nil, err
+	}
+	h.file = dup.File
+	return h.file, nil
+}
+
+// checkKindLocked returns an error if the fd isn't of the given kind.
+func (h *Handle) checkKindLocked(kind fdKind) error {
+	if h.fd.Kind != kind {
+		return fmt.Errorf("fd %q is a %s, not a %s", h.meta.ID, h.fd.Kind, kind)
+	}
+	return nil
+}
+
+// Listener returns a listener for the fd, which must be a listener. It's
+// closed by Close, and shouldn't be closed otherwise.
+//
+// As with Listener, a listener the previous owner served with TLS can only be
+// used once TLSListener has been called for it.
+func (h *Handle) Listener() (net.Listener, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrHandleClosed
+	}
+	if err := h.checkKindLocked(fdKindListener); err != nil {
+		return nil, err
+	}
+	if h.listener != nil {
+		return h.listener, nil
+	}
+	file, err := h.fileLocked()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't create listener for %q: %w", h.meta.ID, err)
+	}
+	ln = h.fd.listenerWithRecordedAddr(ln)
+	h.listener = ln
+	return ln, nil
+}
+
+// PacketConn returns a packet conn for the fd, which must be a packet conn.
+// It's closed by Close, and shouldn't be closed otherwise.
+func (h *Handle) PacketConn() (net.PacketConn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrHandleClosed
+	}
+	if err := h.checkKindLocked(fdKindPacketConn); err != nil {
+		return nil, err
+	}
+	if h.packetConn != nil {
+		return h.packetConn, nil
+	}
+	file, err := h.fileLocked()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't create packet conn for %q: %w", h.meta.ID, err)
+	}
+	conn = h.fd.packetConnWithRecordedAddr(conn)
+	h.packetConn = conn
+	return conn, nil
+}
+
+// Conn returns a connection for the fd, which must be a connection. It's
+// closed by Close, and shouldn't be closed otherwise.
+func (h *Handle) Conn() (net.Conn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrHandleClosed
+	}
+	if err := h.checkKindLocked(fdKindConn); err != nil {
+		return nil, err
+	}
+	if h.conn != nil {
+		return h.conn, nil
+	}
+	file, err := h.fileLocked()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("can't create conn for %q: %w", h.meta.ID, err)
+	}
+	conn = h.fd.connWithRecordedAddrs(conn)
+	h.conn = conn
+	return conn, nil
+}
+
+// Close closes everything the Handle created. The fd in Fds stays open. It
+// returns the first error from closing them, and ErrHandleClosed if it was
+// already closed.
+func (h *Handle) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrHandleClosed
+	}
+	h.closed = true
+	var closers []io.Closer
+	if h.listener != nil {
+		closers = append(closers, h.listener)
+	}
+	if h.packetConn != nil {
+		closers = append(closers, h.packetConn)
+	}
+	if h.conn != nil {
+		closers = append(closers, h.conn)
+	}
+	if h.file != nil {
+		closers = append(closers, h.file)
+	}
+	var firstErr error
+	for _, c := range closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
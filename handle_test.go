@@ -0,0 +1,78 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestHandle(t *testing.T) {
+	ctx := context.Background()
+	fds := newFds(l, nil)
+	if h := fds.Handle("web"); h != nil {
+		t.Fatalf("expected no handle for a missing fd, got %v", h)
+	}
+	ln, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h := fds.Handle("web")
+	if h == nil {
+		t.Fatalf("expected a handle")
+	}
+	if meta := h.Metadata(); meta.ID != "web" || meta.Kind != "listener" || meta.Network != "tcp" || meta.Inherited {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+	if _, err := h.Conn(); err == nil {
+		t.Fatalf("expected Conn to fail for a listener")
+	}
+	hln, err := h.Listener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := h.Listener(); err != nil || again != hln {
+		t.Fatalf("expected the same listener again, got %v, %v", again, err)
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := hln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("error accepting from the handle's listener: %v", err)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("error closing handle: %v", err)
+	}
+	if err := h.Close(); err != ErrHandleClosed {
+		t.Fatalf("expected ErrHandleClosed closing twice, got %v", err)
+	}
+	if _, err := h.File(); err != ErrHandleClosed {
+		t.Fatalf("expected ErrHandleClosed after Close, got %v", err)
+	}
+	// the fd in Fds stays open
+	if other, err := fds.Listener("web"); err != nil || other == nil {
+		t.Fatalf("expected the fd to stay open, got %v, %v", other, err)
+	} else {
+		other.Close()
+	}
+
+	h = fds.Handle("web")
+	if err := fds.Remove("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.File(); err == nil {
+		t.Fatalf("expected a handle to a removed fd to fail")
+	}
+}
@@ -0,0 +1,182 @@
+package tableroll
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Peer credentials show which user a process runs as, but on a shared host,
+// that may not be enough to tell the service's own processes from others
+// running as the same user. With a handoff secret, the owner and new process
+// each prove they know a secret before any fds are passed: the new process
+// sends a random nonce in its hello, the owner replies with its own nonce and
+// an HMAC of both keyed with the secret, and the new process replies with an
+// HMAC of both in the other order. Neither side sends the secret itself, and
+// the nonces keep responses from being replayed.
+
+// minHandoffSecretSize is the shortest handoff secret accepted.
+const minHandoffSecretSize = 16
+
+const authNonceSize = 32
+
+// WithHandoffSecret requires the owner and new process to authenticate each
+// other with a secret read from path before any fds are passed, in addition
+// to any other checks such as WithUpgradeApproval. The file must not be
+// readable or writable by anyone but its owner, and should only be readable
+// by the service's account. Its contents are used as they are, and must be
+// at least 16 bytes long.
+//
+// Every process in an upgrade chain must use the same secret. An owner using
+// one rejects new processes which don't, or which use a different one, with
+// a *HandoffAuthError; a new process using one refuses to take fds from an
+// owner which doesn't prove it knows the secret. Processes speaking the
+// legacy protocol can't authenticate, so they're refused too.
+func WithHandoffSecret(path string) Option {
+	return func(u *Upgrader) {
+		u.handoffSecretPath = path
+	}
+}
+
+// HandoffAuthError is returned when the owner and new process couldn't
+// authenticate each other with the secret given to WithHandoffSecret.
+type HandoffAuthError struct {
+	Reason string
+}
+
+func (e *HandoffAuthError) Error() string {
+	return "handoff authentication failed: " + e.Reason
+}
+
+// loadHandoffSecret reads the secret configured with WithHandoffSecret.
+func (u *Upgrader) loadHandoffSecret() error {
+	if u.handoffSecretPath == "" {
+		return nil
+	}
+	fi, err := os.Stat(u.handoffSecretPath)
+	if err != nil {
+		return fmt.Errorf("can't read handoff secret: %w", err)
+	}
+	if perm := fi.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("handoff secret %q must not be accessible to other users, but has mode %v", u.handoffSecretPath, perm)
+	}
+	key, err := ioutil.ReadFile(u.handoffSecretPath)
+	if err != nil {
+		return fmt.Errorf("can't read handoff secret: %w", err)
+	}
+	if len(key) < minHandoffSecretSize {
+		return fmt.Errorf("handoff secret %q is %d bytes long, but must be at least %d", u.handoffSecretPath, len(key), minHandoffSecretSize)
+	}
+	u.handoffKey = key
+	return nil
+}
+
+// handoffMAC computes the proof that role knows key, in response to the
+// challenge nonce from the other side.
+func handoffMAC(key []byte, role string, challenge, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "tableroll handoff %s\x00", role)
+	mac.Write(challenge)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func newAuthNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("can't generate authentication nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// authenticate checks the sibling knows our handoff secret, if we have one,
+// and proves to it that we do. If not, it rejects the sibling.
+func (u *Upgrader) authenticate(nextOwner *sibling, hello *proto.Hello) bool {
+	if u.handoffKey == nil {
+		if hello.AuthNonce != nil {
+			nextOwner.rejectWithCode(proto.RejectionUnauthenticated, "the owner has no handoff secret")
+			return false
+		}
+		return true
+	}
+	if len(hello.AuthNonce) != authNonceSize {
+		u.l.Warn("refusing an unauthenticated upgrade request", "peer", nextOwner.peer)
+		nextOwner.rejectWithCode(proto.RejectionUnauthenticated, "the owner requires a handoff secret")
+		return false
+	}
+	nonce, err := newAuthNonce()
+	if err != nil {
+		nextOwner.reject(err.Error())
+		return false
+	}
+	if err := nextOwner.frames.WriteFrame(proto.MessageAuthChallenge, proto.AuthChallenge{
+		Nonce: nonce,
+		MAC:   handoffMAC(u.handoffKey, "owner", hello.AuthNonce, nonce),
+	}); err != nil {
+		u.l.Warn("could not send authentication challenge", "err", err)
+		return false
+	}
+	frame, err := nextOwner.frames.ReadFrameOfType(proto.MessageAuthResponse)
+	if err != nil {
+		u.l.Warn("could not read authentication response", "peer", nextOwner.peer, "err", err)
+		return false
+	}
+	var response proto.AuthResponse
+	if err := frame.Decode(&response); err != nil {
+		nextOwner.reject(err.Error())
+		return false
+	}
+	if !hmac.Equal(response.MAC, handoffMAC(u.handoffKey, "newcomer", nonce, hello.AuthNonce)) {
+		u.l.Warn("refusing an upgrade request with the wrong handoff secret", "peer", nextOwner.peer)
+		nextOwner.rejectWithCode(proto.RejectionUnauthenticated, "wrong handoff secret")
+		return false
+	}
+	u.l.Info("authenticated peer with the handoff secret")
+	return true
+}
+
+// helloAuthNonce returns the nonce to send in our hello, if we have a
+// handoff secret.
+func (s *upgradeSession) helloAuthNonce() ([]byte, error) {
+	if s.handoffKey == nil {
+		return nil, nil
+	}
+	nonce, err := newAuthNonce()
+	if err != nil {
+		return nil, err
+	}
+	s.authNonce = nonce
+	return nonce, nil
+}
+
+// authenticateOwner checks the owner knows our handoff secret, if we have
+// one, and proves to it that we do. It must follow a hello carrying the nonce
+// from helloAuthNonce.
+func (s *upgradeSession) authenticateOwner() error {
+	if s.handoffKey == nil {
+		return nil
+	}
+	frame, err := s.frames().ReadFrameOfType(proto.MessageAuthChallenge)
+	if err != nil {
+		if _, ok := err.(*proto.RejectedError); ok {
+			return err
+		}
+		return &HandoffAuthError{Reason: "the owner did not authenticate itself: " + err.Error()}
+	}
+	var challenge proto.AuthChallenge
+	if err := frame.Decode(&challenge); err != nil {
+		return &HandoffAuthError{Reason: err.Error()}
+	}
+	if len(challenge.Nonce) != authNonceSize || !hmac.Equal(challenge.MAC, handoffMAC(s.handoffKey, "owner", s.authNonce, challenge.Nonce)) {
+		return &HandoffAuthError{Reason: "the owner does not know the handoff secret"}
+	}
+	s.l.Info("authenticated the owner with the handoff secret")
+	return s.frames().WriteFrame(proto.MessageAuthResponse, proto.AuthResponse{
+		MAC: handoffMAC(s.handoffKey, "newcomer", challenge.Nonce, s.authNonce),
+	})
+}
@@ -0,0 +1,80 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestHandoffSecret(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	writeSecret := func(name, secret string, mode os.FileMode) string {
+		path := filepath.Join(coordDir, name)
+		if err := ioutil.WriteFile(path, []byte(secret), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secret := writeSecret("secret", "correct horse battery staple", 0600)
+	wrongSecret := writeSecret("wrong-secret", "incorrect horse battery staple", 0600)
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithHandoffSecret(writeSecret("public", "correct horse battery staple", 0644))); err == nil {
+		t.Fatal("expected a secret readable by others to be refused")
+	}
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithHandoffSecret(writeSecret("short", "hunter2", 0600))); err == nil {
+		t.Fatal("expected a short secret to be refused")
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithHandoffSecret(secret))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	for name, opts := range map[string][]Option{
+		"no secret":    {WithLogger(l)},
+		"wrong secret": {WithLogger(l), WithHandoffSecret(wrongSecret)},
+	} {
+		_, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, opts...)
+		if _, ok := err.(*HandoffAuthError); !ok {
+			t.Fatalf("%s: expected a *HandoffAuthError, got %T %v", name, err, err)
+		}
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithHandoffSecret(secret))
+	if err != nil {
+		t.Fatalf("error upgrading with the secret: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	// an owner without a secret can't authenticate itself
+	upg2.Stop()
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3, deadPids: map[int]bool{1: true, 2: true}}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 4}, coordDir, WithLogger(l), WithHandoffSecret(secret))
+	if _, ok := err.(*HandoffAuthError); !ok {
+		t.Fatalf("expected a *HandoffAuthError, got %T %v", err, err)
+	}
+}
@@ -0,0 +1,40 @@
+package tableroll
+
+import (
+	"fmt"
+)
+
+// WithHandoffState provides opaque state which is passed to the next owner
+// along with the file descriptors. The provider is called while an upgrade is
+// in progress, after fd mutations have been locked, and the upgrade is
+// rejected if it returns an error. The next owner may retrieve the state with
+// HandoffState.
+//
+// This is meant for state which goes along with the passed fds, and which the
+// next owner needs to use them correctly, such as the keys used to route QUIC
+// packets by connection ID or to validate address validation tokens. See
+// docs/quic.md. It is limited by the protocol's maximum message size, and is
+// not passed to processes using older versions of tableroll. Data which
+// isn't tied to the fds can be kept in the Store instead.
+func WithHandoffState(provider func() ([]byte, error)) Option {
+	return func(u *Upgrader) {
+		u.handoffState = provider
+	}
+}
+
+// HandoffState returns the state the previous owner provided with
+// WithHandoffState, or nil if there was none.
+func (u *Upgrader) HandoffState() []byte {
+	return append([]byte(nil), u.inheritedState...)
+}
+
+func (u *Upgrader) snapshotHandoffState() ([]byte, error) {
+	if u.handoffState == nil {
+		return nil, nil
+	}
+	state, err := u.handoffState()
+	if err != nil {
+		return nil, fmt.Errorf("could not get handoff state: %w", err)
+	}
+	return state, nil
+}
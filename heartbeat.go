@@ -0,0 +1,208 @@
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// After an upgrade, the previous owner and the new one keep the connection
+// they upgraded over open until they exit, so that each can tell when the
+// other has gone: the kernel closes it if either exits or crashes. With
+// WithHeartbeat, they also check the other still answers heartbeats over it,
+// to tell when it's hung. Processes running an older version of tableroll
+// close the connection once the previous owner has drained, so their exit is
+// found by polling their pid instead, and they're sent no heartbeats.
+
+// HeartbeatTimeoutError is the error of an EventSuccessorExited when the next
+// owner stopped answering heartbeats, rather than exiting.
+type HeartbeatTimeoutError struct {
+	Pid     int
+	Timeout time.Duration
+}
+
+func (e *HeartbeatTimeoutError) Error() string {
+	return fmt.Sprintf("process %d has not answered heartbeats for %v", e.Pid, e.Timeout)
+}
+
+// WithHeartbeat sends a heartbeat to the other process every interval after
+// an upgrade, from the previous owner to the new one and the other way round,
+// and presumes it's hung, as if it had exited, if it doesn't answer any for
+// timeout. Without it, processes which exit or crash are still noticed, but
+// hung ones aren't. See PredecessorExited and SuccessorExited.
+func WithHeartbeat(interval, timeout time.Duration) Option {
+	return func(u *Upgrader) {
+		u.heartbeatInterval = interval
+		u.heartbeatTimeout = timeout
+	}
+}
+
+// PredecessorExited returns a channel which is closed once the process this
+// Upgrader took ownership from has exited, crashed, or, with WithHeartbeat,
+// stopped answering heartbeats. If there was no previous owner, the channel
+// is closed immediately. Unlike PredecessorDrained, it isn't closed when the
+// previous owner calls NotifyDrainComplete, so it may be used to wait for
+// resources which only the previous process's exit frees.
+func (u *Upgrader) PredecessorExited() <-chan struct{} {
+	return u.predecessorExitedC
+}
+
+// SuccessorExited returns a channel which is closed if, after this process
+// handed off, the process which took over from it exits, crashes, stops its
+// Upgrader, or, with WithHeartbeat, stops answering heartbeats, while this
+// process is still running. An EventSuccessorExited is emitted too. A
+// process which is draining may use it to notice the new release failed, and
+// e.g. alert, or stop draining and serve until a fixed release is deployed.
+// It's never closed if the successor runs an older version of tableroll and
+// this process has called NotifyDrainComplete.
+func (u *Upgrader) SuccessorExited() <-chan struct{} {
+	return u.successorExitedC
+}
+
+func (u *Upgrader) closePredecessorExited() {
+	u.predecessorExitedOnce.Do(func() {
+		close(u.predecessorExitedC)
+	})
+}
+
+// heartbeat sends heartbeats to the process at the other end of a
+// connection, and notices when it stops answering them.
+type heartbeat struct {
+	// lastAck is when the other process last answered, in unix
+	// nanoseconds. It's first so it's 64-bit aligned for atomic access.
+	lastAck int64
+
+	interval time.Duration
+	timeout  time.Duration
+	clock    clock.Clock
+	stopC    chan struct{}
+	stopOnce sync.Once
+}
+
+// startHeartbeat sends heartbeats with send, and calls onTimeout if they
+// aren't acknowledged in time. It returns nil if heartbeats are disabled.
+func (u *Upgrader) startHeartbeat(pid int, send func(proto.MessageType) error, onTimeout func(error)) *heartbeat {
+	if u.heartbeatInterval <= 0 {
+		return nil
+	}
+	hb := &heartbeat{
+		lastAck:  u.clock.Now().UnixNano(),
+		interval: u.heartbeatInterval,
+		timeout:  u.heartbeatTimeout,
+		clock:    u.clock,
+		stopC:    make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-hb.stopC:
+				return
+			case <-hb.clock.After(hb.interval):
+			}
+			if hb.clock.Since(time.Unix(0, atomic.LoadInt64(&hb.lastAck))) > hb.timeout {
+				onTimeout(&HeartbeatTimeoutError{Pid: pid, Timeout: hb.timeout})
+				return
+			}
+			if err := send(proto.MessageHeartbeat); err != nil {
+				// the connection's gone, which its reader will notice
+				return
+			}
+		}
+	}()
+	return hb
+}
+
+// ack records that the other process answered a heartbeat.
+func (hb *heartbeat) ack() {
+	if hb != nil {
+		atomic.StoreInt64(&hb.lastAck, hb.clock.Now().UnixNano())
+	}
+}
+
+func (hb *heartbeat) stop() {
+	if hb != nil {
+		hb.stopOnce.Do(func() { close(hb.stopC) })
+	}
+}
+
+// writePredecessor writes a frame to our predecessor's connection. Writes
+// to it are serialized with the state lock.
+func (u *Upgrader) writePredecessor(conn *net.UnixConn, typ proto.MessageType) error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return proto.WriteFrame(conn, typ, nil)
+}
+
+// writeSuccessor writes a frame to our successor's connection, if it's still
+// our successor.
+func (u *Upgrader) writeSuccessor(successor *sibling, typ proto.MessageType) error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.successor != successor {
+		return errClosed
+	}
+	return successor.frames.WriteFrame(typ, nil)
+}
+
+// watchSuccessor reads what our successor sends us until its connection is
+// closed, answering heartbeats, and noticing if it exits or shuts the
+// service down.
+func (u *Upgrader) watchSuccessor(successor *sibling) {
+	var hb *heartbeat
+	if successor.heartbeats {
+		hb = u.startHeartbeat(successor.peer.Pid, func(typ proto.MessageType) error {
+			return u.writeSuccessor(successor, typ)
+		}, func(err error) {
+			u.loseSuccessor(successor, err)
+		})
+	}
+	defer hb.stop()
+	for {
+		frame, err := successor.frames.ReadFrame()
+		if err != nil {
+			u.loseSuccessor(successor, nil)
+			return
+		}
+		switch frame.Type {
+		case proto.MessageChainShutdown:
+			u.l.Info("the next owner is shutting down the service")
+			u.closeChainShutdown()
+		case proto.MessageHeartbeat:
+			if err := u.writeSuccessor(successor, proto.MessageHeartbeatAck); err != nil {
+				u.l.Debug("could not answer the next owner's heartbeat", "err", err)
+			}
+		case proto.MessageHeartbeatAck:
+			hb.ack()
+		default:
+			u.l.Debug("ignoring unexpected message from the next owner", "type", frame.Type)
+		}
+	}
+}
+
+// loseSuccessor handles our successor exiting, or, if err is set, hanging,
+// unless we've already closed its connection ourselves.
+func (u *Upgrader) loseSuccessor(successor *sibling, err error) {
+	u.stateLock.Lock()
+	if u.successor != successor {
+		u.stateLock.Unlock()
+		return
+	}
+	u.successor = nil
+	u.stateLock.Unlock()
+	successor.conn.Close()
+	if err != nil {
+		u.l.Error("the next owner stopped answering heartbeats, presuming it's hung", "peer", successor.peer, "err", err)
+	} else {
+		u.l.Warn("the next owner has exited", "peer", successor.peer)
+	}
+	peer := successor.peer
+	u.emit(Event{Type: EventSuccessorExited, Peer: &peer, Err: err})
+	u.successorExitedOnce.Do(func() {
+		close(u.successorExitedC)
+	})
+}
@@ -0,0 +1,165 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// handOff creates an owner and a process which upgrades from it, and waits
+// for the handoff.
+func handOff(t *testing.T, ctx context.Context, coordDir string, opts1, opts2 []Option) (*Upgrader, *Upgrader) {
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, append([]Option{WithLogger(l)}, opts1...)...)
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, append([]Option{WithLogger(l)}, opts2...)...)
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	return upg1, upg2
+}
+
+func TestPredecessorExited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, upg2 := handOff(t, ctx, coordDir, nil, nil)
+	defer upg2.Stop()
+	select {
+	case <-upg1.PredecessorExited():
+	default:
+		t.Fatalf("expected a process without a predecessor not to wait for one")
+	}
+
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	select {
+	case <-upg2.PredecessorDrained():
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for the predecessor to drain")
+	}
+	select {
+	case <-upg2.PredecessorExited():
+		t.Fatalf("expected the predecessor not to have exited after draining")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	upg1.Stop()
+	select {
+	case <-upg2.PredecessorExited():
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting for the predecessor to exit")
+	}
+	select {
+	case <-upg1.SuccessorExited():
+		t.Fatalf("expected closing the connection ourselves not to be the successor exiting")
+	default:
+	}
+}
+
+func TestSuccessorExited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	events := make(chan Event, 1)
+	upg1, upg2 := handOff(t, ctx, coordDir, []Option{WithEventHandler(func(e Event) {
+		if e.Type == EventSuccessorExited {
+			events <- e
+		}
+	})}, nil)
+	defer upg1.Stop()
+	defer upg2.Stop()
+
+	// the connection is closed by the kernel when the new owner exits
+	upg2.stateLock.Lock()
+	upg2.predecessorConn.Close()
+	upg2.stateLock.Unlock()
+	select {
+	case <-upg1.SuccessorExited():
+	case <-ctx.Done():
+		t.Fatalf("timed out waiting to notice the successor exit")
+	}
+	if e := <-events; e.Peer == nil || e.Err != nil {
+		t.Fatalf("expected an exit event without an error, got %+v", e)
+	}
+}
+
+func TestHeartbeatsKeepFlowing(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	heartbeats := []Option{WithHeartbeat(10*time.Millisecond, 200*time.Millisecond)}
+	upg1, upg2 := handOff(t, ctx, coordDir, heartbeats, heartbeats)
+	defer upg1.Stop()
+	defer upg2.Stop()
+
+	// each side keeps answering the other's heartbeats
+	select {
+	case <-upg1.SuccessorExited():
+		t.Fatalf("expected the successor to keep answering heartbeats")
+	case <-upg2.PredecessorExited():
+		t.Fatalf("expected the predecessor to keep answering heartbeats")
+	case <-time.After(time.Second):
+	}
+}
+
+func TestHeartbeatTimeout(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	fake := fakeclock.NewFakeClock(time.Now())
+	upg, err := newUpgrader(context.Background(), fake, mockOS{pid: 1}, coordDir, WithLogger(l), WithHeartbeat(time.Second, 3*time.Second))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+
+	sent := make(chan proto.MessageType, 10)
+	timedOut := make(chan error, 1)
+	hb := upg.startHeartbeat(2, func(typ proto.MessageType) error {
+		sent <- typ
+		return nil
+	}, func(err error) {
+		timedOut <- err
+	})
+	defer hb.stop()
+
+	// acknowledged heartbeats keep it alive
+	for i := 0; i < 5; i++ {
+		stepWhenWaiting(t, fake, time.Second)
+		if typ := <-sent; typ != proto.MessageHeartbeat {
+			t.Fatalf("expected a heartbeat, got %s", typ)
+		}
+		hb.ack()
+	}
+	// once they stop being acknowledged, it times out
+	for {
+		stepWhenWaiting(t, fake, time.Second)
+		select {
+		case err := <-timedOut:
+			if hbErr, ok := err.(*HeartbeatTimeoutError); !ok || hbErr.Pid != 2 {
+				t.Fatalf("expected a heartbeat timeout, got %v", err)
+			}
+			return
+		case <-sent:
+		}
+	}
+}
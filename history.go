@@ -0,0 +1,136 @@
+package tableroll
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Each process appends to a history file in the coordination directory as it
+// becomes the owner, hands off ownership, and finishes draining, so that it's
+// possible to reconstruct afterwards which binary held the fds when. The file
+// is only ever appended to, one json object per line, so operators may
+// truncate or rotate it as they see fit.
+
+// HistoryEventType identifies what a HistoryEntry records.
+type HistoryEventType string
+
+const (
+	// HistoryBecameOwner records a process becoming the owner. PeerPid is the
+	// previous owner, if there was one.
+	HistoryBecameOwner HistoryEventType = "became-owner"
+	// HistoryHandedOff records an owner passing ownership to PeerPid and
+	// starting to drain.
+	HistoryHandedOff HistoryEventType = "handed-off"
+	// HistoryDrainComplete records a previous owner finishing draining.
+	HistoryDrainComplete HistoryEventType = "drain-complete"
+	// HistoryForceDrained records an owner starting to drain at a
+	// controller's request, without passing ownership on.
+	HistoryForceDrained HistoryEventType = "force-drained"
+	// HistoryLeaseLost records an owner finding that PeerPid seized
+	// ownership after its ownership lease expired, and starting to drain.
+	HistoryLeaseLost HistoryEventType = "lease-lost"
+)
+
+// HistoryEntry is one line of the upgrade history.
+type HistoryEntry struct {
+	Time       time.Time        `json:"time"`
+	Type       HistoryEventType `json:"type"`
+	Generation uint32           `json:"generation"`
+	Pid        int              `json:"pid"`
+	// Exe and StartTime describe the process with the given pid, if they
+	// could be determined.
+	Exe       string    `json:"exe,omitempty"`
+	StartTime time.Time `json:"startTime"`
+	// PeerPid is the other process involved in the event, if any.
+	PeerPid int `json:"peerPid,omitempty"`
+	// Identity is what the process set with WithIdentity, if anything.
+	Identity string `json:"identity,omitempty"`
+}
+
+// maxHistoryLine bounds the length of a line read from the history file.
+const maxHistoryLine = 64 * 1024
+
+func historyPath(dir string) string {
+	return filepath.Join(dir, "history")
+}
+
+// ReadHistory reads the upgrade history recorded in the given coordination
+// directory, oldest first. It returns no entries if there is no history yet,
+// and a *LayoutVersionError if the directory was written by a newer version
+// of tableroll.
+func ReadHistory(coordinationDir string) ([]HistoryEntry, error) {
+	if err := checkLayoutReadable(coordinationDir); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(historyPath(coordinationDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open upgrade history: %w", err)
+	}
+	defer f.Close()
+
+	var entries []HistoryEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxHistoryLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("invalid upgrade history entry on line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("can't read upgrade history: %w", err)
+	}
+	return entries, nil
+}
+
+// History returns the upgrade history recorded in the Upgrader's
+// coordination directory, oldest first. See ReadHistory.
+func (u *Upgrader) History() ([]HistoryEntry, error) {
+	return ReadHistory(u.coord.dir)
+}
+
+// recordHistory appends an entry about this process to the upgrade history.
+// Failures are only logged, as the history is informational.
+func (u *Upgrader) recordHistory(typ HistoryEventType, peerPid int) {
+	pid := u.coord.os.Getpid()
+	entry := HistoryEntry{
+		Time:       u.clock.Now(),
+		Type:       typ,
+		Generation: u.generation,
+		Pid:        pid,
+		PeerPid:    peerPid,
+		Identity:   u.identity,
+	}
+	entry.Exe, entry.StartTime = processDetails(pid)
+	if err := appendHistory(u.coord.dir, entry); err != nil {
+		u.l.Warn("could not record upgrade history", "event", typ, "err", err)
+	}
+}
+
+func appendHistory(dir string, entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(historyPath(dir), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// a single write with O_APPEND keeps concurrent writers' lines whole
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,91 @@
+package tableroll
+
+import (
+	"fmt"
+	"sort"
+)
+
+// WithIdAliases renames fds inherited from the previous owner: an fd the
+// previous owner had under one of the map's keys is looked up, and passed on
+// to the next owner, under the corresponding value instead. A version which
+// renames a listener, say from "http" to "web", can then use
+// WithIdAliases(map[string]string{"http": "web"}) and inherit the socket,
+// rather than orphaning it and binding a new one.
+//
+// An fd the previous owner already had under the new id takes precedence
+// over an aliased one, which is left under its old id. Aliases apply to the
+// previous owner's ids only, so they don't chain, and no two old ids may be
+// renamed to the same new one.
+func WithIdAliases(aliases map[string]string) Option {
+	return func(u *Upgrader) {
+		u.idAliases = make(map[string]string, len(aliases))
+		for from, to := range aliases {
+			u.idAliases[from] = to
+		}
+	}
+}
+
+func (u *Upgrader) checkIdAliases() error {
+	renamedFrom := make(map[string]string, len(u.idAliases))
+	froms := make([]string, 0, len(u.idAliases))
+	for from := range u.idAliases {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		to := u.idAliases[from]
+		if from == "" || to == "" {
+			return fmt.Errorf("id alias %q -> %q must not have an empty id", from, to)
+		}
+		if from == to {
+			return fmt.Errorf("id %q is aliased to itself", from)
+		}
+		if other, ok := renamedFrom[to]; ok {
+			return fmt.Errorf("ids %q and %q are both aliased to %q", other, from, to)
+		}
+		renamedFrom[to] = from
+	}
+	return nil
+}
+
+// aliasFds renames inherited fds according to WithIdAliases. has reports
+// whether an fd already exists under a new id, in which case the aliased fd
+// keeps its old id.
+func (u *Upgrader) aliasFds(fds []*fd, has func(id string) bool) {
+	if len(u.idAliases) == 0 {
+		return
+	}
+	for _, fi := range fds {
+		to, ok := u.idAliases[fi.ID]
+		if !ok {
+			continue
+		}
+		if has(to) {
+			u.l.Warn("not renaming inherited fd, its new id is already in use", "from", u.redactString(fi.ID), "to", u.redactString(to))
+			continue
+		}
+		u.l.Info("renaming inherited fd", "from", u.redactString(fi.ID), "to", u.redactString(to))
+		fi.ID = to
+	}
+}
+
+// aliasFdMap is aliasFds for the fds received during a handoff.
+func (u *Upgrader) aliasFdMap(files map[string]*fd) map[string]*fd {
+	if len(u.idAliases) == 0 || len(files) == 0 {
+		return files
+	}
+	fds := make([]*fd, 0, len(files))
+	for _, fi := range files {
+		fds = append(fds, fi)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i].ID < fds[j].ID })
+	u.aliasFds(fds, func(id string) bool {
+		_, ok := files[id]
+		return ok
+	})
+	aliased := make(map[string]*fd, len(fds))
+	for _, fi := range fds {
+		aliased[fi.ID] = fi
+	}
+	return aliased
+}
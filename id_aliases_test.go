@@ -0,0 +1,75 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestIdAliases(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	addrs := make(map[string]string)
+	for _, id := range []string{"http", "admin", "status"} {
+		ln, err := upg1.Fds.Listen(ctx, id, nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		addrs[id] = ln.Addr().String()
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdAliases(map[string]string{
+		"http":  "web",
+		"admin": "status",
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+
+	if ln, err := upg2.Fds.Listener("web"); err != nil || ln == nil {
+		t.Fatalf("expected to inherit http as web, got %v, %v", ln, err)
+	}
+	if ln, err := upg2.Fds.Listener("http"); err != nil || ln != nil {
+		t.Fatalf("expected nothing under the old id, got %v, %v", ln, err)
+	}
+	// the previous owner's own status listener takes precedence
+	ln, err := upg2.Fds.Listener("status")
+	if err != nil || ln == nil {
+		t.Fatalf("expected to inherit status, got %v, %v", ln, err)
+	}
+	if got, want := ln.Addr().String(), addrs["status"]; got != want {
+		t.Fatalf("expected status to be the previous owner's status listener at %s, got %s", want, got)
+	}
+	if ln, err := upg2.Fds.Listener("admin"); err != nil || ln == nil {
+		t.Fatalf("expected admin to keep its id, got %v, %v", ln, err)
+	}
+}
+
+func TestIdAliasesInvalid(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	for _, aliases := range []map[string]string{
+		{"http": "http"},
+		{"http": ""},
+		{"http": "web", "www": "web"},
+	} {
+		upg, err := newUpgrader(context.Background(), clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithIdAliases(aliases))
+		if err == nil {
+			upg.Stop()
+			t.Fatalf("expected aliases %v to be rejected", aliases)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package tableroll
+
+// WithIdentity sets a human-readable identity for this process, such as its
+// version or build, which is exchanged with the other process during an
+// upgrade. Both sides log it, it's recorded in the upgrade history and the
+// owner's status, and the other process can read it with PeerIdentity, so
+// that it's clear which version inherited from which rather than just which
+// pid.
+func WithIdentity(identity string) Option {
+	return func(u *Upgrader) {
+		u.identity = identity
+	}
+}
+
+// PeerIdentity returns the identity the previous owner set with
+// WithIdentity. It's empty if there was no previous owner, or if it didn't
+// set one.
+func (u *Upgrader) PeerIdentity() string {
+	return u.session.ownerIdentity()
+}
+
+// ownerIdentity returns the identity the owner sent with its fds, if any.
+func (s *upgradeSession) ownerIdentity() string {
+	if s == nil || s.owner == nil {
+		return ""
+	}
+	return s.owner.Identity
+}
@@ -0,0 +1,67 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestIdentity(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	approved := make(chan string, 1)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithIdentity("v1.4.2"), WithUpgradeApproval(func(peer PeerInfo) error {
+		approved <- peer.Identity
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if upg1.PeerIdentity() != "" {
+		t.Errorf("expected no peer identity without a previous owner, got %q", upg1.PeerIdentity())
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if status, err := GetOwnerStatus(ctx, coordDir); err != nil || status.Identity != "v1.4.2" {
+		t.Fatalf("expected the owner's status to include its identity, got %+v, %v", status, err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdentity("v1.5.0"))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if upg2.PeerIdentity() != "v1.4.2" {
+		t.Errorf("expected to inherit from v1.4.2, got %q", upg2.PeerIdentity())
+	}
+	if prev, ok := upg2.PreviousOwner(); !ok || prev.Identity != "v1.4.2" {
+		t.Errorf("expected the previous owner's info to include its identity, got %v", prev)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if got := <-approved; got != "v1.5.0" {
+		t.Errorf("expected the owner to see the next owner's identity, got %q", got)
+	}
+
+	history, err := upg2.History()
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	identities := map[HistoryEventType][]string{}
+	for _, entry := range history {
+		identities[entry.Type] = append(identities[entry.Type], entry.Identity)
+	}
+	if got := identities[HistoryBecameOwner]; len(got) != 2 || got[0] != "v1.4.2" || got[1] != "v1.5.0" {
+		t.Errorf("expected each owner's identity in the history, got %v", got)
+	}
+	if got := identities[HistoryHandedOff]; len(got) != 1 || got[0] != "v1.4.2" {
+		t.Errorf("expected the hand off to be recorded with the previous owner's identity, got %v", got)
+	}
+}
@@ -0,0 +1,66 @@
+// Package clock abstracts time, so that tableroll's timeouts, retries and
+// timestamps can be driven by a fake clock in tests. It's a subset of
+// k8s.io/utils/clock, without the dependency.
+package clock
+
+import "time"
+
+// Clock tells the time, and waits for it to pass.
+type Clock interface {
+	Now() time.Time
+	Since(time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+	Sleep(d time.Duration)
+}
+
+// Timer is a time.Timer created by a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// RealClock is a Clock using the time package.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// Since returns time.Since(t).
+func (RealClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// After returns time.After(d).
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// NewTimer returns a Timer wrapping time.NewTimer(d).
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// Sleep calls time.Sleep(d).
+func (RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+func (r realTimer) Reset(d time.Duration) bool {
+	return r.t.Reset(d)
+}
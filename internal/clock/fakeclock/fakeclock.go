@@ -0,0 +1,140 @@
+// Package fakeclock provides a clock.Clock whose time only moves when it's
+// told to.
+package fakeclock
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// FakeClock is a clock.Clock whose time only moves when Step, SetTime or
+// Sleep is called, firing any timers which are then due.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+var _ clock.Clock = &FakeClock{}
+
+// NewFakeClock returns a FakeClock set to t.
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now returns the clock's current time.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Since returns how long it's been since t by the clock.
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After returns a channel which receives the clock's time once d has passed
+// on it.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer returns a Timer which fires once d has passed on the clock.
+func (f *FakeClock) NewTimer(d time.Duration) clock.Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.resetLocked(d)
+	return t
+}
+
+// Sleep advances the clock by d, as no one else would.
+func (f *FakeClock) Sleep(d time.Duration) {
+	f.Step(d)
+}
+
+// Step advances the clock by d.
+func (f *FakeClock) Step(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setTimeLocked(f.now.Add(d))
+}
+
+// SetTime sets the clock's time to t.
+func (f *FakeClock) SetTime(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.setTimeLocked(t)
+}
+
+func (f *FakeClock) setTimeLocked(t time.Time) {
+	f.now = t
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.target.After(t) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.c <- t:
+		default:
+		}
+	}
+	f.waiters = pending
+}
+
+// HasWaiters returns true if a timer is waiting for the clock to advance.
+func (f *FakeClock) HasWaiters() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters) > 0
+}
+
+type fakeTimer struct {
+	clock  *FakeClock
+	target time.Time
+	c      chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.stopLocked()
+}
+
+func (t *fakeTimer) stopLocked() bool {
+	for i, w := range t.clock.waiters {
+		if w == t {
+			t.clock.waiters = append(t.clock.waiters[:i], t.clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.stopLocked()
+	t.resetLocked(d)
+	return active
+}
+
+func (t *fakeTimer) resetLocked(d time.Duration) {
+	t.target = t.clock.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- t.clock.now:
+		default:
+		}
+		return
+	}
+	t.clock.waiters = append(t.clock.waiters, t)
+}
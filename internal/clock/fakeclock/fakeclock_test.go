@@ -0,0 +1,48 @@
+package fakeclock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	timer := c.NewTimer(time.Second)
+	stopped := c.NewTimer(time.Second)
+	if !c.HasWaiters() {
+		t.Fatal("expected the timers to be waiting")
+	}
+	if !stopped.Stop() {
+		t.Fatal("expected stopping an active timer to return true")
+	}
+
+	c.Step(999 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("expected the timer not to fire early")
+	default:
+	}
+	c.Step(time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("expected the timer to fire with the clock's time, got %v", now)
+		}
+	default:
+		t.Fatal("expected the timer to fire")
+	}
+	select {
+	case <-stopped.C():
+		t.Fatal("expected the stopped timer not to fire")
+	default:
+	}
+	if c.HasWaiters() {
+		t.Fatal("expected no timers to be waiting")
+	}
+
+	c.Sleep(time.Minute)
+	if got := c.Since(start); got != time.Minute+time.Second {
+		t.Fatalf("expected sleeping to advance the clock, got %v", got)
+	}
+}
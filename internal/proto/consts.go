@@ -3,7 +3,10 @@ package proto
 const (
 	// Version is the latest version of the protocol. It is implicitly 0 for
 	// clients that didn't yet have a protocol version
-	Version = 1
+	Version = 2
+	// LegacyVersion is the latest version of the protocol spoken on the
+	// legacy, owner-speaks-first, upgrade socket.
+	LegacyVersion = 1
 	// V0NotifyReady is the value sent at the end in the v0 protocol to indicate
 	// readyness
 	V0NotifyReady = 42
@@ -13,4 +16,8 @@ const (
 
 	// V1MessageSteppingDown is the message the old process sends in the handshake
 	V1MessageSteppingDown = "stepping down"
+
+	// MaxBlobSize is the largest json blob that will be read off the wire.
+	// Anything larger is assumed to be a misbehaving peer.
+	MaxBlobSize = 32 << 20
 )
@@ -2,7 +2,7 @@
 // tableroll processes at various versions, as well as the functions for
 // reading and writing this data off the wire.
 //
-// Currently, there are two protocol versions: v0 and v1.
+// Currently, there are three protocol versions: v0, v1, and v2.
 // The v1 protocol exists because the v0 protocol allows for a new process to
 // think it had notified the previous owner it was ready, even if the new owner
 // never read that byte.
@@ -33,4 +33,65 @@
 // which is what we want.
 // All other cases should result in O remaining the owner, or the ownership
 // transfer completing successfully.
+//
+// In v0 and v1, O begins writing file descriptors as soon as N connects, so N
+// has no way to tell O anything before the transfer starts. The v2 protocol
+// fixes that by having N speak first. Because a v1 process would never speak
+// first, v2 is served on a separate socket (see the tableroll package for
+// paths), and the v0/v1 socket continues to be served for older processes.
+//
+// In v2, every message is a Frame: a versioned, length-prefixed json blob
+// holding a message type and a body whose structure the type determines. Each
+// type is only sent by one side of the connection, the owner which accepted
+// it or the process which connected, and a Stream rejects frames of unknown
+// types or sent by the wrong side. The connecting process sends exactly one
+// Hello, as its first message; each connection carries one request, and a
+// process wanting another connects again. New message types may only be sent
+// once the receiver has said, e.g. in its Hello, that it understands them.
+//
+// An upgrade between N and O is:
+//
+// N sends 'Hello{Version: 2, Intent: "upgrade"}' to O
+// O sends either 'Rejected{Reason}', or 'Fds' followed by all file descriptors.
+// (the body of 'Fds' is O's generation, the table of file descriptors, and
+// any opaque state O's user provided for N)
+// N sends 'Ready'
+// O sends 'SteppingDown'
+//
+// After an upgrade, the connection is left open. O sends 'DrainComplete' once
+// it has finished draining, and closes the connection. Fds which only one
+// process may use at a time are withheld from 'Fds', and are instead sent in
+// 'ExclusiveFds' just before 'DrainComplete'. N treats the
+// connection closing without it as O having exited.
+//
+// If N's Hello sets 'Handshake', N and O first exchange any number of
+// 'HandshakeJSON' and 'HandshakeFds' messages, as their users decide, until
+// each has sent 'HandshakeReady'. O may send 'Rejected' at any point instead.
+//
+// N's Hello may carry its trace context, which O uses as the parent of its
+// own spans for the upgrade.
+//
+// If O inherited its file descriptors but its user hasn't yet marked it
+// ready, it sends 'Rejected{Code: "not-ready", RetryAfter}' in response to
+// any Hello.
+//
+// If N gives up on the upgrade after receiving file descriptors, it closes
+// them and may send 'FdsReleased' instead of 'Ready', so that O knows N no
+// longer holds copies of them.
+//
+// If O's user makes commits manual, O waits after N's 'Ready' until its user,
+// or a controlling process C, decides before sending 'SteppingDown', or
+// 'Rejected{Reason}' if the upgrade is aborted. C connects to O's socket and
+// sends 'Hello{Version: 2, Intent: "commit"}' or
+// 'Hello{Version: 2, Intent: "abort", Reason}', and O replies 'Decided' or
+// 'Rejected{Reason}'.
+//
+// The failure modes are the same as v1. N may instead send an Intent of
+// "takeover", in which case O sends 'SteppingDown' without passing any file
+// descriptors.
+//
+// A canary process S may send 'Hello{Version: 2, Intent: "shadow", Shadow}'
+// listing ids of listeners or packet conns. O sends 'Rejected{Reason}', or
+// 'Fds' followed by copies of just those file descriptors, and closes the
+// connection. O remains the owner, and S may later upgrade as N would.
 package proto
@@ -6,8 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-
-	"github.com/pkg/errors"
 )
 
 // WriteVersionedJSONBlob writes a JSON blob to the given writer. It expects
@@ -54,7 +52,12 @@ func WriteJSONBlob(dst io.Writer, obj interface{}) error {
 func ReadVersionedJSONBlob(src io.Reader, obj interface{}) (uint32, error) {
 	var jsonLen int32
 	if err := binary.Read(src, binary.BigEndian, &jsonLen); err != nil {
-		return 0, errors.Wrap(err, "protocol error: could not read length of json")
+		return 0, fmt.Errorf("protocol error: could not read length of json: %w", err)
+	}
+	// The length is provided by our peer, which may be buggy, so check it
+	// before allocating anything.
+	if jsonLen < 0 || jsonLen > MaxBlobSize {
+		return 0, &BlobSizeError{Size: jsonLen}
 	}
 
 	// don't decode directly from src, but rathre go through a buffer, because
@@ -62,7 +65,7 @@ func ReadVersionedJSONBlob(src io.Reader, obj interface{}) (uint32, error) {
 	// lose fd's being sent across a socket.
 	data := make([]byte, jsonLen)
 	if n, err := io.ReadFull(src, data); err != nil || n != int(jsonLen) {
-		return 0, errors.Wrapf(err, "unable to read expected meta json length (expected %v, got (%v, %v))", jsonLen, n, err)
+		return 0, fmt.Errorf("unable to read expected meta json length (expected %v, got %v): %w", jsonLen, n, err)
 	}
 	var prefix []byte
 	for i := 0; i < len(data); i++ {
@@ -73,15 +76,25 @@ func ReadVersionedJSONBlob(src io.Reader, obj interface{}) (uint32, error) {
 	}
 	version, err := decodeVersion(prefix)
 	if err != nil {
-		return 0, errors.Wrapf(err, "could not determine version from prefix")
+		return 0, fmt.Errorf("could not determine version from prefix: %w", err)
 	}
 
 	if err := json.Unmarshal(data, obj); err != nil {
-		return 0, errors.Wrap(err, "can't decode names from owner process")
+		return 0, fmt.Errorf("can't decode names from owner process: %w", err)
 	}
 	return version, nil
 }
 
+// BlobSizeError is returned when a peer announces a json blob which is
+// negative in length or larger than MaxBlobSize.
+type BlobSizeError struct {
+	Size int32
+}
+
+func (e *BlobSizeError) Error() string {
+	return fmt.Sprintf("protocol error: json blob length %d is not within [0, %d]", e.Size, MaxBlobSize)
+}
+
 // ReadJSONBlob reads a length-prefixed json blob written by WriteJSONBlob.
 func ReadJSONBlob(src io.Reader, obj interface{}) error {
 	_, err := ReadVersionedJSONBlob(src, obj)
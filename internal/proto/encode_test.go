@@ -0,0 +1,34 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadBlobSizeLimit(t *testing.T) {
+	for _, size := range []int32{-1, MaxBlobSize + 1} {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, size)
+		var obj interface{}
+		err := ReadJSONBlob(&buf, &obj)
+		if _, ok := err.(*BlobSizeError); !ok {
+			t.Errorf("expected size error for length %v, got %T %v", size, err, err)
+		}
+	}
+}
+
+func TestJSONBlobRoundtrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteVersionedJSONBlob(&buf, Message{Msg: "hello"}, Version); err != nil {
+		t.Fatal(err)
+	}
+	var msg Message
+	version, err := ReadVersionedJSONBlob(&buf, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != Version || msg.Msg != "hello" {
+		t.Fatalf("roundtrip mismatch: %v %+v", version, msg)
+	}
+}
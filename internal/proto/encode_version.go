@@ -21,8 +21,14 @@ func encodeVersion(version uint32) []byte {
 	return result
 }
 
+// maxVersionCrumbs is the most crumbs a uint32 can be encoded as.
+const maxVersionCrumbs = 16
+
 // decodeVersion decodes a version from a json-ignorable sequence of whitespace
 func decodeVersion(data []byte) (uint32, error) {
+	if len(data) > maxVersionCrumbs {
+		return 0, fmt.Errorf("version prefix of %d chars is too long for a uint32", len(data))
+	}
 	var version uint32
 	for i := len(data) - 1; i >= 0; i-- {
 		crumb, err := decodeCrumb(data[i])
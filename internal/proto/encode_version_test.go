@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"bytes"
 	"testing"
 	"testing/quick"
 )
@@ -40,3 +41,9 @@ func TestQuickcheckVersionEncodeDecode(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestDecodeVersionTooLong(t *testing.T) {
+	if _, err := decodeVersion(bytes.Repeat([]byte{'\t'}, maxVersionCrumbs+1)); err == nil {
+		t.Fatal("expected an error decoding a version prefix longer than a uint32")
+	}
+}
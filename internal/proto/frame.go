@@ -0,0 +1,365 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Frame is the unit of communication in the v2+ protocol. Every message in
+// either direction is a single Frame, written as a versioned json blob.
+type Frame struct {
+	Type MessageType `json:"type"`
+	// Body is the message-specific body. Its structure is determined by Type.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// MessageType identifies the body of a Frame.
+type MessageType string
+
+const (
+	// MessageHello is the first message sent by the connecting process. Its
+	// body is a Hello.
+	MessageHello MessageType = "hello"
+	// MessageFds is sent by the owner in response to an upgrade request. Its
+	// body is the table of file descriptors, which are sent immediately after
+	// it.
+	MessageFds MessageType = "fds"
+	// MessageReady is sent by the new process once it is ready to take over.
+	MessageReady MessageType = "ready"
+	// MessageSteppingDown is sent by the owner to acknowledge it is no longer
+	// the owner.
+	MessageSteppingDown MessageType = "stepping-down"
+	// MessageRejected is sent by the owner to refuse a request. Its body is a
+	// Rejection.
+	MessageRejected MessageType = "rejected"
+	// MessageFdsReleased may be sent by the new process instead of
+	// MessageReady if it gives up on the upgrade after receiving file
+	// descriptors. It confirms that it closed all of them.
+	MessageFdsReleased MessageType = "fds-released"
+	// MessageDrainComplete is sent by the previous owner after an upgrade,
+	// once it has finished draining.
+	MessageDrainComplete MessageType = "drain-complete"
+	// MessageExclusiveFds may be sent by the previous owner just before
+	// MessageDrainComplete. Like MessageFds, its body is a table of file
+	// descriptors, which are sent immediately after it.
+	MessageExclusiveFds MessageType = "exclusive-fds"
+	// MessageHandshakeJSON carries an arbitrary json body between the
+	// processes during a custom handshake.
+	MessageHandshakeJSON MessageType = "handshake-json"
+	// MessageHandshakeFds is sent during a custom handshake. Its body is a
+	// HandshakeFds, and the file descriptors it lists are sent immediately
+	// after it.
+	MessageHandshakeFds MessageType = "handshake-fds"
+	// MessageHandshakeReady is sent by each process once it's done with a
+	// custom handshake.
+	MessageHandshakeReady MessageType = "handshake-ready"
+	// MessageDecided is sent by the owner in response to a commit or abort
+	// request once it has been acted on.
+	MessageDecided MessageType = "decided"
+	// MessageStatus is sent by the owner in response to other control
+	// requests. Its body describes the owner after acting on the request.
+	MessageStatus MessageType = "status"
+	// MessageChainShutdown is sent by the owner to the previous owner, on the
+	// connection it used to upgrade, when it's shutting the service down.
+	MessageChainShutdown MessageType = "chain-shutdown"
+	// MessageAuthChallenge is sent by the owner in response to a Hello with
+	// an AuthNonce. Its body is an AuthChallenge.
+	MessageAuthChallenge MessageType = "auth-challenge"
+	// MessageConn may be sent by the previous owner while it drains, to pass
+	// a connection to the new owner. Its body is a Conn, and the connection's
+	// file descriptor is sent immediately after it.
+	MessageConn MessageType = "conn"
+	// MessageAuthResponse is sent by the connecting process in response to a
+	// MessageAuthChallenge. Its body is an AuthResponse.
+	MessageAuthResponse MessageType = "auth-response"
+	// MessageHeartbeat may be sent by either process on the connection used
+	// to upgrade, once the upgrade is complete, to check the other is still
+	// responsive. It must be answered with a MessageHeartbeatAck. A process
+	// may only send it once the other has said it understands it, with
+	// Hello.Heartbeats or the fd table.
+	MessageHeartbeat MessageType = "heartbeat"
+	// MessageHeartbeatAck answers a MessageHeartbeat.
+	MessageHeartbeatAck MessageType = "heartbeat-ack"
+	// MessageHandbackAck is sent by the owner once it has resumed ownership
+	// after the new process sent MessageFdsReleased. It's only sent if the
+	// new process set Hello.Handback.
+	MessageHandbackAck MessageType = "handback-ack"
+)
+
+// Intent is what the connecting process wants from the owner.
+type Intent string
+
+const (
+	// IntentUpgrade requests all file descriptors in order to become the next
+	// owner.
+	IntentUpgrade Intent = "upgrade"
+	// IntentTakeover requests that the owner step down and begin draining
+	// without passing any file descriptors.
+	IntentTakeover Intent = "takeover"
+	// IntentCommit asks an owner using manual commits to commit the upgrade
+	// it's awaiting a decision on.
+	IntentCommit Intent = "commit"
+	// IntentAbort asks an owner using manual commits to abort the upgrade
+	// it's awaiting a decision on, giving the Hello's Reason.
+	IntentAbort Intent = "abort"
+	// IntentStatus asks the owner for its status.
+	IntentStatus Intent = "status"
+	// IntentPause asks the owner to reject upgrades, giving the Hello's
+	// Reason, until it's asked to resume them.
+	IntentPause Intent = "pause"
+	// IntentResume asks the owner to accept upgrades again.
+	IntentResume Intent = "resume"
+	// IntentForceDrain asks the owner to start draining without passing on
+	// its file descriptors.
+	IntentForceDrain Intent = "force-drain"
+	// IntentShadow requests copies of the file descriptors named in the
+	// Hello's Shadow, without taking ownership.
+	IntentShadow Intent = "shadow"
+)
+
+// Hello is the body of a MessageHello.
+type Hello struct {
+	Version int32  `json:"version"`
+	Intent  Intent `json:"intent"`
+	// Candidate is set if the connecting process took part in an upgrade
+	// election.
+	Candidate *Candidate `json:"candidate,omitempty"`
+	// Handshake is set if the connecting process wants to perform a custom
+	// handshake before the owner sends its fds.
+	Handshake bool `json:"handshake,omitempty"`
+	// TraceContext is the connecting process's trace context, if it's
+	// tracing the upgrade.
+	TraceContext map[string]string `json:"traceContext,omitempty"`
+	// Reason is set with IntentAbort and IntentPause.
+	Reason string `json:"reason,omitempty"`
+	// Identity describes the connecting process, such as its version, if it
+	// set one.
+	Identity string `json:"identity,omitempty"`
+	// AuthNonce is set if the connecting process wants to authenticate with
+	// a shared secret. It's a random challenge for the owner.
+	AuthNonce []byte `json:"authNonce,omitempty"`
+	// AcceptsConns is set if the connecting process can receive connections
+	// in MessageConn frames once it's the owner.
+	AcceptsConns bool `json:"acceptsConns,omitempty"`
+	// Heartbeats is set if the connecting process answers MessageHeartbeat
+	// frames once it's the owner, and keeps the connection open until it
+	// exits.
+	Heartbeats bool `json:"heartbeats,omitempty"`
+	// Handback is set if the connecting process waits for a
+	// MessageHandbackAck after sending MessageFdsReleased.
+	Handback bool `json:"handback,omitempty"`
+	// Shadow lists the ids of the file descriptors requested with
+	// IntentShadow.
+	Shadow []string `json:"shadow,omitempty"`
+	// Platform describes what the connecting process runs on.
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// Platform describes what a process runs on, so that processes which can't
+// share fds can refuse to hand off to one another.
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// ImageDigest is the digest of the container image the process runs in,
+	// if it was configured.
+	ImageDigest string `json:"imageDigest,omitempty"`
+}
+
+// Conn is the body of a MessageConn.
+type Conn struct {
+	ID    string `json:"id"`
+	State []byte `json:"state,omitempty"`
+}
+
+// AuthChallenge is the body of a MessageAuthChallenge.
+type AuthChallenge struct {
+	// Nonce is the owner's random challenge for the connecting process.
+	Nonce []byte `json:"nonce"`
+	// MAC proves the owner knows the shared secret: it's an HMAC of the
+	// Hello's AuthNonce and Nonce.
+	MAC []byte `json:"mac"`
+}
+
+// AuthResponse is the body of a MessageAuthResponse.
+type AuthResponse struct {
+	// MAC proves the connecting process knows the shared secret: it's an
+	// HMAC of the AuthChallenge's Nonce and the Hello's AuthNonce.
+	MAC []byte `json:"mac"`
+}
+
+// HandshakeFds is the body of a MessageHandshakeFds.
+type HandshakeFds struct {
+	Names []string `json:"names"`
+}
+
+// Candidate describes a process taking part in an upgrade election.
+type Candidate struct {
+	Pid       int       `json:"pid"`
+	Priority  int       `json:"priority"`
+	StartTime time.Time `json:"startTime"`
+}
+
+// RejectionCode is a machine-readable reason for a Rejection.
+type RejectionCode string
+
+const (
+	// RejectionLostElection indicates the connecting process lost an upgrade
+	// election to the owner.
+	RejectionLostElection RejectionCode = "lost-election"
+	// RejectionNotReady indicates the process the connecting process reached
+	// inherited its fds, but isn't ready to pass them on yet.
+	RejectionNotReady RejectionCode = "not-ready"
+	// RejectionPaused indicates the owner's upgrades are paused. The
+	// rejection's Reason is the reason they were paused.
+	RejectionPaused RejectionCode = "paused"
+	// RejectionShutDown indicates the owner is shutting the service down, so
+	// won't be upgraded.
+	RejectionShutDown RejectionCode = "shut-down"
+	// RejectionVersionTooOld indicates the connecting process's version is
+	// older than the owner accepts.
+	RejectionVersionTooOld RejectionCode = "version-too-old"
+	// RejectionBusy indicates the owner is handing off its fds to another
+	// process, or already has.
+	RejectionBusy RejectionCode = "busy"
+	// RejectionUnauthenticated indicates the connecting process didn't
+	// authenticate with the owner's shared secret.
+	RejectionUnauthenticated RejectionCode = "unauthenticated"
+	// RejectionCircuitOpen indicates upgrades from the connecting process's
+	// executable have failed repeatedly, so the owner refuses them until the
+	// rejection's RetryAfter has passed.
+	RejectionCircuitOpen RejectionCode = "circuit-open"
+	// RejectionPlatformMismatch indicates the connecting process runs on a
+	// different platform than the owner. The rejection's Platform is the
+	// owner's.
+	RejectionPlatformMismatch RejectionCode = "platform-mismatch"
+)
+
+// Rejection is the body of a MessageRejected.
+type Rejection struct {
+	Reason string `json:"reason"`
+	// Code is optional, and set for rejections which the connecting process
+	// may want to handle specially.
+	Code RejectionCode `json:"code,omitempty"`
+	// RetryAfter is optional, and suggests how long to wait before trying
+	// again.
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+	// MinimumVersion is set with RejectionVersionTooOld to the oldest version
+	// the owner accepts.
+	MinimumVersion string `json:"minimumVersion,omitempty"`
+	// Platform is set with RejectionPlatformMismatch to the owner's platform.
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// WriteFrame writes a frame of the given type, with body json-encoded into
+// the frame. A nil body results in a frame with no body.
+func WriteFrame(dst io.Writer, typ MessageType, body interface{}) error {
+	frame := Frame{Type: typ}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("could not encode %s message: %w", typ, err)
+		}
+		frame.Body = data
+	}
+	return WriteVersionedJSONBlob(dst, frame, Version)
+}
+
+// ReadFrame reads a single frame written by WriteFrame.
+func ReadFrame(src io.Reader) (*Frame, error) {
+	var frame Frame
+	if _, err := ReadVersionedJSONBlob(src, &frame); err != nil {
+		return nil, err
+	}
+	if frame.Type == "" {
+		return nil, errors.New("protocol error: frame has no type")
+	}
+	return &frame, nil
+}
+
+// DecodeFrame decodes a frame from data, which must hold exactly one frame as
+// written by WriteFrame. It's equivalent to ReadFrame, but suits fuzzing.
+func DecodeFrame(data []byte) (*Frame, error) {
+	src := bytes.NewReader(data)
+	frame, err := ReadFrame(src)
+	if err != nil {
+		return nil, err
+	}
+	if src.Len() != 0 {
+		return nil, fmt.Errorf("protocol error: %d bytes after frame", src.Len())
+	}
+	return frame, nil
+}
+
+// DecodeHello decodes the body of a MessageHello frame, and checks the
+// connecting process speaks a version of the protocol which has one.
+func DecodeHello(frame *Frame) (*Hello, error) {
+	if frame.Type != MessageHello {
+		return nil, fmt.Errorf("protocol error: expected %s message, got %s", MessageHello, frame.Type)
+	}
+	var hello Hello
+	if err := frame.Decode(&hello); err != nil {
+		return nil, err
+	}
+	if hello.Version < 2 {
+		return nil, fmt.Errorf("unexpected protocol version in hello: %v", hello.Version)
+	}
+	return &hello, nil
+}
+
+// Decode decodes the frame's body into obj.
+func (f *Frame) Decode(obj interface{}) error {
+	if len(f.Body) == 0 {
+		return fmt.Errorf("protocol error: %s message has no body", f.Type)
+	}
+	if err := json.Unmarshal(f.Body, obj); err != nil {
+		return fmt.Errorf("could not decode %s message: %w", f.Type, err)
+	}
+	return nil
+}
+
+// ReadFrameOfType reads a frame and returns an error if it isn't of the
+// expected type. A MessageRejected frame is returned as a *RejectedError.
+func ReadFrameOfType(src io.Reader, typ MessageType) (*Frame, error) {
+	frame, err := ReadFrame(src)
+	if err != nil {
+		return nil, err
+	}
+	return checkFrameType(frame, typ)
+}
+
+// checkFrameType returns frame if it's of the expected type, or otherwise an
+// error, which is a *RejectedError for a MessageRejected frame.
+func checkFrameType(frame *Frame, typ MessageType) (*Frame, error) {
+	if frame.Type == typ {
+		return frame, nil
+	}
+	if frame.Type == MessageRejected {
+		var rejection Rejection
+		if err := frame.Decode(&rejection); err != nil {
+			return nil, err
+		}
+		if rejection.RetryAfter < 0 {
+			rejection.RetryAfter = 0
+		}
+		return nil, &RejectedError{Reason: rejection.Reason, Code: rejection.Code, RetryAfter: rejection.RetryAfter, MinimumVersion: rejection.MinimumVersion, Platform: rejection.Platform}
+	}
+	return nil, fmt.Errorf("protocol error: expected %s message, got %s", typ, frame.Type)
+}
+
+// RejectedError is returned by ReadFrameOfType when the peer sent a
+// MessageRejected.
+type RejectedError struct {
+	Reason         string
+	Code           RejectionCode
+	RetryAfter     time.Duration
+	MinimumVersion string
+	Platform       *Platform
+}
+
+func (e *RejectedError) Error() string {
+	return "rejected by peer: " + e.Reason
+}
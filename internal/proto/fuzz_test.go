@@ -0,0 +1,91 @@
+//go:build go1.18
+// +build go1.18
+
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func addFrameSeeds(f *testing.F) {
+	for _, seed := range []struct {
+		typ  MessageType
+		body interface{}
+	}{
+		{MessageHello, Hello{Version: Version, Intent: IntentUpgrade, Candidate: &Candidate{Pid: 1, Priority: 2}}},
+		{MessageRejected, Rejection{Reason: "no", Code: RejectionNotReady, RetryAfter: 1}},
+		{MessageHandshakeFds, HandshakeFds{Names: []string{"a", "b"}}},
+		{MessageReady, nil},
+	} {
+		var buf bytes.Buffer
+		if err := WriteFrame(&buf, seed.typ, seed.body); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	var legacy bytes.Buffer
+	if err := WriteJSONBlob(&legacy, Message{Msg: V1MessageSteppingDown}); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(legacy.Bytes())
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	addFrameSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		frame, err := DecodeFrame(data)
+		if err != nil {
+			return
+		}
+		if frame.Type == "" {
+			t.Fatal("decoded a frame with no type")
+		}
+		// anything we accept must survive being passed on
+		var buf bytes.Buffer
+		if err := WriteVersionedJSONBlob(&buf, frame, Version); err != nil {
+			t.Fatalf("could not re-encode frame: %v", err)
+		}
+		again, err := DecodeFrame(buf.Bytes())
+		if err != nil {
+			t.Fatalf("could not decode re-encoded frame: %v", err)
+		}
+		if again.Type != frame.Type {
+			t.Fatalf("type changed from %q to %q", frame.Type, again.Type)
+		}
+		if hello, err := DecodeHello(frame); err == nil && hello.Version < 2 {
+			t.Fatalf("accepted hello with version %v", hello.Version)
+		}
+	})
+}
+
+func FuzzReadFrameOfType(f *testing.F) {
+	addFrameSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := ReadFrameOfType(bytes.NewReader(data), MessageReady)
+		if rejected, ok := err.(*RejectedError); ok && rejected.RetryAfter < 0 {
+			t.Fatalf("rejection with negative retry after %v", rejected.RetryAfter)
+		}
+	})
+}
+
+func FuzzReadVersionedJSONBlob(f *testing.F) {
+	for _, version := range []uint32{0, 1, Version, 1<<32 - 1} {
+		var buf bytes.Buffer
+		if err := WriteVersionedJSONBlob(&buf, Message{Msg: "hello"}, version); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var obj interface{}
+		version, err := ReadVersionedJSONBlob(bytes.NewReader(data), &obj)
+		if err != nil {
+			return
+		}
+		back, err := decodeVersion(encodeVersion(version))
+		if err != nil || back != version {
+			t.Fatalf("version %v doesn't roundtrip: %v, %v", version, back, err)
+		}
+	})
+}
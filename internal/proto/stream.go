@@ -0,0 +1,147 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Role is the part a process plays on one connection to an upgrade socket.
+// Roles are fixed for the connection's lifetime: the process which accepted
+// it remains RoleOwner even once it has handed off ownership and is draining.
+type Role string
+
+const (
+	// RoleOwner is the process which accepted the connection.
+	RoleOwner Role = "owner"
+	// RoleConnecting is the process which connected, such as a new process
+	// or a controller.
+	RoleConnecting Role = "connecting"
+)
+
+// messageSpec describes the frames of one MessageType.
+type messageSpec struct {
+	// from is the role which sends it, or "" if either may.
+	from Role
+	// body is set if the frame must have a body.
+	body bool
+}
+
+// messages describes every MessageType. A process may only send a type its
+// peer doesn't know, i.e. one added in a later version, once the peer has
+// said it understands it, as Hello.AcceptsConns does for MessageConn; a
+// Stream treats any other unknown type as a protocol error.
+var messages = map[MessageType]messageSpec{
+	MessageHello:          {from: RoleConnecting, body: true},
+	MessageFds:            {from: RoleOwner, body: true},
+	MessageReady:          {from: RoleConnecting},
+	MessageSteppingDown:   {from: RoleOwner},
+	MessageRejected:       {from: RoleOwner, body: true},
+	MessageFdsReleased:    {from: RoleConnecting},
+	MessageDrainComplete:  {from: RoleOwner},
+	MessageExclusiveFds:   {from: RoleOwner, body: true},
+	MessageHandshakeJSON:  {body: true},
+	MessageHandshakeFds:   {body: true},
+	MessageHandshakeReady: {},
+	MessageDecided:        {from: RoleOwner},
+	MessageStatus:         {from: RoleOwner, body: true},
+	MessageChainShutdown:  {from: RoleConnecting},
+	MessageAuthChallenge:  {from: RoleOwner, body: true},
+	MessageConn:           {from: RoleOwner, body: true},
+	MessageAuthResponse:   {from: RoleConnecting, body: true},
+	MessageHeartbeat:      {},
+	MessageHeartbeatAck:   {},
+	MessageHandbackAck:    {from: RoleOwner},
+}
+
+// Validate checks that the frame is of a known type, which a process with
+// the given role may send, and has a body if its type requires one.
+func (f *Frame) Validate(from Role) error {
+	spec, ok := messages[f.Type]
+	if !ok {
+		return fmt.Errorf("protocol error: unknown message type %q", f.Type)
+	}
+	if spec.from != "" && spec.from != from {
+		return fmt.Errorf("protocol error: %s message can't be sent by the %s", f.Type, from)
+	}
+	if spec.body && len(f.Body) == 0 {
+		return fmt.Errorf("protocol error: %s message has no body", f.Type)
+	}
+	return nil
+}
+
+// ErrRepeatedHello is returned by a Stream when the connecting process sends
+// a second hello. Each connection carries exactly one request.
+var ErrRepeatedHello = errors.New("protocol error: only one hello may be sent per connection")
+
+// Stream reads and writes the v2 frames of one connection, checking those it
+// reads are valid for the peer's role and in order: a connecting process
+// must send exactly one hello, as its first message.
+//
+// A Stream doesn't buffer, so file descriptors which follow a frame may be
+// read from the underlying connection directly. It isn't safe for concurrent
+// use.
+type Stream struct {
+	rw   io.ReadWriter
+	peer Role
+	// hello is set once the connecting process's hello has been read, or
+	// sent.
+	hello bool
+}
+
+// NewStream returns a Stream over rw, whose other end plays the given role.
+func NewStream(rw io.ReadWriter, peer Role) *Stream {
+	return &Stream{rw: rw, peer: peer}
+}
+
+// ReadFrame reads and validates a frame from the peer.
+func (s *Stream) ReadFrame() (*Frame, error) {
+	var frame Frame
+	version, err := ReadVersionedJSONBlob(s.rw, &frame)
+	if err != nil {
+		return nil, err
+	}
+	if version < 2 {
+		return nil, fmt.Errorf("protocol error: frame has version %d, frames were added in 2", version)
+	}
+	if frame.Type == "" {
+		return nil, errors.New("protocol error: frame has no type")
+	}
+	if err := frame.Validate(s.peer); err != nil {
+		return nil, err
+	}
+	if s.peer == RoleConnecting {
+		if frame.Type == MessageHello {
+			if s.hello {
+				return nil, ErrRepeatedHello
+			}
+			s.hello = true
+		} else if !s.hello {
+			return nil, fmt.Errorf("protocol error: expected %s message first, got %s", MessageHello, frame.Type)
+		}
+	}
+	return &frame, nil
+}
+
+// ReadFrameOfType reads a frame as ReadFrame does, and returns an error if it
+// isn't of the expected type. A MessageRejected frame is returned as a
+// *RejectedError.
+func (s *Stream) ReadFrameOfType(typ MessageType) (*Frame, error) {
+	frame, err := s.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return checkFrameType(frame, typ)
+}
+
+// WriteFrame writes a frame of the given type to the peer, as WriteFrame
+// does.
+func (s *Stream) WriteFrame(typ MessageType, body interface{}) error {
+	if s.peer == RoleOwner && typ == MessageHello {
+		if s.hello {
+			return ErrRepeatedHello
+		}
+		s.hello = true
+	}
+	return WriteFrame(s.rw, typ, body)
+}
@@ -0,0 +1,91 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamRequiresOneHello(t *testing.T) {
+	var buf bytes.Buffer
+	owner := NewStream(&buf, RoleConnecting)
+
+	if err := WriteFrame(&buf, MessageReady, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owner.ReadFrame(); err == nil {
+		t.Fatalf("expected a frame before the hello to be rejected")
+	}
+
+	buf.Reset()
+	for i := 0; i < 2; i++ {
+		if err := WriteFrame(&buf, MessageHello, Hello{Version: Version, Intent: IntentUpgrade}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := owner.ReadFrameOfType(MessageHello); err != nil {
+		t.Fatalf("error reading hello: %v", err)
+	}
+	if _, err := owner.ReadFrame(); err != ErrRepeatedHello {
+		t.Fatalf("expected ErrRepeatedHello, got %v", err)
+	}
+
+	connecting := NewStream(&buf, RoleOwner)
+	if err := connecting.WriteFrame(MessageHello, Hello{Version: Version}); err != nil {
+		t.Fatal(err)
+	}
+	if err := connecting.WriteFrame(MessageHello, Hello{Version: Version}); err != ErrRepeatedHello {
+		t.Fatalf("expected ErrRepeatedHello writing a second hello, got %v", err)
+	}
+}
+
+func TestStreamValidatesFrames(t *testing.T) {
+	for _, tc := range []struct {
+		from  Role
+		typ   MessageType
+		body  interface{}
+		valid bool
+	}{
+		{RoleOwner, MessageFds, fdTableBody{}, true},
+		{RoleOwner, MessageType("observe"), nil, false},
+		{RoleOwner, MessageReady, nil, false},
+		{RoleOwner, MessageAuthChallenge, nil, false},
+		{RoleConnecting, MessageReady, nil, true},
+		{RoleConnecting, MessageFds, fdTableBody{}, false},
+		{RoleConnecting, MessageHandshakeReady, nil, true},
+	} {
+		var buf bytes.Buffer
+		reader := NewStream(&buf, tc.from)
+		if tc.from == RoleConnecting {
+			if err := WriteFrame(&buf, MessageHello, Hello{Version: Version}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := reader.ReadFrame(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := WriteFrame(&buf, tc.typ, tc.body); err != nil {
+			t.Fatal(err)
+		}
+		_, err := reader.ReadFrame()
+		if tc.valid && err != nil {
+			t.Errorf("expected %s from the %s to be valid, got %v", tc.typ, tc.from, err)
+		} else if !tc.valid && err == nil {
+			t.Errorf("expected %s from the %s to be rejected", tc.typ, tc.from)
+		}
+	}
+}
+
+// fdTableBody stands in for the tableroll package's fd table.
+type fdTableBody struct {
+	Fds []string `json:"fds"`
+}
+
+func TestStreamRejectsLegacyFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteVersionedJSONBlob(&buf, Frame{Type: MessageHello, Body: []byte("{}")}, LegacyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStream(&buf, RoleConnecting).ReadFrame(); err == nil {
+		t.Fatalf("expected a frame with a legacy version to be rejected")
+	}
+}
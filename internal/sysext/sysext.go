@@ -0,0 +1,46 @@
+// Package sysext holds the system calls some of tableroll's integrations need
+// which the syscall package doesn't provide. They're implemented using
+// golang.org/x/sys by the subpackages which register them here, so that the
+// core package builds with the standard library alone, and only programs
+// which import those subpackages depend on anything more.
+//
+// Each hook is nil until its subpackage is imported, and is set once, from
+// that package's init.
+package sysext
+
+import (
+	"net"
+	"os"
+)
+
+// Vsock is registered by github.com/ngrok/tableroll/vsock.
+var Vsock struct {
+	// Listen returns a listening AF_VSOCK socket bound to cid and port.
+	Listen func(cid, port uint32) (*os.File, error)
+	// FileListener returns a listener using a copy of the listening AF_VSOCK
+	// socket fd, named name. Its address and those of its connections are
+	// described by addr.
+	FileListener func(fd uintptr, name string, addr func(cid, port uint32) net.Addr) (net.Listener, error)
+}
+
+// ReusePort is registered by github.com/ngrok/tableroll/reuseport.
+var ReusePort struct {
+	// Set sets SO_REUSEPORT on the socket fd.
+	Set func(fd uintptr) error
+	// NewSteeringMap returns a REUSEPORT_SOCKARRAY map to steer a group with.
+	NewSteeringMap func() (*os.File, error)
+	// AttachSteeringProgram attaches a program to sockFd's group which steers
+	// its traffic to the socket in mapFd.
+	AttachSteeringProgram func(mapFd, sockFd uintptr) error
+	// SteerTo stores sockFd in mapFd, steering its group's traffic to it.
+	SteerTo func(mapFd, sockFd uintptr) error
+}
+
+// SealedMemory is registered by github.com/ngrok/tableroll/sealedmem.
+var SealedMemory struct {
+	// New returns a memfd holding data, sealed against modification.
+	New func(name string, data []byte) (*os.File, error)
+	// Read returns the contents of a memfd created by New, after checking
+	// it's still sealed and no larger than maxSize.
+	Read func(fd uintptr, maxSize int) ([]byte, error)
+}
@@ -0,0 +1,114 @@
+package tableroll
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The coordination directory is shared by every process in an upgrade chain,
+// which may be running different versions of tableroll, so its layout is
+// versioned. The version is recorded in a "layout" file, which a process
+// checks once it holds the lock. If the directory has an older layout, the
+// process migrates it in place before going on; if it has a newer one, which
+// this version of tableroll doesn't understand, it fails with a
+// *LayoutVersionError rather than guess.
+//
+// Migrations run while the owner, which may be using the older layout, is
+// still running and about to hand off its fds, so each must leave the
+// directory usable by processes on the previous layout until they've stepped
+// down.
+
+// CurrentLayoutVersion is the version of the coordination directory's layout
+// this version of tableroll uses. Directories written by versions of
+// tableroll from before layouts were versioned are version 0.
+const CurrentLayoutVersion = 1
+
+// layoutMigrations[i] migrates the coordination directory from layout version
+// i to version i+1.
+var layoutMigrations = []func(c *coordinator) error{
+	// version 1 is the layout from before versioning, stamped
+	func(c *coordinator) error { return nil },
+}
+
+// LayoutVersionError is returned when the coordination directory's layout is
+// newer than this version of tableroll supports, because a newer version of
+// tableroll has used it. Processes using this version can't join the upgrade
+// chain, or read the directory, until it's upgraded.
+type LayoutVersionError struct {
+	Dir       string
+	Version   int
+	Supported int
+}
+
+func (e *LayoutVersionError) Error() string {
+	return fmt.Sprintf("coordination dir %q has layout version %d, but only versions up to %d are supported; upgrade tableroll", e.Dir, e.Version, e.Supported)
+}
+
+func layoutPath(dir string) string {
+	return filepath.Join(dir, "layout")
+}
+
+// readLayoutVersion returns the layout version of the coordination directory.
+func readLayoutVersion(dir string) (int, error) {
+	data, err := ioutil.ReadFile(layoutPath(dir))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("unable to parse layout version out of data %q", string(data))
+	}
+	return version, nil
+}
+
+// checkLayoutReadable returns a *LayoutVersionError if the coordination
+// directory's layout is too new to be read by this version.
+func checkLayoutReadable(dir string) error {
+	version, err := readLayoutVersion(dir)
+	if err != nil {
+		return err
+	}
+	if version > CurrentLayoutVersion {
+		return &LayoutVersionError{Dir: dir, Version: version, Supported: CurrentLayoutVersion}
+	}
+	return nil
+}
+
+// migrateLayout brings the coordination directory up to the current layout
+// version. It should only be called while the lock is held.
+func (c *coordinator) migrateLayout() error {
+	version, err := readLayoutVersion(c.dir)
+	if err != nil {
+		return classifyCoordinationErr(c.dir, "read layout version", err)
+	}
+	if version > CurrentLayoutVersion {
+		return &LayoutVersionError{Dir: c.dir, Version: version, Supported: CurrentLayoutVersion}
+	}
+	for ; version < CurrentLayoutVersion; version++ {
+		c.l.Info("migrating coordination dir layout", "from", version, "to", version+1)
+		if err := layoutMigrations[version](c); err != nil {
+			return classifyCoordinationErr(c.dir, fmt.Sprintf("migrate layout to version %d", version+1), err)
+		}
+		// record each step, so a failed migration resumes where it stopped
+		if err := c.writeLayoutVersion(version + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *coordinator) writeLayoutVersion(version int) error {
+	tmp := layoutPath(c.dir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(version)), 0644); err != nil {
+		return classifyCoordinationErr(c.dir, "write layout version", err)
+	}
+	err := os.Rename(tmp, layoutPath(c.dir))
+	return classifyCoordinationErr(c.dir, "write layout version", err)
+}
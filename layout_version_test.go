@@ -0,0 +1,68 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestLayoutVersion(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if version, err := readLayoutVersion(coordDir); err != nil || version != CurrentLayoutVersion {
+		t.Fatalf("expected a new dir to be stamped with version %d, got %d, %v", CurrentLayoutVersion, version, err)
+	}
+
+	// an owner from before layouts were versioned
+	if err := os.Remove(layoutPath(coordDir)); err != nil {
+		t.Fatal(err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading from an unversioned dir: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if version, err := readLayoutVersion(coordDir); err != nil || version != CurrentLayoutVersion {
+		t.Fatalf("expected the dir to be migrated to version %d, got %d, %v", CurrentLayoutVersion, version, err)
+	}
+
+	// a newer tableroll has been here
+	if err := ioutil.WriteFile(layoutPath(coordDir), []byte("99"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	tooNew, ok := err.(*LayoutVersionError)
+	if !ok || tooNew.Version != 99 || tooNew.Supported != CurrentLayoutVersion {
+		t.Fatalf("expected a *LayoutVersionError, got %T %v", err, err)
+	}
+	if _, err := ReadHistory(coordDir); err == nil {
+		t.Fatal("expected reading a newer layout's history to fail")
+	}
+	// the lock was released, so once the dir is understood again, upgrades
+	// resume
+	if err := ioutil.WriteFile(layoutPath(coordDir), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg3.Stop()
+}
@@ -0,0 +1,187 @@
+package tableroll
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"syscall"
+)
+
+// The leak detector looks for two kinds of fd leaks, by listing
+// /proc/self/fd. A process started directly by another, e.g. by the tableflip
+// package's Upgrade, inherits any of its fds which weren't marked
+// close-on-exec. Go marks every fd it opens close-on-exec, so any fd open at
+// Ready without that flag which wasn't registered in the Fds was most likely
+// leaked to us, and may keep ports or files held open for as long as this
+// process runs. And once Stop has been called, any fds still open which refer
+// to the same file or socket as one in the Fds were never closed by the
+// application, e.g. a listener which wasn't closed while draining.
+
+// LeakKind describes how an fd leaked.
+type LeakKind string
+
+const (
+	// LeakUnregisteredInherited indicates an fd which was open at Ready
+	// without being marked close-on-exec, so was most likely inherited from
+	// the process which started this one, and wasn't registered in the Fds.
+	LeakUnregisteredInherited LeakKind = "unregistered-inherited"
+	// LeakUnclosed indicates an fd which was still open after Stop, and
+	// refers to the same file or socket as an fd in the Fds.
+	LeakUnclosed LeakKind = "unclosed"
+)
+
+// FdLeak describes a leaked fd.
+type FdLeak struct {
+	Kind LeakKind
+	// Fd is the leaked fd's number.
+	Fd int
+	// Target is what the fd refers to, as shown in /proc/self/fd, e.g.
+	// "socket:[1234]" or a file's path.
+	Target string
+	// ID is the id of the fd in the Fds which the leaked fd refers to the
+	// same file or socket as, if any.
+	ID string
+}
+
+// LeakReport lists the fd leaks found at a checkpoint: "ready" or "stop".
+type LeakReport struct {
+	Checkpoint string
+	Leaks      []FdLeak
+}
+
+// WithLeakDetection checks for leaked fds when Ready and Stop are called,
+// and passes what it finds to report, if anything. Leaks are also logged as
+// warnings. It requires /proc, and does nothing if it isn't available.
+// Stop should be called once the application has closed everything it got
+// from the Fds.
+func WithLeakDetection(report func(LeakReport)) Option {
+	return func(u *Upgrader) {
+		u.leakReport = report
+	}
+}
+
+// fdObject identifies the file or socket an fd refers to.
+type fdObject struct {
+	dev, ino uint64
+}
+
+func fdObjectOf(fd int) (fdObject, bool) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fdObject{}, false
+	}
+	return fdObject{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// openFds lists the open fds other than stdio, or returns nil if they can't
+// be listed.
+func openFds() []int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil
+	}
+	dirFd := int(dir.Fd())
+	fds := make([]int, 0, len(names))
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil || fd <= 2 || fd == dirFd {
+			continue
+		}
+		fds = append(fds, fd)
+	}
+	sort.Ints(fds)
+	return fds
+}
+
+// registeredObjects returns the objects the fds in the store refer to, and
+// the numbers of the store's own copies of them.
+func (f *Fds) registeredObjects() (map[fdObject]string, map[int]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects := make(map[fdObject]string, len(f.fds))
+	own := make(map[int]bool, len(f.fds))
+	for id, fi := range f.fds {
+		if fi.file == nil {
+			continue
+		}
+		own[int(fi.file.fd)] = true
+		if obj, ok := fdObjectOf(int(fi.file.fd)); ok {
+			objects[obj] = id
+		}
+	}
+	return objects, own
+}
+
+// checkLeaksAtReady reports fds which aren't marked close-on-exec, and aren't
+// registered.
+func (u *Upgrader) checkLeaksAtReady() {
+	if u.leakReport == nil {
+		return
+	}
+	objects, own := u.Fds.registeredObjects()
+	var leaks []FdLeak
+	for _, fd := range openFds() {
+		if own[fd] {
+			continue
+		}
+		flags, err := fcntlInt(uintptr(fd), syscall.F_GETFD, 0)
+		if err != nil || flags&syscall.FD_CLOEXEC != 0 {
+			continue
+		}
+		if obj, ok := fdObjectOf(fd); ok {
+			if _, registered := objects[obj]; registered {
+				continue
+			}
+		}
+		leaks = append(leaks, FdLeak{Kind: LeakUnregisteredInherited, Fd: fd, Target: fdTarget(fd)})
+	}
+	u.reportLeaks("ready", leaks)
+}
+
+// checkLeaksAtStop reports fds which refer to the same object as a
+// registered fd, other than the store's own copies.
+func (u *Upgrader) checkLeaksAtStop() {
+	if u.leakReport == nil {
+		return
+	}
+	objects, own := u.Fds.registeredObjects()
+	var leaks []FdLeak
+	for _, fd := range openFds() {
+		if own[fd] {
+			continue
+		}
+		obj, ok := fdObjectOf(fd)
+		if !ok {
+			continue
+		}
+		if id, registered := objects[obj]; registered {
+			leaks = append(leaks, FdLeak{Kind: LeakUnclosed, Fd: fd, Target: fdTarget(fd), ID: id})
+		}
+	}
+	u.reportLeaks("stop", leaks)
+}
+
+func (u *Upgrader) reportLeaks(checkpoint string, leaks []FdLeak) {
+	if len(leaks) == 0 {
+		return
+	}
+	for _, leak := range leaks {
+		u.l.Warn("fd leaked", "checkpoint", checkpoint, "kind", leak.Kind, "fd", leak.Fd, "target", u.redactString(leak.Target), "id", u.redactString(leak.ID))
+	}
+	u.leakReport(LeakReport{Checkpoint: checkpoint, Leaks: leaks})
+}
+
+func fdTarget(fd int) string {
+	target, err := os.Readlink(filepath.Join("/proc/self/fd", strconv.Itoa(fd)))
+	if err != nil {
+		return ""
+	}
+	return target
+}
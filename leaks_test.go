@@ -0,0 +1,79 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestLeakDetection(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("/proc isn't available")
+	}
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	f, err := ioutil.TempFile(coordDir, "leaked")
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	defer f.Close()
+	// dup doesn't set close-on-exec, like an fd inherited over exec
+	leaked, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("error duping file: %v", err)
+	}
+	defer syscall.Close(leaked)
+
+	var reports []LeakReport
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithLeakDetection(func(report LeakReport) {
+		reports = append(reports, report)
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if len(reports) != 1 || reports[0].Checkpoint != "ready" {
+		t.Fatalf("expected a report at ready, got %+v", reports)
+	}
+	found := false
+	for _, leak := range reports[0].Leaks {
+		if leak.Fd == leaked {
+			found = true
+			if leak.Kind != LeakUnregisteredInherited || leak.Target != f.Name() {
+				t.Errorf("unexpected leak reported for the duped fd: %+v", leak)
+			}
+		}
+		if leak.ID != "" {
+			t.Errorf("expected no registered fds to be reported at ready, got %+v", leak)
+		}
+	}
+	if !found {
+		t.Fatalf("expected fd %d to be reported, got %+v", leaked, reports[0].Leaks)
+	}
+
+	// the listener hasn't been closed
+	upg.Stop()
+	if len(reports) != 2 || reports[1].Checkpoint != "stop" {
+		t.Fatalf("expected a report at stop, got %+v", reports)
+	}
+	if len(reports[1].Leaks) != 1 {
+		t.Fatalf("expected one leak at stop, got %+v", reports[1].Leaks)
+	}
+	if leak := reports[1].Leaks[0]; leak.Kind != LeakUnclosed || leak.ID != "ln" {
+		t.Fatalf("expected the listener to be reported as unclosed, got %+v", leak)
+	}
+}
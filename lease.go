@@ -0,0 +1,141 @@
+package tableroll
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WithOwnershipLease makes this process renew a lease on ownership while it's
+// the owner, every third of ttl, and lets it seize ownership from an owner
+// whose lease has expired. An owner which is alive but hung, e.g. stopped or
+// deadlocked, would otherwise keep its fds forever: new processes connect to
+// it and wait for an answer which never comes.
+//
+// Before each renewal, healthy is called, if it's non-nil, and the lease is
+// only renewed if it returns nil, so that it may check the application is
+// still serving. If it hangs, the lease expires.
+//
+// A new process which finds the owner's lease expired starts as if the owner
+// were dead, with a NoOwnerReasonLeaseExpired. The old owner may still hold
+// its listeners, so binding the same addresses may fail unless they use
+// SO_REUSEPORT. If the old owner recovers, it finds it's no longer the owner
+// and starts draining, closing UpgradeComplete as if it had handed off.
+//
+// Leases are off by default. Processes which don't use this option don't
+// renew a lease, and never seize ownership. A ttl of 0 disables leases.
+func WithOwnershipLease(ttl time.Duration, healthy func() error) Option {
+	return func(u *Upgrader) {
+		u.leaseTTL = ttl
+		u.leaseHealthy = healthy
+	}
+}
+
+// ownershipLease is the lease file's contents.
+type ownershipLease struct {
+	Pid     int       `json:"pid"`
+	Expires time.Time `json:"expires"`
+}
+
+func (c *coordinator) leaseFile() string {
+	return filepath.Join(c.dir, "lease")
+}
+
+// writeLease records that we hold ownership until expires.
+func (c *coordinator) writeLease(expires time.Time) error {
+	data, err := json.Marshal(ownershipLease{Pid: c.os.Getpid(), Expires: expires})
+	if err != nil {
+		return err
+	}
+	return classifyCoordinationErr(c.dir, "write lease", ioutil.WriteFile(c.leaseFile(), data, 0755))
+}
+
+// checkLease returns a *NoOwnerError if leases are enabled and the recorded
+// owner is running but has let its lease expire. An owner without a lease,
+// e.g. because it doesn't use leases, is left alone.
+func (c *coordinator) checkLease() error {
+	if !c.leases {
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.leaseFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.l.Warn("could not read the ownership lease", "err", err)
+		}
+		return nil
+	}
+	var lease ownershipLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		c.l.Warn("ignoring invalid ownership lease", "err", err)
+		return nil
+	}
+	owner, err := c.readOwnerPID()
+	if err != nil || owner == 0 || owner != lease.Pid || pidIsDead(c.os, owner) {
+		// the lease belongs to an earlier owner
+		return nil
+	}
+	if expired := c.clock.Since(lease.Expires); expired > 0 {
+		c.l.Warn("the owner's ownership lease has expired, presuming it's hung and taking over", "owner", owner, "expiredFor", expired)
+		return &NoOwnerError{NoOwnerReasonLeaseExpired}
+	}
+	return nil
+}
+
+// takeLease takes out our first ownership lease, without checking the
+// application's health since it's only just become ready, and starts renewing
+// it.
+func (u *Upgrader) takeLease() {
+	if err := u.coord.writeLease(u.clock.Now().Add(u.leaseTTL)); err != nil {
+		u.l.Warn("could not take out an ownership lease", "err", err)
+	}
+	go u.renewLeases()
+}
+
+// renewLease extends our ownership lease, if the application is healthy.
+func (u *Upgrader) renewLease() {
+	if u.leaseHealthy != nil {
+		if err := u.leaseHealthy(); err != nil {
+			u.logRepeated(u.l.Warn, "not renewing the ownership lease, the application is unhealthy", "err", err)
+			return
+		}
+	}
+	if err := u.coord.writeLease(u.clock.Now().Add(u.leaseTTL)); err != nil {
+		u.logRepeated(u.l.Warn, "could not renew the ownership lease", "err", err)
+	}
+}
+
+// renewLeases renews our ownership lease until we're no longer the owner, or
+// find ownership was seized from us.
+func (u *Upgrader) renewLeases() {
+	for {
+		select {
+		case <-u.upgradeCompleteC:
+			return
+		case <-u.clock.After(u.leaseTTL / 3):
+		}
+		owner, err := u.coord.readOwnerPID()
+		if err == nil && owner != 0 && owner != u.os.Getpid() {
+			u.loseLease(owner)
+			return
+		}
+		u.renewLease()
+	}
+}
+
+// loseLease starts draining once another process has seized ownership from
+// us, as if we'd handed off to it.
+func (u *Upgrader) loseLease(owner int) {
+	if err := u.transitionTo(upgraderStateDraining); err != nil {
+		// we've already stepped down
+		return
+	}
+	u.l.Error("ownership was seized after our ownership lease expired, draining", "owner", owner)
+	u.Fds.lockMutations(ErrUpgradeCompleted)
+	u.closeFallbackSock()
+	u.closeUpgradeSocks()
+	u.recordHistory(HistoryLeaseLost, owner)
+	u.emit(Event{Type: EventOwnershipLeaseLost, Peer: &PeerInfo{Pid: owner}})
+	u.closeUpgradeComplete()
+}
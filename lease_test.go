@@ -0,0 +1,102 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestOwnershipLeaseExpiry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	fake := fakeclock.NewFakeClock(time.Now())
+
+	events := make(chan Event, 1)
+	hung := func() error { return errors.New("hung") }
+	upg1, err := newUpgrader(ctx, fake, mockOS{pid: 1}, coordDir, WithLogger(l), WithOwnershipLease(30*time.Second, hung), WithEventHandler(func(e Event) {
+		if e.Type == EventOwnershipLeaseLost {
+			events <- e
+		}
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// while the lease holds, the next process upgrades as usual
+	upg2, err := newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l), WithOwnershipLease(30*time.Second, nil), WithUpgradeTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	if !upg2.Inherited() {
+		t.Fatalf("expected to inherit from an owner holding its lease")
+	}
+	upg2.Stop()
+
+	// the owner is unhealthy, so it stops renewing
+	stepWhenWaiting(t, fake, 31*time.Second)
+
+	upg3, err := newUpgrader(ctx, fake, mockOS{pid: 3}, coordDir, WithLogger(l), WithOwnershipLease(30*time.Second, nil))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if upg3.Inherited() || upg3.NoOwnerReason() != NoOwnerReasonLeaseExpired {
+		t.Fatalf("expected to seize ownership, got reason %q", upg3.NoOwnerReason())
+	}
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// once it checks again, the old owner finds it's been replaced
+	for done := false; !done; {
+		fake.Step(11 * time.Second)
+		select {
+		case <-upg1.UpgradeComplete():
+			done = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if e := <-events; e.Peer == nil || e.Peer.Pid != 3 {
+		t.Fatalf("expected the lease to be lost to the new owner, got %+v", e)
+	}
+	if _, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0"); err != ErrUpgradeCompleted {
+		t.Fatalf("expected the old owner's fds to be locked, got %v", err)
+	}
+}
+
+func TestOwnershipLeaseOptIn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	fake := fakeclock.NewFakeClock(time.Now())
+
+	upg1, err := newUpgrader(ctx, fake, mockOS{pid: 1}, coordDir, WithLogger(l), WithOwnershipLease(30*time.Second, func() error { return errors.New("hung") }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	stepWhenWaiting(t, fake, time.Minute)
+
+	// a process which doesn't use leases doesn't seize ownership
+	upg2, err := newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.Inherited() {
+		t.Fatalf("expected to inherit despite the expired lease, got reason %q", upg2.NoOwnerReason())
+	}
+}
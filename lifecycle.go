@@ -0,0 +1,107 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The intended lifecycle of an Upgrader is New, then any use of Fds, then
+// Ready once the process is ready to serve, and finally Stop. Misusing it
+// usually shows up as an untyped error or a hang far from the mistake, so
+// WithStrictLifecycle reports misuse where it happens.
+
+// ErrLifecycleViolation is the cause of every *LifecycleError.
+var ErrLifecycleViolation = errors.New("upgrader lifecycle violated")
+
+// LifecycleError is returned, or for methods which can't return an error,
+// panicked with, when an Upgrader using WithStrictLifecycle is misused.
+type LifecycleError struct {
+	// Op is the method which was misused, e.g. "Ready".
+	Op string
+	// State is the Upgrader's state at the time, as in OwnerStatus.State, or
+	// "constructing" while New hasn't returned.
+	State string
+	// Reason explains what was violated.
+	Reason string
+}
+
+func (e *LifecycleError) Error() string {
+	return fmt.Sprintf("%v: %s in state %q: %s", ErrLifecycleViolation, e.Op, e.State, e.Reason)
+}
+
+// Unwrap returns ErrLifecycleViolation.
+func (e *LifecycleError) Unwrap() error {
+	return ErrLifecycleViolation
+}
+
+// WithStrictLifecycle makes misuse of the Upgrader's lifecycle fail
+// immediately with a *LifecycleError:
+//
+//   - creating fds with Fds fails until New has returned
+//   - Ready fails if called twice, or after Stop
+//   - Stop panics if called before Ready
+//
+// Giving up on an upgrade by calling Stop before Ready is allowed without
+// this option, but is treated as a mistake with it, since it's usually one:
+// a process which fails to start should call Handback, or exit. This option
+// is intended for development and tests.
+func WithStrictLifecycle() Option {
+	return func(u *Upgrader) {
+		u.strictLifecycle = true
+	}
+}
+
+// constructing is the state reported by LifecycleErrors before New returns.
+const constructing = "constructing"
+
+// lockFdsWhileConstructing stops fds from being created until New returns,
+// with WithStrictLifecycle.
+func (u *Upgrader) lockFdsWhileConstructing() {
+	if u.strictLifecycle {
+		u.Fds.lockMutations(u.constructingErr())
+	}
+}
+
+// constructed is called once New is about to return successfully.
+func (u *Upgrader) constructed() {
+	if u.strictLifecycle {
+		u.Fds.unlockMutationsIf(u.constructingErr())
+	}
+}
+
+func (u *Upgrader) constructingErr() *LifecycleError {
+	if u.constructingLifecycleErr == nil {
+		u.constructingLifecycleErr = &LifecycleError{Op: "Fds", State: constructing, Reason: "fds can't be created until New returns"}
+	}
+	return u.constructingLifecycleErr
+}
+
+// checkReadyLocked returns a *LifecycleError if Ready must not be called in
+// the current state, with WithStrictLifecycle.
+func (u *Upgrader) checkReadyLocked() error {
+	if !u.strictLifecycle {
+		return nil
+	}
+	switch u.state {
+	case upgraderStateCheckingOwner:
+		return nil
+	case upgraderStateStopped:
+		return &LifecycleError{Op: "Ready", State: string(u.state), Reason: "Ready was called after Stop"}
+	default:
+		return &LifecycleError{Op: "Ready", State: string(u.state), Reason: "Ready was already called"}
+	}
+}
+
+// checkStop panics with a *LifecycleError if Stop is called before Ready,
+// with WithStrictLifecycle.
+func (u *Upgrader) checkStop() {
+	if !u.strictLifecycle {
+		return
+	}
+	u.stateLock.Lock()
+	state := u.state
+	u.stateLock.Unlock()
+	if state == upgraderStateCheckingOwner {
+		panic(&LifecycleError{Op: "Stop", State: string(state), Reason: "Stop was called before Ready"})
+	}
+}
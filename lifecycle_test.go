@@ -0,0 +1,73 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestStrictLifecycle(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithStrictLifecycle())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	// fds were locked while constructing, and are unlocked now
+	ln, err := upg.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected to listen once New returned, got %v", err)
+	}
+	defer ln.Close()
+
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	err = upg.Ready()
+	if lifecycleErr, ok := err.(*LifecycleError); !ok || lifecycleErr.Op != "Ready" || lifecycleErr.State != "owner" {
+		t.Fatalf("expected a *LifecycleError for calling Ready twice, got %v", err)
+	}
+	if !errors.Is(err, ErrLifecycleViolation) {
+		t.Fatalf("expected the error's cause to be ErrLifecycleViolation")
+	}
+	upg.Stop()
+	if _, ok := upg.Ready().(*LifecycleError); !ok {
+		t.Fatalf("expected a *LifecycleError for calling Ready after Stop")
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithStrictLifecycle())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	func() {
+		defer func() {
+			lifecycleErr, ok := recover().(*LifecycleError)
+			if !ok || lifecycleErr.Op != "Stop" {
+				t.Fatalf("expected Stop before Ready to panic with a *LifecycleError, got %v", lifecycleErr)
+			}
+		}()
+		upg2.Stop()
+	}()
+	// without strict mode, giving up is allowed
+	upg2.strictLifecycle = false
+	upg2.Stop()
+}
+
+func TestStrictLifecycleFdsWhileConstructing(t *testing.T) {
+	u := &Upgrader{strictLifecycle: true, Fds: newFds(l, nil)}
+	u.lockFdsWhileConstructing()
+	_, err := u.Fds.Listen(context.Background(), "ln", nil, "tcp", "127.0.0.1:0")
+	if lifecycleErr, ok := err.(*LifecycleError); !ok || lifecycleErr.State != constructing {
+		t.Fatalf("expected a *LifecycleError while constructing, got %v", err)
+	}
+	u.constructed()
+	ln, err := u.Fds.Listen(context.Background(), "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected to listen once constructed, got %v", err)
+	}
+	ln.Close()
+}
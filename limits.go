@@ -0,0 +1,99 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// The sibling on the other end of an upgrade session is not trusted. A buggy
+// or malicious process must not be able to exhaust this process's memory or
+// file descriptors, so everything read from it is checked against these
+// limits.
+const (
+	maxFdTableSize  = 1 << 16
+	maxFdIDLength   = 4096
+	maxFdNameLength = 4096
+	maxMetadataSize = proto.MaxBlobSize
+)
+
+// ErrInvalidFdTable indicates the owner process sent a file descriptor table
+// which could not be accepted, such as one containing duplicate ids.
+var ErrInvalidFdTable = errors.New("invalid fd table received from owner")
+
+// LimitError is returned when a sibling sends a protocol message which exceeds
+// one of the hard limits on what tableroll will accept. The upgrade session is
+// closed when this happens.
+type LimitError struct {
+	// Field describes what exceeded the limit, e.g. "fd table size"
+	Field string
+	Limit int
+	Value int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("protocol limit exceeded: %s of %d is over the maximum of %d", e.Field, e.Value, e.Limit)
+}
+
+// asLimitError converts protocol-level size errors into a LimitError, and
+// returns any other error unchanged.
+func asLimitError(err error) error {
+	var sizeErr *proto.BlobSizeError
+	if errors.As(err, &sizeErr) {
+		return &LimitError{Field: "metadata size", Limit: maxMetadataSize, Value: int(sizeErr.Size)}
+	}
+	return err
+}
+
+// decodeFdTable decodes and validates the body of a MessageFds or
+// MessageExclusiveFds frame.
+func decodeFdTable(frame *proto.Frame) (*fdTable, error) {
+	var table fdTable
+	if err := frame.Decode(&table); err != nil {
+		return nil, err
+	}
+	if err := validateFdTable(table.Fds); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// validateFdTable checks the fd metadata received from an owner before any
+// file descriptors are read.
+func validateFdTable(fds []*fd) error {
+	if len(fds) > maxFdTableSize {
+		return &LimitError{Field: "fd table size", Limit: maxFdTableSize, Value: len(fds)}
+	}
+	seen := make(map[string]struct{}, len(fds))
+	for _, f := range fds {
+		if f == nil {
+			return fmt.Errorf("nil entry: %w", ErrInvalidFdTable)
+		}
+		if len(f.ID) == 0 {
+			return fmt.Errorf("empty id: %w", ErrInvalidFdTable)
+		}
+		if len(f.ID) > maxFdIDLength {
+			return &LimitError{Field: "fd id length", Limit: maxFdIDLength, Value: len(f.ID)}
+		}
+		names := []string{f.Name, f.Network, f.Addr, f.LocalAddr, f.RemoteAddr}
+		if f.Identity != nil {
+			names = append(names, f.Identity.SockAddr)
+		}
+		for _, s := range names {
+			if len(s) > maxFdNameLength {
+				return &LimitError{Field: "fd name length", Limit: maxFdNameLength, Value: len(s)}
+			}
+		}
+		switch f.Kind {
+		case fdKindListener, fdKindConn, fdKindFile, fdKindPacketConn:
+		default:
+			return fmt.Errorf("unknown kind %q for id %q: %w", f.Kind, f.ID, ErrInvalidFdTable)
+		}
+		if _, ok := seen[f.ID]; ok {
+			return fmt.Errorf("duplicate id %q: %w", f.ID, ErrInvalidFdTable)
+		}
+		seen[f.ID] = struct{}{}
+	}
+	return nil
+}
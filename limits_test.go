@@ -0,0 +1,45 @@
+package tableroll
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateFdTable(t *testing.T) {
+	tooMany := make([]*fd, maxFdTableSize+1)
+	for i := range tooMany {
+		tooMany[i] = &fd{ID: "x", Kind: fdKindFile}
+	}
+
+	cases := []struct {
+		name  string
+		fds   []*fd
+		limit bool
+		err   bool
+	}{
+		{"empty", nil, false, false},
+		{"ok", []*fd{{ID: "a", Kind: fdKindFile}, {ID: "b", Kind: fdKindListener}}, false, false},
+		{"too many", tooMany, true, true},
+		{"long id", []*fd{{ID: strings.Repeat("a", maxFdIDLength+1), Kind: fdKindFile}}, true, true},
+		{"long addr", []*fd{{ID: "a", Kind: fdKindConn, Addr: strings.Repeat("a", maxFdNameLength+1)}}, true, true},
+		{"duplicate", []*fd{{ID: "a", Kind: fdKindFile}, {ID: "a", Kind: fdKindFile}}, false, true},
+		{"bad kind", []*fd{{ID: "a", Kind: "bogus"}}, false, true},
+		{"no id", []*fd{{Kind: fdKindFile}}, false, true},
+	}
+
+	for _, tc := range cases {
+		err := validateFdTable(tc.fds)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		_, isLimit := err.(*LimitError)
+		if isLimit != tc.limit {
+			t.Errorf("%s: expected limit error %v, got %T", tc.name, tc.limit, err)
+		}
+		if err != nil && !isLimit && !errors.Is(err, ErrInvalidFdTable) {
+			t.Errorf("%s: expected ErrInvalidFdTable, got %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// Listen is a shortcut for services with a single listener. It creates an
+// Upgrader for coordinationDir as New does, and returns the listener with the
+// given id from upg.Fds.Listen, inherited from the owner or created with
+// network and addr.
+//
+// Marking the process ready is left to the caller, since only it knows when
+// it's serving: call upg.Ready once it's accepting connections, or pass upg
+// to Run, which does so. If the listener can't be had, the Upgrader is
+// stopped and the error returned.
+func Listen(ctx context.Context, coordinationDir, id, network, addr string, opts ...Option) (net.Listener, *Upgrader, error) {
+	return listen(ctx, clock.RealClock{}, realOS{}, coordinationDir, id, network, addr, opts...)
+}
+
+func listen(ctx context.Context, clock clock.Clock, os OS, coordinationDir, id, network, addr string, opts ...Option) (net.Listener, *Upgrader, error) {
+	upg, err := newUpgrader(ctx, clock, os, coordinationDir, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := upg.Fds.Listen(ctx, id, nil, network, addr)
+	if err != nil {
+		upg.Stop()
+		return nil, nil, err
+	}
+	return ln, upg, nil
+}
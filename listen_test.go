@@ -0,0 +1,55 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestListen(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	ln1, upg1, err := listen(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, "web", "tcp", "127.0.0.1:0", WithLogger(l))
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer upg1.Stop()
+	defer ln1.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	ln2, upg2, err := listen(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, "web", "tcp", "127.0.0.1:0", WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg2.Stop()
+	defer ln2.Close()
+	if ln1.Addr().String() != ln2.Addr().String() {
+		t.Fatalf("expected the listener to be inherited, got %v and %v", ln1.Addr(), ln2.Addr())
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestListenStopsOnError(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	if _, _, err := listen(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, "web", "bogus", "127.0.0.1:0", WithLogger(l)); err == nil {
+		t.Fatal("expected an error listening on an unknown network")
+	}
+	// the failed upgrader doesn't hold on to the coordination dir
+	ln, upg, err := listen(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, "web", "tcp", "127.0.0.1:0", WithLogger(l))
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ln.Close()
+	upg.Stop()
+}
@@ -0,0 +1,168 @@
+package tableroll
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// DefaultRepeatedLogInterval is how often a message which may repeat rapidly,
+// such as an error accepting upgrade connections, is logged by default.
+const DefaultRepeatedLogInterval = 10 * time.Second
+
+// Logger is what tableroll logs to. Each method takes a message and
+// alternating keys and values. Many key-value logging libraries' loggers
+// satisfy it as is, and others only need a small adapter, so this package
+// doesn't depend on any of them.
+type Logger interface {
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+}
+
+// LogLevel is the severity of a log message. More severe levels are lower.
+type LogLevel int
+
+// The levels of the messages tableroll logs, one for each of Logger's methods.
+const (
+	LogLevelError LogLevel = iota + 1
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// WithLogLevel only logs messages at the given level or more severe, e.g.
+// LogLevelInfo to leave out the details of each handshake which are logged
+// at debug level. It applies to the logger set with WithLogger, regardless
+// of the order of the options.
+func WithLogLevel(level LogLevel) Option {
+	return func(u *Upgrader) {
+		u.logLevel = &level
+	}
+}
+
+// WithRepeatedLogInterval sets how often messages which may repeat rapidly
+// are logged. Repeats within the interval are counted, and the count is
+// included the next time the message is logged. An interval of 0 logs every
+// message.
+func WithRepeatedLogInterval(interval time.Duration) Option {
+	return func(u *Upgrader) {
+		u.repeatedLogs.interval = interval
+	}
+}
+
+// filterLogLevel applies the level set with WithLogLevel by wrapping the
+// configured logger, so the caller's logger isn't modified.
+func (u *Upgrader) filterLogLevel() {
+	if u.logLevel == nil {
+		return
+	}
+	u.l = levelLogger{l: u.l, level: *u.logLevel}
+}
+
+// discardLogger is the default Logger, which logs nothing.
+type discardLogger struct{}
+
+func (discardLogger) Debug(string, ...interface{}) {}
+func (discardLogger) Info(string, ...interface{})  {}
+func (discardLogger) Warn(string, ...interface{})  {}
+func (discardLogger) Error(string, ...interface{}) {}
+
+// levelLogger drops messages less severe than level.
+type levelLogger struct {
+	l     Logger
+	level LogLevel
+}
+
+func (ll levelLogger) Debug(msg string, ctx ...interface{}) {
+	if ll.level >= LogLevelDebug {
+		ll.l.Debug(msg, ctx...)
+	}
+}
+
+func (ll levelLogger) Info(msg string, ctx ...interface{}) {
+	if ll.level >= LogLevelInfo {
+		ll.l.Info(msg, ctx...)
+	}
+}
+
+func (ll levelLogger) Warn(msg string, ctx ...interface{}) {
+	if ll.level >= LogLevelWarn {
+		ll.l.Warn(msg, ctx...)
+	}
+}
+
+func (ll levelLogger) Error(msg string, ctx ...interface{}) {
+	if ll.level >= LogLevelError {
+		ll.l.Error(msg, ctx...)
+	}
+}
+
+// contextLogger adds ctx to the start of each message's keys and values.
+type contextLogger struct {
+	l   Logger
+	ctx []interface{}
+}
+
+// withLogContext returns a Logger which logs to l with the given keys and
+// values added to each message.
+func withLogContext(l Logger, ctx ...interface{}) Logger {
+	return contextLogger{l: l, ctx: ctx}
+}
+
+func (cl contextLogger) with(ctx []interface{}) []interface{} {
+	return append(append(make([]interface{}, 0, len(cl.ctx)+len(ctx)), cl.ctx...), ctx...)
+}
+
+func (cl contextLogger) Debug(msg string, ctx ...interface{}) { cl.l.Debug(msg, cl.with(ctx)...) }
+func (cl contextLogger) Info(msg string, ctx ...interface{})  { cl.l.Info(msg, cl.with(ctx)...) }
+func (cl contextLogger) Warn(msg string, ctx ...interface{})  { cl.l.Warn(msg, cl.with(ctx)...) }
+func (cl contextLogger) Error(msg string, ctx ...interface{}) { cl.l.Error(msg, cl.with(ctx)...) }
+
+// logLimiter limits how often each of a set of messages is logged.
+type logLimiter struct {
+	interval time.Duration
+	clock    clock.Clock
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// allow returns whether msg should be logged now, and if so, how many times
+// it was suppressed since it was last logged.
+func (ll *logLimiter) allow(msg string) (bool, int) {
+	if ll == nil || ll.interval <= 0 {
+		return true, 0
+	}
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	now := ll.clock.Now()
+	if last, ok := ll.last[msg]; ok && now.Sub(last) < ll.interval {
+		ll.suppressed[msg]++
+		return false, 0
+	}
+	if ll.last == nil {
+		ll.last = make(map[string]time.Time)
+		ll.suppressed = make(map[string]int)
+	}
+	ll.last[msg] = now
+	suppressed := ll.suppressed[msg]
+	delete(ll.suppressed, msg)
+	return true, suppressed
+}
+
+// logRepeated logs a message which may repeat rapidly with log, at most once
+// per repeated log interval.
+func (u *Upgrader) logRepeated(log func(msg string, ctx ...interface{}), msg string, ctx ...interface{}) {
+	ok, suppressed := u.repeatedLogs.allow(msg)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		ctx = append(ctx, "suppressedRepeats", suppressed)
+	}
+	log(msg, ctx...)
+}
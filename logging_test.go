@@ -0,0 +1,147 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestLogLevel(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	logger := newRecordingLogger()
+	upg, err := newUpgrader(context.Background(), fakeclock.NewFakeClock(time.Now()), mockOS{pid: 1}, coordDir, WithLogLevel(LogLevelInfo), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	levels := logger.levels()
+	if levels[LogLevelDebug] != 0 || levels[LogLevelInfo] == 0 {
+		t.Fatalf("expected only info and more severe messages, got %v", levels)
+	}
+	// the caller's logger isn't affected
+	logger.Debug("still logged")
+	if logger.levels()[LogLevelDebug] != 1 {
+		t.Fatalf("expected the caller's logger to still log debug messages")
+	}
+}
+
+func TestLogContext(t *testing.T) {
+	logger := newRecordingLogger()
+
+	withLogContext(withLogContext(logger, "dir", "/tmp"), "peer", 2).Info("hello", "attempt", 1)
+	records := logger.logged()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 message to be logged, got %d", len(records))
+	}
+	ctx := records[0].ctx
+	if len(ctx) != 6 || ctx[0] != "dir" || ctx[2] != "peer" || ctx[4] != "attempt" {
+		t.Fatalf("expected the context to come first, got %v", ctx)
+	}
+}
+
+func TestLogRepeated(t *testing.T) {
+	clk := fakeclock.NewFakeClock(time.Now())
+	logger := newRecordingLogger()
+	u := &Upgrader{l: logger, repeatedLogs: &logLimiter{interval: time.Second, clock: clk}}
+
+	for i := 0; i < 5; i++ {
+		u.logRepeated(u.l.Error, "error awaiting upgrade", "attempt", i)
+	}
+	u.logRepeated(u.l.Error, "something else")
+	clk.Step(time.Second)
+	u.logRepeated(u.l.Error, "error awaiting upgrade", "attempt", 5)
+
+	records := logger.logged()
+	if len(records) != 3 {
+		t.Fatalf("expected 3 messages to be logged, got %d", len(records))
+	}
+	last := records[2].ctx
+	if len(last) != 4 || last[2] != "suppressedRepeats" || last[3] != 4 {
+		t.Fatalf("expected the suppressed repeats to be counted, got %v", last)
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	wal, walW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+
+	logger := newRecordingLogger()
+	redact := WithRedaction(func(s string) string {
+		return strings.Replace(s, "secret", "xxx", -1)
+	})
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(logger), redact)
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.OpenFileWith("secret-file", "/var/lib/secret", func(_ string) (*os.File, error) {
+		return w, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := upg1.Fds.Listen(ctx, "secret-web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if err := upg1.Fds.AddExclusive("secret-wal", walW); err != nil {
+		t.Fatalf("error adding exclusive fd: %v", err)
+	}
+	walW.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(logger), redact)
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+	if f, err := upg2.Fds.File("secret-wal"); err != nil || f == nil {
+		t.Fatalf("expected exclusive fd to be passed after draining: %v", err)
+	} else {
+		f.Close()
+	}
+
+	records := logger.logged()
+	if len(records) == 0 {
+		t.Fatal("expected messages to be logged")
+	}
+	for _, r := range records {
+		if line := fmt.Sprint(r.msg, r.ctx); strings.Contains(line, "secret") {
+			t.Errorf("expected log message to be redacted: %s", line)
+		}
+	}
+}
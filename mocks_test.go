@@ -1,16 +1,28 @@
 package tableroll
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
 
 type mockOS struct {
 	pid int
+	// deadPids are reported as not running by FindProcess
+	deadPids map[int]bool
 }
 
 func (m mockOS) Getpid() int {
 	return m.pid
 }
 
-func (m mockOS) FindProcess(pid int) (processIface, error) {
+func (m mockOS) FindProcess(pid int) (Process, error) {
+	if m.deadPids[pid] {
+		return mockProcess{errors.New("process is dead")}, nil
+	}
 	return mockProcess{nil}, nil
 }
 
@@ -21,3 +33,70 @@ type mockProcess struct {
 func (m mockProcess) Signal(s os.Signal) error {
 	return m.err
 }
+
+// logRecord is a message logged to a testLogger.
+type logRecord struct {
+	level LogLevel
+	msg   string
+	ctx   []interface{}
+}
+
+var logLevelNames = map[LogLevel]string{
+	LogLevelError: "error",
+	LogLevelWarn:  "warn",
+	LogLevelInfo:  "info",
+	LogLevelDebug: "debug",
+}
+
+// testLogger is a Logger which writes to stderr, or if it was created by
+// newRecordingLogger, keeps its messages instead.
+type testLogger struct {
+	recording bool
+
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{}
+}
+
+func newRecordingLogger() *testLogger {
+	return &testLogger{recording: true}
+}
+
+func (t *testLogger) Debug(msg string, ctx ...interface{}) { t.log(LogLevelDebug, msg, ctx) }
+func (t *testLogger) Info(msg string, ctx ...interface{})  { t.log(LogLevelInfo, msg, ctx) }
+func (t *testLogger) Warn(msg string, ctx ...interface{})  { t.log(LogLevelWarn, msg, ctx) }
+func (t *testLogger) Error(msg string, ctx ...interface{}) { t.log(LogLevelError, msg, ctx) }
+
+func (t *testLogger) log(level LogLevel, msg string, ctx []interface{}) {
+	if !t.recording {
+		var line strings.Builder
+		fmt.Fprintf(&line, "lvl=%s msg=%q", logLevelNames[level], msg)
+		for i := 0; i+1 < len(ctx); i += 2 {
+			fmt.Fprintf(&line, " %v=%v", ctx[i], ctx[i+1])
+		}
+		log.Print(line.String())
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = append(t.records, logRecord{level: level, msg: msg, ctx: ctx})
+}
+
+// logged returns the messages recorded so far.
+func (t *testLogger) logged() []logRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]logRecord(nil), t.records...)
+}
+
+// levels counts the messages recorded so far at each level.
+func (t *testLogger) levels() map[LogLevel]int {
+	levels := make(map[LogLevel]int)
+	for _, r := range t.logged() {
+		levels[r.level]++
+	}
+	return levels
+}
@@ -0,0 +1,69 @@
+package tableroll
+
+import "time"
+
+// MutationLockStats describes how upgrades have held up changes to the fd
+// store. Mutations are locked while fds are passed to the next owner, so
+// applications which create and remove fds often see them rejected with
+// ErrUpgradeInProgress, or delayed when using a WithContext method.
+type MutationLockStats struct {
+	// UpgradeLocks counts how many times mutations were locked for an
+	// upgrade.
+	UpgradeLocks uint64
+	// UpgradeLockedFor is how long mutations have been locked for upgrades
+	// in total, including any upgrade in progress.
+	UpgradeLockedFor time.Duration
+	// LongestUpgradeLock is the longest mutations were locked for a single
+	// upgrade, including any upgrade in progress.
+	LongestUpgradeLock time.Duration
+	// RejectedInProgress counts mutations rejected with ErrUpgradeInProgress.
+	// A WithContext method which waits for the upgrade and tries again counts
+	// once for each attempt.
+	RejectedInProgress uint64
+	// RejectedOther counts mutations rejected for any other reason, such as
+	// ErrUpgradeCompleted once this process has stepped down.
+	RejectedOther uint64
+}
+
+// MutationLockStats returns counters for how often and for how long
+// mutations were locked by upgrades, since this process started.
+func (f *Fds) MutationLockStats() MutationLockStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	if f.upgradeDoneC != nil {
+		current := f.clock.Since(f.upgradeLockedAt)
+		stats.UpgradeLockedFor += current
+		if current > stats.LongestUpgradeLock {
+			stats.LongestUpgradeLock = current
+		}
+	}
+	return stats
+}
+
+// rejectMutationLocked counts a mutation rejected because mutations are
+// locked, and returns the error it should fail with.
+func (f *Fds) rejectMutationLocked() error {
+	if f.lockedReason == ErrUpgradeInProgress {
+		f.stats.RejectedInProgress++
+	} else {
+		f.stats.RejectedOther++
+	}
+	return f.lockedReason
+}
+
+// upgradeLockedLocked records that mutations were locked for an upgrade.
+func (f *Fds) upgradeLockedLocked() {
+	f.stats.UpgradeLocks++
+	f.upgradeLockedAt = f.clock.Now()
+}
+
+// upgradeUnlockedLocked records that mutations are no longer locked for an
+// upgrade.
+func (f *Fds) upgradeUnlockedLocked() {
+	locked := f.clock.Since(f.upgradeLockedAt)
+	f.stats.UpgradeLockedFor += locked
+	if locked > f.stats.LongestUpgradeLock {
+		f.stats.LongestUpgradeLock = locked
+	}
+}
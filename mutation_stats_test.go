@@ -0,0 +1,46 @@
+package tableroll
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestMutationLockStats(t *testing.T) {
+	clock := fakeclock.NewFakeClock(time.Now())
+	fds := newFds(l, nil)
+	fds.clock = clock
+
+	fds.lockMutations(ErrUpgradeInProgress)
+	clock.Step(2 * time.Second)
+	if _, err := fds.ListenWith("ln", "tcp", "127.0.0.1:0", net.Listen); err != ErrUpgradeInProgress {
+		t.Fatalf("expected ErrUpgradeInProgress, got %v", err)
+	}
+	if _, err := fds.OpenFileWith("null", os.DevNull, os.Open); err != ErrUpgradeInProgress {
+		t.Fatalf("expected ErrUpgradeInProgress, got %v", err)
+	}
+	stats := fds.MutationLockStats()
+	expected := MutationLockStats{UpgradeLocks: 1, UpgradeLockedFor: 2 * time.Second, LongestUpgradeLock: 2 * time.Second, RejectedInProgress: 2}
+	if stats != expected {
+		t.Fatalf("expected %+v during the upgrade, got %+v", expected, stats)
+	}
+
+	// the upgrade fails, and a second one succeeds
+	fds.unlockMutations()
+	clock.Step(time.Minute)
+	fds.lockMutations(ErrUpgradeInProgress)
+	clock.Step(time.Second)
+	fds.lockMutations(ErrUpgradeCompleted)
+	clock.Step(time.Minute)
+	if _, err := fds.OpenFileWith("null", os.DevNull, os.Open); err != ErrUpgradeCompleted {
+		t.Fatalf("expected ErrUpgradeCompleted, got %v", err)
+	}
+	stats = fds.MutationLockStats()
+	expected = MutationLockStats{UpgradeLocks: 2, UpgradeLockedFor: 3 * time.Second, LongestUpgradeLock: 2 * time.Second, RejectedInProgress: 2, RejectedOther: 1}
+	if stats != expected {
+		t.Fatalf("expected %+v, got %+v", expected, stats)
+	}
+}
@@ -0,0 +1,46 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// netlinkNetwork is the network recorded for netlink sockets.
+const netlinkNetwork = "netlink"
+
+// Netlink returns a netlink socket inherited from the previous owner, or
+// creates one for protocol, such as unix.NETLINK_ROUTE, subscribed to the
+// multicast groups in groups, so that no notifications are missed while the
+// next owner starts. The returned file is a copy of the socket in
+// non-blocking mode, which reads and writes netlink messages and may be
+// passed to a netlink library by its fd; the caller must close it. It's only
+// supported on linux.
+func (f *Fds) Netlink(ctx context.Context, id string, protocol int, groups uint32) (*os.File, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	addr := fmt.Sprintf("%d:%d", protocol, groups)
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindPacketConn, Network: netlinkNetwork, Addr: addr}); err != nil {
+		return nil, err
+	}
+	if fi, ok := f.fds[id]; ok && fi.file != nil {
+		f.l.Debug("found existing netlink socket in store", "addr", redactString(f.redact, addr))
+		return copyNetlinkSocket(fi.file)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+
+	sock, err := newNetlinkSocket(protocol, groups)
+	if err != nil {
+		return nil, fmt.Errorf("can't create new netlink socket: %w", err)
+	}
+	defer sock.Close()
+	if err := f.addConnLocked(id, fdKindPacketConn, netlinkNetwork, addr, sock); err != nil {
+		return nil, err
+	}
+	return copyNetlinkSocket(f.fds[id].file)
+}
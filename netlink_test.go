@@ -0,0 +1,49 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFdsNetlink(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	sock, err := parent.Netlink(ctx, "route", unix.NETLINK_ROUTE, unix.RTMGRP_LINK)
+	if err != nil {
+		t.Fatalf("error creating netlink socket: %v", err)
+	}
+	sa, err := unix.Getsockname(int(sock.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.Netlink(ctx, "route", unix.NETLINK_ROUTE, unix.RTMGRP_LINK)
+	if err != nil {
+		t.Fatalf("error inheriting netlink socket: %v", err)
+	}
+	defer inherited.Close()
+	inheritedSa, err := unix.Getsockname(int(inherited.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := inheritedSa.(*unix.SockaddrNetlink), sa.(*unix.SockaddrNetlink); got.Pid != want.Pid || got.Groups != want.Groups {
+		t.Fatalf("expected the inherited socket to keep its address %+v, got %+v", want, got)
+	}
+	identity, err := identify(child.fds["route"].file.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.SockAddr == "*unix.SockaddrNetlink" {
+		t.Fatalf("expected the socket's address to be described, got %q", identity.SockAddr)
+	}
+
+	var exists *IdExistsError
+	if _, err := child.Netlink(ctx, "route", unix.NETLINK_ROUTE, 0); !errors.As(err, &exists) {
+		t.Fatalf("expected an id conflict for other groups, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package tableroll
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// onceInChainPrefix prefixes the Store keys recording which OnceInChain
+// functions have run.
+const onceInChainPrefix = "tableroll/once/"
+
+// OnceInChain runs fn unless it, or another function with the same key, has
+// already run successfully in this upgrade chain, such as for a migration
+// which only the first generation should perform. Once fn returns nil, that
+// is recorded in the Store along with this process's generation, and later
+// calls with key, in this process or those which take over from it, return
+// nil without running anything. If fn fails, its error is returned and
+// nothing is recorded, so it runs again on the next call.
+//
+// Calls are serialized, so fn runs once even if OnceInChain is called
+// concurrently. It should be called before Ready: once this process may hand
+// off, the Store can be passed on while fn runs, in which case fn's success
+// can't be recorded, and OnceInChain returns the Store's error. As with the
+// Store, the record doesn't survive a cold start.
+func (u *Upgrader) OnceInChain(key string, fn func() error) error {
+	u.onceMu.Lock()
+	defer u.onceMu.Unlock()
+	storeKey := onceInChainPrefix + key
+	if entry, ok := u.store.Get(storeKey); ok {
+		u.l.Debug("skipping function which already ran in the chain", "key", key, "generation", string(entry.Value))
+		return nil
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if _, err := u.store.Put(storeKey, []byte(strconv.FormatUint(uint64(u.generation), 10))); err != nil {
+		return fmt.Errorf("%q ran, but could not be recorded: %w", key, err)
+	}
+	u.l.Info("ran function once in the chain", "key", key)
+	return nil
+}
@@ -0,0 +1,67 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestOnceInChain(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	runs := 0
+	migrate := func() error {
+		runs++
+		return nil
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	failure := errors.New("migration failed")
+	if err := upg1.OnceInChain("migrate", func() error { return failure }); err != failure {
+		t.Fatalf("expected the function's error, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := upg1.OnceInChain("migrate", migrate); err != nil {
+			t.Fatalf("error running once: %v", err)
+		}
+	}
+	if runs != 1 {
+		t.Fatalf("expected the function to run once after failing, ran %d times", runs)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.OnceInChain("migrate", migrate); err != nil {
+		t.Fatalf("error running once: %v", err)
+	}
+	if runs != 1 {
+		t.Fatalf("expected the next generation not to run the function again, ran %d times", runs)
+	}
+	other := false
+	if err := upg2.OnceInChain("other", func() error { other = true; return nil }); err != nil || !other {
+		t.Fatalf("expected another key to run, got %v", err)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	// once the store has been passed on, success can't be recorded
+	if err := upg1.OnceInChain("late", func() error { return nil }); !errors.Is(err, ErrUpgradeCompleted) {
+		t.Fatalf("expected the store to be locked, got %v", err)
+	}
+}
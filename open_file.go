@@ -0,0 +1,70 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"syscall"
+)
+
+// FileMismatchError is returned by OpenFile when the file inherited with an
+// id is no longer the file at its path, e.g. because a log file was rotated
+// or deleted while the previous owner had it open. The inherited file stays
+// in the store; use Replace or UpsertFileWith to open the file now at the
+// path in its place.
+type FileMismatchError struct {
+	ID   string
+	Path string
+	// Diffs describes each way in which the file at Path differs from the
+	// inherited one.
+	Diffs []string
+}
+
+func (e *FileMismatchError) Error() string {
+	return fmt.Sprintf("inherited file %q is no longer %s: %s", e.ID, e.Path, strings.Join(e.Diffs, ", "))
+}
+
+// OpenFile retrieves the given file from the store, and if it's not present
+// opens it with os.OpenFile and adds it. This suits files which should stay
+// open across upgrades, such as a log or journal which is appended to, so
+// writes aren't lost or reordered between processes.
+//
+// An inherited file is checked to still be the file at path, by device and
+// inode, and a *FileMismatchError is returned if it isn't.
+func (f *Fds) OpenFile(id string, path string, flag int, perm os.FileMode) (*os.File, error) {
+	return f.openFile(id, path, flag, perm, nil)
+}
+
+func (f *Fds) openFile(id string, path string, flag int, perm os.FileMode, info *FdInfo) (*os.File, error) {
+	return f.openFileWithContext(context.Background(), id, path, func(name string) (*os.File, error) {
+		return os.OpenFile(name, flag, perm)
+	}, func(fi *os.File) error {
+		return checkFileAtPath(id, path, fi)
+	}, info)
+}
+
+// checkFileAtPath returns a *FileMismatchError if fi isn't the file at path.
+func checkFileAtPath(id, path string, fi *os.File) error {
+	inherited, err := identify(fi.Fd())
+	if err != nil {
+		return err
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		if os.IsNotExist(err) {
+			return &FileMismatchError{ID: id, Path: path, Diffs: []string{"it no longer exists"}}
+		}
+		return &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	current := &fdIdentity{
+		Dev:  uint64(st.Dev),
+		Ino:  uint64(st.Ino),
+		Mode: uint32(st.Mode) & syscall.S_IFMT,
+	}
+	if diffs := current.diff(inherited); len(diffs) > 0 {
+		return &FileMismatchError{ID: id, Path: path, Diffs: diffs}
+	}
+	return nil
+}
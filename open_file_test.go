@@ -0,0 +1,62 @@
+package tableroll
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFdsOpenFile(t *testing.T) {
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	path := filepath.Join(dir, "journal")
+
+	parent := newFds(l, nil)
+	fi, err := parent.OpenFile("journal", path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	fi.WriteString("parent\n")
+	fi.Close()
+
+	inherit := func() *Fds {
+		inherited := *parent.fds["journal"]
+		inherited.inherited = true
+		return newFds(l, map[string]*fd{"journal": &inherited})
+	}
+	fi, err = inherit().OpenFile("journal", path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("error inheriting file: %v", err)
+	}
+	fi.WriteString("child\n")
+	fi.Close()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "parent\nchild\n" {
+		t.Fatalf("expected both processes to append to the same file, got %q", contents)
+	}
+
+	// the file is rotated, so the inherited one is no longer at the path
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inherit().OpenFile("journal", path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+		t.Fatal("expected a rotated file not to be inherited")
+	} else if mismatch, ok := err.(*FileMismatchError); !ok {
+		t.Fatalf("expected a *FileMismatchError, got %T: %v", err, err)
+	} else if mismatch.ID != "journal" || mismatch.Path != path {
+		t.Fatalf("unexpected error: %v", mismatch)
+	}
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inherit().OpenFile("journal", path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err == nil {
+		t.Fatal("expected a file replaced at the path not to be inherited")
+	} else if _, ok := err.(*FileMismatchError); !ok {
+		t.Fatalf("expected a *FileMismatchError, got %T: %v", err, err)
+	}
+	parent.Remove("journal")
+}
@@ -2,9 +2,27 @@ package tableroll
 
 import "os"
 
-type osIface interface {
+// OS is the part of the operating system an Upgrader uses to learn its own
+// pid and check on other processes. It can be replaced with WithOS, e.g. to
+// simulate pid reuse in tests; see the tablerolltest package.
+type OS interface {
 	Getpid() int
-	FindProcess(pid int) (processIface, error)
+	// FindProcess is like os.FindProcess. A process is considered to be
+	// running if sending it signal 0 succeeds.
+	FindProcess(pid int) (Process, error)
+}
+
+// Process is a process returned by OS.FindProcess.
+type Process interface {
+	Signal(os.Signal) error
+}
+
+// WithOS replaces the operating system the Upgrader uses to find its own pid
+// and check on other processes. It's intended for tests.
+func WithOS(os OS) Option {
+	return func(u *Upgrader) {
+		u.os = os
+	}
 }
 
 type realOS struct{}
@@ -13,10 +31,6 @@ func (realOS) Getpid() int {
 	return os.Getpid()
 }
 
-func (realOS) FindProcess(pid int) (processIface, error) {
+func (realOS) FindProcess(pid int) (Process, error) {
 	return os.FindProcess(pid)
 }
-
-type processIface interface {
-	Signal(os.Signal) error
-}
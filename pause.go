@@ -0,0 +1,96 @@
+package tableroll
+
+import (
+	"fmt"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// UpgradesPausedError is returned when the owner refused to pass on its fds
+// because its upgrades are paused.
+type UpgradesPausedError struct {
+	Pid    int
+	Reason string
+}
+
+func (e *UpgradesPausedError) Error() string {
+	return fmt.Sprintf("upgrades from process %d are paused: %s", e.Pid, e.Reason)
+}
+
+// PauseUpgrades makes this process refuse to hand off its fds until
+// ResumeUpgrades is called, e.g. during a schema migration. Processes trying
+// to upgrade from it fail with an UpgradesPausedError giving reason; those
+// using older versions of tableroll get an UpgradeRejectedError. Pausing
+// again replaces the reason.
+//
+// Once PauseUpgrades returns successfully no handoff can start until
+// ResumeUpgrades is called. It fails with ErrUpgradeInProgress if a handoff
+// has already started, in which case it may be retried once the handoff has
+// failed, or with ErrUpgradeCompleted if one has completed.
+func (u *Upgrader) PauseUpgrades(reason string) error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	switch u.state {
+	case upgraderStateTransferringOwnership:
+		return ErrUpgradeInProgress
+	case upgraderStateDraining:
+		return ErrUpgradeCompleted
+	case upgraderStateStopped:
+		return ErrUpgraderStopped
+	}
+	u.paused = true
+	u.pauseReason = reason
+	u.l.Info("upgrades paused", "reason", reason)
+	return nil
+}
+
+// ResumeUpgrades lets this process hand off its fds again after
+// PauseUpgrades.
+func (u *Upgrader) ResumeUpgrades() {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.paused {
+		u.l.Info("upgrades resumed")
+	}
+	u.paused = false
+	u.pauseReason = ""
+}
+
+// rejectIfPaused rejects the sibling if upgrades are paused.
+func (u *Upgrader) rejectIfPaused(nextOwner *sibling) bool {
+	u.stateLock.Lock()
+	paused, reason := u.paused, u.pauseReason
+	u.stateLock.Unlock()
+	if paused {
+		u.rejectPaused(nextOwner, reason)
+	}
+	return paused
+}
+
+func (u *Upgrader) rejectPaused(nextOwner *sibling, reason string) {
+	u.l.Info("rejecting upgrade while paused", "peer", nextOwner.peer, "reason", reason)
+	nextOwner.rejectWithCode(proto.RejectionPaused, reason)
+}
+
+// beginTransfer moves us into the transferring state, unless upgrades are
+// paused, checking both at once so a handoff can't start once PauseUpgrades
+// has returned. It rejects the sibling and returns false on failure.
+func (u *Upgrader) beginTransfer(nextOwner *sibling) bool {
+	u.stateLock.Lock()
+	paused, reason := u.paused, u.pauseReason
+	var err error
+	if !paused {
+		err = u.state.transitionTo(upgraderStateTransferringOwnership)
+	}
+	u.stateLock.Unlock()
+	if paused {
+		u.rejectPaused(nextOwner, reason)
+		return false
+	}
+	if err != nil {
+		u.l.Info("cannot handle upgrade request", "reason", err)
+		nextOwner.rejectWithCode(proto.RejectionBusy, err.Error())
+		return false
+	}
+	return true
+}
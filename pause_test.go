@@ -0,0 +1,69 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestPauseUpgrades(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if err := upg1.PauseUpgrades("schema migration"); err != nil {
+		t.Fatalf("error pausing: %v", err)
+	}
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	paused, ok := err.(*UpgradesPausedError)
+	if !ok || paused.Reason != "schema migration" {
+		t.Fatalf("expected the upgrade to be refused with the pause reason, got %T %v", err, err)
+	}
+	// a forced cold start is refused too
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithForceColdStart())
+	if _, ok := err.(*UpgradesPausedError); !ok {
+		t.Fatalf("expected the takeover to be refused, got %T %v", err, err)
+	}
+
+	upg1.ResumeUpgrades()
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading after resuming: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.PauseUpgrades("too late"); err != ErrUpgradeCompleted {
+		t.Fatalf("expected pausing after an upgrade to fail, got %v", err)
+	}
+}
+
+func TestPauseUpgradesDuringHandoff(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	upg1, upg2, readyErr := startManualCommitUpgrade(t, coordDir)
+	defer upg1.Stop()
+	defer upg2.Stop()
+
+	if err := upg1.PauseUpgrades("too late"); err != ErrUpgradeInProgress {
+		t.Fatalf("expected pausing during a handoff to fail, got %v", err)
+	}
+	if err := upg1.Commit(); err != nil {
+		t.Fatalf("error committing: %v", err)
+	}
+	if err := <-readyErr; err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
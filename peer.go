@@ -0,0 +1,54 @@
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// PeerInfo describes the process on the other end of an upgrade session.
+// Pid, Uid, and Gid are provided by the kernel for the connection, and so may
+// be trusted. Exe and StartTime are looked up afterwards on a best-effort
+// basis, and will be empty if they could not be determined.
+type PeerInfo struct {
+	Pid int
+	Uid int
+	Gid int
+	// Exe is the path to the peer's executable.
+	Exe string
+	// StartTime is when the peer process started.
+	StartTime time.Time
+	// Identity is what the peer set with WithIdentity, if anything. Unlike
+	// the other fields, it's reported by the peer itself during the upgrade.
+	Identity string
+}
+
+func (p PeerInfo) String() string {
+	s := fmt.Sprintf("pid=%d uid=%d gid=%d exe=%q started=%s", p.Pid, p.Uid, p.Gid, p.Exe, p.StartTime.Format(time.RFC3339))
+	if p.Identity != "" {
+		s += fmt.Sprintf(" identity=%q", p.Identity)
+	}
+	return s
+}
+
+// peerInfo determines who is on the other end of a unix connection using the
+// credentials the kernel recorded when the connection was established.
+func peerInfo(conn *net.UnixConn) (PeerInfo, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	var info PeerInfo
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		info, credErr = peerCredentials(fd)
+	})
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	if credErr != nil {
+		return PeerInfo{}, credErr
+	}
+	info.Exe, info.StartTime = processDetails(info.Pid)
+	return info, nil
+}
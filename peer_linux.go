@@ -0,0 +1,104 @@
+// +build linux
+
+package tableroll
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"syscall"
+)
+
+// clockTicksPerSecond is USER_HZ, which /proc reports process start times in.
+// It is 100 on every architecture Linux supports.
+const clockTicksPerSecond = 100
+
+func peerCredentials(fd uintptr) (PeerInfo, error) {
+	cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return PeerInfo{}, fmt.Errorf("could not get peer credentials: %w", err)
+	}
+	return PeerInfo{
+		Pid: int(cred.Pid),
+		Uid: int(cred.Uid),
+		Gid: int(cred.Gid),
+	}, nil
+}
+
+// processDetails looks up a process's executable and start time in /proc. If
+// either can't be determined, its zero value is returned.
+func processDetails(pid int) (string, time.Time) {
+	exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	start, _ := processStartTime(pid)
+	return exe, start
+}
+
+// processExeHash returns the hex sha256 of a process's executable, read
+// through /proc so that it's the binary the process is running even if its
+// path has since been replaced.
+func processExeHash(pid int) (string, error) {
+	exe, err := os.Open(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return "", err
+	}
+	defer exe.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, exe); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func processStartTime(pid int) (time.Time, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The second field, the command name, may contain spaces and parens, so
+	// skip past its closing paren before splitting. The start time is the
+	// 22nd field, i.e. the 20th after the command name.
+	idx := bytes.LastIndexByte(stat, ')')
+	if idx < 0 {
+		return time.Time{}, errors.New("malformed stat file")
+	}
+	fields := strings.Fields(string(stat[idx+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, errors.New("malformed stat file")
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	boot, err := bootTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return boot.Add(time.Duration(ticks) * time.Second / clockTicksPerSecond), nil
+}
+
+func bootTime() (time.Time, error) {
+	stat, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(stat), "\n") {
+		if !strings.HasPrefix(line, "btime ") {
+			continue
+		}
+		secs, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(line, "btime ")), 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, errors.New("no btime in /proc/stat")
+}
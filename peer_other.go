@@ -0,0 +1,20 @@
+// +build !linux
+
+package tableroll
+
+import (
+	"errors"
+	"time"
+)
+
+func peerCredentials(fd uintptr) (PeerInfo, error) {
+	return PeerInfo{}, errors.New("peer credentials are only supported on linux")
+}
+
+func processDetails(pid int) (string, time.Time) {
+	return "", time.Time{}
+}
+
+func processExeHash(pid int) (string, error) {
+	return "", errors.New("executable hashes are only supported on linux")
+}
@@ -0,0 +1,56 @@
+package tableroll
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPeerInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on linux")
+	}
+	server, client, err := unixSocketPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer client.Close()
+
+	info, err := peerInfo(server)
+	if err != nil {
+		t.Fatalf("error getting peer info: %v", err)
+	}
+	if info.Pid != os.Getpid() || info.Uid != os.Getuid() {
+		t.Errorf("expected our own pid and uid, got %+v", info)
+	}
+	exe, _ := os.Executable()
+	if info.Exe != exe {
+		t.Errorf("expected exe %q, got %q", exe, info.Exe)
+	}
+	if info.StartTime.IsZero() || info.StartTime.After(time.Now()) {
+		t.Errorf("unexpected start time: %v", info.StartTime)
+	}
+}
+
+func unixSocketPair() (*net.UnixConn, *net.UnixConn, error) {
+	dir, cleanup := tmpDir()
+	defer cleanup()
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: dir + "/sock"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	client, err := net.DialUnix("unix", nil, ln.Addr().(*net.UnixAddr))
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := ln.AcceptUnix()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	return server, client, nil
+}
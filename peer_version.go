@@ -0,0 +1,178 @@
+package tableroll
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// PeerVersionError is returned when the owner refused to pass on its fds
+// because this process's version is older than the minimum it accepts; see
+// WithMinimumPeerVersion.
+type PeerVersionError struct {
+	// Version is the version the new process reported, which is empty if it
+	// didn't report one.
+	Version string
+	// Minimum is the oldest version the owner accepts.
+	Minimum string
+}
+
+func (e *PeerVersionError) Error() string {
+	if e.Version == "" {
+		return fmt.Sprintf("the owner requires version %s or newer, and no version was reported", e.Minimum)
+	}
+	return fmt.Sprintf("the owner requires version %s or newer, got %s", e.Minimum, e.Version)
+}
+
+// WithMinimumPeerVersion makes the owner refuse to pass its fds to a process
+// reporting a semantic version older than min, so that a rollback started by
+// mistake during a botched deploy can't take over. The version is the first
+// space-separated field of the identity set with WithIdentity which parses
+// as a semantic version, with or without a leading "v", such as "v1.4.2" or
+// "myapp 1.4.2-rc.1 (abc123)". Processes which don't report a version,
+// including those using older versions of tableroll, are refused too; they
+// fail with a *PeerVersionError.
+//
+// New fails if min isn't a semantic version.
+func WithMinimumPeerVersion(min string) Option {
+	return func(u *Upgrader) {
+		u.minPeerVersion = min
+	}
+}
+
+// checkMinPeerVersion returns an error if the configured minimum version
+// isn't valid.
+func (u *Upgrader) checkMinPeerVersion() error {
+	if u.minPeerVersion == "" {
+		return nil
+	}
+	if _, ok := parseSemver(u.minPeerVersion); !ok {
+		return fmt.Errorf("minimum peer version %q is not a semantic version", u.minPeerVersion)
+	}
+	return nil
+}
+
+// rejectIfTooOld rejects the sibling if its version is older than the
+// minimum.
+func (u *Upgrader) rejectIfTooOld(nextOwner *sibling) bool {
+	if u.minPeerVersion == "" {
+		return false
+	}
+	min, _ := parseSemver(u.minPeerVersion)
+	version, ok := identityVersion(nextOwner.peer.Identity)
+	if ok && compareSemver(version, min) >= 0 {
+		return false
+	}
+	raw := ""
+	if ok {
+		raw = version.raw
+	}
+	u.l.Warn("refusing an upgrade from an older version", "peer", nextOwner.peer, "version", raw, "minimum", u.minPeerVersion)
+	nextOwner.sendRejection(proto.Rejection{
+		Reason:         (&PeerVersionError{Version: raw, Minimum: u.minPeerVersion}).Error(),
+		Code:           proto.RejectionVersionTooOld,
+		MinimumVersion: u.minPeerVersion,
+	})
+	return true
+}
+
+// semver is a parsed semantic version. Build metadata is ignored, as it
+// doesn't affect precedence.
+type semver struct {
+	raw                 string
+	major, minor, patch uint64
+	prerelease          []string
+}
+
+// identityVersion finds the version in an identity set with WithIdentity.
+func identityVersion(identity string) (semver, bool) {
+	for _, field := range strings.Fields(identity) {
+		if v, ok := parseSemver(field); ok {
+			return v, true
+		}
+	}
+	return semver{}, false
+}
+
+func parseSemver(s string) (semver, bool) {
+	v := semver{raw: s}
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, id := range v.prerelease {
+			if id == "" {
+				return semver{}, false
+			}
+		}
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return semver{}, false
+	}
+	nums := []*uint64{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return semver{}, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// compareSemver returns -1, 0 or 1 as a has lower, equal or higher precedence
+// than b.
+func compareSemver(a, b semver) int {
+	for _, pair := range [][2]uint64{{a.major, b.major}, {a.minor, b.minor}, {a.patch, b.patch}} {
+		if pair[0] != pair[1] {
+			return compareUint(pair[0], pair[1])
+		}
+	}
+	// a version without a prerelease is newer than any prerelease of it
+	switch {
+	case len(a.prerelease) == 0 && len(b.prerelease) == 0:
+		return 0
+	case len(a.prerelease) == 0:
+		return 1
+	case len(b.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.prerelease) && i < len(b.prerelease); i++ {
+		if c := comparePrerelease(a.prerelease[i], b.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(a.prerelease)), uint64(len(b.prerelease)))
+}
+
+// comparePrerelease compares prerelease identifiers: numeric ones
+// numerically, and lower than alphanumeric ones, which compare lexically.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
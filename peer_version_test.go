@@ -0,0 +1,72 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestCompareSemver(t *testing.T) {
+	ordered := []string{"0.9.0", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "v1.0.0", "1.0.1", "1.2.0", "1.10.0", "2.0.0"}
+	for i := range ordered {
+		for j := range ordered {
+			a, ok := parseSemver(ordered[i])
+			if !ok {
+				t.Fatalf("could not parse %q", ordered[i])
+			}
+			b, _ := parseSemver(ordered[j])
+			expected := compareUint(uint64(i), uint64(j))
+			if got := compareSemver(a, b); got != expected {
+				t.Errorf("expected comparing %s with %s to give %d, got %d", ordered[i], ordered[j], expected, got)
+			}
+		}
+	}
+	for _, invalid := range []string{"", "1", "1.2", "1.2.x", "1.2.3-", "1.2.3-a..b", "latest"} {
+		if _, ok := parseSemver(invalid); ok {
+			t.Errorf("expected %q not to parse", invalid)
+		}
+	}
+	if v, ok := identityVersion("myapp 1.4.2-rc.1+abc123 (linux)"); !ok || v.raw != "1.4.2-rc.1+abc123" {
+		t.Errorf("expected to find the version in the identity, got %q", v.raw)
+	}
+}
+
+func TestMinimumPeerVersion(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithMinimumPeerVersion("latest")); err == nil {
+		t.Fatal("expected an invalid minimum version to be refused")
+	}
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithIdentity("myapp v1.4.2"), WithMinimumPeerVersion("v1.4.0"))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	for identity, reported := range map[string]string{"myapp v1.3.9": "v1.3.9", "myapp": "", "": ""} {
+		_, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdentity(identity))
+		tooOld, ok := err.(*PeerVersionError)
+		if !ok || tooOld.Version != reported || tooOld.Minimum != "v1.4.0" {
+			t.Fatalf("expected %q to be refused, got %T %v", identity, err, err)
+		}
+	}
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdentity("myapp v1.3.9"), WithForceColdStart())
+	if _, ok := err.(*PeerVersionError); !ok {
+		t.Fatalf("expected a forced cold start to be refused too, got %T %v", err, err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdentity("myapp v1.4.0"))
+	if err != nil {
+		t.Fatalf("expected the minimum version to be accepted, got %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+)
+
+// PipeEnd identifies one end of a pipe.
+type PipeEnd string
+
+const (
+	// PipeReadEnd is the end of a pipe which is read from.
+	PipeReadEnd PipeEnd = "read"
+	// PipeWriteEnd is the end of a pipe which is written to.
+	PipeWriteEnd PipeEnd = "write"
+)
+
+// PipeEndID returns the id the given end of the pipe with the given id is
+// stored with. Each end is stored as a file, so it may also be retrieved with
+// File or removed with Remove.
+func PipeEndID(id string, end PipeEnd) string {
+	return id + "." + string(end)
+}
+
+// Pipe returns both ends of a pipe inherited from the previous owner, or
+// creates a pipe and stores both ends. This allows a pipe to a helper process
+// which outlives upgrades to keep being used by the next owner. If the pipe
+// was created with PipeOneEnd, only the stored end is returned, and the other
+// is nil. The caller is responsible for closing the returned files.
+func (f *Fds) Pipe(id string) (r, w *os.File, err error) {
+	return f.pipe(context.Background(), id, PipeReadEnd, PipeWriteEnd)
+}
+
+// PipeOneEnd is like Pipe, but only stores one end of the pipe it creates.
+// The other end is still returned, so it can be passed to another process,
+// e.g. with exec.Cmd's ExtraFiles, and should be closed once it has been.
+// When the pipe is inherited, only the stored end is returned, and the other
+// is nil.
+func (f *Fds) PipeOneEnd(id string, keep PipeEnd) (r, w *os.File, err error) {
+	return f.pipe(context.Background(), id, keep)
+}
+
+func (f *Fds) pipe(ctx context.Context, id string, keep ...PipeEnd) (r, w *os.File, err error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer f.mu.Unlock()
+
+	for _, end := range []PipeEnd{PipeReadEnd, PipeWriteEnd} {
+		if err := f.conflictLocked(pipeEndFd(id, end)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r, err = f.fileLocked(PipeEndID(id, PipeReadEnd)); err != nil {
+		return nil, nil, err
+	}
+	if w, err = f.fileLocked(PipeEndID(id, PipeWriteEnd)); err != nil {
+		if r != nil {
+			r.Close()
+		}
+		return nil, nil, err
+	}
+	if r != nil || w != nil {
+		return r, w, nil
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, nil, err
+	}
+
+	r, w, err = os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, end := range keep {
+		fi := r
+		if end == PipeWriteEnd {
+			fi = w
+		}
+		stored := pipeEndFd(id, end)
+		dup, err := dupFile(fi, stored.ID)
+		if err != nil {
+			r.Close()
+			w.Close()
+			f.removePipeLocked(id)
+			return nil, nil, err
+		}
+		stored.file = dup
+		stored.Generation = f.generation
+		f.storeLocked(stored)
+	}
+	return r, w, nil
+}
+
+// removePipeLocked closes and removes any stored ends of the given pipe.
+func (f *Fds) removePipeLocked(id string) {
+	for _, end := range []PipeEnd{PipeReadEnd, PipeWriteEnd} {
+		endID := PipeEndID(id, end)
+		if fi, ok := f.fds[endID]; ok {
+			fi.file.Close()
+			delete(f.fds, endID)
+		}
+	}
+}
+
+func pipeEndFd(id string, end PipeEnd) *fd {
+	return &fd{ID: PipeEndID(id, end), Kind: fdKindFile, Name: "pipe:" + string(end)}
+}
@@ -0,0 +1,162 @@
+package tableroll
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Platform describes what a process runs on. Processes exchange their
+// platforms when upgrading, so that a fleet which is half way through
+// migrating to another architecture, or another container image, doesn't
+// hand fds between binaries which can't use them in the same way.
+type Platform struct {
+	// OS and Arch are the process's GOOS and GOARCH.
+	OS   string
+	Arch string
+	// ImageDigest is the digest set with WithImageDigest, if any.
+	ImageDigest string
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Arch
+	if p.ImageDigest != "" {
+		s += "@" + p.ImageDigest
+	}
+	return s
+}
+
+// compatible returns whether processes on p and other may hand off to one
+// another. Image digests are only compared if both processes set one.
+func (p Platform) compatible(other Platform) bool {
+	if p.OS != other.OS || p.Arch != other.Arch {
+		return false
+	}
+	return p.ImageDigest == "" || other.ImageDigest == "" || p.ImageDigest == other.ImageDigest
+}
+
+func platformFromProto(p proto.Platform) Platform {
+	return Platform{OS: p.OS, Arch: p.Arch, ImageDigest: p.ImageDigest}
+}
+
+func (p Platform) proto() *proto.Platform {
+	return &proto.Platform{OS: p.OS, Arch: p.Arch, ImageDigest: p.ImageDigest}
+}
+
+// PlatformPolicy is what to do when a process on another platform takes
+// part in an upgrade; see WithPlatformPolicy.
+type PlatformPolicy string
+
+const (
+	// PlatformMismatchWarn logs a warning, and hands off anyway. It's the
+	// default.
+	PlatformMismatchWarn PlatformPolicy = "warn"
+	// PlatformMismatchReject refuses to hand off.
+	PlatformMismatchReject PlatformPolicy = "reject"
+	// PlatformMismatchIgnore doesn't compare platforms at all.
+	PlatformMismatchIgnore PlatformPolicy = "ignore"
+)
+
+// PlatformMismatchError is returned when a handoff was refused because the
+// owner and the new process run on incompatible platforms; see
+// WithPlatformPolicy.
+type PlatformMismatchError struct {
+	// Pid is the other process.
+	Pid int
+	// Local is this process's platform, and Peer the other process's.
+	Local Platform
+	Peer  Platform
+}
+
+func (e *PlatformMismatchError) Error() string {
+	return fmt.Sprintf("process %d runs on %s, which is incompatible with %s", e.Pid, e.Peer, e.Local)
+}
+
+// WithImageDigest sets the digest of the container image this process runs
+// in, to be compared with the other process's when upgrading. Since every
+// release normally has its own image, it should identify what the inherited
+// fds depend on, such as a base image or runtime, rather than the release
+// itself. Digests are only compared if both processes set one.
+func WithImageDigest(digest string) Option {
+	return func(u *Upgrader) {
+		u.imageDigest = digest
+	}
+}
+
+// WithPlatformPolicy sets what to do when the other process in an upgrade
+// runs on an incompatible platform: another GOOS or GOARCH, or another image
+// digest; see WithImageDigest. Both the owner and the new process apply
+// their own policy. An owner which refuses the new process, or a new process
+// which refuses the owner's fds, makes New fail with a
+// *PlatformMismatchError. Processes using versions of tableroll which don't
+// report their platform are never refused. The default is
+// PlatformMismatchWarn.
+func WithPlatformPolicy(policy PlatformPolicy) Option {
+	return func(u *Upgrader) {
+		u.platformPolicy = policy
+	}
+}
+
+// platform describes the platform this process runs on.
+func (u *Upgrader) platform() Platform {
+	return Platform{OS: runtime.GOOS, Arch: runtime.GOARCH, ImageDigest: u.imageDigest}
+}
+
+// checkPlatformPolicy returns an error if the configured policy isn't valid.
+func (u *Upgrader) checkPlatformPolicy() error {
+	switch u.platformPolicy {
+	case "", PlatformMismatchWarn, PlatformMismatchReject, PlatformMismatchIgnore:
+		return nil
+	}
+	return fmt.Errorf("unknown platform policy %q", u.platformPolicy)
+}
+
+// rejectIfPlatformMismatch rejects the sibling if it runs on an incompatible
+// platform and the policy says to.
+func (u *Upgrader) rejectIfPlatformMismatch(nextOwner *sibling) bool {
+	if u.platformPolicy == PlatformMismatchIgnore || nextOwner.platform == nil {
+		return false
+	}
+	ours := u.platform()
+	theirs := platformFromProto(*nextOwner.platform)
+	if ours.compatible(theirs) {
+		return false
+	}
+	err := &PlatformMismatchError{Pid: nextOwner.peer.Pid, Local: ours, Peer: theirs}
+	peer := nextOwner.peer
+	u.emit(Event{Type: EventPlatformMismatch, Peer: &peer, Err: err})
+	if u.platformPolicy != PlatformMismatchReject {
+		u.l.Warn("handing off to a process on an incompatible platform", "peer", nextOwner.peer, "err", err)
+		return false
+	}
+	u.l.Warn("refusing an upgrade from a process on an incompatible platform", "peer", nextOwner.peer, "err", err)
+	nextOwner.sendRejection(proto.Rejection{
+		Reason:   err.Error(),
+		Code:     proto.RejectionPlatformMismatch,
+		Platform: ours.proto(),
+	})
+	return true
+}
+
+// checkOwnerPlatform returns a *PlatformMismatchError if the owner runs on an
+// incompatible platform and the policy says to refuse its fds.
+func (s *upgradeSession) checkOwnerPlatform(owner *proto.Platform) error {
+	if s.platformPolicy == PlatformMismatchIgnore || owner == nil {
+		return nil
+	}
+	theirs := platformFromProto(*owner)
+	if s.platform.compatible(theirs) {
+		return nil
+	}
+	err := &PlatformMismatchError{Local: s.platform, Peer: theirs}
+	if s.owner != nil {
+		err.Pid = s.owner.Pid
+	}
+	if s.platformPolicy != PlatformMismatchReject {
+		s.l.Warn("inheriting fds from a process on an incompatible platform", "err", err)
+		return nil
+	}
+	s.l.Warn("refusing fds from a process on an incompatible platform", "err", err)
+	return err
+}
@@ -0,0 +1,109 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestPlatformCompatible(t *testing.T) {
+	linux := Platform{OS: "linux", Arch: "amd64"}
+	for _, tc := range []struct {
+		a, b Platform
+		want bool
+	}{
+		{linux, linux, true},
+		{linux, Platform{OS: "linux", Arch: "arm64"}, false},
+		{linux, Platform{OS: "darwin", Arch: "amd64"}, false},
+		{Platform{OS: "linux", Arch: "amd64", ImageDigest: "sha256:a"}, linux, true},
+		{Platform{OS: "linux", Arch: "amd64", ImageDigest: "sha256:a"}, Platform{OS: "linux", Arch: "amd64", ImageDigest: "sha256:a"}, true},
+		{Platform{OS: "linux", Arch: "amd64", ImageDigest: "sha256:a"}, Platform{OS: "linux", Arch: "amd64", ImageDigest: "sha256:b"}, false},
+	} {
+		if got := tc.a.compatible(tc.b); got != tc.want {
+			t.Errorf("%v and %v: expected %v, got %v", tc.a, tc.b, tc.want, got)
+		}
+	}
+}
+
+func TestPlatformPolicy(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithPlatformPolicy("sometimes")); err == nil {
+		t.Fatalf("expected an unknown policy to be refused")
+	}
+
+	events := make(chan Event, 10)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithImageDigest("sha256:a"),
+		WithPlatformPolicy(PlatformMismatchReject),
+		WithEventHandler(func(e Event) { events <- e }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// the owner refuses an incompatible process
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithImageDigest("sha256:b"))
+	var mismatch *PlatformMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a *PlatformMismatchError, got %v", err)
+	}
+	if mismatch.Peer.ImageDigest != "sha256:a" || mismatch.Local.ImageDigest != "sha256:b" {
+		t.Fatalf("unexpected mismatch: %+v", mismatch)
+	}
+	select {
+	case e := <-events:
+		if e.Type != EventPlatformMismatch || e.Peer == nil {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a platform mismatch event")
+	}
+
+	// the new process refuses an incompatible owner, which only warns
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l),
+		WithImageDigest("sha256:a"),
+		WithPlatformPolicy(PlatformMismatchWarn))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l),
+		WithImageDigest("sha256:b"),
+		WithPlatformPolicy(PlatformMismatchReject))
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a *PlatformMismatchError, got %v", err)
+	}
+	if mismatch.Peer.ImageDigest != "sha256:a" {
+		t.Fatalf("unexpected mismatch: %+v", mismatch)
+	}
+
+	// the owner recovers from the failed upgrade, and only warns
+	deadline := time.Now().Add(5 * time.Second)
+	for upg2.Status().State != string(upgraderStateOwner) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the owner to recover from a failed upgrade")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l), WithImageDigest("sha256:b"))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if upg3.NoOwnerReason() != NoOwnerReasonNone {
+		t.Fatalf("expected to upgrade despite the warning, got %q", upg3.NoOwnerReason())
+	}
+}
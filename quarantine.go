@@ -0,0 +1,142 @@
+package tableroll
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WithFdQuarantine verifies the fds received from the owner as
+// WithFdVerification does, but rather than failing New if any don't match,
+// quarantines them: they aren't returned by Listener and the like, aren't
+// passed on to the next owner, and aren't closed, so that they may be
+// inspected with Quarantined and resolved with Unquarantine or
+// DiscardQuarantined. Using their ids to create new fds fails with a
+// *QuarantinedError until they're resolved.
+func WithFdQuarantine() Option {
+	return func(u *Upgrader) {
+		u.verifyFds = fdVerificationQuarantine
+	}
+}
+
+// QuarantinedFd describes an inherited fd which failed verification; see
+// WithFdQuarantine.
+type QuarantinedFd struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Network and Addr are set for sockets, and Name for files, as described
+	// by the owner.
+	Network string `json:"network,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	Name    string `json:"name,omitempty"`
+	// Generation is the generation of the process which created the fd.
+	Generation uint32 `json:"generation"`
+	// Reasons describes each way in which the fd failed verification.
+	Reasons []string `json:"reasons"`
+}
+
+// QuarantinedError is returned when creating an fd with the id of a
+// quarantined one, until it's resolved with Unquarantine or
+// DiscardQuarantined.
+type QuarantinedError struct {
+	ID      string
+	Reasons []string
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("fd %q is quarantined: %s", e.ID, strings.Join(e.Reasons, ", "))
+}
+
+// quarantineLocked sets aside an inherited fd which failed verification.
+func (f *Fds) quarantineLocked(fi *fd) {
+	if f.quarantined == nil {
+		f.quarantined = make(map[string]*fd)
+	}
+	f.quarantined[fi.ID] = fi
+}
+
+// Quarantined describes the quarantined fds, sorted by id.
+func (f *Fds) Quarantined() []QuarantinedFd {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	quarantined := make([]QuarantinedFd, 0, len(f.quarantined))
+	for _, fi := range f.quarantined {
+		fi = f.redacted(fi)
+		quarantined = append(quarantined, QuarantinedFd{
+			ID:         fi.ID,
+			Kind:       string(fi.Kind),
+			Network:    fi.Network,
+			Addr:       fi.Addr,
+			Name:       fi.Name,
+			Generation: fi.Generation,
+			Reasons:    append([]string(nil), fi.quarantine...),
+		})
+	}
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i].ID < quarantined[j].ID })
+	return quarantined
+}
+
+// Unquarantine accepts a quarantined fd despite it failing verification, so
+// that it's returned by Listener and the like, and passed on to the next
+// owner, as any other inherited fd.
+func (f *Fds) Unquarantine(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.quarantined[id]
+	if !ok {
+		return fmt.Errorf("fd %q is not quarantined", id)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return err
+	}
+	delete(f.quarantined, id)
+	f.l.Info("unquarantined inherited fd", "fd", f.redacted(fi))
+	fi.quarantine = nil
+	f.restoreSocketOptionsLocked(fi)
+	f.storeLocked(fi)
+	return nil
+}
+
+// DiscardQuarantined closes a quarantined fd, so that its id may be used to
+// create a new one.
+func (f *Fds) DiscardQuarantined(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.quarantined[id]
+	if !ok {
+		return fmt.Errorf("fd %q is not quarantined", id)
+	}
+	delete(f.quarantined, id)
+	f.l.Info("discarded quarantined fd", "fd", f.redacted(fi))
+	if fi.file != nil {
+		fi.file.Close()
+	}
+	return nil
+}
+
+// discardQuarantinedLocked closes every quarantined fd.
+func (f *Fds) discardQuarantinedLocked() {
+	for id, fi := range f.quarantined {
+		if fi.file != nil {
+			fi.file.Close()
+		}
+		delete(f.quarantined, id)
+	}
+}
+
+// reportQuarantined emits an event describing the received fds which were
+// quarantined, if any.
+func (u *Upgrader) reportQuarantined(owner *PeerInfo, fds []*fd) {
+	mismatches := make(map[string][]string)
+	for _, fi := range fds {
+		if fi.quarantine != nil {
+			mismatches[fi.ID] = fi.quarantine
+		}
+	}
+	if len(mismatches) == 0 {
+		return
+	}
+	err := &FdMismatchError{Mismatches: mismatches}
+	u.l.Warn("quarantined inherited fds", "err", err)
+	u.emit(Event{Type: EventFdsQuarantined, Peer: owner, Err: err})
+}
@@ -0,0 +1,137 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestCheckFdsKind(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "tableroll_quarantine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	identity, err := identify(tmp.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file described as a listener
+	received := &fd{ID: "web", Kind: fdKindListener, Identity: identity, file: &file{tmp, tmp.Fd()}}
+	mismatches := checkFds([]*fd{received})
+	if len(mismatches["web"]) != 1 {
+		t.Fatalf("expected a kind mismatch, got %v", mismatches)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dup, err := dupConn(ln.(Listener), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := identify(dup.fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := *identity
+	wrong.SockAddr = "127.0.0.1:1"
+	received := &fd{ID: "web", Kind: fdKindListener, Network: "tcp", Addr: "127.0.0.1:0", Identity: &wrong, file: dup, inherited: true}
+	received.quarantine = checkFds([]*fd{received})["web"]
+
+	fds := newFds(l, map[string]*fd{"web": received})
+	quarantined := fds.Quarantined()
+	if len(quarantined) != 1 || quarantined[0].ID != "web" || len(quarantined[0].Reasons) != 1 {
+		t.Fatalf("expected web to be quarantined for its address, got %+v", quarantined)
+	}
+	if got, err := fds.Listener("web"); got != nil || err != nil {
+		t.Fatalf("expected a quarantined fd not to be used, got %v, %v", got, err)
+	}
+	var qerr *QuarantinedError
+	if _, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0"); !errors.As(err, &qerr) {
+		t.Fatalf("expected a quarantined error, got %v", err)
+	}
+
+	if err := fds.Unquarantine("web"); err != nil {
+		t.Fatalf("error unquarantining: %v", err)
+	}
+	if len(fds.Quarantined()) != 0 {
+		t.Fatalf("expected nothing to be quarantined")
+	}
+	got, err := fds.Listener("web")
+	if err != nil || got == nil {
+		t.Fatalf("expected the unquarantined listener, got %v, %v", got, err)
+	}
+	got.Close()
+	if err := fds.Unquarantine("web"); err == nil {
+		t.Fatalf("expected an error unquarantining an fd which isn't quarantined")
+	}
+}
+
+func TestDiscardQuarantined(t *testing.T) {
+	ctx := context.Background()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dup, err := dupConn(ln.(Listener), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := &fd{ID: "web", Kind: fdKindListener, Network: "tcp", Addr: "127.0.0.1:0", file: dup, inherited: true, quarantine: []string{"socket error: broken"}}
+	fds := newFds(l, map[string]*fd{"web": received})
+
+	if err := fds.DiscardQuarantined("web"); err != nil {
+		t.Fatalf("error discarding: %v", err)
+	}
+	if _, err := dup.Stat(); err == nil {
+		t.Fatalf("expected the quarantined fd to be closed")
+	}
+	newLn, err := fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected the id to be usable once discarded: %v", err)
+	}
+	newLn.Close()
+}
+
+func TestUpgradeWithFdQuarantine(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithFdQuarantine())
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg2.Stop()
+	if q := upg2.Fds.Quarantined(); len(q) != 0 {
+		t.Fatalf("expected matching fds not to be quarantined, got %+v", q)
+	}
+	if ln, err := upg2.Fds.Listener("web"); err != nil || ln == nil {
+		t.Fatalf("expected the inherited listener, got %v, %v", ln, err)
+	}
+}
@@ -0,0 +1,37 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+)
+
+// Reacquire takes ownership back from the process this Upgrader handed off
+// to, for instance because that process's version was rolled back by some
+// other means, and this process should serve again. It connects to the
+// current owner as a new process would, and returns a new Upgrader holding
+// the current owner's fds, created with this Upgrader's options. As with New,
+// the new Upgrader becomes the owner once its Ready is called.
+//
+// Reacquire may only be called once this Upgrader has handed off, that is,
+// after UpgradeComplete is closed and before Stop. This Upgrader stops
+// serving upgrade requests, but otherwise carries on draining; it should
+// still be stopped once it's done. If there's no owner to take the fds back
+// from, Reacquire returns a *NoOwnerError rather than cold-starting.
+func (u *Upgrader) Reacquire(ctx context.Context) (*Upgrader, error) {
+	u.stateLock.Lock()
+	state := u.state
+	u.stateLock.Unlock()
+	if state != upgraderStateDraining {
+		return nil, fmt.Errorf("cannot reacquire ownership in state %v, only after handing off", state)
+	}
+	u.l.Info("reacquiring ownership from the current owner")
+	// the new Upgrader listens on the same upgrade sockets, which we only
+	// use to turn away upgrades while draining
+	u.closeUpgradeSocks()
+	opts := append(append([]Option(nil), u.opts...), WithRequireExistingOwner())
+	next, err := newUpgrader(ctx, u.clock, u.os, u.coordinationDir, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not reacquire ownership: %w", err)
+	}
+	return next, nil
+}
@@ -0,0 +1,61 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestReacquire(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Reacquire(ctx); err == nil {
+		t.Fatal("expected Reacquire to fail before handing off")
+	}
+	ln, err := upg1.Fds.Listen(ctx, "testListen", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	// the new version was rolled back, so the first process takes over again
+	again, err := upg1.Reacquire(ctx)
+	if err != nil {
+		t.Fatalf("error reacquiring: %v", err)
+	}
+	defer again.Stop()
+	if err := again.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg2.UpgradeComplete()
+	if gen := again.Generation(); gen != 2 {
+		t.Fatalf("expected the reacquired ownership to be generation 2, got %d", gen)
+	}
+	reacquired, err := again.Fds.Listener("testListen")
+	if err != nil || reacquired == nil {
+		t.Fatalf("expected to get the listener back, got %v, %v", reacquired, err)
+	}
+	if reacquired.Addr().String() != ln.Addr().String() {
+		t.Fatalf("expected the same listener, got %v rather than %v", reacquired.Addr(), ln.Addr())
+	}
+}
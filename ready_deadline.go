@@ -0,0 +1,130 @@
+package tableroll
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReadyDeadlineAction is what an Upgrader does when Ready isn't called within
+// the deadline set with WithReadyDeadline.
+type ReadyDeadlineAction int
+
+const (
+	// ReadyDeadlineWarn logs an error and emits EventReadyDeadlineExceeded,
+	// but otherwise carries on waiting for Ready.
+	ReadyDeadlineWarn ReadyDeadlineAction = iota
+	// ReadyDeadlineRelease also gives up on becoming the owner: it closes the
+	// connection to the previous owner, which remains the owner, and unlocks
+	// the coordination directory so another process may upgrade. Ready then
+	// fails with a *ReadyDeadlineError. This process keeps any fds it holds
+	// until Stop is called.
+	ReadyDeadlineRelease
+)
+
+// ReadyDeadlineError is returned by Ready when it was called after the
+// deadline set with WithReadyDeadline, and the action was
+// ReadyDeadlineRelease.
+type ReadyDeadlineError struct {
+	Deadline time.Duration
+}
+
+func (e *ReadyDeadlineError) Error() string {
+	return fmt.Sprintf("Ready was not called within %v, so the upgrade was given up", e.Deadline)
+}
+
+// WithReadyDeadline guards against an application which never calls Ready,
+// e.g. because a bug skips the code path which should, and so holds the
+// coordination lock, and any previous owner's upgrade, indefinitely. If Ready
+// hasn't been called within d of New returning, the Upgrader logs an error,
+// emits EventReadyDeadlineExceeded, and then does what action says.
+//
+// The previous owner's upgrade timeout, see WithUpgradeTimeout, also protects
+// it from a new process which never becomes ready, but only the new process
+// can release the coordination lock.
+func WithReadyDeadline(d time.Duration, action ReadyDeadlineAction) Option {
+	return func(u *Upgrader) {
+		u.readyDeadline = d
+		u.readyDeadlineAction = action
+	}
+}
+
+// ReadyDeadline returns when the previous owner will give up on this process
+// if it hasn't called Ready, i.e. when the previous owner's upgrade timeout
+// runs out, so the application may budget its initialization, e.g. with
+// context.WithDeadline, and call Handback rather than carry on once it can no
+// longer make it. ok is false if there was no previous owner, or it uses a
+// version of tableroll which doesn't report its timeout.
+//
+// The deadline is only meaningful until Ready is called.
+func (u *Upgrader) ReadyDeadline() (deadline time.Time, ok bool) {
+	if u.ownerReadyTimeout <= 0 {
+		return time.Time{}, false
+	}
+	return u.ownerReadyBy, true
+}
+
+// startReadyDeadline starts the watchdog for WithReadyDeadline, if it was
+// used. It's stopped by Ready or Stop.
+func (u *Upgrader) startReadyDeadline() {
+	if u.readyDeadline <= 0 || u.session == nil {
+		return
+	}
+	timer := u.clock.NewTimer(u.readyDeadline)
+	stopC := make(chan struct{})
+	var once sync.Once
+	u.stopReadyDeadline = func() {
+		once.Do(func() { close(stopC) })
+	}
+	go func() {
+		select {
+		case <-timer.C():
+			u.readyDeadlineExceeded()
+		case <-stopC:
+			timer.Stop()
+		}
+	}()
+}
+
+func (u *Upgrader) readyDeadlineExceeded() {
+	u.stateLock.Lock()
+	if u.state != upgraderStateCheckingOwner || u.readyCalled {
+		u.stateLock.Unlock()
+		return
+	}
+	u.l.Error("Ready was not called within the ready deadline, is the application stuck or did it skip calling Ready?", "deadline", u.readyDeadline, "action", u.readyDeadlineAction)
+	owner := u.session.owner
+	if u.readyDeadlineAction == ReadyDeadlineRelease {
+		u.readyDeadlineErr = &ReadyDeadlineError{Deadline: u.readyDeadline}
+		u.session.Close()
+		u.l.Warn("gave up on becoming the owner, released the coordination lock")
+	}
+	u.stateLock.Unlock()
+	// the handler may call the Upgrader, so it's called without the lock
+	u.emit(Event{Type: EventReadyDeadlineExceeded, Peer: owner})
+}
+
+func (a ReadyDeadlineAction) String() string {
+	switch a {
+	case ReadyDeadlineWarn:
+		return "warn"
+	case ReadyDeadlineRelease:
+		return "release"
+	}
+	return fmt.Sprintf("ReadyDeadlineAction(%d)", int(a))
+}
+
+// checkRepeatedReadyLocked logs loudly and returns true if Ready has already
+// been called, which is always a bug in the application, even when it's
+// harmless. The caller emits EventReadyRepeated once it's unlocked.
+func (u *Upgrader) checkRepeatedReadyLocked() bool {
+	repeated := u.readyCalled
+	if repeated {
+		u.l.Error("Ready was called more than once, it should only be called once", "state", u.state)
+	}
+	u.readyCalled = true
+	if u.stopReadyDeadline != nil {
+		u.stopReadyDeadline()
+	}
+	return repeated
+}
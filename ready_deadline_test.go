@@ -0,0 +1,164 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+// stepWhenWaiting advances the clock once something is waiting on it.
+func stepWhenWaiting(t *testing.T, clock *fakeclock.FakeClock, d time.Duration) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !clock.HasWaiters() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a timer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Step(d)
+}
+
+func TestReadyDeadlineRelease(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	events := make(chan Event, 1)
+	upg2, err := newUpgrader(ctx, fake, mockOS{pid: 2}, coordDir, WithLogger(l),
+		WithReadyDeadline(time.Minute, ReadyDeadlineRelease),
+		WithEventHandler(func(e Event) { events <- e }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	stepWhenWaiting(t, fake, time.Minute)
+	if e := <-events; e.Type != EventReadyDeadlineExceeded || e.Peer == nil {
+		t.Fatalf("expected a ready deadline event with the owner, got %+v", e)
+	}
+	if _, ok := upg2.Ready().(*ReadyDeadlineError); !ok {
+		t.Fatalf("expected Ready to fail after the deadline released the upgrade")
+	}
+
+	// the owner recovered, and another process may upgrade
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	upg3, err := waitOwnership(waitCtx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l), WithLockRetryInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestReadyDeadlineWarn(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	events := make(chan Event, 1)
+	upg, err := newUpgrader(ctx, fake, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithReadyDeadline(time.Minute, ReadyDeadlineWarn),
+		WithEventHandler(func(e Event) { events <- e }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	stepWhenWaiting(t, fake, time.Minute)
+	if e := <-events; e.Type != EventReadyDeadlineExceeded {
+		t.Fatalf("expected a ready deadline event, got %+v", e)
+	}
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("expected Ready to succeed late with ReadyDeadlineWarn, got %v", err)
+	}
+	if err := upg.Ready(); err == nil {
+		t.Fatalf("expected a second Ready to fail")
+	}
+}
+
+func TestReadyDeadlineFromOwner(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithUpgradeTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, ok := upg1.ReadyDeadline(); ok {
+		t.Fatalf("expected no ready deadline without a previous owner")
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	before := time.Now()
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	deadline, ok := upg2.ReadyDeadline()
+	if !ok {
+		t.Fatalf("expected the owner to report its ready deadline")
+	}
+	if deadline.Before(before.Add(30*time.Second)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("expected a deadline within the owner's upgrade timeout, got %v from %v", deadline, before)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+}
+
+func TestReadyRepeated(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	events := make(chan Event, 1)
+	var upg *Upgrader
+	upg, err := newUpgrader(context.Background(), clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithEventHandler(func(e Event) {
+			// the handler may call the Upgrader
+			upg.Status()
+			events <- e
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("expected no event for the first Ready, got %+v", e)
+	default:
+	}
+
+	upg.Ready()
+	select {
+	case e := <-events:
+		if e.Type != EventReadyRepeated {
+			t.Fatalf("expected a repeated ready event, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a repeated ready event")
+	}
+}
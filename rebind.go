@@ -0,0 +1,208 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// A release which changes the addresses it listens on can't simply inherit
+// its predecessor's listeners, nor bind its own in their place: the old
+// addresses stay bound by both processes, and the new ones must be bound
+// before the process is ready. DeclareListeners reconciles the listeners a
+// process wants with those it inherited. The old owner keeps serving every
+// address until it drains, and the new owner keeps its copies of the
+// listeners it no longer wants open until then too, so that they're only
+// unbound once nothing serves them any longer.
+
+// ListenerSpec describes a listener passed to DeclareListeners. Config is
+// optional, and used as with Listen.
+type ListenerSpec struct {
+	ID      string
+	Network string
+	Addr    string
+	Config  *net.ListenConfig
+}
+
+// ListenerPlan describes how DeclareListeners reconciled the declared
+// listeners with the inherited ones. Each list of ids is sorted.
+type ListenerPlan struct {
+	// Listeners holds a listener for every declared id.
+	Listeners map[string]net.Listener
+	// Kept are the ids which were inherited with the declared network and
+	// address.
+	Kept []string
+	// Added are the ids which weren't inherited, and were bound.
+	Added []string
+	// Changed are the ids which were inherited with a different network or
+	// address, and were bound at the declared one.
+	Changed []string
+	// Removed are the ids of inherited listeners which weren't declared.
+	Removed []string
+}
+
+// ErrAlreadyReady is returned by DeclareListeners once Ready has been called.
+var ErrAlreadyReady = errors.New("listeners must be declared before Ready is called")
+
+// DeclareListeners declares the complete set of listeners this process
+// serves, and reconciles it with those inherited from the previous owner, so
+// that a release may change its listening addresses. Inherited listeners with
+// the declared network and address are kept. Declared listeners which
+// weren't inherited, or were inherited with another address, are bound. If
+// any can't be bound, those which were are closed, Fds is left as it was,
+// and the error is returned.
+//
+// Inherited listeners which weren't declared, and those replaced by one with
+// another address, are removed from Fds at once, so they aren't passed on to
+// the next owner and their ids may be reused, but this process's copies are
+// only closed once the previous owner has drained; see PredecessorDrained.
+// The listeners returned for them earlier, if any, should be closed by the
+// caller. Other kinds of fds, and listeners this process created itself, are
+// left alone.
+//
+// It must be called before Ready, and returns ErrAlreadyReady otherwise.
+func (u *Upgrader) DeclareListeners(ctx context.Context, specs ...ListenerSpec) (*ListenerPlan, error) {
+	if !u.awaitingReady() {
+		return nil, ErrAlreadyReady
+	}
+	plan, err := u.Fds.declareListeners(ctx, specs)
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Changed) > 0 || len(plan.Removed) > 0 {
+		u.l.Info("rebinding listeners", "added", plan.Added, "changed", plan.Changed, "removed", plan.Removed)
+		go u.closeRetiringAfterDrain()
+	}
+	return plan, nil
+}
+
+// closeRetiringAfterDrain closes the listeners DeclareListeners removed once
+// the previous owner has drained, or this process has stopped or handed off.
+func (u *Upgrader) closeRetiringAfterDrain() {
+	select {
+	case <-u.predecessorDrainedC:
+	case <-u.upgradeCompleteC:
+	}
+	u.Fds.closeRetiring()
+}
+
+// boundListener is a listener declareListeners has bound, and the fd it'll
+// store for it.
+type boundListener struct {
+	id string
+	ln Listener
+	fi *fd
+}
+
+func (f *Fds) declareListeners(ctx context.Context, specs []ListenerSpec) (_ *ListenerPlan, err error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	plan := &ListenerPlan{Listeners: make(map[string]net.Listener, len(specs))}
+	declared := make(map[string]bool, len(specs))
+	var bound []boundListener
+	defer func() {
+		if err != nil {
+			for _, ln := range plan.Listeners {
+				ln.Close()
+			}
+			for _, b := range bound {
+				b.ln.Close()
+				b.fi.file.Close()
+			}
+		}
+	}()
+	for _, spec := range specs {
+		if spec.ID == "" {
+			return nil, errors.New("listener declared without an id")
+		}
+		if declared[spec.ID] {
+			return nil, fmt.Errorf("listener %q declared more than once", spec.ID)
+		}
+		declared[spec.ID] = true
+		if q, ok := f.quarantined[spec.ID]; ok {
+			return nil, &QuarantinedError{ID: q.ID, Reasons: q.quarantine}
+		}
+		existing, ok := f.fds[spec.ID]
+		if ok && existing.sameResource(&fd{ID: spec.ID, Kind: fdKindListener, Network: spec.Network, Addr: spec.Addr}) {
+			ln, err := f.listenerLocked(spec.ID)
+			if err != nil {
+				return nil, err
+			}
+			plan.Listeners[spec.ID] = ln
+			plan.Kept = append(plan.Kept, spec.ID)
+			continue
+		}
+		if ok && existing.Kind != fdKindListener {
+			return nil, newIdExistsError(existing)
+		}
+		if err := f.checkMutationLocked(spec.ID); err != nil {
+			return nil, err
+		}
+		cfg := spec.Config
+		if cfg == nil {
+			cfg = &net.ListenConfig{}
+		}
+		ln, err := listenNetwork(ctx, cfg, spec.Network, spec.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("can't create new listener %q: %w", spec.ID, err)
+		}
+		fdLn, ok := ln.(Listener)
+		if !ok {
+			ln.Close()
+			return nil, fmt.Errorf("%T doesn't implement tableroll.Listener", ln)
+		}
+		fi, err := f.dupConnFd(spec.ID, fdKindListener, spec.Network, spec.Addr, fdLn)
+		if err != nil {
+			fdLn.Close()
+			return nil, err
+		}
+		bound = append(bound, boundListener{id: spec.ID, ln: fdLn, fi: fi})
+	}
+
+	// everything's bound, so nothing can fail from here on
+	var retiring []*fd
+	for _, b := range bound {
+		if existing, ok := f.fds[b.id]; ok {
+			retiring = append(retiring, existing)
+			plan.Changed = append(plan.Changed, b.id)
+		} else {
+			plan.Added = append(plan.Added, b.id)
+		}
+		if ifc, ok := b.ln.(unlinkOnCloser); ok {
+			ifc.SetUnlinkOnClose(false)
+		}
+		f.storeLocked(b.fi)
+		plan.Listeners[b.id] = b.ln
+	}
+	for _, fi := range f.sortedLocked() {
+		if fi.inherited && fi.Kind == fdKindListener && !declared[fi.ID] {
+			retiring = append(retiring, fi)
+			plan.Removed = append(plan.Removed, fi.ID)
+			delete(f.fds, fi.ID)
+			delete(f.onTransfer, fi.ID)
+		}
+	}
+	f.retiring = append(f.retiring, retiring...)
+	sort.Strings(plan.Kept)
+	sort.Strings(plan.Added)
+	sort.Strings(plan.Changed)
+	return plan, nil
+}
+
+// closeRetiring closes the listeners declareListeners removed.
+func (f *Fds) closeRetiring() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fi := range f.retiring {
+		f.l.Info("closing listener which is no longer declared", "fd", f.redacted(fi))
+		if fi.file != nil {
+			fi.file.Close()
+		}
+	}
+	f.retiring = nil
+}
@@ -0,0 +1,125 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestDeclareListeners(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	sock := func(name string) string {
+		return filepath.Join(coordDir, name+".sock")
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	for _, id := range []string{"keep", "http", "old"} {
+		ln, err := upg1.Fds.Listen(ctx, id, nil, "unix", sock(id))
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		defer ln.Close()
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+
+	// a listener which can't be bound leaves the fds as they were
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	if _, err := upg2.DeclareListeners(ctx,
+		ListenerSpec{ID: "http", Network: "unix", Addr: sock("http2")},
+		ListenerSpec{ID: "taken", Network: "tcp", Addr: taken.Addr().String()},
+	); err == nil {
+		t.Fatalf("expected binding a taken address to fail")
+	}
+	if got := upg2.Fds.IDs(); !reflect.DeepEqual(got, []string{"http", "keep", "old"}) {
+		t.Fatalf("expected the fds to be untouched, got %v", got)
+	}
+	if _, err := net.Dial("unix", sock("http2")); err == nil {
+		t.Fatalf("expected the listener bound before the failure to be closed")
+	}
+
+	plan, err := upg2.DeclareListeners(ctx,
+		ListenerSpec{ID: "keep", Network: "unix", Addr: sock("keep")},
+		ListenerSpec{ID: "http", Network: "unix", Addr: sock("http2")},
+		ListenerSpec{ID: "new", Network: "unix", Addr: sock("new")},
+	)
+	if err != nil {
+		t.Fatalf("error declaring listeners: %v", err)
+	}
+	for _, ln := range plan.Listeners {
+		defer ln.Close()
+	}
+	want := &ListenerPlan{
+		Listeners: plan.Listeners,
+		Kept:      []string{"keep"},
+		Added:     []string{"new"},
+		Changed:   []string{"http"},
+		Removed:   []string{"old"},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Fatalf("expected %+v, got %+v", want, plan)
+	}
+	if len(plan.Listeners) != 3 {
+		t.Fatalf("expected a listener for each declared id, got %v", plan.Listeners)
+	}
+	if addr := plan.Listeners["http"].Addr().String(); addr != sock("http2") {
+		t.Fatalf("expected http to be rebound, got %v", addr)
+	}
+	if got := upg2.Fds.IDs(); !reflect.DeepEqual(got, []string{"http", "keep", "new"}) {
+		t.Fatalf("expected the removed listener to be gone, got %v", got)
+	}
+
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if _, err := upg2.DeclareListeners(ctx); err != ErrAlreadyReady {
+		t.Fatalf("expected ErrAlreadyReady, got %v", err)
+	}
+	// the replaced listeners are only closed once the old owner has drained
+	<-upg1.UpgradeComplete()
+	upg2.Fds.mu.Lock()
+	retiring := len(upg2.Fds.retiring)
+	upg2.Fds.mu.Unlock()
+	if retiring != 2 {
+		t.Fatalf("expected 2 listeners to be retiring, got %d", retiring)
+	}
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		upg2.Fds.mu.Lock()
+		retiring = len(upg2.Fds.retiring)
+		upg2.Fds.mu.Unlock()
+		if retiring == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the retiring listeners to be closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
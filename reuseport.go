@@ -0,0 +1,235 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+)
+
+// SO_REUSEPORT steering is an alternative to passing a socket between owners.
+// Instead, each owner creates its own socket with SO_REUSEPORT set, which
+// joins the sockets of previous owners in a group sharing the address. The
+// first owner attaches an eBPF program to the group which sends new
+// connections, or for UDP new packets, to whichever socket is stored in a
+// small map. That map is what's passed between owners in the fd store, and
+// each new owner stores its socket in it once it's ready. Since each process
+// reads only from its own socket, a draining owner keeps receiving traffic
+// which was already queued for it, without competing with the next owner
+// for everything else.
+
+func reusePortSteeringName(network, addr string) string {
+	return "bpf-map:reuseport:" + network + ":" + addr
+}
+
+// ListenReusePort creates a listener with SO_REUSEPORT set which shares its
+// address with the listeners previous owners created with the same id,
+// rather than inheriting one of them. New connections go to this process's
+// listener immediately if there was no previous owner, or otherwise once the
+// Upgrader is Ready. Until then, they go to the previous owner.
+// The previous owner should close its listener once it starts draining, after
+// accepting any connections already queued for it.
+//
+// It requires importing github.com/ngrok/tableroll/reuseport, which supports
+// linux. Steering requires linux 4.19 or newer, and permission to load eBPF
+// programs. Without those, a warning is logged and the kernel spreads new
+// connections across the listeners of all owners until older ones are closed.
+// Each id may only be used once per process.
+func (f *Fds) ListenReusePort(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	var ln net.Listener
+	err := f.joinReusePortGroup(ctx, id, cfg, network, addr, func(cfg *net.ListenConfig) (syscall.Conn, error) {
+		var err error
+		ln, err = cfg.Listen(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		sysConn, ok := ln.(syscall.Conn)
+		if !ok {
+			ln.Close()
+			return nil, fmt.Errorf("%T doesn't implement syscall.Conn", ln)
+		}
+		return sysConn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// ListenPacketReusePort is like ListenReusePort, but for packet conns, such as
+// UDP sockets. Once this process's conn receives new packets, packets for
+// flows the previous owner was handling will also be sent to it, so this is
+// best suited to protocols where each packet stands alone, or which can route
+// packets between processes; see docs/quic.md.
+func (f *Fds) ListenPacketReusePort(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string) (net.PacketConn, error) {
+	var conn net.PacketConn
+	err := f.joinReusePortGroup(ctx, id, cfg, network, addr, func(cfg *net.ListenConfig) (syscall.Conn, error) {
+		var err error
+		conn, err = cfg.ListenPacket(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		sysConn, ok := conn.(syscall.Conn)
+		if !ok {
+			conn.Close()
+			return nil, fmt.Errorf("%T doesn't implement syscall.Conn", conn)
+		}
+		return sysConn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (f *Fds) joinReusePortGroup(ctx context.Context, id string, cfg *net.ListenConfig, network, addr string, listen func(cfg *net.ListenConfig) (syscall.Conn, error)) error {
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	name := reusePortSteeringName(network, addr)
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindFile, Name: name}); err != nil {
+		return err
+	}
+	if f.reusePortJoined[id] {
+		return fmt.Errorf("already listening with SO_REUSEPORT for id %q", id)
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return err
+	}
+
+	withReusePort := net.ListenConfig{}
+	if cfg != nil {
+		withReusePort = *cfg
+	}
+	userControl := withReusePort.Control
+	withReusePort.Control = func(network, address string, c syscall.RawConn) error {
+		if userControl != nil {
+			if err := userControl(network, address, c); err != nil {
+				return err
+			}
+		}
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setReusePort(fd)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+	conn, err := listen(&withReusePort)
+	if err != nil {
+		return fmt.Errorf("can't create SO_REUSEPORT socket: %w", err)
+	}
+	if f.reusePortJoined == nil {
+		f.reusePortJoined = make(map[string]bool)
+	}
+	f.reusePortJoined[id] = true
+
+	steering, ok := f.fds[id]
+	if ok && steering.file != nil {
+		// we inherited the group's steering map, so take over once ready
+		f.pendingSteering = append(f.pendingSteering, func() error {
+			return withRawFd(conn, func(sockFd uintptr) error {
+				return steerTo(steering.file.fd, sockFd)
+			})
+		})
+		return nil
+	}
+
+	// we're the first owner, so set up steering for the group
+	mapFile, err := newSteeringMap()
+	if err != nil {
+		f.l.Warn("can't steer SO_REUSEPORT connections, they will be spread across owners", "id", redactString(f.redact, id), "err", err)
+		return nil
+	}
+	defer mapFile.Close()
+	err = withRawFd(conn, func(sockFd uintptr) error {
+		if err := attachSteeringProgram(mapFile.Fd(), sockFd); err != nil {
+			return err
+		}
+		return steerTo(mapFile.Fd(), sockFd)
+	})
+	if err != nil {
+		f.l.Warn("can't steer SO_REUSEPORT connections, they will be spread across owners", "id", redactString(f.redact, id), "err", err)
+		return nil
+	}
+	dup, err := dupFd(mapFile.Fd(), name)
+	if err != nil {
+		return err
+	}
+	f.storeLocked(&fd{
+		ID:         id,
+		Kind:       fdKindFile,
+		Name:       name,
+		Generation: f.generation,
+		file:       dup,
+	})
+	return nil
+}
+
+// steerReusePortGroups sends new connections for each SO_REUSEPORT group this
+// process joined to its own socket. It's called once this process becomes
+// the owner.
+func (f *Fds) steerReusePortGroups() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, steer := range f.pendingSteering {
+		if err := steer(); err != nil {
+			f.l.Warn("could not steer SO_REUSEPORT connections to this process", "err", err)
+		}
+	}
+	f.pendingSteering = nil
+}
+
+func withRawFd(conn syscall.Conn, fn func(fd uintptr) error) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := raw.Control(func(fd uintptr) {
+		fnErr = fn(fd)
+	}); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+var errReusePortUnavailable = errors.New("SO_REUSEPORT requires importing github.com/ngrok/tableroll/reuseport, which supports linux")
+
+// The system calls below are provided by the reuseport package, if it's
+// imported.
+
+func setReusePort(sockFd uintptr) error {
+	if sysext.ReusePort.Set == nil {
+		return errReusePortUnavailable
+	}
+	return sysext.ReusePort.Set(sockFd)
+}
+
+func newSteeringMap() (*os.File, error) {
+	if sysext.ReusePort.NewSteeringMap == nil {
+		return nil, errReusePortUnavailable
+	}
+	return sysext.ReusePort.NewSteeringMap()
+}
+
+func attachSteeringProgram(mapFd, sockFd uintptr) error {
+	if sysext.ReusePort.AttachSteeringProgram == nil {
+		return errReusePortUnavailable
+	}
+	return sysext.ReusePort.AttachSteeringProgram(mapFd, sockFd)
+}
+
+func steerTo(mapFd, sockFd uintptr) error {
+	if sysext.ReusePort.SteerTo == nil {
+		return errReusePortUnavailable
+	}
+	return sysext.ReusePort.SteerTo(mapFd, sockFd)
+}
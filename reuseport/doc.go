@@ -0,0 +1,8 @@
+// Package reuseport enables tableroll's SO_REUSEPORT listeners, which need
+// system calls the standard library doesn't provide. Import it for its side
+// effects to use Fds.ListenReusePort and Fds.ListenPacketReusePort:
+//
+//	import _ "github.com/ngrok/tableroll/reuseport"
+//
+// It only does so on linux; elsewhere, and without it, they return an error.
+package reuseport
@@ -0,0 +1,158 @@
+// +build linux
+
+package reuseport
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	sysext.ReusePort.Set = setReusePort
+	sysext.ReusePort.NewSteeringMap = newSteeringMap
+	sysext.ReusePort.AttachSteeringProgram = attachSteeringProgram
+	sysext.ReusePort.SteerTo = steerTo
+}
+
+// The steering program is an SK_REUSEPORT eBPF program which selects the
+// socket stored at index 0 of a REUSEPORT_SOCKARRAY map. If the map is empty,
+// e.g. because that socket was closed, selection fails and the kernel falls
+// back to picking a socket in the group by hash.
+const (
+	bpfCmdMapCreate     = 0
+	bpfCmdMapUpdateElem = 2
+	bpfCmdProgLoad      = 5
+
+	bpfMapTypeReuseportSockarray = 20
+	bpfProgTypeSkReuseport       = 21
+	bpfFuncSkSelectReuseport     = 82
+	bpfPseudoMapFd               = 1
+	skPass                       = 1
+)
+
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+func steeringProgram(mapFd int) []bpfInsn {
+	return []bpfInsn{
+		// *(u32 *)(r10 - 4) = 0
+		{code: 0x62, regs: 10, off: -4, imm: 0},
+		// r2 = map (a 16 byte load, so it takes two instructions)
+		{code: 0x18, regs: 2 | bpfPseudoMapFd<<4, imm: int32(mapFd)},
+		{},
+		// r3 = r10 - 4
+		{code: 0xbf, regs: 3 | 10<<4},
+		{code: 0x07, regs: 3, imm: -4},
+		// r4 = 0
+		{code: 0xb7, regs: 4, imm: 0},
+		// r1 is still the context
+		{code: 0x85, imm: bpfFuncSkSelectReuseport},
+		// return SK_PASS
+		{code: 0xb7, regs: 0, imm: skPass},
+		{code: 0x95},
+	}
+}
+
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// newSteeringMap creates the map used by the steering program to find the
+// socket new connections should go to.
+func newSteeringMap() (*os.File, error) {
+	attr := struct {
+		mapType    uint32
+		keySize    uint32
+		valueSize  uint32
+		maxEntries uint32
+		mapFlags   uint32
+	}{
+		mapType:    bpfMapTypeReuseportSockarray,
+		keySize:    4,
+		valueSize:  8,
+		maxEntries: 1,
+	}
+	mapFd, err := bpfSyscall(bpfCmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, fmt.Errorf("could not create reuseport steering map: %w", err)
+	}
+	unix.CloseOnExec(mapFd)
+	return os.NewFile(uintptr(mapFd), "bpf-map:reuseport-steering"), nil
+}
+
+// attachSteeringProgram loads the steering program for the given map and
+// attaches it to the SO_REUSEPORT group of the given socket.
+func attachSteeringProgram(mapFd, sockFd uintptr) error {
+	insns := steeringProgram(int(mapFd))
+	license := []byte("BSD\x00")
+	attr := struct {
+		progType    uint32
+		insnCnt     uint32
+		insns       uint64
+		license     uint64
+		logLevel    uint32
+		logSize     uint32
+		logBuf      uint64
+		kernVersion uint32
+		progFlags   uint32
+	}{
+		progType: bpfProgTypeSkReuseport,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFd, err := bpfSyscall(bpfCmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		return fmt.Errorf("could not load reuseport steering program: %w", err)
+	}
+	// the socket group holds a reference to the program once it's attached
+	defer unix.Close(progFd)
+	if err := unix.SetsockoptInt(int(sockFd), unix.SOL_SOCKET, unix.SO_ATTACH_REUSEPORT_EBPF, progFd); err != nil {
+		return fmt.Errorf("could not attach reuseport steering program: %w", err)
+	}
+	return nil
+}
+
+// steerTo updates the steering map so new connections go to the given socket.
+func steerTo(mapFd, sockFd uintptr) error {
+	key := uint32(0)
+	value := uint64(sockFd)
+	attr := struct {
+		mapFd uint32
+		_     uint32
+		key   uint64
+		value uint64
+		flags uint64
+	}{
+		mapFd: uint32(mapFd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err := bpfSyscall(bpfCmdMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	if err != nil {
+		return fmt.Errorf("could not update reuseport steering map: %w", err)
+	}
+	return nil
+}
+
+// setReusePort sets SO_REUSEPORT on a socket before it's bound.
+func setReusePort(sockFd uintptr) error {
+	return unix.SetsockoptInt(int(sockFd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
@@ -0,0 +1,67 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	_ "github.com/ngrok/tableroll/reuseport"
+)
+
+// acceptsAll dials ln's address n times, and checks that every connection is
+// accepted by ln.
+func acceptsAll(t *testing.T, ln net.Listener, n int) {
+	for i := 0; i < n; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("error dialing: %v", err)
+		}
+		defer client.Close()
+		ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("connection %d was not steered to the expected listener: %v", i, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	ctx := context.Background()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+
+	parent := newFds(l, nil)
+	ln1, err := parent.ListenReusePort(ctx, "web", nil, "tcp", addr)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln1.Close()
+	if _, err := parent.ListenReusePort(ctx, "web", nil, "tcp", addr); err == nil {
+		t.Fatalf("expected an error joining the same group twice")
+	}
+	if _, ok := parent.fds["web"]; !ok {
+		t.Skip("reuseport steering is unavailable, probably due to missing privileges")
+	}
+	acceptsAll(t, ln1, 5)
+
+	child := newFds(l, parent.copy())
+	ln2, err := child.ListenReusePort(ctx, "web", nil, "tcp", addr)
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln2.Close()
+	// until the child is the owner, the parent gets every connection
+	acceptsAll(t, ln1, 5)
+
+	child.steerReusePortGroups()
+	acceptsAll(t, ln2, 5)
+	// once the parent closes its listener, the child still gets them all
+	ln1.Close()
+	acceptsAll(t, ln2, 5)
+}
@@ -0,0 +1,169 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultDrainTimeout is how long Run waits for drain to return by default.
+const DefaultDrainTimeout = 30 * time.Second
+
+// StopReason describes why Run stopped serving.
+type StopReason string
+
+const (
+	// StopReasonUpgraded indicates a new process took ownership.
+	StopReasonUpgraded StopReason = "upgraded"
+	// StopReasonSignal indicates one of the stop signals was received.
+	StopReasonSignal StopReason = "signal"
+	// StopReasonContext indicates the context passed to Run was done.
+	StopReasonContext StopReason = "context"
+	// StopReasonServeReturned indicates the serve function returned by
+	// itself.
+	StopReasonServeReturned StopReason = "serve-returned"
+	// StopReasonChainShutdown indicates ShutdownChain was called.
+	StopReasonChainShutdown StopReason = "chain-shutdown"
+)
+
+// RunResult describes how Run went.
+type RunResult struct {
+	Reason StopReason
+	// Signal is the signal received, if Reason is StopReasonSignal.
+	Signal os.Signal
+	// ServeErr is the error the serve function returned, if any.
+	ServeErr error
+	// DrainErr is the error the drain function returned, if any. If it didn't
+	// return before the drain timeout, DrainTimedOut is set and DrainErr is
+	// the context's error.
+	DrainErr      error
+	DrainTimedOut bool
+}
+
+type runConfig struct {
+	drainTimeout time.Duration
+	signals      []os.Signal
+}
+
+// RunOption is an option function for Run.
+type RunOption func(c *runConfig)
+
+// WithDrainTimeout sets how long Run waits for the drain function, rather
+// than DefaultDrainTimeout.
+func WithDrainTimeout(timeout time.Duration) RunOption {
+	return func(c *runConfig) {
+		c.drainTimeout = timeout
+	}
+}
+
+// WithStopSignals sets the signals which cause Run to drain and stop, rather
+// than SIGINT and SIGTERM. With no signals, Run doesn't handle any.
+func WithStopSignals(signals ...os.Signal) RunOption {
+	return func(c *runConfig) {
+		c.signals = signals
+	}
+}
+
+// Run runs a process's usual lifecycle under tableroll. The process's fds
+// should already have been created or inherited with upg.Fds.
+//
+// Run starts serve, marks upg as Ready, and waits until a new process takes
+// over, a stop signal is received, ctx is done, ShutdownChain is called, or
+// serve returns. The context passed to serve is cancelled once draining is
+// over; serve should stop using its fds and return then. Run then calls
+// drain, which should close listeners and wait for in-flight work to finish,
+// with a context which is done after the drain timeout. If a new process
+// took over, Run lets it know it's done draining with NotifyDrainComplete.
+// Finally it calls upg.Stop.
+//
+// The returned error is set if upg could not be marked ready, or if serve or
+// drain failed.
+func Run(ctx context.Context, upg *Upgrader, serve func(ctx context.Context) error, drain func(ctx context.Context) error, opts ...RunOption) (*RunResult, error) {
+	cfg := runConfig{
+		drainTimeout: DefaultDrainTimeout,
+		signals:      []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	defer upg.Stop()
+
+	signals := make(chan os.Signal, 1)
+	if len(cfg.signals) > 0 {
+		signal.Notify(signals, cfg.signals...)
+		defer signal.Stop(signals)
+	}
+
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+	serveDone := make(chan error, 1)
+	go func() {
+		serveDone <- serve(serveCtx)
+	}()
+	serveReturned := false
+
+	result := &RunResult{}
+	if err := upg.Ready(); err != nil {
+		result.Reason = StopReasonServeReturned
+		stopServing()
+		<-serveDone
+		return result, fmt.Errorf("could not become ready: %w", err)
+	}
+
+	select {
+	case <-upg.UpgradeComplete():
+		result.Reason = StopReasonUpgraded
+	case sig := <-signals:
+		result.Reason = StopReasonSignal
+		result.Signal = sig
+	case <-ctx.Done():
+		result.Reason = StopReasonContext
+	case <-upg.ChainShutdown():
+		result.Reason = StopReasonChainShutdown
+	case err := <-serveDone:
+		result.Reason = StopReasonServeReturned
+		result.ServeErr = err
+		serveReturned = true
+	}
+	upg.l.Info("stopping", "reason", result.Reason, "signal", result.Signal)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.drainTimeout)
+	defer cancel()
+	drainDone := make(chan error, 1)
+	go func() {
+		drainDone <- drain(drainCtx)
+	}()
+	select {
+	case result.DrainErr = <-drainDone:
+	case <-drainCtx.Done():
+		result.DrainErr = drainCtx.Err()
+		result.DrainTimedOut = true
+	}
+	stopServing()
+	if !serveReturned {
+		select {
+		case result.ServeErr = <-serveDone:
+		case <-drainCtx.Done():
+			upg.l.Warn("serve did not return after draining")
+		}
+	}
+
+	if result.Reason == StopReasonUpgraded {
+		if err := upg.NotifyDrainComplete(); err != nil {
+			upg.l.Warn("could not notify the next owner that we're done draining", "err", err)
+		}
+	}
+
+	switch {
+	case result.ServeErr != nil:
+		return result, fmt.Errorf("serve failed: %w", result.ServeErr)
+	case result.DrainTimedOut:
+		return result, fmt.Errorf("drain did not finish in time: %w", result.DrainErr)
+	case result.DrainErr != nil:
+		return result, fmt.Errorf("drain failed: %w", result.DrainErr)
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package tableroll
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestRunUpgrade(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	ctx := context.Background()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	drained := make(chan struct{})
+	type runResult struct {
+		result *RunResult
+		err    error
+	}
+	done := make(chan runResult, 1)
+	go func() {
+		result, err := Run(ctx, upg1, func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}, func(ctx context.Context) error {
+			close(drained)
+			return nil
+		}, WithStopSignals())
+		done <- runResult{result, err}
+	}()
+	waitForState(t, upg1, upgraderStateOwner)
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking second upgrader ready: %v", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("expected Run to succeed, got %v", res.err)
+	}
+	if res.result.Reason != StopReasonUpgraded {
+		t.Fatalf("expected reason %v, got %v", StopReasonUpgraded, res.result.Reason)
+	}
+	<-drained
+	select {
+	case <-upg2.PredecessorDrained():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Run to notify the new owner once it drained")
+	}
+}
+
+func TestRunSignalDrainTimeout(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	ctx := context.Background()
+
+	upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	go func() {
+		waitForState(t, upg, upgraderStateOwner)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+	}()
+	result, err := Run(ctx, upg, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	}, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithStopSignals(syscall.SIGUSR1), WithDrainTimeout(10*time.Millisecond))
+	if err == nil {
+		t.Fatalf("expected an error when draining times out")
+	}
+	if result.Reason != StopReasonSignal || result.Signal != syscall.SIGUSR1 {
+		t.Fatalf("expected to stop due to SIGUSR1, got %v %v", result.Reason, result.Signal)
+	}
+	if !result.DrainTimedOut {
+		t.Fatalf("expected drain to time out")
+	}
+	waitForState(t, upg, upgraderStateStopped)
+}
+
+func waitForState(t *testing.T, upg *Upgrader, state upgraderState) {
+	for i := 0; i < 500; i++ {
+		upg.stateLock.Lock()
+		current := upg.state
+		upg.stateLock.Unlock()
+		if current == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("upgrader never reached state %v", state)
+}
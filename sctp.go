@@ -0,0 +1,16 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+)
+
+// listenNetwork creates a listener as cfg.Listen does, adding support for
+// SCTP, which net doesn't.
+func listenNetwork(ctx context.Context, cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	switch network {
+	case "sctp", "sctp4", "sctp6":
+		return listenSCTP(cfg, network, addr)
+	}
+	return cfg.Listen(ctx, network, addr)
+}
@@ -0,0 +1,67 @@
+// +build linux
+
+package tableroll
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"syscall"
+)
+
+// listenSCTP creates a one-to-one style SCTP socket listening on addr. Its
+// connections are accepted as *net.TCPConns, which read and write SCTP
+// streams like TCP ones, but ignore TCP-specific options.
+func listenSCTP(cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	tcpNetwork := "tcp" + strings.TrimPrefix(network, "sctp")
+	tcpAddr, err := net.ResolveTCPAddr(tcpNetwork, addr)
+	if err != nil {
+		return nil, err
+	}
+	family, sa := syscall.AF_INET6, syscall.Sockaddr(nil)
+	if ip4 := tcpAddr.IP.To4(); network == "sctp4" || (ip4 != nil && network != "sctp6") {
+		inet4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		if ip4 != nil {
+			copy(inet4.Addr[:], ip4)
+		}
+		family, sa = syscall.AF_INET, inet4
+	} else {
+		inet6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(inet6.Addr[:], tcpAddr.IP.To16())
+		sa = inet6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_SCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("%s:%s", network, addr))
+	defer file.Close()
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 && network == "sctp" {
+		// accept IPv4 too, as net does for "tcp"
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+			return nil, os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if cfg.Control != nil {
+		raw, err := file.SyscallConn()
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.Control(network, addr, raw); err != nil {
+			return nil, err
+		}
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return net.FileListener(file)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package tableroll
+
+import (
+	"errors"
+	"net"
+)
+
+func listenSCTP(cfg *net.ListenConfig, network, addr string) (net.Listener, error) {
+	return nil, errors.New("SCTP is only supported on linux by tableroll")
+}
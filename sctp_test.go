@@ -0,0 +1,62 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFdsListenSCTP(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	ln, err := parent.Listen(ctx, "sctp", nil, "sctp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPROTONOSUPPORT) || errors.Is(err, syscall.ESOCKTNOSUPPORT) || errors.Is(err, syscall.EAFNOSUPPORT) {
+		t.Skipf("SCTP isn't supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	ln.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.Listen(ctx, "sctp", nil, "sctp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error inheriting listener: %v", err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != addr.String() {
+		t.Fatalf("expected the inherited listener on %v, got %v", addr, inherited.Addr())
+	}
+	// net can't dial SCTP, so connect by hand
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa := &unix.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+	if err := unix.Connect(fd, sa); err != nil {
+		unix.Close(fd)
+		t.Fatalf("error connecting: %v", err)
+	}
+	clientFile := os.NewFile(uintptr(fd), "sctp client")
+	defer clientFile.Close()
+	conn, err := inherited.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+	if _, err := clientFile.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected to read from the inherited listener's conn, got %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,9 @@
+// Package sealedmem enables tableroll's TLS session ticket keys, which are
+// passed between owners in sealed memfds, created with system calls the
+// standard library doesn't provide. Import it for its side effects to use
+// Fds.SetSessionTicketKeys and the methods built on it:
+//
+//	import _ "github.com/ngrok/tableroll/sealedmem"
+//
+// It only does so on linux; elsewhere, and without it, they return an error.
+package sealedmem
@@ -0,0 +1,63 @@
+// +build linux
+
+package sealedmem
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	sysext.SealedMemory.New = newSealedMemory
+	sysext.SealedMemory.Read = readSealedMemory
+}
+
+const sealedMemorySeals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+
+// newSealedMemory returns a memfd holding data, sealed so that it can't be
+// modified by this or any other process.
+func newSealedMemory(name string, data []byte) (*os.File, error) {
+	memfd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, fmt.Errorf("could not create memfd: %w", err)
+	}
+	f := os.NewFile(uintptr(memfd), "memfd:"+name)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not write to memfd: %w", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(memfd), unix.F_ADD_SEALS, sealedMemorySeals); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not seal memfd: %w", err)
+	}
+	return f, nil
+}
+
+// readSealedMemory returns the contents of a memfd created by
+// newSealedMemory, after checking that it's still sealed and no larger than
+// maxSize.
+func readSealedMemory(fd uintptr, maxSize int) ([]byte, error) {
+	seals, err := unix.FcntlInt(fd, unix.F_GET_SEALS, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not get seals, fd is not a memfd: %w", err)
+	}
+	if seals&sealedMemorySeals != sealedMemorySeals {
+		return nil, fmt.Errorf("memfd is not sealed against modification (seals %#x)", seals)
+	}
+	var st unix.Stat_t
+	if err := unix.Fstat(int(fd), &st); err != nil {
+		return nil, fmt.Errorf("could not stat memfd: %w", err)
+	}
+	if st.Size > int64(maxSize) {
+		return nil, fmt.Errorf("memfd is too large: %d bytes, expected at most %d", st.Size, maxSize)
+	}
+	data := make([]byte, st.Size)
+	n, err := unix.Pread(int(fd), data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not read memfd: %w", err)
+	}
+	return data[:n], nil
+}
@@ -0,0 +1,224 @@
+package tableroll
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// Session is the connection between the owner and a new process during a
+// custom handshake. It lets them exchange their own messages and file
+// descriptors, e.g. to agree on a schema version, before the owner passes on
+// its fds as usual. See WithHandshake and WithHandshakeHandler.
+//
+// Both sides decide the order of messages between themselves; each call to
+// SendJSON or SendFds must be matched by a RecvJSON or RecvFds on the other
+// side. The handshake ends once both sides have called SendReady, which is
+// done automatically when the handshake function returns.
+type Session struct {
+	conn *net.UnixConn
+	peer PeerInfo
+	l    Logger
+
+	sentReady bool
+	peerReady bool
+}
+
+// ErrHandshakeEnded is returned by RecvJSON and RecvFds if the other process
+// has already sent SendReady.
+var ErrHandshakeEnded = errors.New("the other process ended the handshake")
+
+// HandshakeError is returned by New when the function passed to WithHandshake
+// returns an error, or the handshake fails.
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "custom handshake failed: " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// WithHandshake performs a custom handshake with the owner, if there is one,
+// before inheriting its fds. The owner must use WithHandshakeHandler, or the
+// upgrade will be rejected. If handshake returns an error, New returns a
+// *HandshakeError.
+func WithHandshake(handshake func(s *Session) error) Option {
+	return func(u *Upgrader) {
+		u.handshake = handshake
+	}
+}
+
+// WithHandshakeHandler sets the function which performs the owner's side of
+// a custom handshake with new processes which use WithHandshake. If it
+// returns an error, the upgrade is rejected with the error as the reason.
+// New processes which don't use WithHandshake upgrade as usual.
+func WithHandshakeHandler(handler func(s *Session) error) Option {
+	return func(u *Upgrader) {
+		u.handshakeHandler = handler
+	}
+}
+
+func newSession(l Logger, conn *net.UnixConn, peer PeerInfo) *Session {
+	return &Session{
+		conn: conn,
+		peer: peer,
+		l:    l,
+	}
+}
+
+// Peer returns information about the other process.
+func (s *Session) Peer() PeerInfo {
+	return s.peer
+}
+
+// SendJSON sends v, encoded as json, to the other process.
+func (s *Session) SendJSON(v interface{}) error {
+	if s.sentReady {
+		return errors.New("can't send after SendReady")
+	}
+	return proto.WriteFrame(s.conn, proto.MessageHandshakeJSON, v)
+}
+
+// RecvJSON reads a json message sent with SendJSON into v.
+func (s *Session) RecvJSON(v interface{}) error {
+	frame, err := s.recv(proto.MessageHandshakeJSON)
+	if err != nil {
+		return err
+	}
+	return frame.Decode(v)
+}
+
+// SendFds sends duplicates of the given files to the other process. The
+// caller remains responsible for closing them.
+func (s *Session) SendFds(files ...*os.File) error {
+	if s.sentReady {
+		return errors.New("can't send after SendReady")
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if err := proto.WriteFrame(s.conn, proto.MessageHandshakeFds, proto.HandshakeFds{Names: names}); err != nil {
+		return err
+	}
+	connFile, closeConnFile, err := fdPassingFile(s.conn)
+	if err != nil {
+		return fmt.Errorf("could not convert connection to file: %w", err)
+	}
+	defer closeConnFile()
+	for _, f := range files {
+		raw, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		var sendErr error
+		if err := raw.Control(func(fd uintptr) {
+			sendErr = sendFd(connFile, f.Name(), fd)
+		}); err != nil {
+			return err
+		}
+		if sendErr != nil {
+			return fmt.Errorf("could not send fd: %w", sendErr)
+		}
+	}
+	return nil
+}
+
+// RecvFds receives the files sent by a call to SendFds. The caller is
+// responsible for closing them.
+func (s *Session) RecvFds() ([]*os.File, error) {
+	frame, err := s.recv(proto.MessageHandshakeFds)
+	if err != nil {
+		return nil, err
+	}
+	var announced proto.HandshakeFds
+	if err := frame.Decode(&announced); err != nil {
+		return nil, err
+	}
+	if len(announced.Names) > maxFdTableSize {
+		return nil, &LimitError{Field: "handshake fd count", Limit: maxFdTableSize, Value: len(announced.Names)}
+	}
+	connFile, closeConnFile, err := fdPassingFile(s.conn)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert connection to file: %w", err)
+	}
+	defer closeConnFile()
+	files := make([]*os.File, 0, len(announced.Names))
+	for range announced.Names {
+		f, err := recvFd(connFile)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("could not receive fd: %w", err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// SendReady tells the other process that this one is done with the
+// handshake, and wants the upgrade to go ahead. Nothing more may be sent
+// afterwards, but messages from the other process may still be received
+// until it sends SendReady too.
+func (s *Session) SendReady() error {
+	if s.sentReady {
+		return nil
+	}
+	if err := proto.WriteFrame(s.conn, proto.MessageHandshakeReady, nil); err != nil {
+		return err
+	}
+	s.sentReady = true
+	return nil
+}
+
+func (s *Session) recv(typ proto.MessageType) (*proto.Frame, error) {
+	if s.peerReady {
+		return nil, ErrHandshakeEnded
+	}
+	frame, err := proto.ReadFrame(s.conn)
+	if err != nil {
+		return nil, err
+	}
+	switch frame.Type {
+	case typ:
+		return frame, nil
+	case proto.MessageHandshakeReady:
+		s.peerReady = true
+		return nil, ErrHandshakeEnded
+	case proto.MessageRejected:
+		var rejection proto.Rejection
+		if err := frame.Decode(&rejection); err != nil {
+			return nil, err
+		}
+		return nil, &proto.RejectedError{Reason: rejection.Reason, Code: rejection.Code}
+	}
+	return nil, fmt.Errorf("protocol error: expected %s message, got %s", typ, frame.Type)
+}
+
+// run runs fn as one side of the handshake, and then waits for the other
+// side to finish too.
+func (s *Session) run(fn func(s *Session) error) error {
+	if err := fn(s); err != nil {
+		return err
+	}
+	if err := s.SendReady(); err != nil {
+		return err
+	}
+	if !s.peerReady {
+		if _, err := proto.ReadFrameOfType(s.conn, proto.MessageHandshakeReady); err != nil {
+			return err
+		}
+		s.peerReady = true
+	}
+	s.l.Debug("custom handshake complete")
+	return nil
+}
@@ -0,0 +1,168 @@
+package tableroll
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+)
+
+// TLS session ticket keys are passed to the next owner so that clients can
+// resume sessions started with the previous process. The keys aren't a
+// resource like a listener, but are stored in the fd store as a sealed memfd,
+// which can't be modified once written. That way they're passed on, and
+// inspected, the same way as every other fd, without writing them into the
+// handoff protocol's metadata where they might be logged.
+
+// sessionTicketKeysName is the memfd name used for session ticket keys.
+const sessionTicketKeysName = "tableroll-session-ticket-keys"
+
+// maxSessionTicketKeys bounds how many keys will be read back from the store.
+const maxSessionTicketKeys = 1024
+
+// SetSessionTicketKeys stores TLS session ticket keys with the given id, so
+// that they're passed to the next owner, replacing any keys already stored
+// with that id. The first key is used to create new tickets, and all of them
+// to resume sessions, as with tls.Config.SetSessionTicketKeys.
+// Session ticket keys require importing github.com/ngrok/tableroll/sealedmem,
+// which supports linux.
+func (f *Fds) SetSessionTicketKeys(id string, keys [][32]byte) error {
+	return f.setSessionTicketKeysContext(context.Background(), id, keys)
+}
+
+func (f *Fds) setSessionTicketKeysContext(ctx context.Context, id string, keys [][32]byte) error {
+	if len(keys) == 0 || len(keys) > maxSessionTicketKeys {
+		return fmt.Errorf("expected between 1 and %d session ticket keys, got %d", maxSessionTicketKeys, len(keys))
+	}
+	data := make([]byte, 0, 32*len(keys))
+	for _, key := range keys {
+		data = append(data, key[:]...)
+	}
+	mem, err := newSealedMemory(sessionTicketKeysName, data)
+	if err != nil {
+		return err
+	}
+	defer mem.Close()
+
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	want := &fd{ID: id, Kind: fdKindFile, Name: mem.Name()}
+	if err := f.conflictLocked(want); err != nil {
+		return err
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return err
+	}
+	dup, err := dupFile(mem, id)
+	if err != nil {
+		return err
+	}
+	want.Generation = f.generation
+	want.file = dup
+	old, hadOld := f.fds[id]
+	f.storeLocked(want)
+	if hadOld {
+		f.closeReplacedLocked(old)
+	}
+	return nil
+}
+
+// SessionTicketKeys returns the TLS session ticket keys stored with the given
+// id, or nil if there are none.
+func (f *Fds) SessionTicketKeys(id string) ([][32]byte, error) {
+	return f.sessionTicketKeysContext(context.Background(), id)
+}
+
+func (f *Fds) sessionTicketKeysContext(ctx context.Context, id string) ([][32]byte, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+	fi, ok := f.fds[id]
+	if !ok || fi.file == nil {
+		return nil, nil
+	}
+	data, err := readSealedMemory(fi.file.fd, 32*maxSessionTicketKeys)
+	if err != nil {
+		return nil, fmt.Errorf("can't read session ticket keys %q: %w", id, err)
+	}
+	if len(data) == 0 || len(data)%32 != 0 {
+		return nil, fmt.Errorf("session ticket keys %q have an invalid length of %d bytes", id, len(data))
+	}
+	keys := make([][32]byte, len(data)/32)
+	for i := range keys {
+		copy(keys[i][:], data[32*i:])
+	}
+	return keys, nil
+}
+
+// ConfigureSessionTicketKeys sets the session ticket keys of cfg to those
+// stored with the given id, typically inherited from the previous owner. If
+// there are none, a new key is generated and stored first.
+func (f *Fds) ConfigureSessionTicketKeys(id string, cfg *tls.Config) error {
+	keys, err := f.SessionTicketKeys(id)
+	if err != nil {
+		return err
+	}
+	if keys == nil {
+		return f.RotateSessionTicketKeys(id, cfg, 0)
+	}
+	cfg.SetSessionTicketKeys(keys)
+	return nil
+}
+
+// RotateSessionTicketKeys generates a new session ticket key, which will be
+// used for new tickets, and sets it along with up to keep of the previous keys
+// on cfg, so that sessions using them may still be resumed. The keys are
+// stored with the given id, as with SetSessionTicketKeys.
+// It's expected this will be called periodically by the owner.
+func (f *Fds) RotateSessionTicketKeys(id string, cfg *tls.Config, keep int) error {
+	previous, err := f.SessionTicketKeys(id)
+	if err != nil {
+		return err
+	}
+	if keep > maxSessionTicketKeys-1 {
+		keep = maxSessionTicketKeys - 1
+	}
+	if len(previous) > keep {
+		previous = previous[:keep]
+	}
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("could not generate session ticket key: %w", err)
+	}
+	keys := append([][32]byte{key}, previous...)
+	if err := f.SetSessionTicketKeys(id, keys); err != nil {
+		return err
+	}
+	cfg.SetSessionTicketKeys(keys)
+	return nil
+}
+
+var errSealedMemoryUnavailable = errors.New("session ticket keys require importing github.com/ngrok/tableroll/sealedmem, which supports linux")
+
+// newSealedMemory returns a memfd holding data, sealed so that it can't be
+// modified by this or any other process. It's provided by the sealedmem
+// package, if it's imported.
+func newSealedMemory(name string, data []byte) (*os.File, error) {
+	if sysext.SealedMemory.New == nil {
+		return nil, errSealedMemoryUnavailable
+	}
+	return sysext.SealedMemory.New(name, data)
+}
+
+// readSealedMemory returns the contents of a memfd created by
+// newSealedMemory, after checking that it's still sealed and no larger than
+// maxSize.
+func readSealedMemory(fd uintptr, maxSize int) ([]byte, error) {
+	if sysext.SealedMemory.Read == nil {
+		return nil, errSealedMemoryUnavailable
+	}
+	return sysext.SealedMemory.Read(fd, maxSize)
+}
@@ -0,0 +1,107 @@
+package tableroll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	_ "github.com/ngrok/tableroll/sealedmem"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tableroll.test"},
+		DNSNames:     []string{"tableroll.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// handshake performs a TLS handshake between client and server configs, and
+// returns whether the session was resumed.
+func handshake(t *testing.T, server, client *tls.Config) bool {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- tls.Server(serverConn, server).Handshake()
+	}()
+	c := tls.Client(clientConn, client)
+	if err := c.Handshake(); err != nil {
+		t.Fatalf("client handshake failed: %v", err)
+	}
+	if err := <-errC; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	return c.ConnectionState().DidResume
+}
+
+func TestSessionTicketKeys(t *testing.T) {
+	cert := testCertificate(t)
+	newServerConfig := func() *tls.Config {
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12}
+	}
+	client := &tls.Config{
+		ServerName:         "tableroll.test",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		MaxVersion:         tls.VersionTLS12,
+	}
+
+	parent := newFds(l, nil)
+	server1 := newServerConfig()
+	if err := parent.ConfigureSessionTicketKeys("tickets", server1); err != nil {
+		t.Fatalf("error configuring session ticket keys: %v", err)
+	}
+	if handshake(t, server1, client) {
+		t.Fatalf("first handshake should not have been resumed")
+	}
+
+	// a new process inheriting the keys can resume the client's session
+	child := newFds(l, parent.copy())
+	server2 := newServerConfig()
+	if err := child.ConfigureSessionTicketKeys("tickets", server2); err != nil {
+		t.Fatalf("error configuring session ticket keys: %v", err)
+	}
+	if !handshake(t, server2, client) {
+		t.Fatalf("expected the session to be resumed with inherited keys")
+	}
+
+	// a rotation keeps the previous key around for resumption
+	before, err := child.SessionTicketKeys("tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.RotateSessionTicketKeys("tickets", server2, 1); err != nil {
+		t.Fatalf("error rotating session ticket keys: %v", err)
+	}
+	after, err := child.SessionTicketKeys("tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 2 || after[1] != before[0] || after[0] == before[0] {
+		t.Fatalf("expected a new key followed by the previous one, got %d keys", len(after))
+	}
+
+	if _, err := child.OpenFileWith("tickets", "/dev/null", nil); err == nil {
+		t.Fatalf("expected an error reusing the session ticket key id for a file")
+	}
+}
@@ -0,0 +1,333 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// A canary can be run alongside the owner as a shadow, which receives copies
+// of some of the owner's listeners without taking ownership. Both processes
+// then accept connections from the same sockets, so the canary serves a share
+// of the traffic; for SO_REUSEPORT listeners (see ListenReusePort), the share
+// can instead be controlled by having the canary join the group with its own
+// socket. Once the canary has proven itself, Promote upgrades to it as New
+// would.
+//
+// The owner keeps no record of its shadows: they don't hold up upgrades, and
+// keep serving from their copies until they close them, even after the owner
+// has been upgraded or has exited.
+
+// WithShadowApproval configures which processes may shadow this one, and with
+// which fds. approve is called with the process's credentials and the ids it
+// requested, and the request is rejected if it returns an error. By default,
+// any process which may upgrade this one may shadow it.
+func WithShadowApproval(approve func(peer PeerInfo, ids []string) error) Option {
+	return func(u *Upgrader) {
+		u.approveShadow = approve
+	}
+}
+
+// handleShadowRequest sends copies of the requested fds to a shadow.
+func (u *Upgrader) handleShadowRequest(shadow *sibling, ids []string) {
+	if u.approveShadow != nil {
+		if err := u.approveShadow(shadow.peer, ids); err != nil {
+			u.l.Info("shadow was not approved", "peer", shadow.peer, "reason", err)
+			shadow.reject(err.Error())
+			return
+		}
+	}
+	u.stateLock.Lock()
+	state := u.state
+	u.stateLock.Unlock()
+	if state != upgraderStateOwner {
+		shadow.rejectWithCode(proto.RejectionBusy, "not serving as the owner: "+string(state))
+		return
+	}
+	fds, err := u.Fds.shadowCopies(ids)
+	if err != nil {
+		shadow.reject(err.Error())
+		return
+	}
+	defer func() {
+		for _, fi := range fds {
+			fi.file.Close()
+		}
+	}()
+	u.l.Info("sending copies of fds to a shadow", "peer", shadow.peer, "fds", u.redactIDs(ids))
+	shadow.identity = u.identity
+	shadow.maxTransferDuration = u.maxTransferDuration
+	shadow.clock = u.clock
+	if err := shadow.sendFds(proto.MessageFds, fds, u.generation, nil, nil); err != nil {
+		u.l.Warn("could not send fds to a shadow", "peer", shadow.peer, "err", err)
+	}
+}
+
+// redactIDs applies WithRedaction to each of ids.
+func (u *Upgrader) redactIDs(ids []string) []string {
+	redacted := make([]string, len(ids))
+	for i, id := range ids {
+		redacted[i] = u.redactString(id)
+	}
+	return redacted
+}
+
+// shadowCopies returns duplicates of the listeners and packet conns with the
+// given ids, to send to a shadow. The caller must close them.
+func (f *Fds) shadowCopies(ids []string) ([]*fd, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copies := make([]*fd, 0, len(ids))
+	closeCopies := func() {
+		for _, fi := range copies {
+			fi.file.Close()
+		}
+	}
+	for _, id := range ids {
+		fi, ok := f.fds[id]
+		if !ok || fi.file == nil {
+			closeCopies()
+			return nil, fmt.Errorf("no fd with id %q", id)
+		}
+		if fi.Kind != fdKindListener && fi.Kind != fdKindPacketConn {
+			closeCopies()
+			return nil, fmt.Errorf("fd %q is a %s, only listeners and packet conns can be shadowed", id, fi.Kind)
+		}
+		dup, err := dupFd(fi.file.fd, fi.String())
+		if err != nil {
+			closeCopies()
+			return nil, err
+		}
+		copied := *fi
+		copied.file = dup
+		copies = append(copies, &copied)
+	}
+	return copies, nil
+}
+
+// Shadow holds copies of an owner's listeners and packet conns, received
+// without taking ownership. See NewShadow.
+type Shadow struct {
+	mu         sync.Mutex
+	fds        map[string]*fd
+	owner      PeerInfo
+	generation uint32
+
+	dir   string
+	opts  []Option
+	clock clock.Clock
+	os    OS
+}
+
+// NewShadow asks the owner of coordinationDir for copies of the listeners and
+// packet conns with the given ids, without taking ownership or holding the
+// coordination lock, so that this process can serve a share of their traffic
+// as a canary. It fails if there's no owner, if any of the ids are missing or
+// of another kind, or with an *OwnerBusyError if the owner is in the middle
+// of an upgrade. The options are those which will be passed to New by
+// Promote; of them, NewShadow uses the logger, redaction, the stable layout,
+// the socket name, the handoff secret, the identity and fd verification, which fails
+// rather than quarantining fds even with WithFdQuarantine.
+func NewShadow(ctx context.Context, coordinationDir string, ids []string, opts ...Option) (*Shadow, error) {
+	return newShadow(ctx, clock.RealClock{}, realOS{}, coordinationDir, ids, opts...)
+}
+
+func newShadow(ctx context.Context, clock clock.Clock, os OS, coordinationDir string, ids []string, opts ...Option) (*Shadow, error) {
+	if len(ids) == 0 {
+		return nil, errors.New("no fds to shadow")
+	}
+	cfg := &Upgrader{l: discardLogger{}}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if err := cfg.loadHandoffSecret(); err != nil {
+		return nil, err
+	}
+	coord := newCoordinator(clock, os, cfg.l, coordinationDir)
+	coord.sockName = cfg.socketName
+	if cfg.stableLayoutDir != "" {
+		if err := coord.useStableLayout(cfg.stableLayoutDir); err != nil {
+			return nil, err
+		}
+	}
+	conn, legacy, err := coord.ConnectOwner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if legacy {
+		return nil, errors.New("the owner is too old to be shadowed")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	sess := &upgradeSession{
+		wr:          conn,
+		coordinator: coord,
+		l:           cfg.l,
+		identity:    cfg.identity,
+		handoffKey:  cfg.handoffKey,
+		verifyFds:   cfg.verifyFds,
+		redact:      cfg.redact,
+	}
+	if sess.verifyFds == fdVerificationQuarantine {
+		// there's nowhere to keep quarantined fds in a shadow
+		sess.verifyFds = fdVerificationReject
+	}
+	if owner, err := peerInfo(conn); err == nil {
+		sess.owner = &owner
+	}
+	fds, err := sess.readShadowFds(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	s := &Shadow{
+		fds:        make(map[string]*fd, len(fds)),
+		generation: sess.ownerGeneration,
+		dir:        coordinationDir,
+		opts:       opts,
+		clock:      clock,
+		os:         os,
+	}
+	if sess.owner != nil {
+		s.owner = *sess.owner
+	}
+	for _, fi := range fds {
+		s.fds[fi.ID] = fi
+	}
+	cfg.l.Info("shadowing the owner", "owner", s.owner, "fds", redactFds(cfg.redact, fds))
+	return s, nil
+}
+
+// readShadowFds requests copies of the fds with the given ids from the owner.
+func (s *upgradeSession) readShadowFds(ctx context.Context, ids []string) ([]*fd, error) {
+	sockFile, closeSockFile, err := fdPassingFile(s.wr)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert owner connection to file: %w", err)
+	}
+	defer closeSockFile()
+	defer s.closeOnCancel(ctx)()
+
+	authNonce, err := s.helloAuthNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.frames().WriteFrame(proto.MessageHello, proto.Hello{
+		Version:   proto.Version,
+		Intent:    proto.IntentShadow,
+		Identity:  s.identity,
+		AuthNonce: authNonce,
+		Shadow:    ids,
+	}); err != nil {
+		return nil, orContextErr(ctx, fmt.Errorf("can't request fds to shadow: %w", err))
+	}
+	if err := s.authenticateOwner(); err != nil {
+		if _, ok := err.(*HandoffAuthError); ok {
+			return nil, err
+		}
+		return nil, orContextErr(ctx, s.publicProtocolErr(err))
+	}
+	frame, err := s.frames().ReadFrameOfType(proto.MessageFds)
+	if err != nil {
+		return nil, orContextErr(ctx, s.publicProtocolErr(err))
+	}
+	table, err := decodeFdTable(frame)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFdTable(table.Fds); err != nil {
+		return nil, err
+	}
+	if err := receiveFds(sockFile, table.Fds, s.verifyFds, nil); err != nil {
+		return nil, orContextErr(ctx, err)
+	}
+	s.ownerGeneration = table.Generation
+	return table.Fds, nil
+}
+
+// Owner returns the process being shadowed.
+func (s *Shadow) Owner() PeerInfo {
+	return s.owner
+}
+
+// IDs returns the ids of the shadowed fds, sorted.
+func (s *Shadow) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.fds))
+	for id := range s.fds {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Listener returns a copy of the shadowed listener with the given id, or nil
+// if it wasn't shadowed. The caller must close it.
+func (s *Shadow) Listener(id string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, ok := s.fds[id]
+	if !ok || fi.file == nil {
+		return nil, nil
+	}
+	if fi.Kind != fdKindListener {
+		return nil, newIdExistsError(fi)
+	}
+	ln, err := net.FileListener(fi.file.File)
+	if err != nil {
+		return nil, fmt.Errorf("can't use shadowed listener %s: %w", fi.file, err)
+	}
+	return ln, nil
+}
+
+// PacketConn returns a copy of the shadowed packet conn with the given id, or
+// nil if it wasn't shadowed. The caller must close it.
+func (s *Shadow) PacketConn(id string) (net.PacketConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fi, ok := s.fds[id]
+	if !ok || fi.file == nil {
+		return nil, nil
+	}
+	if fi.Kind != fdKindPacketConn {
+		return nil, newIdExistsError(fi)
+	}
+	conn, err := net.FilePacketConn(fi.file.File)
+	if err != nil {
+		return nil, fmt.Errorf("can't use shadowed packet conn %s: %w", fi.file, err)
+	}
+	return conn, nil
+}
+
+// Promote upgrades the owner to this process, as New would with the options
+// given to NewShadow, and returns the resulting Upgrader. The Shadow is left
+// open: the Upgrader inherits the same sockets, so listeners from the Shadow
+// can keep serving until the application has switched to the Upgrader's,
+// after which the Shadow should be closed.
+func (s *Shadow) Promote(ctx context.Context) (*Upgrader, error) {
+	return newUpgrader(ctx, s.clock, s.os, s.dir, s.opts...)
+}
+
+// Close closes the Shadow's copies of the fds. Listeners and packet conns
+// already returned by it are unaffected.
+func (s *Shadow) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for id, fi := range s.fds {
+		if fi.file != nil {
+			if err := fi.file.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		delete(s.fds, id)
+	}
+	return firstErr
+}
@@ -0,0 +1,107 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestShadow(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var approved []string
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithShadowApproval(func(peer PeerInfo, ids []string) error {
+			approved = ids
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ownerLn, err := upg1.Fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ownerLn.Close()
+	if _, err := upg1.Fds.OpenFile("log", filepath.Join(coordDir, "log"), os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newShadow(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, []string{"web"}, WithLogger(l)); err == nil {
+		t.Fatalf("expected shadowing to fail before there's an owner")
+	} else if _, ok := err.(*NoOwnerError); !ok {
+		t.Fatalf("expected a *NoOwnerError, got %T: %v", err, err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	for _, ids := range [][]string{{"missing"}, {"log"}} {
+		if _, err := newShadow(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, ids, WithLogger(l)); err == nil {
+			t.Fatalf("expected shadowing %v to fail", ids)
+		} else if _, ok := err.(*UpgradeRejectedError); !ok {
+			t.Fatalf("expected an *UpgradeRejectedError, got %T: %v", err, err)
+		}
+	}
+
+	shadow, err := newShadow(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, []string{"web"}, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error shadowing: %v", err)
+	}
+	defer shadow.Close()
+	if len(approved) != 1 || approved[0] != "web" {
+		t.Fatalf("expected the shadowed ids to be approved, got %v", approved)
+	}
+	if shadow.Owner().Pid == 0 {
+		t.Fatalf("expected the owner's credentials")
+	}
+	shadowLn, err := shadow.Listener("web")
+	if err != nil || shadowLn == nil {
+		t.Fatalf("expected a shadowed listener, got %v, %v", shadowLn, err)
+	}
+	defer shadowLn.Close()
+	if shadowLn.Addr().String() != ownerLn.Addr().String() {
+		t.Fatalf("expected the shadow to share the owner's socket at %s, got %s", ownerLn.Addr(), shadowLn.Addr())
+	}
+	// with the owner not accepting, the shadow gets the connection
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := shadowLn.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.Dial("tcp", ownerLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("error accepting on the shadowed listener: %v", err)
+	}
+	if status := upg1.Status(); status.State != "owner" {
+		t.Fatalf("expected the owner to remain the owner, got %v", status.State)
+	}
+
+	upg2, err := shadow.Promote(ctx)
+	if err != nil {
+		t.Fatalf("error promoting the shadow: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	ln, err := upg2.Fds.Listener("web")
+	if err != nil || ln == nil {
+		t.Fatalf("expected the promoted shadow to inherit the listener, got %v, %v", ln, err)
+	}
+	ln.Close()
+}
@@ -0,0 +1,99 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// Shards is an Upgrader for each of several coordination directories, for
+// daemons which manage many independent upgrade domains in one process. Each
+// shard is upgraded independently, as if by its own process, but on linux,
+// the upgrade sockets of all shards are served by a single goroutine, rather
+// than one per socket.
+type Shards struct {
+	dirs      []string
+	upgraders map[string]*Upgrader
+	mux       *acceptMux
+}
+
+// NewShards creates an Upgrader for each coordination directory, as New
+// does, with the given options. If any can't be created, those which were are
+// stopped and the error is returned.
+func NewShards(ctx context.Context, coordinationDirs []string, opts ...Option) (*Shards, error) {
+	return newShards(ctx, clock.RealClock{}, realOS{}, coordinationDirs, opts...)
+}
+
+func newShards(ctx context.Context, clock clock.Clock, os OS, coordinationDirs []string, opts ...Option) (*Shards, error) {
+	mux, err := newAcceptMux()
+	if err != nil {
+		return nil, fmt.Errorf("could not create accept loop: %w", err)
+	}
+	s := &Shards{
+		upgraders: make(map[string]*Upgrader, len(coordinationDirs)),
+		mux:       mux,
+	}
+	withMux := func(u *Upgrader) {
+		u.acceptMux = mux
+	}
+	for _, dir := range coordinationDirs {
+		if _, ok := s.upgraders[dir]; ok {
+			s.Stop()
+			return nil, fmt.Errorf("coordination dir %s is given more than once", dir)
+		}
+		u, err := newUpgrader(ctx, clock, os, dir, append(opts[:len(opts):len(opts)], withMux)...)
+		if err != nil {
+			s.Stop()
+			return nil, fmt.Errorf("shard %s: %w", dir, err)
+		}
+		s.dirs = append(s.dirs, dir)
+		s.upgraders[dir] = u
+	}
+	return s, nil
+}
+
+// Dirs returns the shards' coordination directories, in the order given to
+// NewShards.
+func (s *Shards) Dirs() []string {
+	return append([]string{}, s.dirs...)
+}
+
+// Upgrader returns the Upgrader for the given coordination directory, or nil
+// if it isn't one of the shards.
+func (s *Shards) Upgrader(coordinationDir string) *Upgrader {
+	return s.upgraders[coordinationDir]
+}
+
+// Ready calls Ready for each shard. It tries every shard, and returns the
+// first error.
+func (s *Shards) Ready() error {
+	var first error
+	for _, dir := range s.dirs {
+		if err := s.upgraders[dir].Ready(); err != nil && first == nil {
+			first = fmt.Errorf("shard %s: %w", dir, err)
+		}
+	}
+	return first
+}
+
+// UpgradeComplete returns a channel which is closed once every shard's
+// upgrade is complete.
+func (s *Shards) UpgradeComplete() <-chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		for _, u := range s.upgraders {
+			<-u.UpgradeComplete()
+		}
+		close(c)
+	}()
+	return c
+}
+
+// Stop stops every shard's Upgrader, and the shared accept loop.
+func (s *Shards) Stop() {
+	for _, u := range s.upgraders {
+		u.Stop()
+	}
+	s.mux.close()
+}
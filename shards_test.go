@@ -0,0 +1,72 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestShards(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+	dirs := []string{filepath.Join(coordDir, "a"), filepath.Join(coordDir, "b"), filepath.Join(coordDir, "c")}
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := newShards(ctx, clock.RealClock{}, mockOS{pid: 1}, []string{dirs[0], dirs[0]}, WithLogger(l)); err == nil {
+		t.Fatalf("expected a repeated coordination dir to be rejected")
+	}
+
+	shards1, err := newShards(ctx, clock.RealClock{}, mockOS{pid: 1}, dirs, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating shards: %v", err)
+	}
+	defer shards1.Stop()
+	for _, dir := range dirs {
+		ln, err := shards1.Upgrader(dir).Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		defer ln.Close()
+	}
+	if err := shards1.Ready(); err != nil {
+		t.Fatalf("error marking shards ready: %v", err)
+	}
+
+	// each shard has an upgrade socket and a legacy one
+	if runtime.GOOS == "linux" && shards1.mux.served() != 6 {
+		t.Fatalf("expected the accept loop to serve 6 sockets, got %d", shards1.mux.served())
+	}
+
+	// one shard is stopped, so its sockets must leave the accept loop
+	// without disturbing the others
+	shards1.Upgrader(dirs[2]).Stop()
+	if runtime.GOOS == "linux" && shards1.mux.served() != 4 {
+		t.Fatalf("expected the accept loop to serve 4 sockets, got %d", shards1.mux.served())
+	}
+
+	// the other shards upgrade independently
+	for i, dir := range dirs[:2] {
+		upg, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2 + i}, dir, WithLogger(l))
+		if err != nil {
+			t.Fatalf("error upgrading shard %s: %v", dir, err)
+		}
+		defer upg.Stop()
+		if !upg.Fds.WasInherited("ln") {
+			t.Fatalf("expected shard %s's listener to be inherited", dir)
+		}
+		if err := upg.Ready(); err != nil {
+			t.Fatalf("error marking ready: %v", err)
+		}
+		<-shards1.Upgrader(dir).UpgradeComplete()
+	}
+	<-shards1.UpgradeComplete()
+}
@@ -1,26 +1,96 @@
 package tableroll
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"time"
 
-	"github.com/inconshreveable/log15"
+	"github.com/ngrok/tableroll/internal/clock"
 	"github.com/ngrok/tableroll/internal/proto"
-	"github.com/opencontainers/runc/libcontainer/utils"
-	"github.com/pkg/errors"
+	"syscall"
 )
 
 type sibling struct {
 	readyC chan struct{}
 	conn   *net.UnixConn
-	l      log15.Logger
+	// frames carries the v2 protocol over conn.
+	frames *proto.Stream
+	// legacy indicates this sibling connected over the legacy upgrade socket,
+	// and so speaks the v0 or v1 protocol.
+	legacy bool
+	peer   PeerInfo
+	// sentFds holds the ids of the fds we've sent the sibling
+	sentFds []string
+	// released is set if the sibling confirmed it closed the fds we sent it
+	released bool
+	// awaitsSteppingDown is set once the sibling has said it's ready, if it
+	// waits for us to confirm we're stepping down.
+	awaitsSteppingDown bool
+	// wantsHandshake is set if the sibling asked for a custom handshake
+	// before we pass it our fds.
+	wantsHandshake bool
+	// acceptsConns is set if the sibling can receive connections once it's
+	// the owner; see TransferConn.
+	acceptsConns bool
+	// heartbeats is set if the sibling answers heartbeats, and keeps its
+	// connection open until it exits, once it's the owner.
+	heartbeats bool
+	// handback is set if the sibling waits for us to acknowledge that we've
+	// resumed ownership if it releases our fds; see Upgrader.Handback.
+	handback bool
+	// vetoed holds the ids of fds a transfer interceptor withheld from the
+	// sibling, with the reasons.
+	vetoed map[string]string
+	// substitutes are the fds a transfer interceptor passed to the sibling
+	// in place of ours.
+	substitutes []*fd
+	// progress is called as fds are sent; see WithTransferProgress.
+	progress func(sent, total int)
+	// maxTransferDuration limits how long sending fds may take; see
+	// WithMaxTransferDuration.
+	maxTransferDuration time.Duration
+	clock               clock.Clock
+	// stopTimeout stops the connection timing out; see timeoutAfter.
+	stopTimeout func()
+	// redact is applied to fd metadata before it's logged; see WithRedaction.
+	redact func(string) string
+	// readyTimeout is how long the sibling has to become ready, and readyBy
+	// when that runs out on clock; see timeoutAfter.
+	readyTimeout time.Duration
+	readyBy      time.Time
+	// identity is our identity, sent along with our fds; see WithIdentity.
+	identity string
+	// platform is the sibling's platform, if it reported one, and
+	// ownPlatform ours, sent along with our fds; see WithPlatformPolicy.
+	platform    *proto.Platform
+	ownPlatform *proto.Platform
+	// exeKey identifies the sibling's executable, once it's been looked up;
+	// see WithUpgradeCircuitBreaker.
+	exeKey string
+	l      Logger
 }
 
-func newSibling(l log15.Logger, conn *net.UnixConn) *sibling {
+// errSiblingReleasedFds is returned when a sibling gives up on an upgrade
+// after receiving our fds.
+var errSiblingReleasedFds = errors.New("sibling gave up on the upgrade and released its fds")
+
+func newSibling(l Logger, conn *net.UnixConn, legacy bool) *sibling {
+	peer, err := peerInfo(conn)
+	if err != nil {
+		l.Warn("could not determine who our sibling is", "err", err)
+	} else {
+		l = withLogContext(l, "peer", peer.Pid)
+		l.Info("sibling connected", "peerInfo", peer)
+	}
 	return &sibling{
-		conn: conn,
-		l:    l,
+		conn:   conn,
+		frames: proto.NewStream(conn, proto.RoleConnecting),
+		legacy: legacy,
+		peer:   peer,
+		l:      l,
 	}
 }
 
@@ -28,20 +98,103 @@ func (s *sibling) String() string {
 	return s.conn.RemoteAddr().String()
 }
 
-// passFdsToSibling passes all this processes file descriptors to a sibling
-// over the provided unix connection.  It returns an error channel which will,
-// at most, have one error written to it.
-func (s *sibling) giveFDs(passedFiles map[string]*fd) error {
+// readHello reads the first message of the v2 protocol, in which the sibling
+// tells us what it wants.
+func (s *sibling) readHello() (*proto.Hello, error) {
+	frame, err := s.frames.ReadFrameOfType(proto.MessageHello)
+	if err != nil {
+		return nil, err
+	}
+	hello, err := proto.DecodeHello(frame)
+	if err != nil {
+		return nil, err
+	}
+	s.wantsHandshake = hello.Handshake
+	s.acceptsConns = hello.AcceptsConns
+	s.heartbeats = hello.Heartbeats
+	s.handback = hello.Handback
+	s.platform = hello.Platform
+	return hello, nil
+}
+
+// reject tells the sibling we won't service its request. Legacy siblings have
+// no way to receive a reason, so they simply have their connection closed.
+func (s *sibling) reject(reason string) {
+	s.rejectWithCode("", reason)
+}
+
+func (s *sibling) rejectWithCode(code proto.RejectionCode, reason string) {
+	s.sendRejection(proto.Rejection{Reason: reason, Code: code})
+}
+
+// rejectNotReady tells the sibling we can't pass on our fds until we're
+// ready, and when it should try again.
+func (s *sibling) rejectNotReady(retryAfter time.Duration) {
+	s.sendRejection(proto.Rejection{
+		Reason:     "not ready to pass on fds yet",
+		Code:       proto.RejectionNotReady,
+		RetryAfter: retryAfter,
+	})
+}
+
+func (s *sibling) sendRejection(rejection proto.Rejection) {
+	s.l.Info("rejecting request from sibling", "reason", rejection.Reason)
+	if s.legacy {
+		return
+	}
+	if err := s.frames.WriteFrame(proto.MessageRejected, rejection); err != nil {
+		s.l.Warn("could not send rejection to sibling", "err", err)
+	}
+}
+
+// giveFDs passes all this processes file descriptors, other than exclusive
+// ones, to a sibling over the provided unix connection, and waits for it to
+// be ready. The caller must then call confirmReady or reject.
+func (s *sibling) giveFDs(ctx context.Context, tracer Tracer, passedFiles map[string]*fd, generation uint32, state []byte, store *storeSnapshot) error {
 	fds := make([]*fd, 0, len(passedFiles))
 	for _, fd := range passedFiles {
+		if fd.Exclusive {
+			// these are only passed once we've drained
+			continue
+		}
 		fds = append(fds, fd)
 	}
+	sortFds(fds)
+
+	_, span := tracer.Start(ctx, "tableroll.send_fds")
+	span.SetAttribute("tableroll.fds", len(fds))
+	err := s.sendFds(proto.MessageFds, fds, generation, state, store)
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+	_, span = tracer.Start(ctx, "tableroll.await_ready")
+	err = s.awaitReady()
+	endSpan(span, err)
+	return err
+}
+
+// giveExclusiveFDs passes exclusive fds to a sibling which has already taken
+// ownership of all other fds.
+func (s *sibling) giveExclusiveFDs(fds []*fd, generation uint32) error {
+	return s.sendFds(proto.MessageExclusiveFds, fds, generation, nil, nil)
+}
+
+// sendFds sends a table of fds in a message of the given type, followed by
+// the fds themselves.
+func (s *sibling) sendFds(typ proto.MessageType, fds []*fd, generation uint32, state []byte, store *storeSnapshot) error {
+	finish := s.limitTransfer()
+	sent, total, err := s.writeFds(typ, fds, generation, state, store)
+	return finish(sent, total, err)
+}
 
-	connFile, err := s.conn.File()
+// writeFds does the work of sendFds, returning how many of the fds it sent.
+func (s *sibling) writeFds(typ proto.MessageType, fds []*fd, generation uint32, state []byte, store *storeSnapshot) (int, int, error) {
+	connFile, closeConnFile, err := fdPassingFile(s.conn)
 	if err != nil {
-		return errors.Wrapf(err, "could not convert sibling connection to file")
+		return 0, len(fds), fmt.Errorf("could not convert sibling connection to file: %w", err)
 	}
-	defer connFile.Close()
+	defer closeConnFile()
 
 	validFds := make([]*fd, 0, len(fds))
 	rawFds := make([]*os.File, 0, len(fds))
@@ -50,26 +203,112 @@ func (s *sibling) giveFDs(passedFiles map[string]*fd) error {
 		if fd.file == nil {
 			continue
 		}
+		// send a copy with the identity filled in, since the original is
+		// still shared with the Fds store
+		described := *fd
+		if identity, err := identify(fd.file.fd); err != nil {
+			s.l.Warn("could not identify fd, the sibling won't be able to verify it", "fd", redactFd(s.redact, fd), "err", err)
+		} else {
+			described.Identity = identity
+		}
+		if fd.Kind == fdKindFile {
+			state, err := captureFileState(fd.file.fd)
+			if err != nil {
+				s.l.Warn("could not record the file's offset", "fd", redactFd(s.redact, fd), "err", err)
+			}
+			described.FileState = state
+		}
 		rawFds = append(rawFds, fd.file.File)
-		validFds = append(validFds, fd)
+		validFds = append(validFds, &described)
 	}
 
-	s.l.Info("passing along fds to our sibling", "files", fds)
-	if err := proto.WriteVersionedJSONBlob(s.conn, validFds, proto.Version); err != nil {
-		return fmt.Errorf("error writing json to sibling: %v", err)
+	s.l.Info("passing along fds to our sibling", "files", redactFds(s.redact, fds), "type", typ)
+	if err := s.writeFdTable(typ, validFds, generation, state, store); err != nil {
+		return 0, len(rawFds), fmt.Errorf("error writing json to sibling: %v", err)
 	}
 
 	// Write all files it's expecting
-	for _, fi := range rawFds {
-		if err := utils.SendFd(connFile, fi.Name(), fi.Fd()); err != nil {
-			return fmt.Errorf("could not write fds to sibling: %v", err)
+	reportProgress(s.progress, 0, len(rawFds))
+	for i, fi := range rawFds {
+		if err := sendFd(connFile, fi.Name(), fi.Fd()); err != nil {
+			return i, len(rawFds), fmt.Errorf("could not write fds to sibling: %v", err)
+		}
+		s.sentFds = append(s.sentFds, validFds[i].ID)
+		reportProgress(s.progress, i+1, len(rawFds))
+	}
+	return len(rawFds), len(rawFds), nil
+}
+
+func (s *sibling) writeFdTable(typ proto.MessageType, fds []*fd, generation uint32, state []byte, store *storeSnapshot) error {
+	if s.legacy {
+		if len(state) > 0 {
+			s.l.Warn("not passing handoff state to a sibling using an older protocol")
 		}
+		if store != nil {
+			s.l.Warn("not passing the store to a sibling using an older protocol")
+		}
+		return proto.WriteVersionedJSONBlob(s.conn, fds, proto.LegacyVersion)
+	}
+	return s.frames.WriteFrame(typ, fdTable{
+		Generation: generation,
+		Identity:   s.identity,
+		Fds:        fds,
+		State:      state,
+		Store:      store,
+		Heartbeats: true,
+		Handback:   true,
+		Platform:   s.ownPlatform,
+
+		ReadyTimeout:   s.readyTimeout,
+		ReadyRemaining: s.readyRemaining(),
+	})
+}
+
+// readyRemaining returns how long the sibling has left to become ready, or 0
+// if it's not being timed out.
+func (s *sibling) readyRemaining() time.Duration {
+	if s.readyBy.IsZero() || s.clock == nil {
+		return 0
 	}
+	if remaining := s.readyBy.Sub(s.clock.Now()); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
 
-	return s.awaitReady()
+// fdPassingFile returns a duplicate of conn for passing fds with SendFd or
+// RecvFd. Those use (*os.File).Fd, which puts the socket into blocking mode,
+// and since the duplicate shares its open file description with conn, that
+// would stop deadlines on conn from working. The returned function closes the
+// duplicate and undoes that.
+func fdPassingFile(conn *net.UnixConn) (*os.File, func(), error) {
+	f, err := conn.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() {
+		syscall.SetNonblock(int(f.Fd()), true)
+		f.Close()
+	}, nil
 }
 
 func (s *sibling) awaitReady() error {
+	if !s.legacy {
+		frame, err := s.frames.ReadFrame()
+		if err == nil && frame.Type == proto.MessageFdsReleased {
+			s.released = true
+			return errSiblingReleasedFds
+		}
+		if err == nil && frame.Type != proto.MessageReady {
+			err = fmt.Errorf("protocol error: expected %s message, got %s", proto.MessageReady, frame.Type)
+		}
+		if err != nil {
+			s.l.Debug("our sibling failed to send us a ready", "err", err)
+			return fmt.Errorf("sibling did not send us a ready: %w", err)
+		}
+		s.awaitsSteppingDown = true
+		return nil
+	}
 	// Finally, read ready byte and the handoff is done!
 	var b [1]byte
 	n, err := s.conn.Read(b[:])
@@ -80,8 +319,11 @@ func (s *sibling) awaitReady() error {
 	case n > 0 && b[0] == proto.V1StartReadyHandshake:
 		return s.readyHandshake()
 	default:
+		if err == nil {
+			err = fmt.Errorf("protocol error: unexpected ready byte %v", b[0])
+		}
 		s.l.Debug("our sibling failed to send us a ready", "err", err)
-		return errors.Wrapf(err, "sibling did not send us a ready byte: read %v bytes, %v", n, b)
+		return fmt.Errorf("sibling did not send us a ready byte: read %v bytes, %v: %w", n, b, err)
 	}
 }
 
@@ -94,13 +336,32 @@ func (s *sibling) readyHandshake() error {
 	// We told our sibling our version via encoding it in the versioned json blob
 	// of files, so it should speak a version we know. If it doesn't, that mean's
 	// it's a misbehaving client.
-	if vInfo.Version != proto.Version {
+	if vInfo.Version != proto.LegacyVersion {
 		return fmt.Errorf("unable to transfer ownership: unexpected protocol version: %v", vInfo.Version)
 	}
-	// Send back that we're stepping down, return nil which causes us to step down.
-	err = proto.WriteJSONBlob(s.conn, proto.Message{
-		Msg: proto.V1MessageSteppingDown,
-	})
+	s.awaitsSteppingDown = true
+	return nil
+}
+
+// confirmReady tells a sibling which said it's ready that we're stepping
+// down, if it waits for us to.
+func (s *sibling) confirmReady() {
+	if s.awaitsSteppingDown {
+		s.stepDown()
+	}
+}
+
+// stepDown sends back that we're stepping down. The caller should step down
+// regardless of whether this succeeds.
+func (s *sibling) stepDown() {
+	var err error
+	if s.legacy {
+		err = proto.WriteJSONBlob(s.conn, proto.Message{
+			Msg: proto.V1MessageSteppingDown,
+		})
+	} else {
+		err = s.frames.WriteFrame(proto.MessageSteppingDown, nil)
+	}
 	if err != nil {
 		// We can't be totally sure in this case if the new owner received our message or not.
 		// Assume that they did and we should step down, so just log an error and
@@ -108,5 +369,4 @@ func (s *sibling) readyHandshake() error {
 		// Zero owners is better than two owners.
 		s.l.Error("error sending stepping down message", "err", err)
 	}
-	return nil
 }
@@ -0,0 +1,61 @@
+// +build linux
+
+package tableroll
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Go's net package can't reconstruct netlink sockets from their fds, so
+// tableroll wraps them itself.
+
+// pollableCopy returns a copy of fd in non-blocking mode, so that reads and
+// writes through the returned file use the runtime's poller, after checking
+// it's a socket of the given domain.
+func pollableCopy(f *file, domain int) (*os.File, error) {
+	actual, err := syscall.GetsockoptInt(int(f.fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	if err != nil {
+		return nil, fmt.Errorf("can't inherit %s: %w", f, err)
+	}
+	if actual != domain {
+		return nil, fmt.Errorf("can't inherit %s: expected socket domain %d, got %d", f, domain, actual)
+	}
+	dup, err := fcntlInt(f.fd, syscall.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can't dup fd using fcntl: %w", err)
+	}
+	if err := syscall.SetNonblock(dup, true); err != nil {
+		syscall.Close(dup)
+		return nil, err
+	}
+	// the runtime's poller only takes on files which are non-blocking when
+	// they're created
+	return os.NewFile(uintptr(dup), f.Name()), nil
+}
+
+func newNetlinkSocket(protocol int, groups uint32) (*os.File, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sock := os.NewFile(uintptr(fd), fmt.Sprintf("netlink:%d:%d", protocol, groups))
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: groups}); err != nil {
+		sock.Close()
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return sock, nil
+}
+
+func copyNetlinkSocket(f *file) (*os.File, error) {
+	return pollableCopy(f, syscall.AF_NETLINK)
+}
+
+// platformSockaddrString describes the addresses of sockets only linux has.
+func platformSockaddrString(sa syscall.Sockaddr) (string, bool) {
+	if sa, ok := sa.(*syscall.SockaddrNetlink); ok {
+		return fmt.Sprintf("netlink:%d:%d", sa.Pid, sa.Groups), true
+	}
+	return "", false
+}
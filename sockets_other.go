@@ -0,0 +1,23 @@
+// +build !linux
+
+package tableroll
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errNetlinkUnsupported = errors.New("netlink is only supported on linux")
+
+func newNetlinkSocket(protocol int, groups uint32) (*os.File, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func copyNetlinkSocket(f *file) (*os.File, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func platformSockaddrString(sa syscall.Sockaddr) (string, bool) {
+	return "", false
+}
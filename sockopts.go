@@ -0,0 +1,210 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+
+	"syscall"
+)
+
+// SocketOptions are the socket options tableroll keeps track of for sockets
+// in the fd store. A nil field means the option is unset, or doesn't apply to
+// the socket.
+//
+// Options are a property of the socket, and so are shared with every process
+// holding it. That can be surprising; for example, the net package sets
+// TCP_NODELAY on the connections it dials, but not on connections created
+// from an inherited fd, and a previous owner may have changed an option after
+// passing a socket on. To make that visible, the options of each socket are
+// recorded when it's added to the store and checked after it's inherited.
+type SocketOptions struct {
+	// NoDelay is TCP_NODELAY.
+	NoDelay *bool `json:"noDelay,omitempty"`
+	// KeepAlive is SO_KEEPALIVE.
+	KeepAlive *bool `json:"keepAlive,omitempty"`
+	// RecvBuffer is SO_RCVBUF. Note that when reading this option, Linux
+	// reports double the value that was set.
+	RecvBuffer *int `json:"recvBuffer,omitempty"`
+	// SendBuffer is SO_SNDBUF, and is doubled in the same way as RecvBuffer.
+	SendBuffer *int `json:"sendBuffer,omitempty"`
+}
+
+// socketOption describes how to get and set one of the fields of
+// SocketOptions.
+type socketOption struct {
+	name  string
+	level int
+	opt   int
+	field func(o *SocketOptions) interface{}
+}
+
+var socketOptions = []socketOption{
+	{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, func(o *SocketOptions) interface{} { return &o.NoDelay }},
+	{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, func(o *SocketOptions) interface{} { return &o.KeepAlive }},
+	{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, func(o *SocketOptions) interface{} { return &o.RecvBuffer }},
+	{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, func(o *SocketOptions) interface{} { return &o.SendBuffer }},
+}
+
+// get returns the option's value in o, and false if it's unset.
+func (so socketOption) get(o *SocketOptions) (int, bool) {
+	switch v := so.field(o).(type) {
+	case **bool:
+		if *v == nil {
+			return 0, false
+		}
+		if **v {
+			return 1, true
+		}
+		return 0, true
+	case **int:
+		if *v == nil {
+			return 0, false
+		}
+		return **v, true
+	}
+	panic(fmt.Sprintf("unexpected socket option field %T", so.field(o)))
+}
+
+func (so socketOption) set(o *SocketOptions, value int) {
+	switch v := so.field(o).(type) {
+	case **bool:
+		b := value != 0
+		*v = &b
+	case **int:
+		*v = &value
+	}
+}
+
+// readSocketOptions reads the options of the socket fd. Options which can't be
+// read, e.g. TCP_NODELAY on a unix socket, are left nil. It returns nil if fd
+// isn't a socket.
+func readSocketOptions(fd uintptr) *SocketOptions {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(fd), &st); err != nil || uint32(st.Mode)&syscall.S_IFMT != syscall.S_IFSOCK {
+		return nil
+	}
+	opts := &SocketOptions{}
+	for _, so := range socketOptions {
+		value, err := syscall.GetsockoptInt(int(fd), so.level, so.opt)
+		if err != nil {
+			continue
+		}
+		so.set(opts, value)
+	}
+	return opts
+}
+
+// applySocketOptions sets each option which is set in opts on the socket fd.
+func applySocketOptions(fd uintptr, opts *SocketOptions) error {
+	for _, so := range socketOptions {
+		value, ok := so.get(opts)
+		if !ok {
+			continue
+		}
+		if err := syscall.SetsockoptInt(int(fd), so.level, so.opt, value); err != nil {
+			return fmt.Errorf("could not set %s: %w", so.name, err)
+		}
+	}
+	return nil
+}
+
+// diff returns a description of each option set in both o and actual which
+// differs between them.
+func (o *SocketOptions) diff(actual *SocketOptions) []string {
+	var diffs []string
+	for _, so := range socketOptions {
+		expected, ok := so.get(o)
+		if !ok {
+			continue
+		}
+		got, ok := so.get(actual)
+		if !ok {
+			continue
+		}
+		if expected != got {
+			diffs = append(diffs, fmt.Sprintf("%s: expected %d, got %d", so.name, expected, got))
+		}
+	}
+	return diffs
+}
+
+// SetSocketOptions sets the given options on the socket with the given id, and
+// pins them, so that every later owner re-applies them after inheriting the
+// socket. Options left nil are not changed, and any previously pinned value
+// for them is kept.
+func (f *Fds) SetSocketOptions(id string, opts SocketOptions) error {
+	return f.setSocketOptionsContext(context.Background(), id, opts)
+}
+
+func (f *Fds) setSocketOptionsContext(ctx context.Context, id string, opts SocketOptions) error {
+	if err := f.lockContext(ctx); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+	fi, ok := f.fds[id]
+	if !ok || fi.file == nil {
+		return fmt.Errorf("no fd with id %q", id)
+	}
+	if fi.Kind == fdKindFile {
+		return fmt.Errorf("%q is not a socket", id)
+	}
+	if err := applySocketOptions(fi.file.fd, &opts); err != nil {
+		return err
+	}
+	pinned := &SocketOptions{}
+	if fi.PinnedSocketOptions != nil {
+		*pinned = *fi.PinnedSocketOptions
+	}
+	for _, so := range socketOptions {
+		if value, ok := so.get(&opts); ok {
+			so.set(pinned, value)
+		}
+	}
+	fi.PinnedSocketOptions = pinned
+	fi.SocketOptions = readSocketOptions(fi.file.fd)
+	return nil
+}
+
+// AuditSocketOptions compares the current options of each socket in the store
+// against those recorded when it was added, or last changed with
+// SetSocketOptions. It returns a description of each difference, keyed by
+// fd id.
+func (f *Fds) AuditSocketOptions() map[string][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mismatches := make(map[string][]string)
+	for id, fi := range f.fds {
+		if diffs := fi.socketOptionsDiff(); len(diffs) > 0 {
+			mismatches[id] = diffs
+		}
+	}
+	return mismatches
+}
+
+func (fi *fd) socketOptionsDiff() []string {
+	if fi.SocketOptions == nil || fi.file == nil {
+		return nil
+	}
+	actual := readSocketOptions(fi.file.fd)
+	if actual == nil {
+		return []string{"no longer a socket"}
+	}
+	return fi.SocketOptions.diff(actual)
+}
+
+// restoreSocketOptionsLocked is called for each inherited fd. It re-applies
+// any pinned options, and warns about any which differ from those the
+// previous owner recorded.
+func (f *Fds) restoreSocketOptionsLocked(fi *fd) {
+	if fi.file == nil {
+		return
+	}
+	if fi.PinnedSocketOptions != nil {
+		if err := applySocketOptions(fi.file.fd, fi.PinnedSocketOptions); err != nil {
+			f.l.Warn("could not re-apply socket options", "fd", f.redacted(fi), "err", err)
+		}
+	}
+	if diffs := fi.socketOptionsDiff(); len(diffs) > 0 {
+		f.l.Warn("inherited socket's options differ from those recorded by the previous owner", "fd", f.redacted(fi), "differences", diffs)
+	}
+}
@@ -0,0 +1,64 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketOptions(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+
+	ln, err := parent.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := parent.DialWith("conn", "tcp", ln.Addr().String(), net.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the net package sets TCP_NODELAY on dialed connections
+	recorded := parent.fds["conn"].SocketOptions
+	if recorded == nil || recorded.NoDelay == nil || !*recorded.NoDelay {
+		t.Fatalf("expected TCP_NODELAY to be recorded, got %+v", recorded)
+	}
+
+	keepAlive := true
+	if err := parent.SetSocketOptions("conn", SocketOptions{KeepAlive: &keepAlive}); err != nil {
+		t.Fatalf("error setting socket options: %v", err)
+	}
+	if err := parent.SetSocketOptions("missing", SocketOptions{KeepAlive: &keepAlive}); err == nil {
+		t.Fatalf("expected an error setting options on a missing fd")
+	}
+	if mismatches := parent.AuditSocketOptions(); len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches, got %v", mismatches)
+	}
+
+	// change the options behind tableroll's back
+	rawFd := int(parent.fds["conn"].file.fd)
+	if err := unix.SetsockoptInt(rawFd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetsockoptInt(rawFd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mismatches := parent.AuditSocketOptions(); len(mismatches["conn"]) != 2 {
+		t.Fatalf("expected both options to mismatch, got %v", mismatches)
+	}
+
+	// inheriting re-applies the pinned keepalive, but only reports nodelay
+	child := newFds(l, parent.copy())
+	mismatches := child.AuditSocketOptions()
+	if len(mismatches) != 1 || len(mismatches["conn"]) != 1 {
+		t.Fatalf("expected only TCP_NODELAY to mismatch, got %v", mismatches)
+	}
+	if value, err := unix.GetsockoptInt(rawFd, unix.SOL_SOCKET, unix.SO_KEEPALIVE); err != nil || value == 0 {
+		t.Fatalf("expected keepalive to be re-applied, got %v, %v", value, err)
+	}
+}
@@ -0,0 +1,105 @@
+package tableroll
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// By default, each process creates files named after its pid in the
+// coordination directory: its upgrade sockets, and its election candidacy.
+// Mandatory access control policies, such as SELinux or AppArmor ones, can't
+// easily be written for files with unpredictable names, so the stable layout
+// keeps everything in one subdirectory with fixed names. The owner listens on
+// a single upgrade socket, and a new process only binds it, replacing the old
+// owner's, once the old owner has stepped down. The old owner doesn't unlink
+// it when it closes its listener.
+//
+// Since the socket is only ever bound by a process holding the lock, whoever
+// accepts connections on it is the owner: the pid file is informational, and
+// isn't consulted to find the owner. A reused pid can't be mistaken for the
+// owner, and a crashed owner's socket is recognized as stale because
+// connecting to it is refused. Tools can find the owner without reading any
+// files, by connecting to the socket.
+
+// DefaultStableLayoutDir is the subdirectory of the coordination directory
+// used by WithStableLayout if no other is given.
+const DefaultStableLayoutDir = "tableroll"
+
+// StableSocketName is the name of the upgrade socket in the stable layout.
+const StableSocketName = "upgrade.sock"
+
+// WithStableLayout keeps all of tableroll's files in a subdirectory of the
+// coordination directory, with names which don't depend on pids: "pid",
+// "lock-holder", "history", "layout" and "upgrade.sock". The subdirectory is created if
+// needed; if subdir is empty, DefaultStableLayoutDir is used.
+//
+// All processes in an upgrade chain must use the stable layout. Processes
+// using the stable layout don't listen on the legacy upgrade socket, and
+// can't take part in upgrade elections, so it can't be combined with
+// WithUpgradePriority or WithSocketName.
+func WithStableLayout(subdir string) Option {
+	if subdir == "" {
+		subdir = DefaultStableLayoutDir
+	}
+	return func(u *Upgrader) {
+		u.stableLayoutDir = subdir
+	}
+}
+
+// useStableLayout moves the coordinator into the stable layout's
+// subdirectory.
+func (c *coordinator) useStableLayout(subdir string) error {
+	dir := filepath.Join(c.dir, subdir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return classifyCoordinationErr(c.dir, "create stable layout dir", err)
+	}
+	c.dir = dir
+	c.stable = true
+	return nil
+}
+
+// ListenStable binds the stable layout's upgrade socket, replacing any
+// previous owner's. It must only be called while holding the coordination
+// lock, after any previous owner has stepped down.
+func (c *coordinator) ListenStable(ctx context.Context) (*net.UnixListener, error) {
+	path := c.upgradeSockPath(c.os.Getpid())
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, classifyCoordinationErr(c.dir, "remove old upgrade socket", err)
+	}
+	ln, err := c.listen(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	// the next owner replaces the socket, so closing ours mustn't remove it
+	ln.SetUnlinkOnClose(false)
+	return ln, nil
+}
+
+// connectStableOwner connects to the stable layout's upgrade socket.
+func (c *coordinator) connectStableOwner(ctx context.Context) (*net.UnixConn, error) {
+	path := c.upgradeSockPath(c.os.Getpid())
+	c.l.Info("connecting to owner", "socket", path)
+	rawConn, err := (&net.Dialer{}).DialContext(ctx, "unix", path)
+	if err == nil {
+		return rawConn.(*net.UnixConn), nil
+	}
+	if isContextDialErr(err) {
+		return nil, err
+	}
+	if !isNotExistDialErr(err) {
+		// the socket exists, so an owner bound it, but nothing's accepting
+		// on it: the owner has exited without a successor
+		c.l.Info("owner's upgrade socket is stale, owner is dead", "dialErr", err)
+		return nil, &NoOwnerError{NoOwnerReasonOwnerDead}
+	}
+	// without a socket, the pid file tells a first start from a socket
+	// which was removed from under its owner
+	if pid, err := c.GetOwnerPID(); err == nil && pid != 0 {
+		c.l.Warn("an owner was recorded, but there's no upgrade socket", "pid", pid)
+		return nil, &NoOwnerError{NoOwnerReasonSocketMissing}
+	}
+	c.l.Info("owner does not exist")
+	return nil, &NoOwnerError{NoOwnerReasonFirstStart}
+}
@@ -0,0 +1,104 @@
+package tableroll
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestStableLayout(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithStableLayout(""), WithUpgradePriority(1)); err == nil {
+		t.Fatalf("expected the stable layout to be incompatible with elections")
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithStableLayout(""))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if reason := upg1.NoOwnerReason(); reason != NoOwnerReasonFirstStart {
+		t.Fatalf("expected a first start, got %q", reason)
+	}
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithStableLayout(""))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.Fds.WasInherited("ln") {
+		t.Fatalf("expected to inherit the listener")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking second upgrader ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	// the old owner closing its socket mustn't remove the new owner's
+	upg1.Stop()
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l), WithStableLayout(""))
+	if err != nil {
+		t.Fatalf("error creating third upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if !upg3.Fds.WasInherited("ln") {
+		t.Fatalf("expected to inherit the listener again")
+	}
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking third upgrader ready: %v", err)
+	}
+
+	for dir, expected := range map[string][]string{
+		coordDir: {DefaultStableLayoutDir},
+		filepath.Join(coordDir, DefaultStableLayoutDir): {"history", "layout", "lock-holder", "pid", StableSocketName},
+	} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("error reading %v: %v", dir, err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		sort.Strings(names)
+		if len(names) != len(expected) {
+			t.Fatalf("expected %v to contain %v, got %v", dir, expected, names)
+		}
+		for i := range names {
+			if names[i] != expected[i] {
+				t.Fatalf("expected %v to contain %v, got %v", dir, expected, names)
+			}
+		}
+	}
+
+	// the pid file still names the stopped owner, and the mock reports that
+	// pid as running, as if it had been reused; the stale socket tells us the
+	// owner is gone regardless
+	upg3.Stop()
+	upg4, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 4}, coordDir, WithLogger(l), WithStableLayout(""))
+	if err != nil {
+		t.Fatalf("error creating fourth upgrader: %v", err)
+	}
+	defer upg4.Stop()
+	if reason := upg4.NoOwnerReason(); reason != NoOwnerReasonOwnerDead {
+		t.Fatalf("expected the stale socket to mean the owner is dead, got %q", reason)
+	}
+	if err := upg4.Ready(); err != nil {
+		t.Fatalf("error marking fourth upgrader ready: %v", err)
+	}
+}
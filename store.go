@@ -0,0 +1,128 @@
+package tableroll
+
+import (
+	"sort"
+	"sync"
+)
+
+// Store is a small key-value store shared by every process in an upgrade
+// chain. Its contents are passed to the next owner along with the file
+// descriptors, so it's a standard place for data scoped to the chain rather
+// than a single process, such as feature flag epochs or drain deadlines.
+//
+// Every Put is given a version which is higher than that of any earlier Put
+// in the chain, so values written by different processes can be ordered.
+//
+// Like the Fds, the store may only be modified while this process owns it:
+// Put and Delete fail with ErrUpgradeInProgress while the store is being
+// passed on, and with ErrUpgradeCompleted once it has been. The store isn't
+// passed to processes using older versions of tableroll, and doesn't survive
+// a cold start.
+type Store struct {
+	fds *Fds
+
+	mu      sync.Mutex
+	version uint64
+	entries map[string]StoreEntry
+}
+
+// StoreEntry is a value in the Store.
+type StoreEntry struct {
+	Value []byte `json:"value"`
+	// Version is the version of the store the value was written at.
+	Version uint64 `json:"version"`
+}
+
+// storeSnapshot is the contents of the Store as passed to the next owner.
+type storeSnapshot struct {
+	Version uint64                `json:"version"`
+	Entries map[string]StoreEntry `json:"entries,omitempty"`
+}
+
+// newStore creates a store holding the contents the previous owner passed
+// us, if any. Mutations are allowed as long as fds' are.
+func newStore(fds *Fds, inherited *storeSnapshot) *Store {
+	s := &Store{
+		fds:     fds,
+		entries: make(map[string]StoreEntry),
+	}
+	if inherited != nil {
+		s.version = inherited.Version
+		for key, entry := range inherited.Entries {
+			s.entries[key] = entry
+		}
+	}
+	return s
+}
+
+// Store returns the key-value store shared across the upgrade chain.
+func (u *Upgrader) Store() *Store {
+	return u.store
+}
+
+// Get returns the entry for key, and whether it exists.
+func (s *Store) Get(key string) (StoreEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	entry.Value = append([]byte(nil), entry.Value...)
+	return entry, ok
+}
+
+// Keys returns every key in the store, sorted.
+func (s *Store) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put sets the value for key, and returns the version it was written at.
+func (s *Store) Put(key string, value []byte) (uint64, error) {
+	// hold the fds' lock so that the store can't be passed on between
+	// checking we may modify it and doing so
+	s.fds.mu.Lock()
+	defer s.fds.mu.Unlock()
+	if s.fds.locked {
+		return 0, s.fds.rejectMutationLocked()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	s.entries[key] = StoreEntry{Value: append([]byte(nil), value...), Version: s.version}
+	return s.version, nil
+}
+
+// Delete removes key from the store. It's not an error if it doesn't exist.
+func (s *Store) Delete(key string) error {
+	s.fds.mu.Lock()
+	defer s.fds.mu.Unlock()
+	if s.fds.locked {
+		return s.fds.rejectMutationLocked()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// snapshot returns the store's contents to pass to the next owner.
+func (s *Store) snapshot() *storeSnapshot {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version == 0 {
+		return nil
+	}
+	entries := make(map[string]StoreEntry, len(s.entries))
+	for key, entry := range s.entries {
+		entries[key] = entry
+	}
+	return &storeSnapshot{Version: s.version, Entries: entries}
+}
@@ -0,0 +1,68 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	store1 := upg1.Store()
+	if _, err := store1.Put("epoch", []byte("1")); err != nil {
+		t.Fatalf("error putting: %v", err)
+	}
+	if _, err := store1.Put("deleted", []byte("x")); err != nil {
+		t.Fatalf("error putting: %v", err)
+	}
+	version, err := store1.Put("deadline", []byte("30s"))
+	if err != nil {
+		t.Fatalf("error putting: %v", err)
+	}
+	if version != 3 {
+		t.Fatalf("expected the third put to be version 3, got %v", version)
+	}
+	if err := store1.Delete("deleted"); err != nil {
+		t.Fatalf("error deleting: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	store2 := upg2.Store()
+	if keys := store2.Keys(); len(keys) != 2 || keys[0] != "deadline" || keys[1] != "epoch" {
+		t.Fatalf("expected to inherit deadline and epoch, got %v", keys)
+	}
+	if entry, ok := store2.Get("epoch"); !ok || string(entry.Value) != "1" || entry.Version != 1 {
+		t.Fatalf("expected to inherit epoch 1 at version 1, got %+v, %v", entry, ok)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking second upgrader ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	if _, err := store1.Put("epoch", []byte("2")); err != ErrUpgradeCompleted {
+		t.Fatalf("expected the old owner's store to be read-only, got %v", err)
+	}
+	version, err = store2.Put("epoch", []byte("2"))
+	if err != nil {
+		t.Fatalf("error putting: %v", err)
+	}
+	if version != 4 {
+		t.Fatalf("expected versions to continue from the previous owner's, got %v", version)
+	}
+}
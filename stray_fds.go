@@ -0,0 +1,91 @@
+package tableroll
+
+import (
+	"fmt"
+	"time"
+)
+
+// StrayFds describes a process which received copies of this process's fds
+// during an upgrade which then failed, and which never confirmed it closed
+// them. Until it exits, closing one of these fds in this process won't
+// release the underlying socket or file, e.g. a closed listener's port will
+// remain bound.
+type StrayFds struct {
+	Peer PeerInfo
+	// Generation is the generation the peer would have had, had the upgrade
+	// succeeded.
+	Generation uint32
+	// IDs are the ids of the fds the peer was sent.
+	IDs []string
+	// Since is when the upgrade failed.
+	Since time.Time
+}
+
+// WithRequireFdRelease causes this process to reject upgrade requests while a
+// process which failed a previous upgrade is still running and may hold
+// copies of its fds; see StrayFds. Processes using this version of tableroll
+// confirm they closed their copies when they give up on an upgrade, including
+// when Stop is called before Ready, so this only affects processes which hung
+// or crashed partway through, or which use older versions.
+func WithRequireFdRelease() Option {
+	return func(u *Upgrader) {
+		u.requireFdRelease = true
+	}
+}
+
+// StrayFds returns each running process which may still hold copies of this
+// process's fds after failing to upgrade from it.
+func (u *Upgrader) StrayFds() []StrayFds {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.liveStrayFdsLocked()
+}
+
+func (u *Upgrader) liveStrayFdsLocked() []StrayFds {
+	live := u.strayFds[:0]
+	for _, stray := range u.strayFds {
+		// a pid of 0 means we couldn't identify the peer; assume the worst
+		if stray.Peer.Pid != 0 && pidIsDead(u.os, stray.Peer.Pid) {
+			u.l.Info("process holding stray fds has exited", "peer", stray.Peer.Pid)
+			continue
+		}
+		live = append(live, stray)
+	}
+	u.strayFds = live
+	result := make([]StrayFds, len(live))
+	copy(result, live)
+	return result
+}
+
+// recordStrayFds is called after a failed upgrade to track a sibling which may
+// still hold copies of our fds.
+func (u *Upgrader) recordStrayFds(nextOwner *sibling, err error) {
+	if len(nextOwner.sentFds) == 0 || nextOwner.released {
+		return
+	}
+	stray := StrayFds{
+		Peer:       nextOwner.peer,
+		Generation: u.generation + 1,
+		IDs:        nextOwner.sentFds,
+		Since:      u.clock.Now(),
+	}
+	u.l.Warn("a failed upgrade left copies of our fds in another process", "peer", stray.Peer.Pid, "ids", u.redactIDs(stray.IDs))
+	u.stateLock.Lock()
+	u.strayFds = append(u.strayFds, stray)
+	u.stateLock.Unlock()
+	u.emit(Event{Type: EventFdsStranded, Peer: &stray.Peer, Err: err})
+}
+
+// checkStrayFds returns an error if WithRequireFdRelease is set and a process
+// may still hold copies of our fds.
+func (u *Upgrader) checkStrayFds() error {
+	if !u.requireFdRelease {
+		return nil
+	}
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if live := u.liveStrayFdsLocked(); len(live) > 0 {
+		return fmt.Errorf("pid %d still holds copies of our fds from a failed upgrade", live[0].Peer.Pid)
+	}
+	return nil
+}
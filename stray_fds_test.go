@@ -0,0 +1,122 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// waitForOwner waits until upg has finished handling any upgrade request and
+// accepts fd mutations again.
+func waitForOwner(t *testing.T, upg *Upgrader, probeID string) {
+	for i := 0; i < 100; i++ {
+		ln, err := upg.Fds.Listen(context.Background(), probeID, nil, "tcp", "127.0.0.1:0")
+		if err == nil {
+			ln.Close()
+			return
+		}
+		if err != ErrUpgradeInProgress {
+			t.Fatalf("unexpected error listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("owner never finished handling the upgrade")
+}
+
+func TestStopBeforeReadyReleasesFds(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithRequireFdRelease())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "listener", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	upg2.Stop()
+	if n := len(upg2.Fds.copy()); n != 0 {
+		t.Fatalf("expected stopped upgrader to close inherited fds, still has %d", n)
+	}
+
+	waitForOwner(t, upg1, "probe")
+	if stray := upg1.StrayFds(); len(stray) != 0 {
+		t.Fatalf("expected no stray fds after the sibling released them, got %+v", stray)
+	}
+
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected upgrade to succeed, got %v", err)
+	}
+	defer upg3.Stop()
+	if err := upg3.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestStrayFdsAfterTimeout(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	events := make(chan Event, 2)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithUpgradeTimeout(30*time.Millisecond), WithRequireFdRelease(),
+		WithEventHandler(func(e Event) { events <- e }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "listener", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// upg2 hangs instead of becoming ready, so upg1 times out with upg2
+	// holding copies of its fds
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	for e := range events {
+		if e.Type == EventFdsStranded {
+			break
+		}
+	}
+	waitForOwner(t, upg1, "probe")
+
+	stray := upg1.StrayFds()
+	if len(stray) != 1 {
+		t.Fatalf("expected one stray fd holder, got %+v", stray)
+	}
+	if stray[0].Peer.Pid != os.Getpid() || stray[0].Generation != 1 {
+		t.Fatalf("unexpected stray fd holder: %+v", stray[0])
+	}
+	if len(stray[0].IDs) != 1 || stray[0].IDs[0] != "listener" {
+		t.Fatalf("expected the listener to be stray, got %v", stray[0].IDs)
+	}
+
+	// upg1 has already given up on upg2, so can't learn that it released its
+	// copies, and must assume they're held until upg2 exits
+	upg2.Stop()
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if _, ok := err.(*UpgradeRejectedError); !ok {
+		t.Fatalf("expected upgrade to be rejected while fds are stray, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tableflip
+
+import (
+	"context"
+	"net"
+	"os"
+
+	"github.com/ngrok/tableroll"
+)
+
+// Listener can be shared between processes.
+type Listener = tableroll.Listener
+
+// Conn can be shared between processes.
+type Conn = tableroll.Conn
+
+// Fds holds all fds inherited from the previous owner and those added by
+// this process. Unlike tableroll, which identifies fds with ids chosen by the
+// caller, fds are identified by their network and address, or by their name
+// for files, as tableflip does.
+type Fds struct {
+	fds          *tableroll.Fds
+	listenConfig *net.ListenConfig
+}
+
+func listenerID(network, addr string) string {
+	return tableroll.DefaultTableflipID(tableroll.TableflipFd{Kind: "listener", Network: network, Addr: addr})
+}
+
+func packetConnID(network, addr string) string {
+	return tableroll.DefaultTableflipID(tableroll.TableflipFd{Kind: "packet", Network: network, Addr: addr})
+}
+
+func connID(network, addr string) string {
+	return tableroll.DefaultTableflipID(tableroll.TableflipFd{Kind: "conn", Network: network, Addr: addr})
+}
+
+func fileID(name string) string {
+	return tableroll.DefaultTableflipID(tableroll.TableflipFd{Kind: "fd", Addr: name})
+}
+
+// Listen returns a listener inherited from the previous owner, or creates a
+// new one.
+func (f *Fds) Listen(network, addr string) (net.Listener, error) {
+	return f.fds.Listen(context.Background(), listenerID(network, addr), f.listenConfig, network, addr)
+}
+
+// Listener returns an inherited listener, or nil.
+func (f *Fds) Listener(network, addr string) (net.Listener, error) {
+	return f.fds.Listener(listenerID(network, addr))
+}
+
+// AddListener adds a listener, which will be passed on to the next process.
+// The listener is duplicated, so the caller may close it.
+func (f *Fds) AddListener(network, addr string, ln Listener) error {
+	_, err := f.fds.ListenWith(listenerID(network, addr), network, addr, func(string, string) (net.Listener, error) {
+		return ln, nil
+	})
+	return err
+}
+
+// ListenPacket returns a packet conn inherited from the previous owner, or
+// creates a new one.
+func (f *Fds) ListenPacket(network, addr string) (net.PacketConn, error) {
+	return f.fds.ListenPacket(context.Background(), packetConnID(network, addr), f.listenConfig, network, addr)
+}
+
+// PacketConn returns an inherited packet conn, or nil.
+func (f *Fds) PacketConn(network, addr string) (net.PacketConn, error) {
+	return f.fds.PacketConn(packetConnID(network, addr))
+}
+
+// Conn returns an inherited connection, or nil.
+func (f *Fds) Conn(network, addr string) (net.Conn, error) {
+	return f.fds.Conn(connID(network, addr))
+}
+
+// AddConn adds a connection, which will be passed on to the next process.
+// The connection is duplicated, so the caller may close it.
+func (f *Fds) AddConn(network, addr string, conn Conn) error {
+	_, err := f.fds.DialWith(connID(network, addr), network, addr, func(string, string) (net.Conn, error) {
+		return conn, nil
+	})
+	return err
+}
+
+// File returns an inherited file, or nil.
+func (f *Fds) File(name string) (*os.File, error) {
+	return f.fds.File(fileID(name))
+}
+
+// AddFile adds a file, which will be passed on to the next process. The file
+// is duplicated, so the caller may close it.
+func (f *Fds) AddFile(name string, file *os.File) error {
+	_, err := f.fds.OpenFileWith(fileID(name), name, func(string) (*os.File, error) {
+		return file, nil
+	})
+	return err
+}
@@ -0,0 +1,224 @@
+// Package tableflip mirrors the API of github.com/cloudflare/tableflip on top
+// of tableroll, so that projects using tableflip can switch to tableroll by
+// changing their import path and setting Options.CoordinationDir.
+//
+// A process using this package may be started by the Upgrade method of a
+// process using tableflip itself, and will inherit its fds, so that a service
+// can be migrated without downtime.
+//
+// Unlike tableflip, the new process is found through the coordination
+// directory rather than being started as a child, so a new process may also
+// be started by a process supervisor instead of with Upgrade.
+package tableflip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ngrok/tableroll"
+)
+
+// DefaultUpgradeTimeout is the duration in which the upgraded process must
+// call Ready, matching tableflip's.
+const DefaultUpgradeTimeout = time.Minute
+
+// ErrNotSupported exists for compatibility with tableflip, and is never
+// returned.
+var ErrNotSupported = errors.New("tableflip: platform does not support graceful restart")
+
+// Options control the behaviour of the Upgrader.
+type Options struct {
+	// CoordinationDir is the directory all processes in an upgrade chain
+	// coordinate with. It is required, and must exist. See tableroll.New.
+	CoordinationDir string
+	// UpgradeTimeout is the time a new process has to call Ready. Defaults to
+	// DefaultUpgradeTimeout.
+	UpgradeTimeout time.Duration
+	// PIDFile, if set, is written with the pid of the process once it's
+	// ready.
+	PIDFile string
+	// ListenConfig is used by Fds.Listen and Fds.ListenPacket, if set.
+	ListenConfig *net.ListenConfig
+	// Logger is passed to tableroll. Nothing is logged by default.
+	Logger tableroll.Logger
+}
+
+// Upgrader handles zero downtime upgrades and passing files between
+// processes.
+type Upgrader struct {
+	*Fds
+
+	opts Options
+	upg  *tableroll.Upgrader
+
+	mu        sync.Mutex
+	upgrading bool
+	stopped   bool
+}
+
+// New creates an Upgrader, inheriting fds from the current owner of
+// opts.CoordinationDir if there is one.
+func New(opts Options) (*Upgrader, error) {
+	if opts.CoordinationDir == "" {
+		return nil, errors.New("tableflip: a coordination dir is required")
+	}
+	if opts.UpgradeTimeout <= 0 {
+		opts.UpgradeTimeout = DefaultUpgradeTimeout
+	}
+	tablerollOpts := []tableroll.Option{
+		tableroll.WithUpgradeTimeout(opts.UpgradeTimeout),
+		tableroll.WithTableflipImport(nil),
+	}
+	if opts.Logger != nil {
+		tablerollOpts = append(tablerollOpts, tableroll.WithLogger(opts.Logger))
+	}
+	upg, err := tableroll.New(context.Background(), opts.CoordinationDir, tablerollOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Upgrader{
+		Fds:  &Fds{fds: upg.Fds, listenConfig: opts.ListenConfig},
+		opts: opts,
+		upg:  upg,
+	}, nil
+}
+
+// Tableroll returns the underlying tableroll Upgrader, for using features
+// tableflip doesn't have.
+func (u *Upgrader) Tableroll() *tableroll.Upgrader {
+	return u.upg
+}
+
+// Ready signals that the current process is ready to accept connections,
+// and writes the PID file if one is configured.
+func (u *Upgrader) Ready() error {
+	if err := u.upg.Ready(); err != nil {
+		return err
+	}
+	if u.opts.PIDFile == "" {
+		return nil
+	}
+	if err := writePIDFile(u.opts.PIDFile); err != nil {
+		return fmt.Errorf("tableflip: can't write PID file: %w", err)
+	}
+	return nil
+}
+
+// Exit returns a channel which is closed when the process should exit,
+// either because a new process took over or because Stop was called.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.upg.UpgradeComplete()
+}
+
+// Stop prevents any more upgrades from happening, and closes the channel
+// returned by Exit.
+func (u *Upgrader) Stop() {
+	u.mu.Lock()
+	u.stopped = true
+	u.mu.Unlock()
+	u.upg.Stop()
+}
+
+// HasParent reports whether this process inherited its fds from a previous
+// owner.
+func (u *Upgrader) HasParent() bool {
+	return u.upg.Inherited()
+}
+
+// WaitForParent blocks until the previous owner has finished draining, or
+// ctx is done. It returns immediately if there was no previous owner.
+func (u *Upgrader) WaitForParent(ctx context.Context) error {
+	select {
+	case <-u.upg.PredecessorDrained():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Upgrade starts a new copy of the current executable, with the same
+// arguments and environment, and waits for it to take over. It returns an
+// error if the new process exits or isn't ready within the upgrade timeout.
+// On success, the channel returned by Exit is closed.
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	if u.stopped {
+		u.mu.Unlock()
+		return errors.New("tableflip: terminating")
+	}
+	if u.upgrading {
+		u.mu.Unlock()
+		return errors.New("tableflip: upgrade in progress")
+	}
+	u.upgrading = true
+	u.mu.Unlock()
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("tableflip: can't find executable: %w", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("tableflip: can't start new process: %w", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timeout := time.NewTimer(u.opts.UpgradeTimeout)
+	defer timeout.Stop()
+	select {
+	case <-u.upg.UpgradeComplete():
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if u.stopped {
+			return errors.New("tableflip: terminating")
+		}
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("tableflip: new process exited before it was ready: %v", err)
+	case <-timeout.C:
+		cmd.Process.Kill()
+		return errors.New("tableflip: new process wasn't ready before the upgrade timeout")
+	}
+}
+
+// writePIDFile atomically replaces path with one containing our pid.
+func writePIDFile(path string) error {
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
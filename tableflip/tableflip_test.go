@@ -0,0 +1,84 @@
+package tableflip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestUpgrader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tableflip_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := New(Options{}); err == nil {
+		t.Fatalf("expected an error without a coordination dir")
+	}
+
+	pidFile := filepath.Join(dir, "pid")
+	upg, err := New(Options{CoordinationDir: dir, PIDFile: pidFile})
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg.Stop()
+	if upg.HasParent() {
+		t.Fatalf("expected no parent")
+	}
+
+	ln, err := upg.Fds.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if existing, err := upg.Listener("tcp", "127.0.0.1:0"); err != nil || existing == nil {
+		t.Fatalf("expected to find the listener by its network and address: %v, %v", existing, err)
+	} else {
+		existing.Close()
+	}
+
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln2.Close()
+	if err := upg.AddListener("tcp", ln2.Addr().String(), ln2.(Listener)); err != nil {
+		t.Fatalf("error adding listener: %v", err)
+	}
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	defer f.Close()
+	if err := upg.AddFile("null", f); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if file, err := upg.File("null"); err != nil || file == nil {
+		t.Fatalf("expected to find the file by its name: %v, %v", file, err)
+	}
+	if conn, err := upg.Conn("tcp", "127.0.0.1:1"); err != nil || conn != nil {
+		t.Fatalf("expected no conn: %v, %v", conn, err)
+	}
+
+	if err := upg.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	pid, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("error reading pid file: %v", err)
+	}
+	if string(pid) != strconv.Itoa(os.Getpid()) {
+		t.Fatalf("expected pid file to contain %d, got %q", os.Getpid(), pid)
+	}
+
+	upg.Stop()
+	<-upg.Exit()
+	if err := upg.Upgrade(); err == nil {
+		t.Fatalf("expected upgrading a stopped upgrader to fail")
+	}
+}
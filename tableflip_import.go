@@ -0,0 +1,161 @@
+package tableroll
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"syscall"
+)
+
+// A process started by github.com/cloudflare/tableflip's Upgrade finds out it
+// has a parent from an environment variable. Its parent passes it a pipe to
+// write a ready byte to as fd 3, a pipe as fd 4 on which it writes the gob
+// encoded names of the fds it passes, and the fds themselves from fd 5
+// onwards. The names pipe is closed when the parent exits.
+const (
+	tableflipSentinelEnv = "TABLEFLIP_HAS_PARENT_7DIU3"
+	tableflipNotifyReady = 42
+	tableflipReadyFd     = 3
+	tableflipNamesFd     = 4
+	tableflipFirstFd     = 5
+)
+
+// TableflipFd describes an fd passed by a process using
+// github.com/cloudflare/tableflip.
+type TableflipFd struct {
+	// Kind is "listener", "packet", "conn", or "fd".
+	Kind    string
+	Network string
+	// Addr is the address of a listener, packet conn or conn, or the name of
+	// a file.
+	Addr string
+}
+
+// DefaultTableflipID returns the id an fd imported from tableflip is stored
+// with, unless WithTableflipImport is given another function. The ids are
+// those used by the github.com/ngrok/tableroll/tableflip package, e.g.
+// "listener:tcp:127.0.0.1:8080" or "file:name".
+func DefaultTableflipID(fd TableflipFd) string {
+	switch fd.Kind {
+	case "fd":
+		return "file:" + fd.Addr
+	default:
+		return fd.Kind + ":" + fd.Network + ":" + fd.Addr
+	}
+}
+
+// WithTableflipImport allows New to inherit fds from a process using
+// github.com/cloudflare/tableflip which started this process with its
+// Upgrade method, so that a service can migrate to tableroll without
+// downtime. It's only used if there's no owner in the coordination directory.
+// The id function chooses the id each fd is stored with; if it's nil,
+// DefaultTableflipID is used.
+//
+// The tableflip process is told we're ready by Ready, and
+// PredecessorDrained's channel is closed once it exits. Processes which
+// upgrade from this one do so through the coordination directory as usual.
+func WithTableflipImport(id func(TableflipFd) string) Option {
+	if id == nil {
+		id = DefaultTableflipID
+	}
+	return func(u *Upgrader) {
+		u.tableflipID = id
+	}
+}
+
+// tableflipParent is a process using tableflip which passed us its fds.
+type tableflipParent struct {
+	pid   int
+	ready *os.File
+	names *os.File
+}
+
+// importFromTableflip imports fds from a tableflip parent, if we have one.
+func importFromTableflip(l Logger, redact func(string) string, id func(TableflipFd) string) (*tableflipParent, map[string]*fd, error) {
+	if os.Getenv(tableflipSentinelEnv) == "" {
+		return nil, nil, nil
+	}
+	// processes we start shouldn't think they have a tableflip parent
+	os.Unsetenv(tableflipSentinelEnv)
+	ready := os.NewFile(tableflipReadyFd, "tableflip ready")
+	names := os.NewFile(tableflipNamesFd, "tableflip names")
+	parent, fds, err := readTableflipFds(l, redact, ready, names, tableflipFirstFd, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	parent.pid = os.Getppid()
+	return parent, fds, nil
+}
+
+// readTableflipFds reads the names of the fds a tableflip parent passed us,
+// and takes ownership of the fds, which start at firstFd.
+func readTableflipFds(l Logger, redact func(string) string, ready, names *os.File, firstFd uintptr, id func(TableflipFd) string) (*tableflipParent, map[string]*fd, error) {
+	var fdNames [][]string
+	if err := gob.NewDecoder(names).Decode(&fdNames); err != nil {
+		ready.Close()
+		names.Close()
+		return nil, nil, fmt.Errorf("could not read fd names from tableflip parent: %w", err)
+	}
+	fds := make(map[string]*fd, len(fdNames))
+	for i, parts := range fdNames {
+		rawFd := firstFd + uintptr(i)
+		syscall.CloseOnExec(int(rawFd))
+		var name TableflipFd
+		if len(parts) > 0 {
+			name.Kind = parts[0]
+		}
+		if len(parts) > 1 {
+			name.Network = parts[1]
+		}
+		if len(parts) > 2 {
+			name.Addr = parts[2]
+		}
+		if name.Kind == "fd" {
+			// tableflip stores a file's name where other fds have their network
+			name.Network, name.Addr = "", name.Network
+		}
+		fi := &fd{ID: id(name)}
+		switch name.Kind {
+		case "listener":
+			fi.Kind, fi.Network, fi.Addr = fdKindListener, name.Network, name.Addr
+		case "packet":
+			fi.Kind, fi.Network, fi.Addr = fdKindPacketConn, name.Network, name.Addr
+		case "conn":
+			fi.Kind, fi.Network, fi.Addr = fdKindConn, name.Network, name.Addr
+		case "fd":
+			fi.Kind, fi.Name = fdKindFile, name.Addr
+		default:
+			l.Warn("closing fd of unknown kind from tableflip parent", "kind", name.Kind)
+			syscall.Close(int(rawFd))
+			continue
+		}
+		if _, ok := fds[fi.ID]; ok {
+			l.Warn("closing fd with a duplicate id from tableflip parent", "id", redactString(redact, fi.ID))
+			syscall.Close(int(rawFd))
+			continue
+		}
+		fi.associateFile(os.NewFile(rawFd, fi.String()))
+		fds[fi.ID] = fi
+	}
+	l.Info("imported fds from tableflip parent", "fds", len(fds))
+	return &tableflipParent{ready: ready, names: names}, fds, nil
+}
+
+// sendReady tells the tableflip parent we're ready, which causes it to exit.
+func (p *tableflipParent) sendReady() error {
+	defer p.ready.Close()
+	if _, err := p.ready.Write([]byte{tableflipNotifyReady}); err != nil {
+		return fmt.Errorf("could not notify tableflip parent we're ready: %w", err)
+	}
+	return nil
+}
+
+// awaitExit waits for the tableflip parent to close its end of the names
+// pipe, which happens when it exits.
+func (p *tableflipParent) awaitExit() {
+	defer p.names.Close()
+	io.Copy(ioutil.Discard, p.names)
+}
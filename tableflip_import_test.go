@@ -0,0 +1,95 @@
+package tableroll
+
+import (
+	"encoding/gob"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTableflipImport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	lnFile, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("error getting listener file: %v", err)
+	}
+	defer lnFile.Close()
+	rawFd, err := unix.Dup(int(lnFile.Fd()))
+	if err != nil {
+		t.Fatalf("error duplicating listener: %v", err)
+	}
+
+	// the tableflip parent writes the fds' names and keeps the pipe open
+	// until it exits
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	defer readyR.Close()
+	namesR, namesW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("error creating pipe: %v", err)
+	}
+	addr := ln.Addr().String()
+	if err := gob.NewEncoder(namesW).Encode([][]string{{"listener", "tcp", addr}}); err != nil {
+		t.Fatalf("error writing names: %v", err)
+	}
+
+	parent, fds, err := readTableflipFds(l, nil, readyW, namesR, uintptr(rawFd), DefaultTableflipID)
+	if err != nil {
+		t.Fatalf("error importing fds: %v", err)
+	}
+	id := "listener:tcp:" + addr
+	fi, ok := fds[id]
+	if !ok || fi.Kind != fdKindListener || fi.Addr != addr || !fi.inherited {
+		t.Fatalf("expected an inherited listener %q, got %v", id, fds)
+	}
+	imported, err := newFds(l, fds).Listener(id)
+	if err != nil || imported == nil {
+		t.Fatalf("expected to be able to use the imported listener: %v, %v", imported, err)
+	}
+	imported.Close()
+
+	if err := parent.sendReady(); err != nil {
+		t.Fatalf("error sending ready: %v", err)
+	}
+	var b [1]byte
+	if _, err := readyR.Read(b[:]); err != nil || b[0] != tableflipNotifyReady {
+		t.Fatalf("expected the parent to be told we're ready, got %v, %v", b, err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		parent.awaitExit()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		t.Fatalf("expected to wait for the parent to exit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	namesW.Close()
+	<-exited
+}
+
+func TestDefaultTableflipID(t *testing.T) {
+	for _, tc := range []struct {
+		fd       TableflipFd
+		expected string
+	}{
+		{TableflipFd{Kind: "listener", Network: "tcp", Addr: "127.0.0.1:80"}, "listener:tcp:127.0.0.1:80"},
+		{TableflipFd{Kind: "packet", Network: "udp", Addr: ":53"}, "packet:udp::53"},
+		{TableflipFd{Kind: "fd", Addr: "state"}, "file:state"},
+	} {
+		if id := DefaultTableflipID(tc.fd); id != tc.expected {
+			t.Errorf("expected %q for %v, got %q", tc.expected, tc.fd, id)
+		}
+	}
+}
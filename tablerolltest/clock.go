@@ -0,0 +1,19 @@
+package tablerolltest
+
+import (
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+// FakeClock is a clock whose time only moves when it's told to, for use with
+// tableroll.WithClock. Step advances it, firing any timers which are due,
+// such as the owner's upgrade timeout.
+type FakeClock = fakeclock.FakeClock
+
+// NewClock returns a FakeClock set to now. Give each Upgrader its own: an
+// Upgrader waiting for the coordination directory's lock sleeps on its clock,
+// which advances a FakeClock.
+func NewClock() *FakeClock {
+	return fakeclock.NewFakeClock(time.Now())
+}
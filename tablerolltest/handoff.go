@@ -0,0 +1,98 @@
+package tablerolltest
+
+import (
+	"sync"
+
+	"github.com/ngrok/tableroll"
+)
+
+// HandoffSteps controls the progress of a handoff, so that tests can make it
+// fail or stall at a given step. Pass its Hook to tableroll.WithHandoffHook.
+// For example, to make the owner time out waiting for the next owner, give
+// the owner a FakeClock, block the next owner at tableroll.HandoffStepReady,
+// wait until it's Reached, and Step the owner's clock past its upgrade
+// timeout.
+//
+// A HandoffSteps is safe for concurrent use.
+type HandoffSteps struct {
+	mu       sync.Mutex
+	failures map[tableroll.HandoffStep]error
+	blocked  map[tableroll.HandoffStep]chan struct{}
+	reached  map[tableroll.HandoffStep]chan struct{}
+}
+
+// NewHandoffSteps returns a HandoffSteps which lets every step go ahead
+// until told otherwise.
+func NewHandoffSteps() *HandoffSteps {
+	return &HandoffSteps{
+		failures: make(map[tableroll.HandoffStep]error),
+		blocked:  make(map[tableroll.HandoffStep]chan struct{}),
+		reached:  make(map[tableroll.HandoffStep]chan struct{}),
+	}
+}
+
+// Fail makes step fail with err, until called again with a nil err.
+func (s *HandoffSteps) Fail(step tableroll.HandoffStep, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		delete(s.failures, step)
+		return
+	}
+	s.failures[step] = err
+}
+
+// Block makes step wait until Release is called.
+func (s *HandoffSteps) Block(step tableroll.HandoffStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blocked[step]; !ok {
+		s.blocked[step] = make(chan struct{})
+	}
+}
+
+// Release lets step, and anything waiting at it, go ahead.
+func (s *HandoffSteps) Release(step tableroll.HandoffStep) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if blocked, ok := s.blocked[step]; ok {
+		close(blocked)
+		delete(s.blocked, step)
+	}
+}
+
+// Reached returns a channel which is closed once step has been reached, even
+// if it's blocked.
+func (s *HandoffSteps) Reached(step tableroll.HandoffStep) <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reachedLocked(step)
+}
+
+func (s *HandoffSteps) reachedLocked(step tableroll.HandoffStep) chan struct{} {
+	reached, ok := s.reached[step]
+	if !ok {
+		reached = make(chan struct{})
+		s.reached[step] = reached
+	}
+	return reached
+}
+
+// Hook is the function to pass to tableroll.WithHandoffHook.
+func (s *HandoffSteps) Hook(step tableroll.HandoffStep) error {
+	s.mu.Lock()
+	reached := s.reachedLocked(step)
+	select {
+	case <-reached:
+	default:
+		close(reached)
+	}
+	blocked := s.blocked[step]
+	s.mu.Unlock()
+	if blocked != nil {
+		<-blocked
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures[step]
+}
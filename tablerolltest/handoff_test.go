@@ -0,0 +1,156 @@
+package tablerolltest
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll"
+)
+
+func TestHandoffStepsUpgradeTimeout(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tablerolltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewClock()
+	timedOut := make(chan tableroll.PeerInfo, 1)
+	upg1, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(1)), tableroll.WithClock(clock),
+		tableroll.WithUpgradeTimeout(time.Minute),
+		tableroll.WithUpgradeTimeoutHandler(func(peer tableroll.PeerInfo) { timedOut <- peer }))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	steps := NewHandoffSteps()
+	steps.Block(tableroll.HandoffStepReady)
+	upg2, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2)), tableroll.WithHandoffHook(steps.Hook))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- upg2.Ready()
+	}()
+	<-steps.Reached(tableroll.HandoffStepReady)
+
+	// nothing times out until the owner's clock says so
+	select {
+	case <-timedOut:
+		t.Fatal("expected the owner not to time out yet")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Step(time.Minute)
+	select {
+	case <-timedOut:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the owner to time out")
+	}
+
+	steps.Release(tableroll.HandoffStepReady)
+	if err := <-readyErr; err == nil {
+		t.Fatal("expected Ready to fail after the owner timed out")
+	}
+	select {
+	case <-upg1.UpgradeComplete():
+		t.Fatal("expected the owner to remain the owner")
+	default:
+	}
+}
+
+func TestHandoffStepsFailSendFds(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tablerolltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	steps := NewHandoffSteps()
+	steps.Fail(tableroll.HandoffStepSendFds, errors.New("disk on fire"))
+	upg1, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(1)), tableroll.WithHandoffHook(steps.Hook))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	if _, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2))); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+
+	// the owner passes on its fds once it can
+	steps.Fail(tableroll.HandoffStepSendFds, nil)
+	upg2, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2)))
+	if err != nil {
+		t.Fatalf("error upgrading: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestHandoffStepsBlockedReadyDoesNotHoldLocks(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tablerolltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upg1, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(1)))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	steps := NewHandoffSteps()
+	steps.Block(tableroll.HandoffStepReady)
+	upg2, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2)), tableroll.WithHandoffHook(steps.Hook))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	readyErr := make(chan error, 1)
+	go func() {
+		readyErr <- upg2.Ready()
+	}()
+	<-steps.Reached(tableroll.HandoffStepReady)
+
+	// the upgrader's getters don't wait for the blocked step
+	checked := make(chan struct{})
+	go func() {
+		upg2.CoordinationError()
+		upg2.Status()
+		upg2.Inherited()
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the getters not to block while the ready step is blocked")
+	}
+
+	steps.Release(tableroll.HandoffStepReady)
+	if err := <-readyErr; err != nil {
+		t.Fatalf("error marking second upgrader ready: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Package tablerolltest provides helpers for testing code which uses
+// tableroll, such as running several upgraders in one test process.
+package tablerolltest
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/ngrok/tableroll"
+)
+
+// ErrProcessDead is returned by the Signal method of processes OS reports as
+// not running.
+var ErrProcessDead = errors.New("os: process already finished")
+
+// OS is a fake tableroll.OS, for use with tableroll.WithOS. Since each
+// Upgrader in a coordination directory must have its own pid, give each one
+// its own OS with a different pid to run several in one test process. All
+// other pids are reported as running unless marked otherwise.
+//
+// An OS is safe for concurrent use.
+type OS struct {
+	mu         sync.Mutex
+	pid        int
+	dead       map[int]bool
+	signalErrs map[int]error
+}
+
+var _ tableroll.OS = (*OS)(nil)
+
+// NewOS returns an OS whose Getpid returns pid.
+func NewOS(pid int) *OS {
+	return &OS{pid: pid}
+}
+
+// Getpid returns the pid set with NewOS or SetPid.
+func (o *OS) Getpid() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pid
+}
+
+// SetPid changes the pid Getpid returns, e.g. to simulate a process which
+// forked.
+func (o *OS) SetPid(pid int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pid = pid
+}
+
+// Kill marks pid as not running, as if the process had exited.
+func (o *OS) Kill(pid int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.dead == nil {
+		o.dead = make(map[int]bool)
+	}
+	o.dead[pid] = true
+}
+
+// Reuse marks pid as running again, as if an unrelated process had been
+// given a dead process's pid.
+func (o *OS) Reuse(pid int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.dead, pid)
+}
+
+// FailSignal makes signalling pid fail with err, e.g. syscall.EPERM for a
+// process owned by another user, until called again with a nil err.
+func (o *OS) FailSignal(pid int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err == nil {
+		delete(o.signalErrs, pid)
+		return
+	}
+	if o.signalErrs == nil {
+		o.signalErrs = make(map[int]error)
+	}
+	o.signalErrs[pid] = err
+}
+
+// FindProcess returns a process whose Signal method reflects whether pid
+// has been marked with Kill or FailSignal at the time it's called.
+func (o *OS) FindProcess(pid int) (tableroll.Process, error) {
+	return process{os: o, pid: pid}, nil
+}
+
+type process struct {
+	os  *OS
+	pid int
+}
+
+func (p process) Signal(os.Signal) error {
+	p.os.mu.Lock()
+	defer p.os.mu.Unlock()
+	if err, ok := p.os.signalErrs[p.pid]; ok {
+		return err
+	}
+	if p.os.dead[p.pid] {
+		return ErrProcessDead
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package tablerolltest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll"
+)
+
+func TestOS(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tablerolltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os1 := NewOS(1)
+	upg1, err := tableroll.New(ctx, dir, tableroll.WithOS(os1))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2)))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.Inherited() {
+		t.Fatalf("expected the second upgrader to upgrade from the first")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking second upgrader ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	upg1.Stop()
+	upg2.Stop()
+
+	// the owner's pid is dead, so the next process starts from scratch
+	os3 := NewOS(3)
+	os3.Kill(2)
+	upg3, err := tableroll.New(ctx, dir, tableroll.WithOS(os3))
+	if err != nil {
+		t.Fatalf("error creating third upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if reason := upg3.NoOwnerReason(); reason != tableroll.NoOwnerReasonOwnerDead {
+		t.Fatalf("expected the owner to be dead, got %q", reason)
+	}
+
+	p, _ := os3.FindProcess(2)
+	os3.Reuse(2)
+	if err := p.Signal(os.Signal(nil)); err != nil {
+		t.Fatalf("expected a reused pid to be running, got %v", err)
+	}
+	os3.FailSignal(2, os.ErrPermission)
+	if err := p.Signal(os.Signal(nil)); err != os.ErrPermission {
+		t.Fatalf("expected the signal to fail, got %v", err)
+	}
+}
+
+func TestOSLockHolderDead(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "tablerolltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upg1, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(1)))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	// the second upgrader holds the lock until it's ready or stops
+	upg2, err := tableroll.New(ctx, dir, tableroll.WithOS(NewOS(2)))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+
+	// to the third, both the owner and the lock holder are dead
+	os3 := NewOS(3)
+	os3.Kill(1)
+	os3.Kill(2)
+	type result struct {
+		upg *tableroll.Upgrader
+		err error
+	}
+	started := make(chan result, 1)
+	go func() {
+		upg3, err := tableroll.New(ctx, dir, tableroll.WithOS(os3), tableroll.WithLockRetryInterval(10*time.Millisecond))
+		started <- result{upg3, err}
+	}()
+	select {
+	case <-started:
+		t.Fatal("expected the third upgrader to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	upg2.Stop()
+
+	var res result
+	select {
+	case res = <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the third upgrader to take the lock")
+	}
+	if res.err != nil {
+		t.Fatalf("error creating third upgrader: %v", res.err)
+	}
+	defer res.upg.Stop()
+	if reason := res.upg.NoOwnerReason(); reason != tableroll.NoOwnerReasonLockHolderDead {
+		t.Fatalf("expected the lock holder to be dead, got %q", reason)
+	}
+}
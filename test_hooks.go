@@ -0,0 +1,119 @@
+package tableroll
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// The paths an integration takes when an upgrade goes wrong, such as the next
+// owner not becoming ready in time, are hard to trigger from a test by
+// racing real processes. WithClock and WithHandoffHook let a test control
+// time and the progress of a handoff instead; the tablerolltest package
+// provides a fake clock and a HandoffSteps to use with them.
+
+// Clock is the source of time for an Upgrader; see WithClock.
+type Clock = clock.Clock
+
+// Timer is a timer created by a Clock.
+type Timer = clock.Timer
+
+// WithClock replaces the clock the Upgrader uses for its timeouts, retries
+// and timestamps, e.g. with a fake clock in tests. The upgrade timeout is
+// measured with it, so a fake clock can make the owner time out waiting for
+// the next owner. Give each Upgrader its own fake clock: sleeping on a fake
+// clock, as an Upgrader waiting for the coordination directory's lock does,
+// advances it.
+func WithClock(c Clock) Option {
+	return func(u *Upgrader) {
+		u.clock = c
+	}
+}
+
+// HandoffStep identifies a point in a handoff at which the hook set with
+// WithHandoffHook is called.
+type HandoffStep string
+
+const (
+	// HandoffStepSendFds is reached by the owner once it has approved an
+	// upgrade, just before sending its fds to the next owner. Failing it
+	// makes the owner fail to pass on its fds, and remain the owner.
+	HandoffStepSendFds HandoffStep = "send-fds"
+	// HandoffStepReceiveFds is reached by the new process once it has
+	// connected to the owner, just before asking for its fds. Failing it
+	// makes New fail.
+	HandoffStepReceiveFds HandoffStep = "receive-fds"
+	// HandoffStepReady is reached by the new process in Ready, just before
+	// telling the owner it's ready. Failing it makes Ready fail; blocking in
+	// it past the owner's upgrade timeout makes the owner time out.
+	HandoffStepReady HandoffStep = "ready"
+)
+
+// WithHandoffHook sets a function which is called as this process reaches
+// each HandoffStep, for tests. The step doesn't go ahead until hook returns,
+// and if it returns an error, the step fails with it. It's intended for
+// testing how an integration handles failed upgrades; see
+// tablerolltest.HandoffSteps.
+func WithHandoffHook(hook func(HandoffStep) error) Option {
+	return func(u *Upgrader) {
+		u.handoffHook = hook
+	}
+}
+
+// reachHandoffStep calls the handoff hook, if any.
+func (u *Upgrader) reachHandoffStep(step HandoffStep) error {
+	if u.handoffHook == nil {
+		return nil
+	}
+	if err := u.handoffHook(step); err != nil {
+		return fmt.Errorf("handoff hook failed at %s: %w", step, err)
+	}
+	return nil
+}
+
+// timeoutAfter times out the sibling's connection once d has passed on clock,
+// until clearTimeout is called. It's driven by the clock, rather than a
+// deadline on the connection, so that a fake clock can trigger it.
+func (s *sibling) timeoutAfter(clock clock.Clock, d time.Duration) {
+	s.readyTimeout = d
+	s.readyBy = clock.Now().Add(d)
+	timer := clock.NewTimer(d)
+	stopC := make(chan struct{})
+	var (
+		mu      sync.Mutex
+		stopped bool
+		once    sync.Once
+	)
+	go func() {
+		select {
+		case <-timer.C():
+		case <-stopC:
+			timer.Stop()
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !stopped {
+			// any time in the past will do
+			s.conn.SetDeadline(time.Unix(1, 0))
+		}
+	}()
+	s.stopTimeout = func() {
+		once.Do(func() {
+			mu.Lock()
+			stopped = true
+			mu.Unlock()
+			close(stopC)
+		})
+	}
+}
+
+// clearTimeout stops the sibling's connection timing out.
+func (s *sibling) clearTimeout() {
+	if s.stopTimeout != nil {
+		s.stopTimeout()
+	}
+	s.conn.SetDeadline(time.Time{})
+}
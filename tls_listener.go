@@ -0,0 +1,60 @@
+package tableroll
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// TLSMismatchError is returned when a listener the previous owner served
+// with TLS is requested without it, e.g. with Listener, which would serve
+// plaintext to clients expecting TLS. Use TLSListener instead.
+type TLSMismatchError struct {
+	ID string
+}
+
+func (e *TLSMismatchError) Error() string {
+	return fmt.Sprintf("listener %q was served with TLS by the previous owner; use TLSListener", e.ID)
+}
+
+// TLSListener returns the listener with the given id wrapped with config, or
+// nil if there is none, like Listener. Fds only holds the raw listener, so
+// TLSListener should be used in place of wrapping a listener from Listen or
+// Listener with tls.NewListener, so each process applies its own config
+// without wrapping twice.
+//
+// The listener is recorded as served with TLS, and the next owner must
+// request it with TLSListener too: Listen, Listener and the like return a
+// *TLSMismatchError for it. A new listener, e.g. from Listen or Relisten,
+// must be passed to TLSListener to be recorded.
+func (f *Fds) TLSListener(id string, config *tls.Config) (net.Listener, error) {
+	return f.tlsListenerContext(context.Background(), id, config)
+}
+
+func (f *Fds) tlsListenerContext(ctx context.Context, id string, config *tls.Config) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	fi, ok := f.fds[id]
+	if !ok {
+		return nil, nil
+	}
+	if fi.Kind != fdKindListener {
+		return nil, newIdExistsError(fi)
+	}
+	ln, err := f.rawListenerLocked(id)
+	if ln == nil || err != nil {
+		return ln, err
+	}
+	if fi.inherited && !fi.TLS {
+		// this is expected when upgrading from an owner which predates
+		// TLSListener, but is worth knowing about if clients break
+		f.l.Warn("serving TLS on a listener the previous owner served without it", "id", redactString(f.redact, id))
+	}
+	fi.TLS = true
+	fi.tlsWrapped = true
+	return tls.NewListener(ln, config), nil
+}
@@ -0,0 +1,54 @@
+package tableroll
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestFdsTLSListener(t *testing.T) {
+	parent := newFds(l, nil)
+	if ln, err := parent.TLSListener("web", &tls.Config{}); ln != nil || err != nil {
+		t.Fatalf("expected no listener before one is created, got %v, %v", ln, err)
+	}
+	rawLn, err := parent.Listen(context.Background(), "web", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawLn.Close()
+	ln, err := parent.TLSListener("web", &tls.Config{})
+	if err != nil {
+		t.Fatalf("error wrapping listener: %v", err)
+	}
+	if _, ok := ln.(*net.TCPListener); ok {
+		t.Fatalf("expected the listener to be wrapped with TLS")
+	}
+	ln.Close()
+
+	// pass the fd on as an upgrade would
+	inherited := *parent.fds["web"]
+	inherited.inherited = true
+	inherited.tlsWrapped = false
+	child := newFds(l, map[string]*fd{"web": &inherited})
+	if _, err := child.Listener("web"); err == nil {
+		t.Fatalf("expected requesting a TLS listener as plaintext to fail")
+	} else if _, ok := err.(*TLSMismatchError); !ok {
+		t.Fatalf("expected a *TLSMismatchError, got %T: %v", err, err)
+	}
+	if _, err := child.Listen(context.Background(), "web", nil, "tcp", inherited.Addr); err == nil {
+		t.Fatalf("expected Listen to fail for a TLS listener too")
+	}
+	ln, err = child.TLSListener("web", &tls.Config{})
+	if err != nil || ln == nil {
+		t.Fatalf("expected to inherit the TLS listener, got %v, %v", ln, err)
+	}
+	ln.Close()
+	// once this process has taken responsibility for TLS, the raw listener
+	// may be used, e.g. to sniff protocols
+	ln, err = child.Listener("web")
+	if err != nil || ln == nil {
+		t.Fatalf("expected the raw listener, got %v, %v", ln, err)
+	}
+	ln.Close()
+}
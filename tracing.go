@@ -0,0 +1,80 @@
+package tableroll
+
+import (
+	"context"
+)
+
+// Upgrades may be traced by providing a TracerProvider. The interfaces here
+// are a small subset of OpenTelemetry's, so that tableroll doesn't depend on
+// it; see docs/tracing.md for an adapter. The newcomer's spans cover
+// connecting to the owner, waiting for the coordination lock, receiving fds,
+// and becoming ready. Its trace context is sent to the owner with its first
+// message, so the owner's spans for sending fds, waiting for the newcomer to
+// be ready, and draining are part of the same trace.
+
+// TracerName is the instrumentation name tableroll requests its Tracer with.
+const TracerName = "github.com/ngrok/tableroll"
+
+// TracerProvider provides the Tracer tableroll creates spans with.
+type TracerProvider interface {
+	Tracer(instrumentationName string) Tracer
+}
+
+// Tracer creates spans, and propagates trace contexts between processes.
+type Tracer interface {
+	// Start starts a span as a child of any span in ctx, and returns a
+	// context containing the new span.
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+	// Inject returns the trace context of the span in ctx, to be sent to
+	// another process.
+	Inject(ctx context.Context) map[string]string
+	// Extract returns a context containing the trace context another process
+	// sent with Inject, so that spans started with it are part of the same
+	// trace.
+	Extract(ctx context.Context, carrier map[string]string) context.Context
+}
+
+// Span is a single operation within a trace.
+type Span interface {
+	// SetAttribute records a key-value pair describing the operation. Values
+	// are strings, ints, or bools.
+	SetAttribute(key string, value interface{})
+	// RecordError records that the operation failed.
+	RecordError(err error)
+	End()
+}
+
+// WithTracerProvider traces upgrades with a Tracer from the given provider.
+func WithTracerProvider(tp TracerProvider) Option {
+	return func(u *Upgrader) {
+		u.tracer = tp.Tracer(TracerName)
+	}
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(ctx context.Context) map[string]string {
+	return nil
+}
+
+func (noopTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return ctx
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) RecordError(err error)                      {}
+func (noopSpan) End()                                       {}
+
+// endSpan ends span, recording err first if there was one.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
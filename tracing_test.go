@@ -0,0 +1,121 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+type traceKey struct{}
+
+// recordingTracer records the names of ended spans along with the trace they
+// were part of.
+type recordingTracer struct {
+	mu     sync.Mutex
+	traces int
+	ended  []string
+}
+
+func (r *recordingTracer) Tracer(name string) Tracer {
+	return r
+}
+
+func (r *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	trace, ok := ctx.Value(traceKey{}).(string)
+	if !ok {
+		r.mu.Lock()
+		r.traces++
+		trace = fmt.Sprintf("trace%d", r.traces)
+		r.mu.Unlock()
+		ctx = context.WithValue(ctx, traceKey{}, trace)
+	}
+	return ctx, &recordedSpan{tracer: r, name: trace + ":" + name}
+}
+
+func (r *recordingTracer) Inject(ctx context.Context) map[string]string {
+	trace, _ := ctx.Value(traceKey{}).(string)
+	return map[string]string{"trace": trace}
+}
+
+func (r *recordingTracer) Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if trace := carrier["trace"]; trace != "" {
+		return context.WithValue(ctx, traceKey{}, trace)
+	}
+	return ctx
+}
+
+func (r *recordingTracer) spans() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	spans := append([]string(nil), r.ended...)
+	sort.Strings(spans)
+	return spans
+}
+
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {}
+func (s *recordedSpan) RecordError(err error)                      {}
+func (s *recordedSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.ended = append(s.tracer.ended, s.name)
+}
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	tracer := &recordingTracer{}
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithTracerProvider(tracer))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithTracerProvider(tracer))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+
+	var second []string
+	for _, span := range tracer.spans() {
+		if strings.HasPrefix(span, "trace2:") {
+			second = append(second, strings.TrimPrefix(span, "trace2:"))
+		}
+	}
+	// the owner's spans are part of the second upgrader's trace
+	expected := []string{
+		"tableroll.await_ready",
+		"tableroll.connect",
+		"tableroll.drain",
+		"tableroll.handoff",
+		"tableroll.lock",
+		"tableroll.ready",
+		"tableroll.receive_fds",
+		"tableroll.send_fds",
+		"tableroll.upgrade",
+	}
+	if strings.Join(second, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected spans %v, got %v", expected, second)
+	}
+}
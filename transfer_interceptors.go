@@ -0,0 +1,218 @@
+package tableroll
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// TransferredFd describes an fd the owner is about to pass to the next owner.
+type TransferredFd struct {
+	ID      string
+	Kind    string
+	Network string
+	Addr    string
+	Name    string
+	// Generation is the generation of the process which created the fd.
+	Generation uint32
+	// Inherited is true if the owner inherited the fd rather than creating
+	// it.
+	Inherited bool
+	// Exclusive is true for fds added with AddExclusive, which are only
+	// passed on once the owner has drained.
+	Exclusive bool
+}
+
+// Transfer describes an outgoing handoff to a TransferInterceptor.
+type Transfer struct {
+	// Peer is the process which is taking ownership.
+	Peer PeerInfo
+	// Generation is the generation of the owner.
+	Generation uint32
+	// Fds are the fds which will be passed, sorted by id. Changing them has
+	// no effect; use Veto to withhold one, or Substitute to pass another in
+	// its place.
+	Fds []TransferredFd
+	// State is the state provided with WithHandoffState, if any. It may be
+	// replaced.
+	State []byte
+
+	fds         map[string]*fd
+	vetoed      map[string]string
+	substitutes map[string]*fd
+}
+
+// Veto withholds the fd with the given id from the next owner. The reason is
+// logged.
+func (t *Transfer) Veto(id, reason string) {
+	if t.vetoed == nil {
+		t.vetoed = make(map[string]string)
+	}
+	t.vetoed[id] = reason
+	t.dropSubstitute(id)
+}
+
+// Substitute passes a duplicate of file to the next owner under the given id,
+// in place of the fd this process holds, which is left as it is. This lets
+// the owner give different peers different fds, e.g. a socket for test
+// credentials rather than production ones to a canary, told apart by
+// Peer.Identity. The substitute must be of the same kind as the fd, such as
+// a listening socket for a listener; it's described to the next owner with
+// its own file name or bound address. The caller remains responsible for
+// closing file.
+//
+// The fd must be one of Fds, and not exclusive, since those are only passed
+// on once the owner has drained. A later Veto or Substitute for the same id
+// takes precedence.
+func (t *Transfer) Substitute(id string, file *os.File) error {
+	original, ok := t.fds[id]
+	if !ok {
+		return fmt.Errorf("no fd with id %q is being passed", id)
+	}
+	if original.Exclusive {
+		return fmt.Errorf("fd %q is exclusive, exclusive fds can't be substituted", id)
+	}
+	dup, err := dupFile(file, id)
+	if err != nil {
+		return err
+	}
+	substitute := &fd{
+		ID:         id,
+		Kind:       original.Kind,
+		Network:    original.Network,
+		Addr:       original.Addr,
+		Name:       original.Name,
+		Generation: t.Generation,
+		file:       dup,
+	}
+	if original.Kind == fdKindFile {
+		substitute.Name = file.Name()
+	} else if identity, err := identify(dup.fd); err == nil && identity.SockAddr != "" {
+		substitute.Addr = identity.SockAddr
+	}
+	t.dropSubstitute(id)
+	delete(t.vetoed, id)
+	if t.substitutes == nil {
+		t.substitutes = make(map[string]*fd)
+	}
+	t.substitutes[id] = substitute
+	return nil
+}
+
+// Substituted returns whether the fd with the given id has been substituted
+// by this or an earlier interceptor.
+func (t *Transfer) Substituted(id string) bool {
+	_, ok := t.substitutes[id]
+	return ok
+}
+
+func (t *Transfer) dropSubstitute(id string) {
+	if substitute, ok := t.substitutes[id]; ok {
+		substitute.file.Close()
+		delete(t.substitutes, id)
+	}
+}
+
+// Vetoed returns whether the fd with the given id has been vetoed by this or
+// an earlier interceptor.
+func (t *Transfer) Vetoed(id string) bool {
+	_, ok := t.vetoed[id]
+	return ok
+}
+
+// TransferInterceptor is called by the owner while an upgrade is in progress,
+// after fd mutations have been locked and before any fds are sent. It may
+// inspect the transfer, veto or substitute fds, or replace the handoff state.
+// If it returns an error, the upgrade is rejected with the error as the
+// reason.
+type TransferInterceptor func(t *Transfer) error
+
+// WithTransferInterceptors adds interceptors which are run in order on each
+// outgoing handoff. This allows policy, such as withholding fds by name, to be
+// enforced without changing how fds are added to the store.
+func WithTransferInterceptors(interceptors ...TransferInterceptor) Option {
+	return func(u *Upgrader) {
+		u.transferInterceptors = append(u.transferInterceptors, interceptors...)
+	}
+}
+
+// interceptTransfer runs the transfer interceptors over the fds and state
+// about to be passed to nextOwner, and returns what should be passed instead.
+// Vetoed fds are recorded on the sibling so that exclusive fds are withheld
+// too, and substitutes so that they're closed once they've been sent.
+func (u *Upgrader) interceptTransfer(nextOwner *sibling, fds map[string]*fd, state []byte) (map[string]*fd, []byte, error) {
+	if len(u.transferInterceptors) == 0 {
+		return fds, state, nil
+	}
+	t := &Transfer{
+		Peer:       nextOwner.peer,
+		Generation: u.generation,
+		Fds:        make([]TransferredFd, 0, len(fds)),
+		State:      state,
+		fds:        fds,
+	}
+	for _, fi := range fds {
+		t.Fds = append(t.Fds, TransferredFd{
+			ID:         fi.ID,
+			Kind:       string(fi.Kind),
+			Network:    fi.Network,
+			Addr:       fi.Addr,
+			Name:       fi.Name,
+			Generation: fi.Generation,
+			Inherited:  fi.inherited,
+			Exclusive:  fi.Exclusive,
+		})
+	}
+	sort.Slice(t.Fds, func(i, j int) bool { return t.Fds[i].ID < t.Fds[j].ID })
+	for _, intercept := range u.transferInterceptors {
+		if err := intercept(t); err != nil {
+			for id := range t.substitutes {
+				t.dropSubstitute(id)
+			}
+			return nil, nil, fmt.Errorf("transfer interceptor failed: %w", err)
+		}
+	}
+	if len(t.vetoed) == 0 && len(t.substitutes) == 0 {
+		return fds, t.State, nil
+	}
+	passed := make(map[string]*fd, len(fds))
+	for id, fi := range fds {
+		if reason, ok := t.vetoed[id]; ok {
+			u.l.Info("withholding vetoed fd from the next owner", "fd", redactFd(u.redact, fi), "reason", reason)
+			continue
+		}
+		if substitute, ok := t.substitutes[id]; ok {
+			u.l.Info("passing a substitute fd to the next owner", "fd", redactFd(u.redact, fi), "substitute", redactFd(u.redact, substitute))
+			nextOwner.substitutes = append(nextOwner.substitutes, substitute)
+			fi = substitute
+		}
+		passed[id] = fi
+	}
+	nextOwner.vetoed = t.vetoed
+	return passed, t.State, nil
+}
+
+// closeSubstitutes closes our copies of the substitute fds passed to the
+// sibling, once they've been sent or the transfer has failed.
+func (s *sibling) closeSubstitutes() {
+	for _, fi := range s.substitutes {
+		fi.file.Close()
+	}
+	s.substitutes = nil
+}
+
+// withoutVetoed filters out fds a transfer interceptor withheld from the
+// sibling.
+func (s *sibling) withoutVetoed(fds []*fd) []*fd {
+	if len(s.vetoed) == 0 {
+		return fds
+	}
+	passed := make([]*fd, 0, len(fds))
+	for _, fi := range fds {
+		if _, ok := s.vetoed[fi.ID]; ok {
+			continue
+		}
+		passed = append(passed, fi)
+	}
+	return passed
+}
@@ -0,0 +1,84 @@
+package tableroll
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WithMaxTransferDuration limits how long the owner spends sending its fds to
+// the next owner during an upgrade. Mutations are locked while they're sent,
+// so a next owner which is alive but pathologically slow to read them could
+// otherwise hold them up for as long as the upgrade timeout. If sending takes
+// longer than d, the upgrade is aborted with a *TransferTooSlowError, and this
+// process remains the owner.
+//
+// Unlike WithUpgradeTimeout, this doesn't include the time the next owner
+// takes to become ready once it has the fds. The limit applies separately to
+// passing exclusive fds once this process has drained. A duration of 0, the
+// default, means no limit.
+func WithMaxTransferDuration(d time.Duration) Option {
+	return func(u *Upgrader) {
+		u.maxTransferDuration = d
+	}
+}
+
+// TransferTooSlowError is returned when sending fds to the next owner takes
+// longer than the limit configured with WithMaxTransferDuration.
+type TransferTooSlowError struct {
+	Limit time.Duration
+	// Sent is the number of fds sent before the transfer was aborted, out of
+	// Total.
+	Sent, Total int
+}
+
+func (e *TransferTooSlowError) Error() string {
+	return fmt.Sprintf("sending fds to the next owner took longer than %v, %d of %d were sent", e.Limit, e.Sent, e.Total)
+}
+
+// limitTransfer aborts the sibling's connection if sending fds takes longer
+// than its maxTransferDuration. The returned function must be called once
+// sending is done, with how many fds were sent and the error sending
+// returned, if any. It returns a *TransferTooSlowError instead if the
+// transfer was aborted, even if sending went on to succeed.
+func (s *sibling) limitTransfer() func(sent, total int, err error) error {
+	if s.maxTransferDuration <= 0 {
+		return func(_, _ int, err error) error { return err }
+	}
+	var (
+		mu      sync.Mutex
+		done    bool
+		aborted bool
+	)
+	doneC := make(chan struct{})
+	timer := s.clock.NewTimer(s.maxTransferDuration)
+	go func() {
+		select {
+		case <-timer.C():
+		case <-doneC:
+			timer.Stop()
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			return
+		}
+		aborted = true
+		// Fds are sent with the socket in blocking mode, which deadlines
+		// don't interrupt, but shutting it down does.
+		s.conn.SetDeadline(s.clock.Now())
+		s.conn.CloseWrite()
+	}()
+	return func(sent, total int, err error) error {
+		close(doneC)
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		if !aborted {
+			return err
+		}
+		s.l.Warn("aborting a transfer which took too long", "limit", s.maxTransferDuration, "err", err)
+		return &TransferTooSlowError{Limit: s.maxTransferDuration, Sent: sent, Total: total}
+	}
+}
@@ -0,0 +1,55 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestMaxTransferDuration(t *testing.T) {
+	server, client, err := unixSocketPair()
+	if err != nil {
+		t.Fatalf("error creating socket pair: %v", err)
+	}
+	defer server.Close()
+	// the next owner never reads what it's sent
+	defer client.Close()
+
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	fi, err := dupFile(null, "null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fi.Close()
+	fds := []*fd{{ID: "null", Kind: fdKindFile, Name: os.DevNull, file: fi}}
+
+	nextOwner := newSibling(l, server, false)
+	nextOwner.maxTransferDuration = 50 * time.Millisecond
+	nextOwner.clock = clock.RealClock{}
+	// more state than the socket can buffer
+	state := make([]byte, 8<<20)
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- nextOwner.giveFDs(context.Background(), noopTracer{}, map[string]*fd{"null": fds[0]}, 1, state, nil)
+	}()
+	select {
+	case err := <-errC:
+		tooSlow, ok := err.(*TransferTooSlowError)
+		if !ok {
+			t.Fatalf("expected a *TransferTooSlowError, got %T %v", err, err)
+		}
+		if tooSlow.Sent != 0 || tooSlow.Total != 1 {
+			t.Errorf("expected 0 of 1 fds to have been sent, got %d of %d", tooSlow.Sent, tooSlow.Total)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer wasn't aborted")
+	}
+}
@@ -2,45 +2,170 @@ package tableroll
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sync"
 	"syscall"
+	"time"
 
-	"github.com/inconshreveable/log15"
 	"github.com/ngrok/tableroll/internal/proto"
-	"github.com/opencontainers/runc/libcontainer/utils"
-	"github.com/pkg/errors"
 )
 
+// ErrTakeoverUnsupported is returned when a forced cold start is requested,
+// but the current owner is too old to understand the request.
+var ErrTakeoverUnsupported = errors.New("the current owner does not support forced takeovers")
+
+// UpgradeRejectedError is returned when the current owner refused to service
+// our request to upgrade.
+type UpgradeRejectedError struct {
+	Reason string
+}
+
+func (e *UpgradeRejectedError) Error() string {
+	return "the current owner rejected the upgrade: " + e.Reason
+}
+
+// OwnerNotReadyError is returned when the process we reached inherited its
+// fds from a previous owner, but has not called Ready yet, so it can't pass
+// them on. This is only possible if processes don't share the coordination
+// directory's lock, e.g. with WithCoordinationFallback; otherwise a new
+// process waits for the lock until the inheriting process is Ready.
+type OwnerNotReadyError struct {
+	Pid int
+	// RetryAfter is how long the process suggested waiting before trying
+	// again.
+	RetryAfter time.Duration
+}
+
+func (e *OwnerNotReadyError) Error() string {
+	return fmt.Sprintf("process %d has not finished becoming the owner, retry after %v", e.Pid, e.RetryAfter)
+}
+
 type upgradeSession struct {
-	closeOnce    sync.Once
-	wr           *net.UnixConn
+	closeOnce sync.Once
+	wr        *net.UnixConn
+	// stream carries the v2 protocol over wr; see frames.
+	stream *proto.Stream
+	// legacy is true if the owner is only listening on the legacy upgrade
+	// socket, and thus speaks v1 or earlier of the protocol.
+	legacy       bool
 	coordinator  *coordinator
 	ownerVersion uint32
-	l            log15.Logger
+	// ownerGeneration is the generation of the owner. Legacy owners don't
+	// report it, so it's 0 for them.
+	ownerGeneration uint32
+	// handoffState is the state the owner provided with WithHandoffState
+	handoffState []byte
+	// handoffStore is the contents of the owner's Store
+	handoffStore  *storeSnapshot
+	noOwnerReason NoOwnerReason
+	// owner is the process we connected to, if any
+	owner *PeerInfo
+	// candidate is set if we're taking part in an upgrade election, and
+	// beaten holds the pids of the candidates we won against.
+	candidate *proto.Candidate
+	beaten    map[int]bool
+	// verifyFds is how received fds should be checked against their
+	// identities in the fd table.
+	verifyFds fdVerification
+	// progress is called as fds are received; see WithTransferProgress.
+	progress func(sent, total int)
+	// handshake is the newcomer's side of a custom handshake, set with
+	// WithHandshake.
+	handshake func(*Session) error
+	// traceContext is sent to the owner so its spans join our trace.
+	traceContext map[string]string
+	// identity is sent to the owner; see WithIdentity.
+	identity string
+	// handoffKey is the secret to authenticate with, if any, and authNonce
+	// our challenge for the owner; see WithHandoffSecret.
+	handoffKey []byte
+	authNonce  []byte
+	// acceptsConns is set if we can receive connections; see
+	// WithConnReceiver.
+	acceptsConns bool
+	// ownerHeartbeats is set if the owner answers heartbeats, and keeps its
+	// connection open until it exits, once it's stepped down.
+	ownerHeartbeats bool
+	// ownerHandback is set if the owner acknowledges that it has resumed
+	// ownership when we release its fds.
+	ownerHandback bool
+	// platform is ours, sent to the owner, and platformPolicy what to do if
+	// the owner's is incompatible; see WithPlatformPolicy.
+	platform       Platform
+	platformPolicy PlatformPolicy
+	// ownerReadyTimeout is the owner's upgrade timeout, and ownerReadyBy
+	// when it runs out by now, if the owner reported them; see
+	// Upgrader.ReadyDeadline.
+	ownerReadyTimeout time.Duration
+	ownerReadyBy      time.Time
+	now               func() time.Time
+	// redact is applied to fd metadata before it's logged; see WithRedaction.
+	redact func(string) string
+	l      Logger
 }
 
-func pidIsDead(osi osIface, pid int) bool {
+func pidIsDead(osi OS, pid int) bool {
 	proc, _ := osi.FindProcess(pid)
 	return proc.Signal(syscall.Signal(0)) != nil
 }
 
-func connectToCurrentOwner(ctx context.Context, l log15.Logger, coord *coordinator) (*upgradeSession, error) {
+// connectToCurrentOwner locks the coordination directory and connects to the
+// current owner, if any. If candidate is non-nil, we first take part in an
+// upgrade election as that candidate.
+func connectToCurrentOwner(ctx context.Context, l Logger, coord *coordinator, candidate *proto.Candidate, fallback bool) (*upgradeSession, error) {
+	if candidate != nil {
+		if err := coord.registerCandidate(*candidate); err != nil {
+			return nil, err
+		}
+	}
 	err := coord.Lock(ctx)
 	if err != nil {
+		if candidate != nil {
+			coord.withdrawCandidate(candidate.Pid)
+		}
+		return nil, err
+	}
+	err = coord.migrateLayout()
+	if err == nil {
+		err = coord.checkShutdown()
+	}
+	if err != nil {
+		if candidate != nil {
+			coord.withdrawCandidate(candidate.Pid)
+		}
+		coord.Unlock()
 		return nil, err
 	}
 
 	sess := &upgradeSession{
 		coordinator: coord,
+		candidate:   candidate,
 		l:           l,
 	}
+	if candidate != nil {
+		beaten, err := coord.runElection(*candidate)
+		if err != nil {
+			sess.Close()
+			return nil, err
+		}
+		sess.beaten = beaten
+	}
 
 	// sock is used for all messages between two siblings
-	sock, err := coord.ConnectOwner(ctx)
-	if err == errNoOwner {
+	sock, legacy, err := coord.ConnectOwner(ctx)
+	if _, ok := err.(*NoOwnerError); ok && fallback {
+		if fallbackSock, fallbackErr := coord.ConnectFallbackOwner(ctx); fallbackErr == nil {
+			l.Info("found no owner in the coordination directory, but found one on the fallback socket")
+			sock, legacy, err = fallbackSock, false, nil
+		} else if _, ok := fallbackErr.(*NoOwnerError); !ok {
+			err = fallbackErr
+		}
+	}
+	if noOwner, ok := err.(*NoOwnerError); ok {
+		sess.noOwnerReason = noOwner.Reason
 		return sess, nil
 	}
 	if err != nil {
@@ -48,30 +173,34 @@ func connectToCurrentOwner(ctx context.Context, l log15.Logger, coord *coordinat
 		return nil, err
 	}
 	sess.wr = sock
+	sess.legacy = legacy
+	if owner, err := peerInfo(sock); err != nil {
+		l.Warn("could not determine who the current owner is", "err", err)
+	} else {
+		l.Info("connected to current owner", "owner", owner)
+		sess.owner = &owner
+	}
+	if !legacy {
+		sess.ownerVersion = proto.Version
+	}
 	return sess, nil
 }
 
+// frames returns the stream carrying the v2 protocol to the owner.
+func (s *upgradeSession) frames() *proto.Stream {
+	if s.stream == nil {
+		s.stream = proto.NewStream(s.wr, proto.RoleOwner)
+	}
+	return s.stream
+}
+
 func (s *upgradeSession) hasOwner() bool {
 	return s.wr != nil
 }
 
-// getFiles retrieves all files over the opened upgrade session. In the case of
-// a context error, the upgrade session will be closed and a context error will
-// be returned as a wrapped error. The context error may be retreived with
-// errors.Cause in that case.
-func (s *upgradeSession) getFiles(ctx context.Context) (map[string]*fd, error) {
-	s.l.Info("getting fds")
-	if !s.hasOwner() {
-		s.l.Info("no connection present, no files from owner")
-		return nil, nil
-	}
-
-	sockFile, err := s.wr.File()
-	if err != nil {
-		return nil, errors.Wrapf(err, "could not convert sibling connection to file")
-	}
-	defer sockFile.Close()
-
+// closeOnCancel closes the session if the context is cancelled before the
+// returned function is called.
+func (s *upgradeSession) closeOnCancel(ctx context.Context) func() {
 	functionEnd := make(chan struct{})
 	go func() {
 		select {
@@ -88,64 +217,344 @@ func (s *upgradeSession) getFiles(ctx context.Context) (map[string]*fd, error) {
 			s.Close()
 		}
 	}()
-	defer close(functionEnd)
-	// orContextErr returns a context error instead of the passed error if there is one.
-	// This is done under the assumption that the 'err' passed in was caused by
-	// the context cancel/timeout/whatever, and the context error is therefore
-	// both more useful for a programmer to check and a more meaningful message.
-	orContextErr := func(err error) error {
-		if ctxErr := ctx.Err(); ctxErr != nil {
-			return errors.Wrap(ctxErr, err.Error())
-		}
+	return func() { close(functionEnd) }
+}
+
+// orContextErr returns a context error instead of the passed error if there is one.
+// This is done under the assumption that the 'err' passed in was caused by
+// the context cancel/timeout/whatever, and the context error is therefore
+// both more useful for a programmer to check and a more meaningful message.
+func orContextErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("%s: %w", err.Error(), ctxErr)
+	}
+	return err
+}
+
+// takeover asks the owner to step down and begin draining without passing us
+// any file descriptors. If it returns nil, the owner has stepped down and
+// the session no longer has an owner.
+func (s *upgradeSession) takeover(ctx context.Context) error {
+	if s.legacy {
+		return ErrTakeoverUnsupported
+	}
+	defer s.closeOnCancel(ctx)()
+	s.l.Warn("requesting the current owner step down without passing fds")
+	authNonce, err := s.helloAuthNonce()
+	if err != nil {
 		return err
 	}
+	if err := s.frames().WriteFrame(proto.MessageHello, proto.Hello{
+		Version:      proto.Version,
+		Intent:       proto.IntentTakeover,
+		Candidate:    s.candidate,
+		TraceContext: s.traceContext,
+		Identity:     s.identity,
+		AuthNonce:    authNonce,
+	}); err != nil {
+		return orContextErr(ctx, fmt.Errorf("can't request takeover: %w", err))
+	}
+	if err := s.authenticateOwner(); err != nil {
+		if _, ok := err.(*HandoffAuthError); ok {
+			return err
+		}
+		return orContextErr(ctx, s.publicProtocolErr(err))
+	}
+	if _, err := s.frames().ReadFrameOfType(proto.MessageSteppingDown); err != nil {
+		return orContextErr(ctx, s.publicProtocolErr(err))
+	}
+	s.l.Info("the previous owner stepped down")
+	s.wr.Close()
+	s.wr = nil
+	s.noOwnerReason = NoOwnerReasonForcedColdStart
+	return nil
+}
 
+// readFdTable reads the owner's table of file descriptors, which it will send
+// the file descriptors for immediately after.
+func (s *upgradeSession) readFdTable() ([]*fd, error) {
 	fds := []*fd{}
-	version, err := proto.ReadVersionedJSONBlob(s.wr, &fds)
+	if s.legacy {
+		if s.handshake != nil {
+			return nil, &HandshakeError{Err: errors.New("the owner is too old to support custom handshakes")}
+		}
+		if s.handoffKey != nil {
+			return nil, &HandoffAuthError{Reason: "the owner is too old to authenticate"}
+		}
+		version, err := proto.ReadVersionedJSONBlob(s.wr, &fds)
+		if err != nil {
+			return nil, err
+		}
+		s.ownerVersion = version
+		return fds, nil
+	}
+
+	authNonce, err := s.helloAuthNonce()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.frames().WriteFrame(proto.MessageHello, proto.Hello{
+		Version:      proto.Version,
+		Intent:       proto.IntentUpgrade,
+		Candidate:    s.candidate,
+		Handshake:    s.handshake != nil,
+		TraceContext: s.traceContext,
+		Identity:     s.identity,
+		AuthNonce:    authNonce,
+		AcceptsConns: s.acceptsConns,
+		Heartbeats:   true,
+		Handback:     true,
+		Platform:     s.platform.proto(),
+	}); err != nil {
+		return nil, err
+	}
+	if err := s.authenticateOwner(); err != nil {
+		return nil, err
+	}
+	if s.handshake != nil {
+		var owner PeerInfo
+		if s.owner != nil {
+			owner = *s.owner
+		}
+		if err := newSession(s.l, s.wr, owner).run(s.handshake); err != nil {
+			if _, ok := err.(*proto.RejectedError); ok {
+				return nil, err
+			}
+			return nil, &HandshakeError{Err: err}
+		}
+	}
+	frame, err := s.frames().ReadFrameOfType(proto.MessageFds)
+	if err != nil {
+		return nil, err
+	}
+	table, err := decodeFdTable(frame)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkOwnerPlatform(table.Platform); err != nil {
+		return nil, err
+	}
+	s.ownerGeneration = table.Generation
+	if s.owner != nil {
+		s.owner.Identity = table.Identity
+	}
+	s.handoffState = table.State
+	s.handoffStore = table.Store
+	s.ownerHeartbeats = table.Heartbeats
+	s.ownerHandback = table.Handback
+	if table.ReadyTimeout > 0 && s.now != nil {
+		remaining := table.ReadyRemaining
+		if remaining < 0 {
+			remaining = 0
+		}
+		s.ownerReadyTimeout = table.ReadyTimeout
+		s.ownerReadyBy = s.now().Add(remaining)
+		s.l.Debug("the owner will give up on us if we're not ready in time", "timeout", table.ReadyTimeout, "remaining", remaining)
+	}
+	return table.Fds, nil
+}
+
+// publicProtocolErr converts errors from the proto package into their
+// exported equivalents.
+func (s *upgradeSession) publicProtocolErr(err error) error {
+	if rejected, ok := err.(*proto.RejectedError); ok {
+		if rejected.Code == proto.RejectionLostElection {
+			// the owner is the process which beat us
+			winner, _ := s.coordinator.GetOwnerPID()
+			return &ElectionLostError{WinnerPid: winner}
+		}
+		if rejected.Code == proto.RejectionNotReady {
+			notReady := &OwnerNotReadyError{RetryAfter: rejected.RetryAfter}
+			if s.owner != nil {
+				notReady.Pid = s.owner.Pid
+			}
+			return notReady
+		}
+		if rejected.Code == proto.RejectionUnauthenticated {
+			return &HandoffAuthError{Reason: rejected.Reason}
+		}
+		if rejected.Code == proto.RejectionBusy {
+			busy := &OwnerBusyError{Reason: rejected.Reason}
+			if s.owner != nil {
+				busy.Pid = s.owner.Pid
+			}
+			return busy
+		}
+		if rejected.Code == proto.RejectionVersionTooOld {
+			tooOld := &PeerVersionError{Minimum: rejected.MinimumVersion}
+			if version, ok := identityVersion(s.identity); ok {
+				tooOld.Version = version.raw
+			}
+			return tooOld
+		}
+		if rejected.Code == proto.RejectionShutDown {
+			shutDown := &ChainShutdownError{}
+			if s.owner != nil {
+				shutDown.Pid = s.owner.Pid
+			}
+			return shutDown
+		}
+		if rejected.Code == proto.RejectionCircuitOpen {
+			open := &UpgradeCircuitOpenError{RetryAfter: rejected.RetryAfter}
+			if s.owner != nil {
+				open.Pid = s.owner.Pid
+			}
+			return open
+		}
+		if rejected.Code == proto.RejectionPlatformMismatch {
+			mismatch := &PlatformMismatchError{Local: s.platform}
+			if rejected.Platform != nil {
+				mismatch.Peer = platformFromProto(*rejected.Platform)
+			}
+			if s.owner != nil {
+				mismatch.Pid = s.owner.Pid
+			}
+			return mismatch
+		}
+		if rejected.Code == proto.RejectionPaused {
+			paused := &UpgradesPausedError{Reason: rejected.Reason}
+			if s.owner != nil {
+				paused.Pid = s.owner.Pid
+			}
+			return paused
+		}
+		return &UpgradeRejectedError{Reason: rejected.Reason}
+	}
+	return asLimitError(err)
+}
+
+// getFiles retrieves all files over the opened upgrade session. In the case of
+// a context error, the upgrade session will be closed and a context error will
+// be returned as a wrapped error. The context error may be checked for with
+// errors.Is in that case.
+func (s *upgradeSession) getFiles(ctx context.Context) (map[string]*fd, error) {
+	s.l.Info("getting fds")
+	if !s.hasOwner() {
+		s.l.Info("no connection present, no files from owner")
+		return nil, nil
+	}
+
+	sockFile, closeSockFile, err := fdPassingFile(s.wr)
 	if err != nil {
-		return nil, orContextErr(errors.Wrap(err, "can't read fd metadata from owner process"))
+		return nil, fmt.Errorf("could not convert sibling connection to file: %w", err)
 	}
-	s.ownerVersion = version
+	defer closeSockFile()
+
+	defer s.closeOnCancel(ctx)()
 
-	s.l.Debug("expecting files", "fds", fds)
-	// Now grab all the FDs from the owner from the socket
+	fds, err := s.readFdTable()
+	if err != nil {
+		switch err.(type) {
+		case *HandshakeError, *LimitError, *HandoffAuthError, *PlatformMismatchError:
+			return nil, err
+		}
+		if errors.Is(err, ErrInvalidFdTable) {
+			return nil, err
+		}
+		if publicErr := s.publicProtocolErr(err); publicErr != err {
+			return nil, publicErr
+		}
+		return nil, orContextErr(ctx, fmt.Errorf("can't read fd metadata from owner process: %w", err))
+	}
+	if err := validateFdTable(fds); err != nil {
+		return nil, err
+	}
+
+	s.l.Debug("expecting files", "fds", redactFds(s.redact, fds))
+	if err := receiveFds(sockFile, fds, s.verifyFds, s.progress); err != nil {
+		// we've closed any we got, so the owner can forget about us
+		s.releaseFds()
+		return nil, orContextErr(ctx, err)
+	}
 	files := make(map[string]*fd, len(fds))
-	sockFileNames := make([]string, 0, len(fds))
-	for i := range fds {
-		fd := fds[i]
-		// parts[2] is the 'addr', which is the best we've got for a filename.
-		// TODO(euank): should we just use 'key.String()' like is used in newFile?
-		// I want to check this by seeing what the 'filename' is on each end and if
-		// it changes from the owner ith how I have this.
-		sockFileNames = append(sockFileNames, fd.String())
-	}
-	sockFiles := make([]*os.File, 0, len(sockFileNames))
-	for i := 0; i < len(sockFileNames); i++ {
-		file, err := utils.RecvFd(sockFile)
+	for _, fd := range fds {
+		files[fd.ID] = fd
+	}
+	s.l.Info("got fds from old owner", "files", redactFds(s.redact, fds), "ownerIdentity", s.ownerIdentity())
+	return files, nil
+}
+
+// receiveFds reads the file descriptors described by a validated fd table
+// from the owner, and associates them with their table entries. Each is
+// checked against its identity as set by verify; with quarantine, those which
+// don't match are marked as quarantined rather than failing. progress, if
+// set, is called as they're received. On error, any received files are
+// closed.
+func receiveFds(sockFile *os.File, fds []*fd, verify fdVerification, progress func(sent, total int)) error {
+	sockFiles := make([]*os.File, 0, len(fds))
+	closeAll := func() {
+		// don't leak the files we did get
+		for _, f := range sockFiles {
+			f.Close()
+		}
+	}
+	reportProgress(progress, 0, len(fds))
+	for range fds {
+		file, err := recvFd(sockFile)
 		if err != nil {
-			return nil, orContextErr(errors.Wrap(err, "error getting file descriptors"))
+			closeAll()
+			return fmt.Errorf("error getting file descriptors: %w", err)
 		}
 		sockFiles = append(sockFiles, file)
+		reportProgress(progress, len(sockFiles), len(fds))
+	}
+	for i, fd := range fds {
+		fd.associateFile(sockFiles[i])
 	}
-	if len(sockFiles) != len(fds) {
-		panic(errors.Errorf("got %v sockfiles, but expected %v: %+v; %+v", len(sockFiles), len(fds), sockFiles, fds))
+	switch verify {
+	case fdVerificationReject:
+		if err := verifyFds(fds); err != nil {
+			closeAll()
+			return err
+		}
+	case fdVerificationQuarantine:
+		mismatches := checkFds(fds)
+		for _, fd := range fds {
+			fd.quarantine = mismatches[fd.ID]
+		}
 	}
-	for i := range fds {
-		fd := fds[i]
-		fd.associateFile(fd.String(), sockFiles[i])
+	return nil
+}
 
-		files[fd.ID] = fd
+// releaseFds tells the owner that we've given up on the upgrade and closed
+// all the fds it sent us. This is best-effort, and not possible with legacy
+// owners.
+func (s *upgradeSession) releaseFds() {
+	if s.legacy || s.wr == nil {
+		return
+	}
+	if err := s.frames().WriteFrame(proto.MessageFdsReleased, nil); err != nil {
+		s.l.Warn("could not tell the owner we released its fds", "err", err)
 	}
-	s.l.Info("got fds from old owner", "files", files)
-	return files, nil
 }
 
-func (s *upgradeSession) readyHandshake() error {
+// readyHandshake tells the owner we're ready to take over, and waits for it
+// to step down. For v2 owners, the connection is then left open and returned
+// so that we can be told when the previous owner finishes draining. The
+// session no longer has an owner after this returns.
+func (s *upgradeSession) readyHandshake() (*net.UnixConn, error) {
+	defer func() { s.wr = nil }()
+	if !s.legacy {
+		s.l.Info("performing v2 ready handshake")
+		if err := s.frames().WriteFrame(proto.MessageReady, nil); err != nil {
+			s.wr.Close()
+			return nil, fmt.Errorf("can't notify owner process: %w", err)
+		}
+		if _, err := s.frames().ReadFrameOfType(proto.MessageSteppingDown); err != nil {
+			s.wr.Close()
+			return nil, s.publicProtocolErr(err)
+		}
+		return s.wr, nil
+	}
 	defer s.wr.Close()
+	return nil, s.legacyReadyHandshake()
+}
+
+func (s *upgradeSession) legacyReadyHandshake() error {
 	if s.ownerVersion == 0 {
 		s.l.Info("performing v0 ready handshake")
 		if _, err := s.wr.Write([]byte{proto.V0NotifyReady}); err != nil {
-			return errors.Wrap(err, "can't notify owner process")
+			return fmt.Errorf("can't notify owner process: %w", err)
 		}
 		s.l.Info("notified the owner process we're ready")
 		return nil
@@ -165,12 +574,12 @@ func (s *upgradeSession) readyHandshake() error {
 	// Write a byte that indicates to it we're v1+, and then write proper version
 	// information.
 	if _, err := s.wr.Write([]byte{proto.V1StartReadyHandshake}); err != nil {
-		return errors.Wrap(err, "can't notify owner process")
+		return fmt.Errorf("can't notify owner process: %w", err)
 	}
 	// now write our explicit version information so it knows to perform a v1
 	// handshake
 	if err := proto.WriteJSONBlob(s.wr, proto.VersionInformation{
-		Version: proto.Version,
+		Version: proto.LegacyVersion,
 	}); err != nil {
 		return err
 	}
@@ -198,6 +607,9 @@ func (s *upgradeSession) Close() error {
 		if s.wr != nil {
 			s.wr.Close()
 		}
+		if s.candidate != nil {
+			s.coordinator.withdrawCandidate(s.candidate.Pid)
+		}
 		err = s.coordinator.Unlock()
 	})
 	return err
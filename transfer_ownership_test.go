@@ -2,18 +2,17 @@ package tableroll
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
 
-	"github.com/inconshreveable/log15"
-	"github.com/pkg/errors"
-	"k8s.io/utils/clock"
+	"github.com/ngrok/tableroll/internal/clock"
 )
 
 func TestGetFilesCtxCancel(t *testing.T) {
 	ctx := context.Background()
-	l := log15.New()
+	l := newTestLogger()
 	tmpdir, err := ioutil.TempDir("", "tableroll_getfiles")
 	if err != nil {
 		panic(err)
@@ -27,7 +26,7 @@ func TestGetFilesCtxCancel(t *testing.T) {
 
 	newParent := newCoordinator(clock.RealClock{}, mockOS{pid: 2}, l, tmpdir)
 
-	sess, err := connectToCurrentOwner(ctx, l, newParent)
+	sess, err := connectToCurrentOwner(ctx, l, newParent, nil, false)
 	if err != nil {
 		t.Fatalf("could not connect to parent: %v", err)
 	}
@@ -46,7 +45,7 @@ func TestGetFilesCtxCancel(t *testing.T) {
 	}
 	cancel()
 	err = <-getFilesErr
-	if errors.Cause(err) != context.Canceled {
+	if !errors.Is(err, context.Canceled) {
 		t.Fatalf("expected cancelled error, got: %v", err)
 	}
 }
@@ -0,0 +1,23 @@
+package tableroll
+
+// WithTransferProgress configures a function which is called as fds are
+// passed during an upgrade, on both sides: the owner reports fds sent, and
+// the new process fds received. It's called with 0 once the number of fds is
+// known, and then after each fd, so a transfer which is slow but progressing
+// can be told apart from one which is stuck. Exclusive fds, passed once the
+// owner has drained, are reported separately, with their own total.
+//
+// The function is called synchronously between fds, so it should return
+// quickly.
+func WithTransferProgress(progress func(sent, total int)) Option {
+	return func(u *Upgrader) {
+		u.transferProgress = progress
+	}
+}
+
+// reportProgress calls progress, if it's set.
+func reportProgress(progress func(sent, total int), sent, total int) {
+	if progress != nil {
+		progress(sent, total)
+	}
+}
@@ -0,0 +1,68 @@
+package tableroll
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+type progressRecorder struct {
+	mu      sync.Mutex
+	updates []string
+}
+
+func (p *progressRecorder) record(sent, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.updates = append(p.updates, fmt.Sprintf("%d/%d", sent, total))
+}
+
+func (p *progressRecorder) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return fmt.Sprint(p.updates)
+}
+
+func TestTransferProgress(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var sent, received progressRecorder
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithTransferProgress(sent.record))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	for i := 0; i < 3; i++ {
+		ln, err := upg1.Fds.Listen(ctx, fmt.Sprintf("ln%d", i), nil, "tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		defer ln.Close()
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithTransferProgress(received.record))
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	expected := "[0/3 1/3 2/3 3/3]"
+	if sent.String() != expected {
+		t.Errorf("expected the owner to report %v, got %v", expected, sent.String())
+	}
+	if received.String() != expected {
+		t.Errorf("expected the new process to report %v, got %v", expected, received.String())
+	}
+}
@@ -0,0 +1,83 @@
+package tableroll
+
+// Besides the opaque state for the whole handoff, see WithHandoffState, each
+// fd can carry its own: e.g. how many bytes have been written to a log, or
+// the last sequence number sent on a connection, so that it moves with the fd
+// even if the next owner renames or vetoes others.
+
+// OnTransfer registers fn to be called when the fd with the given id is passed
+// to the next owner. What it returns is sent along with the fd, and the next
+// owner may read it with TransferState. fn is called while fd mutations are
+// locked for the upgrade, so it mustn't wait on them, and is called again for
+// each attempt if an upgrade fails. For exclusive fds, it's called once this
+// process has drained.
+//
+// fn may be registered before the fd is created. Registering another replaces
+// it, a nil fn unregisters it, and removing the fd unregisters it too.
+func (f *Fds) OnTransfer(id string, fn func() []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fn == nil {
+		delete(f.onTransfer, id)
+		return
+	}
+	if f.onTransfer == nil {
+		f.onTransfer = make(map[string]func() []byte)
+	}
+	f.onTransfer[id] = fn
+}
+
+// TransferState returns the state the previous owner's OnTransfer callback
+// sent along with the fd with the given id, or nil if the fd wasn't inherited
+// or had no callback.
+func (f *Fds) TransferState(id string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fi, ok := f.fds[id]
+	if !ok || !fi.inherited {
+		return nil
+	}
+	return fi.TransferState
+}
+
+// withTransferStates returns fds with each one's state from its OnTransfer
+// callback. Fds whose state changes are copied, since the originals are
+// shared with the store; in particular, state we inherited isn't passed on
+// unless a callback provides it again.
+func (f *Fds) withTransferStates(fds []*fd) []*fd {
+	f.mu.Lock()
+	callbacks := make(map[string]func() []byte, len(f.onTransfer))
+	for id, fn := range f.onTransfer {
+		callbacks[id] = fn
+	}
+	f.mu.Unlock()
+
+	out := make([]*fd, len(fds))
+	for i, fi := range fds {
+		var state []byte
+		if fn, ok := callbacks[fi.ID]; ok {
+			state = fn()
+		}
+		if state == nil && fi.TransferState == nil {
+			out[i] = fi
+			continue
+		}
+		withState := *fi
+		withState.TransferState = state
+		out[i] = &withState
+	}
+	return out
+}
+
+// withTransferStateMap is withTransferStates for fds keyed by id.
+func (f *Fds) withTransferStateMap(fds map[string]*fd) map[string]*fd {
+	list := make([]*fd, 0, len(fds))
+	for _, fi := range fds {
+		list = append(list, fi)
+	}
+	out := make(map[string]*fd, len(fds))
+	for _, fi := range f.withTransferStates(list) {
+		out[fi.ID] = fi
+	}
+	return out
+}
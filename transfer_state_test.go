@@ -0,0 +1,77 @@
+package tableroll
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestTransferState(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	upg1.Fds.OnTransfer("log", func() []byte { return []byte("written=42") })
+	if _, err := upg1.Fds.OpenFile("log", filepath.Join(coordDir, "log"), os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := upg1.Fds.Listen(ctx, "web", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	wal, err := os.Create(filepath.Join(coordDir, "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if err := upg1.Fds.AddExclusive("wal", wal); err != nil {
+		t.Fatal(err)
+	}
+	upg1.Fds.OnTransfer("wal", func() []byte { return []byte("seq=7") })
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if state := upg1.Fds.TransferState("log"); state != nil {
+		t.Fatalf("expected no state for an fd which wasn't inherited, got %q", state)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if state := string(upg2.Fds.TransferState("log")); state != "written=42" {
+		t.Fatalf("expected the log's state to be passed on, got %q", state)
+	}
+	if state := upg2.Fds.TransferState("web"); state != nil {
+		t.Fatalf("expected no state for an fd without a callback, got %q", state)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+	if state := string(upg2.Fds.TransferState("wal")); state != "seq=7" {
+		t.Fatalf("expected the exclusive fd's state to be passed on, got %q", state)
+	}
+
+	// state isn't passed on again without a callback
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg3.Stop()
+	if state := upg3.Fds.TransferState("log"); state != nil {
+		t.Fatalf("expected stale state not to be passed on, got %q", state)
+	}
+}
@@ -0,0 +1,155 @@
+package tableroll
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/proto"
+)
+
+// UpgradeCircuitOpenError is returned when the owner refused to pass on its
+// fds because upgrades from this process's executable have failed too many
+// times in a row; see WithUpgradeCircuitBreaker.
+type UpgradeCircuitOpenError struct {
+	Pid int
+	// RetryAfter is how long until the owner will accept an upgrade from the
+	// executable again.
+	RetryAfter time.Duration
+}
+
+func (e *UpgradeCircuitOpenError) Error() string {
+	return fmt.Sprintf("upgrades from this executable keep failing, process %d refuses them for %v", e.Pid, e.RetryAfter)
+}
+
+// WithUpgradeCircuitBreaker makes the owner refuse upgrades from an
+// executable once failures upgrades from it have failed in a row, e.g.
+// because a bad release keeps crashing before it's ready, so that it can't
+// keep disrupting the owner. Upgrades from it are refused for cooldown, which
+// doubles with each further failure up to maxCooldown; once it has passed,
+// one more attempt is let through. The processes refused fail with an
+// *UpgradeCircuitOpenError.
+//
+// Executables are told apart by a hash of their contents, so that a fixed
+// release installed at the same path isn't refused. Processes whose
+// executable can't be read aren't counted.
+func WithUpgradeCircuitBreaker(failures int, cooldown, maxCooldown time.Duration) Option {
+	return func(u *Upgrader) {
+		u.breaker = &upgradeBreaker{
+			failures:    failures,
+			cooldown:    cooldown,
+			maxCooldown: maxCooldown,
+			exes:        make(map[string]*exeFailures),
+		}
+	}
+}
+
+// upgradeBreaker counts failed upgrades by executable.
+type upgradeBreaker struct {
+	failures    int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+
+	mu   sync.Mutex
+	exes map[string]*exeFailures
+}
+
+type exeFailures struct {
+	// consecutive is the number of upgrades which failed in a row.
+	consecutive int
+	// openUntil is when upgrades will be accepted again, if they're being
+	// refused.
+	openUntil time.Time
+}
+
+// cooldownAfter returns how long to refuse upgrades for after the given
+// number of consecutive failures, or 0 if they're still allowed.
+func (b *upgradeBreaker) cooldownAfter(consecutive int) time.Duration {
+	if consecutive < b.failures {
+		return 0
+	}
+	d := b.cooldown
+	for i := b.failures; i < consecutive && d < b.maxCooldown; i++ {
+		d *= 2
+	}
+	if d > b.maxCooldown {
+		d = b.maxCooldown
+	}
+	return d
+}
+
+// exeKey identifies the sibling's executable, or returns "" if it can't be.
+func (u *Upgrader) exeKey(nextOwner *sibling) string {
+	if nextOwner.exeKey != "" || nextOwner.peer.Pid == 0 {
+		return nextOwner.exeKey
+	}
+	hash, err := processExeHash(nextOwner.peer.Pid)
+	if err != nil {
+		u.l.Debug("could not hash the peer's executable", "peer", nextOwner.peer, "err", err)
+		return ""
+	}
+	nextOwner.exeKey = hash
+	return hash
+}
+
+// rejectIfCircuitOpen rejects the sibling if upgrades from its executable
+// are being refused.
+func (u *Upgrader) rejectIfCircuitOpen(nextOwner *sibling) bool {
+	if u.breaker == nil {
+		return false
+	}
+	key := u.exeKey(nextOwner)
+	if key == "" {
+		return false
+	}
+	u.breaker.mu.Lock()
+	var retryAfter time.Duration
+	if f, ok := u.breaker.exes[key]; ok {
+		retryAfter = f.openUntil.Sub(u.clock.Now())
+	}
+	u.breaker.mu.Unlock()
+	if retryAfter <= 0 {
+		return false
+	}
+	err := &UpgradeCircuitOpenError{Pid: u.os.Getpid(), RetryAfter: retryAfter}
+	u.l.Warn("refusing an upgrade from an executable which keeps failing", "peer", nextOwner.peer, "retryAfter", retryAfter)
+	peer := nextOwner.peer
+	u.emit(Event{Type: EventUpgradeCircuitRejected, Peer: &peer, Err: err})
+	nextOwner.sendRejection(proto.Rejection{
+		Reason:     err.Error(),
+		Code:       proto.RejectionCircuitOpen,
+		RetryAfter: retryAfter,
+	})
+	return true
+}
+
+// recordUpgradeFailure counts a failed upgrade against the sibling's
+// executable, and starts refusing upgrades from it if it's failed too often.
+func (u *Upgrader) recordUpgradeFailure(nextOwner *sibling, err error) {
+	if u.breaker == nil {
+		return
+	}
+	key := u.exeKey(nextOwner)
+	if key == "" {
+		return
+	}
+	u.breaker.mu.Lock()
+	f, ok := u.breaker.exes[key]
+	if !ok {
+		f = &exeFailures{}
+		u.breaker.exes[key] = f
+	}
+	f.consecutive++
+	cooldown := u.breaker.cooldownAfter(f.consecutive)
+	if cooldown > 0 {
+		f.openUntil = u.clock.Now().Add(cooldown)
+	}
+	consecutive := f.consecutive
+	u.breaker.mu.Unlock()
+	if cooldown == 0 {
+		return
+	}
+	u.l.Error("upgrades from an executable keep failing, refusing them for a while", "peer", nextOwner.peer, "failures", consecutive, "cooldown", cooldown)
+	peer := nextOwner.peer
+	u.emit(Event{Type: EventUpgradeCircuitOpened, Peer: &peer, Err: err})
+}
@@ -0,0 +1,93 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+)
+
+func TestUpgradeBreakerCooldown(t *testing.T) {
+	b := &upgradeBreaker{failures: 3, cooldown: time.Second, maxCooldown: 5 * time.Second}
+	for consecutive, want := range []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := b.cooldownAfter(consecutive); got != want {
+			t.Errorf("after %d failures: expected a cooldown of %v, got %v", consecutive, want, got)
+		}
+	}
+}
+
+func TestUpgradeCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	fake := fakeclock.NewFakeClock(time.Now())
+	var failing int32 = 1
+	events := make(chan EventType, 10)
+	upg1, err := newUpgrader(ctx, fake, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithUpgradeCircuitBreaker(2, time.Minute, time.Hour),
+		WithEventHandler(func(e Event) { events <- e.Type }),
+		WithHandoffHook(func(step HandoffStep) error {
+			if step == HandoffStepSendFds && atomic.LoadInt32(&failing) == 1 {
+				return errors.New("bad release")
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	awaitOwner := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for upg1.Status().State != string(upgraderStateOwner) {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for the owner to recover from a failed upgrade")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+		var rejected *UpgradeRejectedError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("expected the upgrade to be rejected, got %v", err)
+		}
+		awaitOwner()
+	}
+	if e := <-events; e != EventUpgradeCircuitOpened {
+		t.Fatalf("expected the circuit to open, got %v", e)
+	}
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	var open *UpgradeCircuitOpenError
+	if !errors.As(err, &open) {
+		t.Fatalf("expected an *UpgradeCircuitOpenError, got %v", err)
+	}
+	if open.RetryAfter <= 0 || open.RetryAfter > time.Minute {
+		t.Fatalf("expected to be told to retry within the cooldown, got %v", open.RetryAfter)
+	}
+	if e := <-events; e != EventUpgradeCircuitRejected {
+		t.Fatalf("expected a circuit rejection event, got %v", e)
+	}
+
+	// once the cooldown has passed, a fixed release gets through
+	atomic.StoreInt32(&failing, 0)
+	fake.Step(time.Minute)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected an upgrade after the cooldown to succeed: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
@@ -0,0 +1,49 @@
+package tableroll
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// UpgradePanicError is reported on Errs, with BackgroundOpPanic, when serving
+// an upgrade request panicked. The panic is contained: the connection to the
+// other process is closed, and this process remains the owner unless it had
+// already handed off.
+type UpgradePanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (e *UpgradePanicError) Error() string {
+	return fmt.Sprintf("panic while serving an upgrade request: %v", e.Value)
+}
+
+// recoverUpgradePanic restores the state an upgrade request left behind when
+// it panicked with r, so that a bug in the transfer path, or in a callback
+// it runs, doesn't leave us stuck transferring ownership with our fds locked.
+// nextOwner is nil if the panic happened before the request was read.
+func (u *Upgrader) recoverUpgradePanic(nextOwner *sibling, r interface{}) {
+	err := &UpgradePanicError{Value: r, Stack: debug.Stack()}
+	u.l.Error("recovered from a panic while serving an upgrade request", "panic", r, "stack", string(err.Stack))
+	u.reportErr(BackgroundOpPanic, err)
+	var peer *PeerInfo
+	if nextOwner != nil {
+		p := nextOwner.peer
+		peer = &p
+		u.recordStrayFds(nextOwner, err)
+	}
+	u.emit(Event{Type: EventUpgradePanicked, Peer: peer, Err: err})
+
+	u.stateLock.Lock()
+	transferring := u.state == upgraderStateTransferringOwnership &&
+		u.state.transitionTo(upgraderStateOwner) == nil
+	u.stateLock.Unlock()
+	if !transferring {
+		// either the transfer hadn't begun, or we've already stepped down
+		return
+	}
+	u.resumeAcceptsAfterHandoff()
+	u.Fds.unlockMutationsIf(ErrUpgradeInProgress)
+}
@@ -0,0 +1,70 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestUpgradePanicIsContained(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	panicking := true
+	events := make(chan EventType, 10)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithEventHandler(func(e Event) { events <- e.Type }),
+		WithHandoffHook(func(step HandoffStep) error {
+			if step == HandoffStepSendFds && panicking {
+				panic("bug in the transfer path")
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if _, err := upg1.Fds.Listen(ctx, "testListen", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l)); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	select {
+	case err := <-upg1.Errs():
+		bgErr, ok := err.(*BackgroundError)
+		if !ok || bgErr.Op != BackgroundOpPanic {
+			t.Fatalf("expected a panic error, got %v", err)
+		}
+		if panicErr, ok := bgErr.Err.(*UpgradePanicError); !ok || panicErr.Value != "bug in the transfer path" {
+			t.Fatalf("expected an *UpgradePanicError, got %v", bgErr.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a background error")
+	}
+	if e := <-events; e != EventUpgradePanicked {
+		t.Fatalf("expected an upgrade-panicked event, got %v", e)
+	}
+
+	// the owner is still the owner, and can mutate and pass on its fds
+	if _, err := upg1.Fds.Listen(ctx, "testListen2", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("expected mutations to be unlocked, got %v", err)
+	}
+	panicking = false
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error upgrading after a panic: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
@@ -2,15 +2,16 @@ package tableroll
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/inconshreveable/log15"
-	"github.com/pkg/errors"
-	"k8s.io/utils/clock"
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/proto"
 )
 
 // DefaultUpgradeTimeout is the duration in which the upgrader expects the
@@ -21,12 +22,130 @@ const DefaultUpgradeTimeout time.Duration = time.Minute
 
 // Upgrader handles zero downtime upgrades and passing files between processes.
 type Upgrader struct {
-	upgradeTimeout time.Duration
+	upgradeTimeout       time.Duration
+	requireExistingOwner bool
+	forceColdStart       bool
+	restartAfterShutdown bool
+	approveUpgrade       func(PeerInfo) error
+	onUpgradeTimeout     func(PeerInfo)
+	eventHandler         func(Event)
+	bestEffort           bool
+	lockTimeout          time.Duration
+	lockRetryInterval    time.Duration
+	socketName           string
+	socketMode           *os.FileMode
+	socketGid            int
+	stableLayoutDir      string
+	imageDigest          string
+	platformPolicy       PlatformPolicy
+	createCoordDir       bool
+	redact               func(string) string
+	verifyFds            fdVerification
+	strictLifecycle      bool
+	transferProgress     func(sent, total int)
+	identity             string
+	minPeerVersion       string
+	handoffSecretPath    string
+	handoffKey           []byte
+	connReceiver         func(id string, conn net.Conn, state []byte)
+	handoffHook          func(HandoffStep) error
+	// readyDeadline and readyDeadlineAction are set with WithReadyDeadline.
+	// stopReadyDeadline stops its watchdog, and readyDeadlineErr is set if
+	// it gave up the upgrade. readyCalled is set once Ready is called.
+	readyDeadline       time.Duration
+	readyDeadlineAction ReadyDeadlineAction
+	stopReadyDeadline   func()
+	readyDeadlineErr    error
+	readyCalled         bool
+	// approveShadow decides whether a process may shadow this one; see
+	// WithShadowApproval.
+	approveShadow func(peer PeerInfo, ids []string) error
+	// idAliases maps inherited fd ids to the ids they're renamed to; see
+	// WithIdAliases.
+	idAliases map[string]string
+	// coordinationDir and opts are what the Upgrader was created with, which
+	// Reacquire creates the next Upgrader with.
+	coordinationDir string
+	opts            []Option
+	// errsC holds background errors; see Errs.
+	errsC                chan error
+	maxTransferDuration  time.Duration
+	requireFdRelease     bool
+	handoffState         func() ([]byte, error)
+	coordinationFallback bool
+	handshake            func(*Session) error
+	handshakeHandler     func(*Session) error
+	manualCommit         bool
+	authorizeControl     func(PeerInfo) error
+	transferInterceptors []TransferInterceptor
+	// electionPriority is set if we take part in upgrade elections
+	electionPriority *int
+	// electionLosers are the pids of candidates which lost an upgrade election
+	// to us. They will be rejected if they try to upgrade from us.
+	electionLosers map[int]bool
+	// generation counts how many upgrades led to this process. It's 0 for a
+	// process which didn't inherit from an owner.
+	generation uint32
+	// tableflipID is set if we may import fds from a tableflip parent, and
+	// tableflipParent is set if we did.
+	tableflipID     func(TableflipFd) string
+	tableflipParent *tableflipParent
+	// connTracker tracks connections for DrainThen.
+	connTracker      *connTracker
+	connTrackerOnce  sync.Once
+	drainGracePeriod time.Duration
+	drainIdleTimeout time.Duration
+	// closeGracePeriod is set with WithCloseGracePeriod.
+	closeGracePeriod time.Duration
+	// breaker is set with WithUpgradeCircuitBreaker.
+	breaker *upgradeBreaker
+	// leaseTTL and leaseHealthy are set with WithOwnershipLease.
+	leaseTTL     time.Duration
+	leaseHealthy func() error
+	// acceptPauseDuringHandoff is set with WithAcceptPauseDuringHandoff.
+	acceptPauseDuringHandoff bool
+	// maxAcceptFailures is set with WithMaxAcceptFailures, and degradedSocks
+	// holds the upgrade sockets which are degraded; see Health.
+	maxAcceptFailures int
+	degradedSocks     map[acceptUnixer]*UpgradeSocketError
+	// leakReport is set with WithLeakDetection.
+	leakReport func(LeakReport)
+	// inherited is set if this process took ownership from a previous owner,
+	// rather than cold-starting.
+	inherited bool
+	// inheritedState is the state passed by the previous owner with
+	// WithHandoffState.
+	inheritedState []byte
+	// ownerReadyTimeout and ownerReadyBy are the previous owner's upgrade
+	// timeout and when it runs out; see ReadyDeadline.
+	ownerReadyTimeout time.Duration
+	ownerReadyBy      time.Time
+	// store is shared across the upgrade chain
+	store *Store
+	// onceMu serializes OnceInChain calls.
+	onceMu sync.Mutex
+	// strayFds tracks processes which failed to upgrade from us, but may
+	// still hold copies of our fds.
+	strayFds []StrayFds
+	// coordinationErr is set if bestEffort is set and the coordination dir
+	// was unusable. Upgrades are disabled if it is set.
+	coordinationErr error
 
 	coord       *coordinator
 	session     *upgradeSession
 	upgradeSock *net.UnixListener
-	stopOnce    sync.Once
+	// legacyUpgradeSock serves upgrades to processes which only speak v1 or
+	// earlier of the protocol.
+	legacyUpgradeSock *net.UnixListener
+	// fallbackSock serves upgrades on an abstract socket while we're the
+	// owner, if WithCoordinationFallback was used.
+	fallbackSock *net.UnixListener
+	// constructingLifecycleErr locks Fds until New returns, with
+	// WithStrictLifecycle.
+	constructingLifecycleErr *LifecycleError
+	// acceptMux is shared by Shards to serve their upgrade sockets.
+	acceptMux *acceptMux
+	stopOnce  sync.Once
 
 	stateLock sync.Mutex
 	state     upgraderState
@@ -34,14 +153,62 @@ type Upgrader struct {
 	// upgradeCompleteC is closed when this upgrader has serviced an upgrade and
 	// is no longer the owner of its Fds.
 	// This also occurs when `Stop` is called.
-	upgradeCompleteC chan struct{}
+	upgradeCompleteC    chan struct{}
+	upgradeCompleteOnce sync.Once
 
-	l log15.Logger
+	// pendingCommit is set while an upgrade awaits Commit or Abort.
+	pendingCommit *pendingCommit
+	// paused is set by PauseUpgrades, giving pauseReason.
+	paused      bool
+	pauseReason string
+	// chainShutdown is set by ShutdownChain, and chainShutdownC is closed
+	// once it's called by this process or our successor.
+	chainShutdown     bool
+	chainShutdownC    chan struct{}
+	chainShutdownOnce sync.Once
+
+	// successor is the process we passed ownership to. Its connection is held
+	// open so we can tell it when we're done draining, and, if it supports
+	// it, afterwards so it can tell when we've exited; drainNotified is set
+	// once we've told it.
+	successor     *sibling
+	drainNotified bool
+	// successorExitedC is closed if our successor exits while we're running.
+	successorExitedC    chan struct{}
+	successorExitedOnce sync.Once
+	// predecessorDrainedC is closed once the process we took ownership from
+	// has finished draining.
+	predecessorDrainedC    chan struct{}
+	predecessorDrainedOnce sync.Once
+	// predecessorExitedC is closed once the process we took ownership from
+	// has exited.
+	predecessorExitedC    chan struct{}
+	predecessorExitedOnce sync.Once
+	// heartbeatInterval and heartbeatTimeout are set with WithHeartbeat.
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	// predecessorConn is our connection to the process we took ownership
+	// from, if it's still draining.
+	predecessorConn *net.UnixConn
+
+	tracer Tracer
+
+	// logLevel is set with WithLogLevel, and repeatedLogs limits how often
+	// messages which may repeat rapidly are logged.
+	logLevel     *LogLevel
+	repeatedLogs *logLimiter
+	// traceCtx holds upgradeSpan, which covers this process's upgrade until
+	// it's ready. drainSpan covers draining after we've stepped down.
+	traceCtx    context.Context
+	upgradeSpan Span
+	drainSpan   Span
+
+	l Logger
 
 	Fds *Fds
 
 	// mocks
-	os    osIface
+	os    OS
 	clock clock.Clock
 }
 
@@ -63,12 +230,152 @@ func WithUpgradeTimeout(t time.Duration) Option {
 
 // WithLogger configures the logger to use for tableroll operations.
 // By default, nothing will be logged.
-func WithLogger(l log15.Logger) Option {
+func WithLogger(l Logger) Option {
 	return func(u *Upgrader) {
 		u.l = l
 	}
 }
 
+// WithRequireExistingOwner causes New to return an error, rather than taking
+// ownership itself, if no current owner exists to inherit file descriptors
+// from. The returned error will be a *NoOwnerError describing why no owner was
+// found.
+// This is useful for processes which must never cold-start, for example
+// because they cannot construct some of their file descriptors themselves.
+func WithRequireExistingOwner() Option {
+	return func(u *Upgrader) {
+		u.requireExistingOwner = true
+	}
+}
+
+// WithForceColdStart causes New to never inherit file descriptors. If an
+// owner exists, it is instead told to step down and begin draining, exactly as
+// if it had completed an upgrade, and this process starts with an empty set of
+// Fds.
+// This is intended for emergencies where the chain of upgrades must be
+// broken, such as when the current owner's file descriptors are known to be
+// bad. The previous owner may briefly continue to hold its listeners while it
+// drains, so binding the same addresses may need to be retried.
+func WithForceColdStart() Option {
+	return func(u *Upgrader) {
+		u.forceColdStart = true
+	}
+}
+
+// WithUpgradeApproval configures a function which is called whenever another
+// process requests that this process pass its file descriptors to it, before
+// any are sent. If it returns an error, the request is rejected and the
+// error's message is passed along to the requesting process as the reason.
+// This may be used to reject upgrades based on who the peer is, the time of
+// day, current load, and so on.
+// The function should return quickly, since the requesting process is
+// blocked on it.
+func WithUpgradeApproval(approve func(peer PeerInfo) error) Option {
+	return func(u *Upgrader) {
+		u.approveUpgrade = approve
+	}
+}
+
+// WithUpgradeTimeoutHandler configures a function which is called with the
+// peer's information when a process this process was passing its fds to does
+// not become ready within the upgrade timeout. This process remains the owner
+// regardless, but the other process may still hold duplicates of its fds, and
+// so the function may be used to kill it, e.g. with
+// syscall.Kill(peer.Pid, syscall.SIGKILL).
+// The peer's pid may be 0 if it could not be determined.
+func WithUpgradeTimeoutHandler(handler func(peer PeerInfo)) Option {
+	return func(u *Upgrader) {
+		u.onUpgradeTimeout = handler
+	}
+}
+
+// WithBestEffortCoordination allows New to succeed even if the coordination
+// directory is unusable, for example because it is on a read-only or full
+// filesystem. In that case, the Upgrader acts as a standalone owner: it
+// neither inherits file descriptors nor passes them on, and
+// CoordinationError reports what went wrong.
+// Without this option, New returns a *CoordinationDirError in that case.
+func WithBestEffortCoordination() Option {
+	return func(u *Upgrader) {
+		u.bestEffort = true
+	}
+}
+
+// WithLockTimeout configures how long New waits to acquire the coordination
+// directory's lock, which is held by any other process in the middle of an
+// upgrade. If it can't be acquired in time, New returns a *LockTimeoutError
+// describing who holds it. By default, New waits until its context is
+// cancelled.
+func WithLockTimeout(t time.Duration) Option {
+	return func(u *Upgrader) {
+		u.lockTimeout = t
+	}
+}
+
+// WithLockRetryInterval configures how often New checks whether the
+// coordination directory's lock has been released while waiting for it. If 0
+// is specified, DefaultLockRetryInterval is used.
+func WithLockRetryInterval(t time.Duration) Option {
+	return func(u *Upgrader) {
+		u.lockRetryInterval = t
+		if u.lockRetryInterval <= 0 {
+			u.lockRetryInterval = DefaultLockRetryInterval
+		}
+	}
+}
+
+// WithSocketName configures the name of the upgrade socket each process
+// listens on, which is created in the coordination directory unless it's an
+// absolute path. "{pid}" in the name is replaced with the listening process's
+// pid, and must be present. All processes in an upgrade chain must use the
+// same name; a process using a different name can still upgrade using the
+// legacy socket, which always keeps its default name. The default is
+// DefaultSocketName.
+func WithSocketName(name string) Option {
+	return func(u *Upgrader) {
+		u.socketName = name
+	}
+}
+
+// WithSocketPermissions sets the file mode and owning group of the upgrade
+// sockets. Any user who can connect to an owner's upgrade socket can take
+// over its fds, so on hosts shared by multiple users this should be
+// restricted to e.g. a deploy group with WithSocketPermissions(0660, gid). A
+// gid of -1 leaves the group unchanged. The permissions are applied just after
+// the socket is created, so the coordination directory itself should not be
+// accessible to other users. The abstract socket used by
+// WithCoordinationFallback has no permissions.
+func WithSocketPermissions(mode os.FileMode, gid int) Option {
+	return func(u *Upgrader) {
+		u.socketMode = &mode
+		u.socketGid = gid
+	}
+}
+
+// WithRedaction configures a function which is applied to fd ids, file names,
+// and addresses whenever they are rendered by Fds.String and Fds.Dump, and
+// wherever tableroll's own logs include them. This may be used to hide
+// sensitive values, such as paths containing customer names.
+func WithRedaction(redact func(string) string) Option {
+	return func(u *Upgrader) {
+		u.redact = redact
+	}
+}
+
+// WithFdVerification causes New to check that each file descriptor received
+// from the owner refers to the same file or socket the owner described,
+// comparing the device and inode, file type, socket type, and bound address,
+// and that sockets have no pending error. If any don't match, New returns an
+// *FdMismatchError, and the owner remains the owner. Owners running a version
+// of tableroll which doesn't describe its fds are not verified.
+func WithFdVerification() Option {
+	return func(u *Upgrader) {
+		if u.verifyFds == fdVerificationOff {
+			u.verifyFds = fdVerificationReject
+		}
+	}
+}
+
 // New constructs a tableroll upgrader.
 // The first argument is a directory. All processes in an upgrade chain must
 // use the same coordination directory. The provided directory must exist and
@@ -82,32 +389,138 @@ func New(ctx context.Context, coordinationDir string, opts ...Option) (*Upgrader
 	return newUpgrader(ctx, clock.RealClock{}, realOS{}, coordinationDir, opts...)
 }
 
-func newUpgrader(ctx context.Context, clock clock.Clock, os osIface, coordinationDir string, opts ...Option) (*Upgrader, error) {
-	noopLogger := log15.New()
-	noopLogger.SetHandler(log15.DiscardHandler())
+func newUpgrader(ctx context.Context, clock clock.Clock, os OS, coordinationDir string, opts ...Option) (_ *Upgrader, err error) {
 	u := &Upgrader{
-		upgradeTimeout:   DefaultUpgradeTimeout,
-		state:            upgraderStateCheckingOwner,
-		upgradeCompleteC: make(chan struct{}),
-		l:                noopLogger,
-		os:               os,
-		clock:            clock,
+		upgradeTimeout:      DefaultUpgradeTimeout,
+		lockRetryInterval:   DefaultLockRetryInterval,
+		state:               upgraderStateCheckingOwner,
+		upgradeCompleteC:    make(chan struct{}),
+		predecessorDrainedC: make(chan struct{}),
+		predecessorExitedC:  make(chan struct{}),
+		successorExitedC:    make(chan struct{}),
+		chainShutdownC:      make(chan struct{}),
+		errsC:               make(chan error, errsBufferSize),
+		l:                   discardLogger{},
+		tracer:              noopTracer{},
+		repeatedLogs:        &logLimiter{interval: DefaultRepeatedLogInterval, clock: clock},
+		os:                  os,
+		clock:               clock,
+		coordinationDir:     coordinationDir,
+		opts:                opts,
 	}
 	for _, opt := range opts {
 		opt(u)
 	}
-	u.coord = newCoordinator(clock, os, u.l, coordinationDir)
+	u.repeatedLogs.clock = u.clock
+	u.filterLogLevel()
+	if err := u.checkMinPeerVersion(); err != nil {
+		return nil, err
+	}
+	if err := u.checkPlatformPolicy(); err != nil {
+		return nil, err
+	}
+	if err := u.loadHandoffSecret(); err != nil {
+		return nil, err
+	}
+	if err := u.checkIdAliases(); err != nil {
+		return nil, err
+	}
+	if u.socketName != "" && !strings.Contains(u.socketName, "{pid}") {
+		return nil, fmt.Errorf("socket name %q does not contain {pid}", u.socketName)
+	}
+	u.coord = newCoordinator(u.clock, u.os, u.l, coordinationDir)
+	u.coord.lockTimeout = u.lockTimeout
+	u.coord.sockName = u.socketName
+	u.coord.sockMode = u.socketMode
+	u.coord.sockGid = u.socketGid
+	u.coord.restartAfterShutdown = u.restartAfterShutdown
+	u.coord.leases = u.leaseTTL > 0
+	if u.createCoordDir {
+		if err := u.coord.createDir(); err != nil {
+			return u.degradeOr(err)
+		}
+	}
+	if u.stableLayoutDir != "" {
+		if u.electionPriority != nil || u.socketName != "" {
+			return nil, errors.New("the stable layout can't be used with upgrade elections or a custom socket name")
+		}
+		if err := u.coord.useStableLayout(u.stableLayoutDir); err != nil {
+			return u.degradeOr(err)
+		}
+	}
+	u.coord.lockRetryInterval = u.lockRetryInterval
+	u.coord.tracer = u.tracer
+
+	ctx, span := u.tracer.Start(ctx, "tableroll.upgrade")
+	u.traceCtx, u.upgradeSpan = ctx, span
+	defer func() {
+		if err != nil {
+			endSpan(span, err)
+		}
+	}()
+
+	// in the stable layout, we only listen once we're ready
+	if !u.coord.stable {
+		listener, err := u.coord.Listen(ctx)
+		if err != nil {
+			return u.degradeOr(err)
+		}
+		legacyListener, err := u.coord.ListenLegacy(ctx)
+		if err != nil {
+			listener.Close()
+			return u.degradeOr(err)
+		}
+		u.upgradeSock = listener
+		u.legacyUpgradeSock = legacyListener
+		u.serve(u.upgradeSock, false)
+		u.serve(u.legacyUpgradeSock, true)
+	}
 
-	listener, err := u.coord.Listen(ctx)
+	inherited, err := u.becomeOwner(ctx)
 	if err != nil {
+		u.closeUpgradeSocks()
+		return u.degradeOr(err)
+	}
+	if !inherited && u.requireExistingOwner {
+		err = &NoOwnerError{Reason: u.session.noOwnerReason}
+		u.l.Error("no existing owner, but one is required", "reason", u.session.noOwnerReason)
+		u.session.Close()
+		u.closeUpgradeSocks()
 		return nil, err
 	}
-	u.upgradeSock = listener
-	go u.serveUpgrades()
 
-	_, err = u.becomeOwner(ctx)
+	u.constructed()
+	u.startReadyDeadline()
+	return u, nil
+}
+
+// degradeOr returns the given error, unless it indicates the coordination
+// directory is unusable and best-effort coordination is enabled, in which case
+// the upgrader continues as a standalone owner.
+func (u *Upgrader) degradeOr(err error) (*Upgrader, error) {
+	if _, ok := err.(*CoordinationDirError); !ok || !u.bestEffort {
+		return nil, err
+	}
+	u.l.Error("coordination dir is unusable, continuing as a standalone owner with upgrades disabled", "err", err)
+	u.coordinationErr = err
+	u.session = nil
+	u.closePredecessorDrained()
+	u.closePredecessorExited()
+	u.Fds = newFds(u.l, nil)
+	u.Fds.redact = u.redact
+	u.Fds.clock = u.clock
+	u.store = newStore(u.Fds, nil)
+	return u, nil
+}
 
-	return u, err
+// CoordinationError returns the error which caused this Upgrader to give up on
+// coordinating with other processes, if WithBestEffortCoordination was used.
+// If it returns a non-nil error, this process will not inherit or pass on
+// any file descriptors.
+func (u *Upgrader) CoordinationError() error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.coordinationErr
 }
 
 // BecomeOwner upgrades the calling process to the 'owner' of all file descriptors.
@@ -116,34 +529,117 @@ func newUpgrader(ctx context.Context, clock clock.Clock, os osIface, coordinatio
 // It returns 'false' if it has taken ownership by identifying that no other
 // owner existed.
 func (u *Upgrader) becomeOwner(ctx context.Context) (bool, error) {
-	sess, err := connectToCurrentOwner(ctx, u.l, u.coord)
+	var candidate *proto.Candidate
+	if u.electionPriority != nil {
+		candidate = &proto.Candidate{
+			Pid:       u.os.Getpid(),
+			Priority:  *u.electionPriority,
+			StartTime: u.clock.Now(),
+		}
+	}
+	connectCtx, span := u.tracer.Start(ctx, "tableroll.connect")
+	sess, err := connectToCurrentOwner(connectCtx, u.l, u.coord, candidate, u.coordinationFallback)
+	endSpan(span, err)
 	if err != nil {
 		return false, err
 	}
 	u.session = sess
+	sess.verifyFds = u.verifyFds
+	sess.progress = u.transferProgress
+	sess.handshake = u.handshake
+	sess.traceContext = u.tracer.Inject(ctx)
+	sess.identity = u.identity
+	sess.handoffKey = u.handoffKey
+	sess.acceptsConns = u.connReceiver != nil
+	sess.platform = u.platform()
+	sess.platformPolicy = u.platformPolicy
+	sess.now = u.clock.Now
+	sess.redact = u.redact
+	if u.forceColdStart && sess.hasOwner() {
+		if err := sess.takeover(ctx); err != nil {
+			sess.Close()
+			return false, err
+		}
+	}
+	if sess.hasOwner() {
+		if err := u.reachHandoffStep(HandoffStepReceiveFds); err != nil {
+			sess.Close()
+			return false, err
+		}
+	}
+	_, span = u.tracer.Start(ctx, "tableroll.receive_fds")
 	files, err := sess.getFiles(ctx)
+	span.SetAttribute("tableroll.fds", len(files))
+	endSpan(span, err)
 	if err != nil {
 		sess.Close()
 		return false, err
 	}
-	u.Fds = newFds(u.l, files)
-	return sess.hasOwner(), nil
+	if sess.hasOwner() {
+		u.generation = sess.ownerGeneration + 1
+		u.inherited = true
+		u.inheritedState = sess.handoffState
+		u.ownerReadyTimeout = sess.ownerReadyTimeout
+		u.ownerReadyBy = sess.ownerReadyBy
+	} else if u.tableflipID != nil && !u.forceColdStart {
+		parent, imported, err := importFromTableflip(u.l, u.redact, u.tableflipID)
+		if err != nil {
+			sess.Close()
+			return false, err
+		}
+		if parent != nil {
+			u.tableflipParent = parent
+			u.generation = 1
+			u.inherited = true
+			sess.noOwnerReason = NoOwnerReasonNone
+			files = imported
+		} else {
+			u.closePredecessorDrained()
+			u.closePredecessorExited()
+		}
+	} else {
+		u.closePredecessorDrained()
+		u.closePredecessorExited()
+	}
+	u.Fds = newFds(u.l, u.aliasFdMap(files))
+	received := make([]*fd, 0, len(files))
+	for _, fi := range files {
+		received = append(received, fi)
+	}
+	u.reportQuarantined(sess.owner, received)
+	u.Fds.generation = u.generation
+	u.Fds.redact = u.redact
+	u.Fds.clock = u.clock
+	u.Fds.transferConn = u.transferConn
+	u.lockFdsWhileConstructing()
+	u.store = newStore(u.Fds, sess.handoffStore)
+	return u.inherited, nil
 }
 
 var errClosed = errors.New("connection closed")
 
-func (u *Upgrader) serveUpgrades() {
-	for {
-		conn, err := u.upgradeSock.AcceptUnix()
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				u.l.Info("upgrade socket closed, no longer listening for upgrades")
-				return
-			}
-			u.l.Error("error awaiting upgrade", "err", err)
+// serve accepts upgrade connections on sock, in the shared accept loop if
+// this is one of several Shards.
+func (u *Upgrader) serve(sock *net.UnixListener, legacy bool) {
+	if u.acceptMux != nil {
+		err := u.acceptMux.add(u, sock, legacy)
+		if err == nil {
+			return
+		}
+		u.l.Debug("serving upgrades outside the shared accept loop", "err", err)
+	}
+	go u.serveUpgrades(sock, legacy)
+}
+
+func (u *Upgrader) closeUpgradeSocks() {
+	for _, sock := range []*net.UnixListener{u.upgradeSock, u.legacyUpgradeSock} {
+		if sock == nil {
 			continue
 		}
-		go u.handleUpgradeRequest(conn)
+		if u.acceptMux != nil {
+			u.acceptMux.remove(sock)
+		}
+		sock.Close()
 	}
 }
 
@@ -162,27 +658,206 @@ func (u *Upgrader) mustTransitionTo(state upgraderState) {
 }
 
 func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
+	keepConn := false
+	var nextOwner *sibling
 	defer func() {
-		if err := conn.Close(); err != nil {
-			u.l.Warn("error closing connection", "err", err)
+		if r := recover(); r != nil {
+			keepConn = false
+			u.recoverUpgradePanic(nextOwner, r)
+		}
+		if !keepConn {
+			u.closeUpgradeConn(conn)
 		}
-		u.l.Debug("closed upgrade socket connection")
 	}()
 
-	if err := u.transitionTo(upgraderStateTransferringOwnership); err != nil {
-		u.l.Info("cannot handle upgrade request", "reason", err)
+	nextOwner = newSibling(u.l, conn, false)
+	nextOwner.redact = u.redact
+	nextOwner.timeoutAfter(u.clock, u.upgradeTimeout)
+	defer nextOwner.stopTimeout()
+	hello, err := nextOwner.readHello()
+	if err != nil {
+		u.logRepeated(u.l.Warn, "could not read hello from peer", "err", err)
+		u.reportErr(BackgroundOpProtocol, err)
+		return
+	}
+
+	nextOwner.peer.Identity = hello.Identity
+
+	if isControlIntent(hello.Intent) {
+		u.handleControlRequest(nextOwner, hello)
+		return
+	}
+
+	if !u.authenticate(nextOwner, hello) {
+		return
+	}
+
+	ctx, span := u.tracer.Start(u.tracer.Extract(context.Background(), hello.TraceContext), "tableroll.handoff")
+	defer span.End()
+	span.SetAttribute("tableroll.intent", string(hello.Intent))
+	span.SetAttribute("tableroll.peer.pid", nextOwner.peer.Pid)
+
+	if hello.Candidate != nil && u.beatInElection(hello.Candidate.Pid) {
+		nextOwner.rejectWithCode(proto.RejectionLostElection, "lost the upgrade election to this process")
 		return
 	}
 
-	u.l.Info("handling an upgrade request from peer")
+	if u.awaitingReady() {
+		nextOwner.rejectNotReady(u.lockRetryInterval)
+		return
+	}
+
+	switch hello.Intent {
+	case proto.IntentUpgrade:
+		transferred := u.transferOwnership(ctx, nextOwner)
+		span.SetAttribute("tableroll.transferred", transferred)
+		if transferred {
+			// hold on to the connection so we can tell our successor when
+			// we're done draining.
+			nextOwner.clearTimeout()
+			keepConn = u.setSuccessor(nextOwner)
+		}
+	case proto.IntentTakeover:
+		u.handleTakeover(ctx, nextOwner)
+	case proto.IntentShadow:
+		u.handleShadowRequest(nextOwner, hello.Shadow)
+	default:
+		nextOwner.reject(fmt.Sprintf("unknown intent %q", hello.Intent))
+	}
+}
+
+func (u *Upgrader) handleLegacyUpgradeRequest(conn *net.UnixConn) {
+	var nextOwner *sibling
+	defer func() {
+		if r := recover(); r != nil {
+			u.recoverUpgradePanic(nextOwner, r)
+		}
+		u.closeUpgradeConn(conn)
+	}()
+
+	if u.handoffKey != nil {
+		u.l.Warn("refusing a legacy upgrade request, which can't be authenticated with the handoff secret")
+		return
+	}
+	nextOwner = newSibling(u.l, conn, true)
+	nextOwner.redact = u.redact
+	nextOwner.timeoutAfter(u.clock, u.upgradeTimeout)
+	defer nextOwner.stopTimeout()
+	// legacy siblings can't be told when we're done draining
+	u.transferOwnership(context.Background(), nextOwner)
+}
+
+// setSuccessor records our successor. It returns false if we've been
+// stopped, in which case its connection should be closed.
+func (u *Upgrader) setSuccessor(successor *sibling) bool {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.state != upgraderStateDraining {
+		return false
+	}
+	u.successor = successor
+	go u.watchSuccessor(successor)
+	return true
+}
+
+// awaitingReady returns true if we haven't yet become the owner, and so can't
+// pass on our fds.
+func (u *Upgrader) awaitingReady() bool {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.state == upgraderStateCheckingOwner
+}
+
+// beatInElection returns true if the given candidate lost an upgrade election
+// to us.
+func (u *Upgrader) beatInElection(pid int) bool {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.electionLosers[pid]
+}
+
+func (u *Upgrader) closeUpgradeConn(conn *net.UnixConn) {
+	if err := conn.Close(); err != nil {
+		u.l.Warn("error closing connection", "err", err)
+	}
+	u.l.Debug("closed upgrade socket connection")
+}
+
+// approve checks whether the sibling should be allowed to take ownership
+// from us, and if not, rejects it.
+func (u *Upgrader) approve(nextOwner *sibling) bool {
+	if u.rejectIfShutDown(nextOwner) || u.rejectIfPaused(nextOwner) || u.rejectIfTooOld(nextOwner) || u.rejectIfPlatformMismatch(nextOwner) || u.rejectIfCircuitOpen(nextOwner) {
+		return false
+	}
+	if u.approveUpgrade == nil {
+		return true
+	}
+	if err := u.approveUpgrade(nextOwner.peer); err != nil {
+		u.l.Info("upgrade was not approved", "peer", nextOwner.peer, "reason", err)
+		nextOwner.reject(err.Error())
+		return false
+	}
+	return true
+}
+
+// transferOwnership passes our fds to the sibling. It returns true if the
+// sibling is now the owner.
+func (u *Upgrader) transferOwnership(ctx context.Context, nextOwner *sibling) bool {
+	if !u.approve(nextOwner) {
+		return false
+	}
+	if err := u.checkStrayFds(); err != nil {
+		nextOwner.reject(err.Error())
+		return false
+	}
+	if !u.runHandshakeHandler(nextOwner) {
+		return false
+	}
+	if !u.beginTransfer(nextOwner) {
+		return false
+	}
+
+	u.l.Info("handling an upgrade request from peer", "peerIdentity", nextOwner.peer.Identity)
+	u.pauseAcceptsForHandoff()
 	u.Fds.lockMutations(ErrUpgradeInProgress)
+	defer nextOwner.closeSubstitutes()
 	// time to pass our FDs along
-	conn.SetDeadline(u.clock.Now().Add(u.upgradeTimeout))
-	nextOwner := newSibling(u.l, conn)
-
-	err := nextOwner.giveFDs(u.Fds.copy())
+	passed := u.Fds.copy()
+	store := u.store.snapshot()
+	state, err := u.snapshotHandoffState()
+	if err == nil {
+		passed, state, err = u.interceptTransfer(nextOwner, passed, state)
+	}
+	if err == nil {
+		passed = u.Fds.withTransferStateMap(passed)
+	}
+	if err == nil {
+		err = u.reachHandoffStep(HandoffStepSendFds)
+	}
+	if err != nil {
+		nextOwner.reject(err.Error())
+	} else {
+		nextOwner.progress = u.transferProgress
+		nextOwner.identity = u.identity
+		nextOwner.ownPlatform = u.platform().proto()
+		nextOwner.maxTransferDuration = u.maxTransferDuration
+		nextOwner.clock = u.clock
+		err = nextOwner.giveFDs(ctx, u.tracer, passed, u.generation, state, store)
+		if err == nil {
+			if err = u.awaitCommit(nextOwner); err != nil {
+				nextOwner.reject(err.Error())
+			}
+		}
+	}
 	if err != nil {
 		u.l.Error("failed to pass file descriptors to next owner", "reason", "error", "err", err)
+		u.reportErr(BackgroundOpHandoff, err)
+		if isTimeout(err) {
+			u.handleUpgradeTimeout(nextOwner, err)
+		}
+		u.recordStrayFds(nextOwner, err)
+		u.recordUpgradeFailure(nextOwner, err)
+		u.resumeAcceptsAfterHandoff()
 		// remain owner
 		if err := u.transitionTo(upgraderStateOwner); err != nil {
 			// could happen if 'Stop' was called after 'handleUpgradeRequest'
@@ -192,18 +867,94 @@ func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
 			// is desired.
 			// At this point, we can't really do anything but complain.
 			u.l.Error("unable to remain owner after upgrade failure", "err", err)
-			return
+			u.reportErr(BackgroundOpState, err)
+			return false
 		}
 		u.Fds.unlockMutations()
-		return
+		if nextOwner.released {
+			u.acceptHandback(nextOwner)
+		}
+		return false
 	}
 
 	u.l.Info("next owner is ready, marking ourselves as up for exit")
-	// ignore error, if we were 'Stopped' we can't transition, but we also
-	// don't care.
+	nextOwner.confirmReady()
+	u.stepDown(ctx, nextOwner)
+	return true
+}
+
+// runHandshakeHandler performs our side of a custom handshake, if the sibling
+// asked for one, and rejects the sibling if it fails.
+func (u *Upgrader) runHandshakeHandler(nextOwner *sibling) bool {
+	if !nextOwner.wantsHandshake {
+		return true
+	}
+	if u.handshakeHandler == nil {
+		nextOwner.reject("owner does not support custom handshakes")
+		return false
+	}
+	u.l.Info("performing a custom handshake with peer")
+	if err := newSession(u.l, nextOwner.conn, nextOwner.peer).run(u.handshakeHandler); err != nil {
+		u.l.Info("custom handshake failed", "peer", nextOwner.peer, "err", err)
+		nextOwner.reject(err.Error())
+		return false
+	}
+	return true
+}
+
+// handleUpgradeTimeout is called when a sibling hangs while we're passing it
+// fds.
+func (u *Upgrader) handleUpgradeTimeout(nextOwner *sibling, err error) {
+	u.l.Warn("the next owner did not become ready in time", "peer", nextOwner.peer, "timeout", u.upgradeTimeout)
+	peer := nextOwner.peer
+	u.emit(Event{Type: EventUpgradeTimedOut, Peer: &peer, Err: err})
+	if u.onUpgradeTimeout != nil {
+		u.onUpgradeTimeout(peer)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// handleTakeover steps down without passing any fds to the new process, which
+// has been told to start from scratch.
+func (u *Upgrader) handleTakeover(ctx context.Context, nextOwner *sibling) {
+	if !u.approve(nextOwner) {
+		return
+	}
+	if !u.beginTransfer(nextOwner) {
+		return
+	}
+	u.l.Warn("a new process has forced a cold start, stepping down without passing fds")
+	u.Fds.lockMutations(ErrUpgradeCompleted)
+	nextOwner.stepDown()
+	u.stepDown(ctx, nextOwner)
+}
+
+// stepDown marks this upgrader as no longer the owner, and notifies the
+// caller via the UpgradeComplete channel.
+func (u *Upgrader) stepDown(ctx context.Context, nextOwner *sibling) {
 	u.Fds.lockMutations(ErrUpgradeCompleted)
-	_ = u.transitionTo(upgraderStateDraining)
-	close(u.upgradeCompleteC)
+	u.closeFallbackSock()
+	// if we were 'Stopped' we can't transition, but 'Stop' will have already
+	// closed the upgrade complete channel.
+	if err := u.transitionTo(upgraderStateDraining); err != nil {
+		return
+	}
+	u.recordHistory(HistoryHandedOff, nextOwner.peer.Pid)
+	_, drainSpan := u.tracer.Start(ctx, "tableroll.drain")
+	u.stateLock.Lock()
+	u.drainSpan = drainSpan
+	u.stateLock.Unlock()
+	u.closeUpgradeComplete()
+}
+
+func (u *Upgrader) closeUpgradeComplete() {
+	u.upgradeCompleteOnce.Do(func() {
+		close(u.upgradeCompleteC)
+	})
 }
 
 // Ready signals that the current process is ready to accept connections.
@@ -211,12 +962,66 @@ func (u *Upgrader) handleUpgradeRequest(conn *net.UnixConn) {
 //
 // All fds which were inherited but not used are closed after the call to Ready.
 func (u *Upgrader) Ready() error {
+	if err := u.ready(); err != nil {
+		return err
+	}
+	// the leak report is made without the state lock, so it may call the
+	// Upgrader
+	u.checkLeaksAtReady()
+	return nil
+}
+
+func (u *Upgrader) ready() (err error) {
 	u.stateLock.Lock()
-	defer u.stateLock.Unlock()
+	if u.checkRepeatedReadyLocked() {
+		// deferred first so it runs last, once the state lock is released
+		defer u.emit(Event{Type: EventReadyRepeated})
+	}
+	if err := u.checkCanBecomeOwnerLocked(); err != nil {
+		u.stateLock.Unlock()
+		return err
+	}
+	if u.session == nil {
+		// the coordination dir was unusable, there's no one to coordinate with
+		defer u.stateLock.Unlock()
+		u.endUpgradeSpanLocked(nil)
+		return u.state.transitionTo(upgraderStateOwner)
+	}
+	hasOwner := u.session.hasOwner()
+	u.stateLock.Unlock()
+
+	// the tracer and handoff hook are called without the state lock, so they
+	// may call the Upgrader
+	_, span := u.tracer.Start(u.traceCtx, "tableroll.ready")
+	defer func() { endSpan(span, err) }()
+	var hookErr error
+	if hasOwner {
+		hookErr = u.reachHandoffStep(HandoffStepReady)
+	}
+	return u.finishReady(hookErr)
+}
 
+// checkCanBecomeOwnerLocked returns why Ready can't make this Upgrader the
+// owner, if it can't.
+func (u *Upgrader) checkCanBecomeOwnerLocked() error {
+	if err := u.checkReadyLocked(); err != nil {
+		return err
+	}
+	if u.readyDeadlineErr != nil {
+		return u.readyDeadlineErr
+	}
 	if err := u.state.canTransitionTo(upgraderStateOwner); err != nil {
-		return errors.Errorf("cannot become ready: %v", err)
+		return fmt.Errorf("cannot become ready: %v", err)
 	}
+	return nil
+}
+
+// finishReady finishes Ready once the handoff hook has been called, failing
+// with hookErr if it's set.
+func (u *Upgrader) finishReady(hookErr error) (err error) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	defer func() { u.endUpgradeSpanLocked(err) }()
 
 	defer func() {
 		// unlock the coordination dir even if we fail to become the owner, this
@@ -226,22 +1031,123 @@ func (u *Upgrader) Ready() error {
 			u.l.Error("error closing upgrade session", "err", err)
 		}
 	}()
+	if hookErr != nil {
+		return hookErr
+	}
+	// Stop, Handback or the ready deadline may have got in while the lock was
+	// released
+	if err := u.checkCanBecomeOwnerLocked(); err != nil {
+		return err
+	}
+	var predecessorPid int
 	if u.session.hasOwner() {
+		var err error
+		predecessorPid, err = u.coord.GetOwnerPID()
+		if err != nil {
+			u.l.Warn("could not determine the owner's pid", "err", err)
+		}
 		// We have to notify the owner we're ready if they exist.
-		if err := u.session.readyHandshake(); err != nil {
+		predecessorConn, err := u.session.readyHandshake()
+		if err != nil {
 			return err
 		}
+		if predecessorConn != nil {
+			u.predecessorConn = predecessorConn
+			go u.awaitPredecessorDrain(predecessorConn, predecessorPid, u.session.ownerHeartbeats)
+		} else {
+			go u.awaitPredecessorExit(predecessorPid)
+		}
+	} else if u.tableflipParent != nil {
+		predecessorPid = u.tableflipParent.pid
+		if err := u.tableflipParent.sendReady(); err != nil {
+			return err
+		}
+		go func() {
+			u.tableflipParent.awaitExit()
+			u.closePredecessorDrained()
+			u.closePredecessorExited()
+		}()
 	}
-	if err := u.session.BecomeOwner(); err != nil {
-		return err
+	if err := u.claimOwnership(); err != nil {
+		if _, ok := err.(*CoordinationDirError); !ok || !u.bestEffort {
+			return err
+		}
+		// Any previous owner has already stepped down, so we're the owner
+		// regardless, but no one will be able to find us.
+		u.l.Error("unable to record ourselves as owner, upgrades are disabled", "err", err)
+		u.coordinationErr = err
+		u.closeUpgradeSocks()
 	}
 	// if we notified the owner without error, or one didn't exist, we're the owner now
 	if err := u.state.transitionTo(upgraderStateOwner); err != nil {
 		return err
 	}
+	u.electionLosers = u.session.beaten
+	if u.coordinationErr == nil {
+		u.recordHistory(HistoryBecameOwner, predecessorPid)
+	}
+	u.Fds.steerReusePortGroups()
+	if u.coordinationFallback && u.coordinationErr == nil {
+		go u.listenFallback()
+	}
+	if u.leaseTTL > 0 && u.coordinationErr == nil {
+		u.takeLease()
+	}
+	u.l.Info("ready, now the owner", "generation", u.generation, "fds", u.Fds.String())
+	u.l.Debug("fd table at ready", "table", u.Fds.Dump())
 	return nil
 }
 
+// claimOwnership records us as the owner in the coordination directory, and
+// in the stable layout binds the upgrade socket now that any previous owner
+// has stepped down.
+func (u *Upgrader) claimOwnership() error {
+	if u.coord.stable {
+		listener, err := u.coord.ListenStable(u.traceCtx)
+		if err != nil {
+			return err
+		}
+		u.upgradeSock = listener
+		u.serve(u.upgradeSock, false)
+	}
+	return u.session.BecomeOwner()
+}
+
+// NoOwnerReason returns why no previous owner was found when this Upgrader
+// was created. If fds were inherited from a previous owner, it returns
+// NoOwnerReasonNone.
+func (u *Upgrader) NoOwnerReason() NoOwnerReason {
+	if u.session == nil {
+		return NoOwnerReasonNone
+	}
+	return u.session.noOwnerReason
+}
+
+// PreviousOwner returns information about the process this Upgrader
+// connected to as the previous owner. It returns false if there was no
+// previous owner, or if it couldn't be identified.
+func (u *Upgrader) PreviousOwner() (PeerInfo, bool) {
+	if u.session == nil || u.session.owner == nil {
+		return PeerInfo{}, false
+	}
+	return *u.session.owner, true
+}
+
+// Generation returns how many upgrades led to this process: 0 if it didn't
+// inherit from a previous owner, or one more than the previous owner's
+// generation if it did. Owners running a version of tableroll which predates
+// generations are treated as generation 0.
+func (u *Upgrader) Generation() uint32 {
+	return u.generation
+}
+
+// Inherited returns whether this process inherited its fds from a previous
+// owner, rather than cold-starting. A process which forced a cold start, or
+// which degraded to a standalone owner, did not inherit.
+func (u *Upgrader) Inherited() bool {
+	return u.inherited
+}
+
 // UpgradeComplete returns a channel which is closed when the managed file
 // descriptors have been passed to the next process, and the next process has
 // indicated it is ready.
@@ -249,22 +1155,234 @@ func (u *Upgrader) UpgradeComplete() <-chan struct{} {
 	return u.upgradeCompleteC
 }
 
+// NotifyDrainComplete tells the process which took over from this one that
+// this process has finished draining, which is observable via its
+// PredecessorDrained method, and passes it any exclusive fds. It should be
+// called after UpgradeComplete is closed, once all connections have been
+// drained and exclusive fds are no longer in use. If the next process uses an
+// older version of tableroll, this only closes this process's copies of
+// exclusive fds.
+func (u *Upgrader) NotifyDrainComplete() error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.state != upgraderStateDraining {
+		return fmt.Errorf("cannot notify drain complete in state %v", u.state)
+	}
+	u.endDrainSpanLocked()
+	successorPid := 0
+	if u.successor != nil {
+		successorPid = u.successor.peer.Pid
+	}
+	u.recordHistory(HistoryDrainComplete, successorPid)
+	exclusive := u.Fds.takeExclusive()
+	defer func() {
+		for _, fi := range exclusive {
+			fi.file.Close()
+		}
+	}()
+	successor := u.successor
+	if successor == nil || u.drainNotified {
+		return nil
+	}
+	if successor.heartbeats {
+		// it keeps the connection open to tell when we've exited
+		u.drainNotified = true
+	} else {
+		u.successor = nil
+		defer successor.conn.Close()
+	}
+	exclusive = successor.withoutVetoed(exclusive)
+	if len(exclusive) > 0 {
+		if err := successor.giveExclusiveFDs(u.Fds.withTransferStates(exclusive), u.generation); err != nil {
+			return fmt.Errorf("could not pass exclusive fds to the next owner: %w", err)
+		}
+	}
+	if err := successor.frames.WriteFrame(proto.MessageDrainComplete, nil); err != nil {
+		return fmt.Errorf("could not notify the next owner: %w", err)
+	}
+	u.l.Info("notified the next owner that we're done draining")
+	return nil
+}
+
+// PredecessorDrained returns a channel which is closed once the process this
+// Upgrader took ownership from has finished draining. That is the case once it
+// calls NotifyDrainComplete or Stop, or exits. If there was no previous owner,
+// the channel is closed immediately.
+// This may be used to wait to use resources which only one process may use
+// at a time.
+func (u *Upgrader) PredecessorDrained() <-chan struct{} {
+	return u.predecessorDrainedC
+}
+
+func (u *Upgrader) closePredecessorDrained() {
+	u.predecessorDrainedOnce.Do(func() {
+		close(u.predecessorDrainedC)
+	})
+}
+
+// awaitPredecessorDrain waits for our predecessor, whose pid is pid, to tell
+// us it has drained, or to close the connection. If it supports heartbeats,
+// the connection stays open until it exits; otherwise, its exit is found by
+// polling its pid once it closes the connection.
+func (u *Upgrader) awaitPredecessorDrain(conn *net.UnixConn, pid int, heartbeats bool) {
+	defer conn.Close()
+	defer u.closePredecessorDrained()
+	var hb *heartbeat
+	if heartbeats {
+		hb = u.startHeartbeat(pid, func(typ proto.MessageType) error {
+			return u.writePredecessor(conn, typ)
+		}, func(err error) {
+			u.l.Error("the previous owner stopped answering heartbeats, presuming it's hung", "err", err)
+			conn.Close()
+		})
+	}
+	defer hb.stop()
+	frames := proto.NewStream(conn, proto.RoleOwner)
+	for {
+		frame, err := frames.ReadFrame()
+		if err != nil {
+			if heartbeats {
+				u.l.Info("connection to the previous owner closed, it has exited", "err", err)
+				u.closePredecessorDrained()
+				u.closePredecessorExited()
+				return
+			}
+			u.l.Info("connection to the previous owner closed, assuming it has finished draining", "err", err)
+			u.closePredecessorDrained()
+			u.awaitPredecessorExit(pid)
+			return
+		}
+		switch frame.Type {
+		case proto.MessageDrainComplete:
+			u.l.Info("the previous owner has finished draining")
+			u.closePredecessorDrained()
+			continue
+		case proto.MessageHeartbeat:
+			if err := u.writePredecessor(conn, proto.MessageHeartbeatAck); err != nil {
+				u.l.Debug("could not answer the previous owner's heartbeat", "err", err)
+			}
+			continue
+		case proto.MessageHeartbeatAck:
+			hb.ack()
+			continue
+		case proto.MessageExclusiveFds:
+			if err := u.receiveExclusiveFds(conn, frame); err != nil {
+				u.l.Error("could not receive exclusive fds from the previous owner", "err", err)
+				u.reportErr(BackgroundOpPredecessor, err)
+				go u.awaitPredecessorExit(pid)
+				return
+			}
+			continue
+		case proto.MessageConn:
+			if err := u.receiveConn(conn, frame); err != nil {
+				u.l.Error("could not receive a connection from the previous owner", "err", err)
+				u.reportErr(BackgroundOpPredecessor, err)
+				go u.awaitPredecessorExit(pid)
+				return
+			}
+			continue
+		}
+		u.l.Debug("ignoring unexpected message from the previous owner", "type", frame.Type)
+	}
+}
+
+func (u *Upgrader) receiveExclusiveFds(conn *net.UnixConn, frame *proto.Frame) error {
+	table, err := decodeFdTable(frame)
+	if err != nil {
+		return err
+	}
+	sockFile, closeSockFile, err := fdPassingFile(conn)
+	if err != nil {
+		return fmt.Errorf("could not convert connection to file: %w", err)
+	}
+	defer closeSockFile()
+	if err := receiveFds(sockFile, table.Fds, u.verifyFds, u.transferProgress); err != nil {
+		return err
+	}
+	u.l.Info("got exclusive fds from the previous owner", "files", redactFds(u.redact, table.Fds))
+	u.aliasFds(table.Fds, func(id string) bool {
+		for _, fi := range table.Fds {
+			if fi.ID == id {
+				return true
+			}
+		}
+		return u.Fds.WasInherited(id)
+	})
+	u.Fds.addExclusive(table.Fds)
+	u.reportQuarantined(nil, table.Fds)
+	return nil
+}
+
+// awaitPredecessorExit polls for a legacy predecessor, which can't tell us
+// when it's done draining, to exit.
+func (u *Upgrader) awaitPredecessorExit(pid int) {
+	for pid == 0 || !pidIsDead(u.os, pid) {
+		select {
+		case <-u.upgradeCompleteC:
+			// we're no longer the owner, so no one's waiting on this
+			return
+		case <-u.clock.After(time.Second):
+		}
+	}
+	u.l.Info("the previous owner has exited")
+	u.closePredecessorDrained()
+	u.closePredecessorExited()
+}
+
 // Stop prevents any more upgrades from happening, and closes
 // the upgrade complete channel.
 func (u *Upgrader) Stop() {
+	u.checkStop()
+	u.stop()
+}
+
+func (u *Upgrader) stop() {
+	if u.stopReadyDeadline != nil {
+		u.stopReadyDeadline()
+	}
 	u.mustTransitionTo(upgraderStateStopped)
 	if u.session != nil {
+		if u.session.hasOwner() && u.closeGracePeriod > 0 {
+			u.closeInheritedAfterGrace()
+		} else if u.session.hasOwner() {
+			// we never became the owner, so let the owner know we're not
+			// holding on to its fds
+			u.Fds.closeInherited()
+			u.session.releaseFds()
+		}
 		u.session.Close()
 	}
 	u.stopOnce.Do(func() {
 		u.Fds.lockMutations(ErrUpgraderStopped)
 		// Interrupt any running Upgrade(), and
 		// prevent new upgrade from happening.
-		u.upgradeSock.Close()
-		select {
-		case <-u.upgradeCompleteC:
-		default:
-			close(u.upgradeCompleteC)
-		}
+		u.closeUpgradeSocks()
+		u.closeUpgradeComplete()
+		u.checkLeaksAtStop()
 	})
+	u.closeFallbackSock()
+	u.stateLock.Lock()
+	if u.successor != nil {
+		u.successor.conn.Close()
+		u.successor = nil
+	}
+	u.endUpgradeSpanLocked(ErrUpgraderStopped)
+	u.endDrainSpanLocked()
+	u.stateLock.Unlock()
+}
+
+// endUpgradeSpanLocked ends the span covering our upgrade, if it's still
+// open.
+func (u *Upgrader) endUpgradeSpanLocked(err error) {
+	if u.upgradeSpan != nil {
+		endSpan(u.upgradeSpan, err)
+		u.upgradeSpan = nil
+	}
+}
+
+func (u *Upgrader) endDrainSpanLocked() {
+	if u.drainSpan != nil {
+		u.drainSpan.End()
+		u.drainSpan = nil
+	}
 }
@@ -4,18 +4,23 @@ import "fmt"
 
 // upgraderState represents a small finite state machine. It has the following transitions:
 // ∅                     → CheckingOwner
-// CheckingOwnership     → AwaitingOwnership
-// CheckingOwnership     → Owner
-// AwaitingOwnership     → Owner
+// CheckingOwner         → Owner
+// CheckingOwner         → Stopped
 // Owner                 → TransferringOwnership
+// Owner                 → Draining
+// Owner                 → Stopped
 // TransferringOwnership → Owner
 // TransferringOwnership → Draining
+// TransferringOwnership → Stopped
+// Draining              → Draining
+// Draining              → Stopped
+// Stopped               → Stopped
 //
 // The meaning of each state is described above the state's definition below.
 type upgraderState string
 
 const (
-	// CheckingOwnership is the initial state. It indicates this upgrader is
+	// CheckingOwner is the initial state. It indicates this upgrader is
 	// trying to connect to the current owner to determine if they exist.
 	upgraderStateCheckingOwner upgraderState = "checking-owner"
 	// Owner is the state of an upgrader that has successfully either upgraded or
@@ -25,7 +30,8 @@ const (
 	// request from a new process to pass over its FDs, but either has not passed
 	// them all over, or has not yet received a ready.
 	upgraderStateTransferringOwnership = "transferring-ownership"
-	// Draining is the state a process is in after a new owner has taken over.
+	// Draining is the state a process is in after a new owner has taken over,
+	// or a controller forced it to drain.
 	upgraderStateDraining = "draining"
 	// Stopped is the state a process is in after it has completed draining or
 	// has been marked to stop.
@@ -39,6 +45,7 @@ var validTransitions = map[upgraderState][]upgraderState{
 	},
 	upgraderStateOwner: []upgraderState{
 		upgraderStateTransferringOwnership,
+		upgraderStateDraining,
 		upgraderStateStopped,
 	},
 	upgraderStateTransferringOwnership: []upgraderState{
@@ -2,22 +2,29 @@ package tableroll
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/inconshreveable/log15"
-	"k8s.io/utils/clock"
-	fakeclock "k8s.io/utils/clock/testing"
+	"github.com/ngrok/tableroll/internal/clock"
+	"github.com/ngrok/tableroll/internal/clock/fakeclock"
+	"github.com/ngrok/tableroll/internal/proto"
 )
 
-var l = log15.New()
+var l = newTestLogger()
 
 func tmpDir() (string, func()) {
 	dir, err := ioutil.TempDir("", "tableroll_test")
@@ -319,8 +326,12 @@ func TestUpgradeTimeout(t *testing.T) {
 	coordDir, cleanup := tmpDir()
 	defer cleanup()
 
+	timedOut := make(chan PeerInfo, 1)
+	events := make(chan Event, 1)
 	// If upg1 times out serving the upgrade, upg2 should not be able to think it's the owner
-	upg1, err := newUpgrader(ctx, clock, mockOS{pid: 1}, coordDir, WithLogger(l.New("pid", "1")), WithUpgradeTimeout(30*time.Millisecond))
+	upg1, err := newUpgrader(ctx, clock, mockOS{pid: 1}, coordDir, WithLogger(withLogContext(l, "pid", "1")), WithUpgradeTimeout(30*time.Millisecond),
+		WithUpgradeTimeoutHandler(func(peer PeerInfo) { timedOut <- peer }),
+		WithEventHandler(func(e Event) { events <- e }))
 	if err != nil {
 		t.Fatalf("error creating upgrader: %v", err)
 	}
@@ -328,15 +339,21 @@ func TestUpgradeTimeout(t *testing.T) {
 		t.Fatalf("unable to mark self as ready: %v", err)
 	}
 
-	upg2, err := newUpgrader(ctx, clock, mockOS{pid: 2}, coordDir, WithLogger(l.New("pid", "2")))
+	upg2, err := newUpgrader(ctx, clock, mockOS{pid: 2}, coordDir, WithLogger(withLogContext(l, "pid", "2")))
 	if err != nil {
 		t.Fatalf("error creating upgrader: %v", err)
 	}
-	// upg1 serve timeout
-	time.Sleep(60 * time.Millisecond)
+	// upg1 serve timeout, which is measured on its clock
+	clock.Step(30 * time.Millisecond)
+	if peer := <-timedOut; peer.Pid != os.Getpid() {
+		t.Fatalf("expected timeout handler to be called with pid %d, got %d", os.Getpid(), peer.Pid)
+	}
 	if err := upg2.Ready(); err == nil {
 		t.Fatalf("should not be able to mark as ready after parent timed out")
 	}
+	if e := <-events; e.Type != EventUpgradeTimedOut || e.Peer == nil {
+		t.Fatalf("expected an upgrade timed out event, got %+v", e)
+	}
 }
 
 func assertResp(t *testing.T, url string, c *http.Client, expected string) {
@@ -393,3 +410,879 @@ func memoryOpenFile(name string) (*os.File, error) {
 type closeIdleTransport interface {
 	CloseIdleConnections()
 }
+
+func TestRequireExistingOwner(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	_, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithRequireExistingOwner())
+	noOwner, ok := err.(*NoOwnerError)
+	if !ok {
+		t.Fatalf("expected NoOwnerError, got %v", err)
+	}
+	if noOwner.Reason != NoOwnerReasonFirstStart {
+		t.Fatalf("expected first start, got %v", noOwner.Reason)
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithRequireExistingOwner())
+	if err != nil {
+		t.Fatalf("expected to inherit from existing owner: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+// TestLegacyUpgradeHandoff verifies that an upgrade still works when the owner
+// is only listening on the legacy (v1) upgrade socket.
+func TestLegacyUpgradeHandoff(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	// pretend to be an owner which predates the v2 socket
+	upg1.upgradeSock.Close()
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.session.legacy {
+		t.Fatalf("expected to use the legacy protocol")
+	}
+	if ln2, err := upg2.Fds.Listener("ln"); err != nil || ln2 == nil {
+		t.Fatalf("expected to inherit listener: %v, %v", ln2, err)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestForceColdStart(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithForceColdStart())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	// the previous owner steps down before we're even ready
+	<-upg1.UpgradeComplete()
+
+	if upg2.NoOwnerReason() != NoOwnerReasonForcedColdStart {
+		t.Fatalf("expected forced cold start, got %q", upg2.NoOwnerReason())
+	}
+	if ln2, err := upg2.Fds.Listener("ln"); err != nil || ln2 != nil {
+		t.Fatalf("expected no inherited listener: %v, %v", ln2, err)
+	}
+	if upg2.Inherited() {
+		t.Fatalf("expected a forced cold start not to count as inheriting")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if pid, err := upg2.coord.GetOwnerPID(); err != nil || pid != 2 {
+		t.Fatalf("expected pid 2 to be owner, got %v, %v", pid, err)
+	}
+}
+
+func TestInherited(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if upg1.Inherited() {
+		t.Fatalf("expected the first process to cold-start")
+	}
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if upg1.Fds.WasInherited("ln") {
+		t.Fatalf("expected a listener we created not to be inherited")
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.Inherited() {
+		t.Fatalf("expected the second process to inherit")
+	}
+	if !upg2.Fds.WasInherited("ln") {
+		t.Fatalf("expected the listener to be inherited")
+	}
+	if upg2.Fds.WasInherited("missing") {
+		t.Fatalf("expected a missing fd not to be inherited")
+	}
+	ln2, err := upg2.Fds.Listen(ctx, "ln2", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln2.Close()
+	if upg2.Fds.WasInherited("ln2") {
+		t.Fatalf("expected a listener we created not to be inherited")
+	}
+}
+
+func TestUpgradeApproval(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var approved int32
+	peers := make(chan PeerInfo, 2)
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithUpgradeApproval(func(peer PeerInfo) error {
+		peers <- peer
+		if atomic.LoadInt32(&approved) == 0 {
+			return errors.New("maintenance window")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	rejected, ok := err.(*UpgradeRejectedError)
+	if !ok {
+		t.Fatalf("expected upgrade to be rejected, got %v", err)
+	}
+	if rejected.Reason != "maintenance window" {
+		t.Fatalf("unexpected rejection reason: %q", rejected.Reason)
+	}
+	if peer := <-peers; peer.Pid != os.Getpid() {
+		t.Fatalf("expected peer pid %v, got %v", os.Getpid(), peer.Pid)
+	}
+
+	atomic.StoreInt32(&approved, 1)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if owner, ok := upg2.PreviousOwner(); !ok || owner.Pid != os.Getpid() {
+		t.Fatalf("expected previous owner to be identified, got %+v", owner)
+	}
+	if upg1.Generation() != 0 || upg2.Generation() != 1 {
+		t.Fatalf("expected generations 0 and 1, got %d and %d", upg1.Generation(), upg2.Generation())
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestUpgradeElection(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// pid 3 is racing us with a higher priority
+	rival := newCoordinator(clock.RealClock{}, mockOS{pid: 3}, l, coordDir)
+	if err := rival.registerCandidate(proto.Candidate{Pid: 3, Priority: 10, StartTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithUpgradePriority(0))
+	if lost, ok := err.(*ElectionLostError); !ok || lost.WinnerPid != 3 {
+		t.Fatalf("expected to lose the election to pid 3, got %v", err)
+	}
+
+	// now it has a lower priority, so we win
+	if err := rival.registerCandidate(proto.Candidate{Pid: 3, Priority: -1, StartTime: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithUpgradePriority(0))
+	if err != nil {
+		t.Fatalf("expected to win the election, got %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	// the loser only gets the lock after we're done, and must still lose
+	_, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l), WithUpgradePriority(-1))
+	if lost, ok := err.(*ElectionLostError); !ok || lost.WinnerPid != 2 {
+		t.Fatalf("expected to lose the election to pid 2, got %v", err)
+	}
+
+	// processes which weren't part of the election can still upgrade
+	upg4, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 4}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg4.Stop()
+	if err := upg4.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg2.UpgradeComplete()
+}
+
+func TestPredecessorDrained(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	select {
+	case <-upg1.PredecessorDrained():
+	default:
+		t.Fatalf("expected predecessor drained to be closed with no predecessor")
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if err := upg1.NotifyDrainComplete(); err == nil {
+		t.Fatalf("expected an error notifying drain complete before an upgrade")
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	select {
+	case <-upg2.PredecessorDrained():
+		t.Fatalf("expected predecessor to still be draining")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	select {
+	case <-upg2.PredecessorDrained():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected predecessor drained to be closed")
+	}
+}
+
+func TestExclusiveFds(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Fds.AddExclusive("wal", w); err != nil {
+		t.Fatalf("error adding exclusive fd: %v", err)
+	}
+	w.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if f, _ := upg2.Fds.File("wal"); f != nil {
+		t.Fatalf("expected exclusive fd to not be passed until the owner drained")
+	}
+
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+	f, err := upg2.Fds.File("wal")
+	if err != nil || f == nil {
+		t.Fatalf("expected exclusive fd to be passed after draining: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil || string(buf) != "x" {
+		t.Fatalf("expected to write to the exclusive fd, got %q, %v", buf, err)
+	}
+}
+
+func TestHandoffState(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var failState int32 = 1
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithHandoffState(func() ([]byte, error) {
+		if atomic.LoadInt32(&failState) == 1 {
+			return nil, errors.New("routing table is being rebuilt")
+		}
+		return []byte("connection id key"), nil
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l)); err == nil {
+		t.Fatalf("expected the upgrade to be rejected when the handoff state can't be provided")
+	} else if _, ok := err.(*UpgradeRejectedError); !ok {
+		t.Fatalf("expected an *UpgradeRejectedError, got %v", err)
+	}
+
+	atomic.StoreInt32(&failState, 0)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if state := string(upg2.HandoffState()); state != "connection id key" {
+		t.Fatalf("expected handoff state to be passed, got %q", state)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestCoordinationFallback(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	waitForFallbackSock := func(upg *Upgrader) {
+		for i := 0; i < 100; i++ {
+			upg.stateLock.Lock()
+			listening := upg.fallbackSock != nil
+			upg.stateLock.Unlock()
+			if listening {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("upgrader never listened on the fallback socket")
+	}
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithCoordinationFallback())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if _, err := upg1.Fds.Listen(ctx, "listener", nil, "tcp", "127.0.0.1:0"); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	waitForFallbackSock(upg1)
+
+	// simulate a new process which can't see the owner's coordination
+	// directory
+	if err := os.Remove(upg1.coord.pidFile()); err != nil {
+		t.Fatal(err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithCoordinationFallback())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if _, ok := upg2.PreviousOwner(); !ok {
+		t.Fatalf("expected to find the owner through the fallback socket")
+	}
+	if ln, err := upg2.Fds.Listener("listener"); err != nil || ln == nil {
+		t.Fatalf("expected to inherit the owner's listener, got %v, %v", ln, err)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	// the new owner takes over the fallback socket once the old one releases
+	// it
+	waitForFallbackSock(upg2)
+}
+
+func TestCustomHandshake(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	type schema struct {
+		Version int `json:"version"`
+	}
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithHandshakeHandler(func(s *Session) error {
+		var theirs schema
+		if err := s.RecvJSON(&theirs); err != nil {
+			return err
+		}
+		if theirs.Version < 2 {
+			return fmt.Errorf("schema version %d is too old", theirs.Version)
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		defer w.Close()
+		if _, err := w.Write([]byte("migration plan")); err != nil {
+			return err
+		}
+		return s.SendFds(r)
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	// the owner requires a handshake from processes which ask for one
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithHandshake(func(s *Session) error {
+		return s.SendJSON(schema{Version: 1})
+	})); err == nil {
+		t.Fatalf("expected the upgrade to be rejected for an old schema version")
+	} else if rejected, ok := err.(*UpgradeRejectedError); !ok || rejected.Reason != "schema version 1 is too old" {
+		t.Fatalf("expected an *UpgradeRejectedError, got %v", err)
+	}
+
+	var plan string
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithHandshake(func(s *Session) error {
+		if s.Peer().Pid == 0 {
+			return errors.New("expected to know the owner's pid")
+		}
+		if err := s.SendJSON(schema{Version: 2}); err != nil {
+			return err
+		}
+		files, err := s.RecvFds()
+		if err != nil {
+			return err
+		}
+		defer files[0].Close()
+		data := make([]byte, len("migration plan"))
+		if _, err := io.ReadFull(files[0], data); err != nil {
+			return err
+		}
+		plan = string(data)
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if plan != "migration plan" {
+		t.Fatalf("expected to read the fd passed in the handshake, got %q", plan)
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+
+	// an owner without a handler rejects handshakes, but still serves
+	// processes which don't ask for one
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l), WithHandshake(func(s *Session) error {
+		return nil
+	}))
+	if err == nil {
+		upg3.Stop()
+		t.Fatalf("expected an owner without a handshake handler to reject the upgrade")
+	} else if _, ok := err.(*UpgradeRejectedError); !ok {
+		t.Fatalf("expected an *UpgradeRejectedError, got %v", err)
+	}
+	upg3, err = newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected an upgrade without a handshake to succeed, got %v", err)
+	}
+	upg3.Stop()
+}
+
+func TestTransferInterceptors(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	var reject int32 = 1
+	var seen []string
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithHandoffState(func() ([]byte, error) { return []byte("state"), nil }),
+		WithTransferInterceptors(func(tr *Transfer) error {
+			if atomic.LoadInt32(&reject) == 1 {
+				return errors.New("compliance check failed")
+			}
+			return nil
+		}, func(tr *Transfer) error {
+			seen = seen[:0]
+			for _, fi := range tr.Fds {
+				seen = append(seen, fi.ID)
+				if strings.HasPrefix(fi.Name, os.TempDir()) {
+					tr.Veto(fi.ID, "temporary files stay with the owner")
+				}
+			}
+			tr.State = append(tr.State, "+intercepted"...)
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	tmp, err := ioutil.TempFile("", "tableroll_intercept")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Close()
+	if _, err := upg1.Fds.OpenFileWith("scratch", tmp.Name(), os.Open); err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	if _, err := upg1.Fds.OpenFileWith("null", os.DevNull, os.Open); err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	exclusive, err := os.Open(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upg1.Fds.AddExclusive("exclusive-scratch", exclusive); err != nil {
+		t.Fatalf("error adding exclusive fd: %v", err)
+	}
+	exclusive.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l)); err == nil {
+		t.Fatalf("expected the upgrade to be rejected by the interceptor")
+	} else if _, ok := err.(*UpgradeRejectedError); !ok {
+		t.Fatalf("expected an *UpgradeRejectedError, got %v", err)
+	}
+
+	atomic.StoreInt32(&reject, 0)
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if strings.Join(seen, ",") != "exclusive-scratch,null,scratch" {
+		t.Fatalf("expected the interceptor to see all fds in order, got %v", seen)
+	}
+	if state := string(upg2.HandoffState()); state != "state+intercepted" {
+		t.Fatalf("expected the interceptor to replace the handoff state, got %q", state)
+	}
+	if f, _ := upg2.Fds.File("null"); f == nil {
+		t.Fatalf("expected the allowed fd to be passed")
+	}
+	if f, _ := upg2.Fds.File("scratch"); f != nil {
+		t.Fatalf("expected the vetoed fd to be withheld")
+	}
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+	<-upg2.PredecessorDrained()
+	if f, _ := upg2.Fds.File("exclusive-scratch"); f != nil {
+		t.Fatalf("expected the vetoed exclusive fd to be withheld")
+	}
+}
+
+func TestTransferSubstitute(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	testCreds, err := net.Listen("unix", filepath.Join(coordDir, "test-creds.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testCreds.Close()
+	testCredsFile, err := testCreds.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testCredsFile.Close()
+
+	var substituteErr error
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l),
+		WithTransferInterceptors(func(tr *Transfer) error {
+			if tr.Peer.Identity != "canary" {
+				return nil
+			}
+			substituteErr = tr.Substitute("exclusive", testCredsFile)
+			if err := tr.Substitute("creds", testCredsFile); err != nil {
+				return err
+			}
+			if !tr.Substituted("creds") {
+				return errors.New("expected creds to be substituted")
+			}
+			return nil
+		}))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	prodPath := filepath.Join(coordDir, "prod-creds.sock")
+	if _, err := upg1.Fds.Listen(ctx, "creds", nil, "unix", prodPath); err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	exclusive, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upg1.Fds.AddExclusive("exclusive", exclusive); err != nil {
+		t.Fatalf("error adding exclusive fd: %v", err)
+	}
+	exclusive.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithIdentity("canary"), WithFdVerification())
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if substituteErr == nil {
+		t.Fatalf("expected substituting an exclusive fd to fail")
+	}
+	ln, err := upg2.Fds.Listener("creds")
+	if err != nil {
+		t.Fatalf("error getting listener: %v", err)
+	}
+	defer ln.Close()
+	if addr := ln.Addr().String(); addr != testCreds.Addr().String() {
+		t.Fatalf("expected the canary to get the test socket, got %v", addr)
+	}
+
+	// the owner keeps its own fd
+	ln, err = upg1.Fds.Listener("creds")
+	if err != nil {
+		t.Fatalf("error getting listener: %v", err)
+	}
+	defer ln.Close()
+	if addr := ln.Addr().String(); addr != prodPath {
+		t.Fatalf("expected the owner to keep its socket, got %v", addr)
+	}
+}
+
+func TestUpgradeBeforeReady(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+
+	// upg2 holds the coordination lock until it's ready, so reach it directly
+	// as a process which doesn't share the lock would
+	conn, err := net.Dial("unix", upgradeSockPath(coordDir, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sess := &upgradeSession{wr: conn.(*net.UnixConn), coordinator: upg2.coord, owner: &PeerInfo{Pid: 2}, l: l}
+	_, err = sess.getFiles(ctx)
+	notReady, ok := err.(*OwnerNotReadyError)
+	if !ok {
+		t.Fatalf("expected an *OwnerNotReadyError, got %v", err)
+	}
+	if notReady.Pid != 2 || notReady.RetryAfter != DefaultLockRetryInterval {
+		t.Fatalf("unexpected error: %+v", notReady)
+	}
+
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	upg3, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 3}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("expected to upgrade once the owner is ready, got %v", err)
+	}
+	upg3.Stop()
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+	if err := upg1.NotifyDrainComplete(); err != nil {
+		t.Fatalf("error notifying drain complete: %v", err)
+	}
+
+	history, err := upg2.History()
+	if err != nil {
+		t.Fatalf("error reading history: %v", err)
+	}
+	var got []string
+	for _, entry := range history {
+		got = append(got, fmt.Sprintf("%s:%d:%d", entry.Type, entry.Pid, entry.Generation))
+		if entry.Type == HistoryBecameOwner && entry.Pid == 2 && entry.PeerPid != 1 {
+			t.Fatalf("expected the second owner to record its predecessor, got %+v", entry)
+		}
+	}
+	// upg1 hands off and upg2 becomes the owner at about the same time, so
+	// those two may be recorded in either order
+	if len(got) == 4 && got[1] > got[2] {
+		got[1], got[2] = got[2], got[1]
+	}
+	expected := []string{"became-owner:1:0", "became-owner:2:1", "handed-off:1:0", "drain-complete:1:0"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected history %v, got %v", expected, got)
+	}
+}
+
+func TestSocketNameAndPermissions(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	if _, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithSocketName("upgrade.sock")); err == nil {
+		t.Fatalf("expected a socket name without {pid} to be rejected")
+	}
+
+	opts := []Option{WithLogger(l), WithSocketName("upgrade-{pid}.sock"), WithSocketPermissions(0600, os.Getgid())}
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, opts...)
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	info, err := os.Stat(coordDir + "/upgrade-1.sock")
+	if err != nil {
+		t.Fatalf("expected the upgrade socket to use the configured name: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the upgrade socket to have mode 0600, got %v", info.Mode())
+	}
+	if _, err := os.Stat(upgradeSockPath(coordDir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("expected no socket with the default name, got %v", err)
+	}
+	ln, err := upg1.Fds.Listen(ctx, "ln", nil, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+
+	upg2, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, opts...)
+	if err != nil {
+		t.Fatalf("error creating second upgrader: %v", err)
+	}
+	defer upg2.Stop()
+	if !upg2.Fds.WasInherited("ln") {
+		t.Fatalf("expected to inherit over the renamed socket")
+	}
+}
@@ -0,0 +1,90 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+)
+
+// vsockNetwork is the network recorded for AF_VSOCK listeners.
+const vsockNetwork = "vsock"
+
+// VsockAddr is the address of an AF_VSOCK socket, used between virtual
+// machines and their host.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+// Network returns "vsock".
+func (a *VsockAddr) Network() string {
+	return vsockNetwork
+}
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+// ListenVsock returns an AF_VSOCK listener inherited from the previous owner,
+// or creates one bound to cid and port, such as for an agent serving its
+// host from a guest. Its connections are accepted with *VsockAddr addresses.
+// Listener returns it too, once it's been created. It requires importing
+// github.com/ngrok/tableroll/vsock, which supports linux.
+func (f *Fds) ListenVsock(ctx context.Context, id string, cid, port uint32) (net.Listener, error) {
+	if err := f.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer f.mu.Unlock()
+
+	addr := (&VsockAddr{CID: cid, Port: port}).String()
+	if err := f.conflictLocked(&fd{ID: id, Kind: fdKindListener, Network: vsockNetwork, Addr: addr}); err != nil {
+		return nil, err
+	}
+	ln, err := f.listenerLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if ln != nil {
+		f.l.Debug("found existing vsock listener in store", "addr", redactString(f.redact, addr))
+		return ln, nil
+	}
+	if err := f.checkMutationLocked(id); err != nil {
+		return nil, err
+	}
+
+	sock, err := newVsockSocket(cid, port)
+	if err != nil {
+		return nil, fmt.Errorf("can't create new vsock listener: %w", err)
+	}
+	defer sock.Close()
+	if err := f.addConnLocked(id, fdKindListener, vsockNetwork, addr, sock); err != nil {
+		return nil, err
+	}
+	return newVsockListener(f.fds[id].file)
+}
+
+var errVsockUnavailable = errors.New("vsock requires importing github.com/ngrok/tableroll/vsock, which supports linux")
+
+// newVsockSocket and newVsockListener are provided by the vsock package, if
+// it's imported, since Go's net package can't reconstruct AF_VSOCK sockets
+// from their fds.
+
+func newVsockSocket(cid, port uint32) (*os.File, error) {
+	if sysext.Vsock.Listen == nil {
+		return nil, errVsockUnavailable
+	}
+	return sysext.Vsock.Listen(cid, port)
+}
+
+func newVsockListener(f *file) (net.Listener, error) {
+	if sysext.Vsock.FileListener == nil {
+		return nil, errVsockUnavailable
+	}
+	return sysext.Vsock.FileListener(f.fd, f.Name(), func(cid, port uint32) net.Addr {
+		return &VsockAddr{CID: cid, Port: port}
+	})
+}
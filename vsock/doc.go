@@ -0,0 +1,8 @@
+// Package vsock enables tableroll's AF_VSOCK listeners, which need system
+// calls the standard library doesn't provide. Import it for its side effects
+// to use Fds.ListenVsock, and to inherit vsock listeners:
+//
+//	import _ "github.com/ngrok/tableroll/vsock"
+//
+// It only does so on linux; elsewhere, and without it, they return an error.
+package vsock
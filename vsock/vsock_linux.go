@@ -0,0 +1,129 @@
+// +build linux
+
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/ngrok/tableroll/internal/sysext"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	sysext.Vsock.Listen = listen
+	sysext.Vsock.FileListener = fileListener
+}
+
+// Go's net package can't reconstruct AF_VSOCK sockets from their fds, so
+// they're wrapped here.
+
+func listen(cid, port uint32) (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sock := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port))
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		sock.Close()
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		sock.Close()
+		return nil, os.NewSyscallError("listen", err)
+	}
+	return sock, nil
+}
+
+func fileListener(fd uintptr, name string, addr func(cid, port uint32) net.Addr) (net.Listener, error) {
+	domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return nil, fmt.Errorf("can't inherit %s: %w", name, err)
+	}
+	if domain != unix.AF_VSOCK {
+		return nil, fmt.Errorf("can't inherit %s: expected socket domain %d, got %d", name, unix.AF_VSOCK, domain)
+	}
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	vm, ok := sa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, fmt.Errorf("can't inherit %s: unexpected address %T", name, sa)
+	}
+	dup, err := unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can't dup fd using fcntl: %w", err)
+	}
+	if err := unix.SetNonblock(dup, true); err != nil {
+		unix.Close(dup)
+		return nil, err
+	}
+	// the runtime's poller only takes on files which are non-blocking when
+	// they're created
+	sock := os.NewFile(uintptr(dup), name)
+	return &listener{file: sock, addr: addr(vm.CID, vm.Port), addrFunc: addr}, nil
+}
+
+// listener is an AF_VSOCK listener.
+type listener struct {
+	file     *os.File
+	addr     net.Addr
+	addrFunc func(cid, port uint32) net.Addr
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	raw, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var nfd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err = raw.Read(func(fd uintptr) bool {
+		nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		return acceptErr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, os.NewSyscallError("accept4", acceptErr)
+	}
+	var remote net.Addr
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = l.addrFunc(vm.CID, vm.Port)
+	} else {
+		remote = l.addrFunc(0, 0)
+	}
+	return &conn{File: os.NewFile(uintptr(nfd), "vsock:"+remote.String()), local: l.addr, remote: remote}, nil
+}
+
+func (l *listener) Close() error {
+	return l.file.Close()
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+func (l *listener) SyscallConn() (syscall.RawConn, error) {
+	return l.file.SyscallConn()
+}
+
+// conn is a connection accepted from a listener. The file provides reads,
+// writes and deadlines through the runtime's poller.
+type conn struct {
+	*os.File
+	local, remote net.Addr
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,60 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	_ "github.com/ngrok/tableroll/vsock"
+	"golang.org/x/sys/unix"
+)
+
+func TestFdsListenVsock(t *testing.T) {
+	ctx := context.Background()
+	parent := newFds(l, nil)
+	ln, err := parent.ListenVsock(ctx, "agent", unix.VMADDR_CID_ANY, 0)
+	if errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.ENODEV) {
+		t.Skipf("vsock isn't supported here: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := ln.Addr().(*VsockAddr)
+	ln.Close()
+
+	child := newFds(l, parent.copy())
+	inherited, err := child.Listener("agent")
+	if err != nil || inherited == nil {
+		t.Fatalf("error inheriting listener: %v", err)
+	}
+	defer inherited.Close()
+	if got := inherited.Addr().(*VsockAddr); got.Port != addr.Port {
+		t.Fatalf("expected the inherited listener on port %d, got %v", addr.Port, got)
+	}
+
+	// connect over the loopback, if the kernel has it
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := os.NewFile(uintptr(fd), "vsock client")
+	defer client.Close()
+	if err := unix.Connect(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_LOCAL, Port: addr.Port}); err != nil {
+		t.Skipf("vsock loopback isn't supported here: %v", err)
+	}
+	conn, err := inherited.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+	defer conn.Close()
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected to read from the inherited listener's conn, got %q, %v", buf[:n], err)
+	}
+}
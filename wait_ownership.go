@@ -0,0 +1,82 @@
+package tableroll
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+// OwnerBusyError is returned when the owner refused to pass on its fds
+// because it's already handing them off to another process, or has done so.
+// Trying again once that process is the owner may succeed.
+type OwnerBusyError struct {
+	Pid    int
+	Reason string
+}
+
+func (e *OwnerBusyError) Error() string {
+	return fmt.Sprintf("process %d is busy with another upgrade: %s", e.Pid, e.Reason)
+}
+
+// WaitOwnership creates an Upgrader as New does, but rather than failing
+// when the owner can't hand off its fds right now, waits and tries again
+// until it can, or ctx is done. That's the case when the owner isn't ready
+// yet, is handing off to or has lost an upgrade election to another process,
+// has paused upgrades, or the coordination directory's lock timed out. Other
+// errors are returned as from New. Between attempts it waits for the interval
+// set with WithLockRetryInterval, or as long as the owner asked.
+//
+// As with New, the returned Upgrader holds the fds, and becomes the owner
+// once Ready is called.
+func WaitOwnership(ctx context.Context, coordinationDir string, opts ...Option) (*Upgrader, error) {
+	return waitOwnership(ctx, clock.RealClock{}, realOS{}, coordinationDir, opts...)
+}
+
+func waitOwnership(ctx context.Context, clock clock.Clock, os OS, coordinationDir string, opts ...Option) (*Upgrader, error) {
+	// read the options which affect waiting
+	cfg := &Upgrader{lockRetryInterval: DefaultLockRetryInterval, l: discardLogger{}}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	for attempt := 1; ; attempt++ {
+		u, err := newUpgrader(ctx, clock, os, coordinationDir, opts...)
+		if err == nil {
+			return u, nil
+		}
+		wait, ok := ownershipRetryAfter(err, cfg.lockRetryInterval)
+		if !ok {
+			return nil, err
+		}
+		cfg.l.Info("could not take ownership yet, waiting to try again", "attempt", attempt, "wait", wait, "err", err)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up waiting for ownership after %d attempts, the last failed with %v: %w", attempt, err, ctx.Err())
+		case <-clock.After(wait):
+		}
+	}
+}
+
+// ownershipRetryAfter returns how long to wait before trying to take
+// ownership again after err, or false if it isn't worth trying again.
+func ownershipRetryAfter(err error, interval time.Duration) (time.Duration, bool) {
+	var (
+		notReady    *OwnerNotReadyError
+		busy        *OwnerBusyError
+		lost        *ElectionLostError
+		paused      *UpgradesPausedError
+		lockTimeout *LockTimeoutError
+	)
+	switch {
+	case errors.As(err, &notReady):
+		if notReady.RetryAfter > 0 {
+			return notReady.RetryAfter, true
+		}
+		return interval, true
+	case errors.As(err, &busy), errors.As(err, &lost), errors.As(err, &paused), errors.As(err, &lockTimeout):
+		return interval, true
+	}
+	return 0, false
+}
@@ -0,0 +1,69 @@
+package tableroll
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ngrok/tableroll/internal/clock"
+)
+
+func TestWaitOwnership(t *testing.T) {
+	ctx := context.Background()
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	upg1, err := newUpgrader(ctx, clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l))
+	if err != nil {
+		t.Fatalf("error creating upgrader: %v", err)
+	}
+	defer upg1.Stop()
+	if err := upg1.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	if err := upg1.PauseUpgrades("schema migration"); err != nil {
+		t.Fatalf("error pausing: %v", err)
+	}
+
+	// gives up once ctx is done
+	shortCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = waitOwnership(shortCtx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithLockRetryInterval(20*time.Millisecond))
+	if err == nil {
+		t.Fatal("expected waiting while paused to time out")
+	}
+
+	upgC := make(chan *Upgrader, 1)
+	errC := make(chan error, 1)
+	go func() {
+		upg2, err := waitOwnership(ctx, clock.RealClock{}, mockOS{pid: 2}, coordDir, WithLogger(l), WithLockRetryInterval(20*time.Millisecond))
+		errC <- err
+		upgC <- upg2
+	}()
+	select {
+	case err := <-errC:
+		t.Fatalf("expected to wait while upgrades are paused, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	upg1.ResumeUpgrades()
+	if err := <-errC; err != nil {
+		t.Fatalf("error waiting for ownership: %v", err)
+	}
+	upg2 := <-upgC
+	defer upg2.Stop()
+	if err := upg2.Ready(); err != nil {
+		t.Fatalf("error marking ready: %v", err)
+	}
+	<-upg1.UpgradeComplete()
+}
+
+func TestWaitOwnershipPermanentError(t *testing.T) {
+	coordDir, cleanup := tmpDir()
+	defer cleanup()
+
+	_, err := waitOwnership(context.Background(), clock.RealClock{}, mockOS{pid: 1}, coordDir, WithLogger(l), WithSocketName("no-pid.sock"))
+	if err == nil {
+		t.Fatal("expected an invalid option to fail immediately")
+	}
+}